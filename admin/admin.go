@@ -0,0 +1,239 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/delayed"
+	"github.com/yamakiller/magicMqtt/ratelimit"
+	"github.com/yamakiller/magicMqtt/sessions"
+	"github.com/yamakiller/magicMqtt/trace"
+)
+
+const (
+	//tracePath 跟踪规则接口
+	tracePath = "/trace"
+	//rateLimitPath 限流统计接口
+	rateLimitPath = "/ratelimit"
+	//delayedPath 延迟消息接口
+	delayedPath = "/delayed"
+	//offlinePath 离线队列统计接口
+	offlinePath = "/offline"
+	//shutdownTimeout 关闭时等待请求完成的时间
+	shutdownTimeout = 5 * time.Second
+)
+
+//traceRequest 添加跟踪规则的请求, TTL单位为秒, 0表示一直有效
+type traceRequest struct {
+	ClientID string `json:"clientId"`
+	Filter   string `json:"filter"`
+	TTL      int    `json:"ttl"`
+}
+
+//Server 管理接口
+//
+//	GET    /trace         列出跟踪规则
+//	POST   /trace         添加跟踪规则 {"clientId": "...", "filter": "...", "ttl": 600}
+//	DELETE /trace/{id}    删除跟踪规则
+//	DELETE /trace         删除所有跟踪规则
+//	GET    /ratelimit     限流统计与被限流的客户端
+//	GET    /delayed       列出等待中的延迟消息
+//	DELETE /delayed/{id}  取消一条延迟消息
+//	GET    /offline       离线队列丢弃统计与有消息被丢弃的会话
+//
+//设置了token时请求必须带有 Authorization: Bearer {token}
+type Server struct {
+	_srv      *http.Server
+	_tracer   *trace.Tracer
+	_throttle *ratelimit.Metrics
+	_delayed  *delayed.Store
+	_sessions *sessions.SessionGroup
+	_token    string
+}
+
+//rateLimitResponse 限流统计
+type rateLimitResponse struct {
+	Total   ratelimit.Stats         `json:"total"`
+	Clients []ratelimit.ClientStats `json:"clients"`
+}
+
+//offlineResponse 离线队列统计
+type offlineResponse struct {
+	Total   sessions.OfflineStats         `json:"total"`
+	Clients []sessions.ClientOfflineStats `json:"clients"`
+}
+
+//New 创建管理接口
+func New(tracer *trace.Tracer, token string) *Server {
+	slf := &Server{_tracer: tracer, _token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc(tracePath, slf.handleTrace)
+	mux.HandleFunc(tracePath+"/", slf.handleTrace)
+	mux.HandleFunc(rateLimitPath, slf.handleRateLimit)
+	mux.HandleFunc(delayedPath, slf.handleDelayed)
+	mux.HandleFunc(delayedPath+"/", slf.handleDelayed)
+	mux.HandleFunc(offlinePath, slf.handleOffline)
+	slf._srv = &http.Server{Handler: slf.authorize(mux)}
+	return slf
+}
+
+//WithThrottle 设置限流统计
+func (slf *Server) WithThrottle(metrics *ratelimit.Metrics) {
+	slf._throttle = metrics
+}
+
+//WithDelayed 设置延迟消息存储, 未启用延迟发布时为nil
+func (slf *Server) WithDelayed(store *delayed.Store) {
+	slf._delayed = store
+}
+
+//WithSessions 设置会话管理器
+func (slf *Server) WithSessions(group *sessions.SessionGroup) {
+	slf._sessions = group
+}
+
+//ListenAndServe 监听address并在后台提供服务
+func (slf *Server) ListenAndServe(address string) error {
+	lst, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	go slf._srv.Serve(lst)
+	return nil
+}
+
+//Shutdown 关闭管理接口
+func (slf *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	slf._srv.Shutdown(ctx)
+}
+
+//Handler 返回管理接口的HTTP处理器
+func (slf *Server) Handler() http.Handler {
+	return slf._srv.Handler
+}
+
+func (slf *Server) authorize(next http.Handler) http.Handler {
+	if slf._token == "" {
+		return next
+	}
+
+	want := []byte("Bearer " + slf._token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (slf *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, tracePath), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, slf._tracer.Rules())
+	case r.Method == http.MethodPost && id == "":
+		req := traceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.TTL < 0 {
+			writeError(w, http.StatusBadRequest, "negative ttl")
+			return
+		}
+
+		rule, err := slf._tracer.Add(req.ClientID, req.Filter, time.Duration(req.TTL)*time.Second)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	case r.Method == http.MethodDelete && id == "":
+		slf._tracer.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid rule id")
+			return
+		}
+		if err := slf._tracer.Remove(n); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (slf *Server) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clients := slf._throttle.Clients()
+	if clients == nil {
+		clients = []ratelimit.ClientStats{}
+	}
+	writeJSON(w, http.StatusOK, rateLimitResponse{Total: slf._throttle.Stats(), Clients: clients})
+}
+
+func (slf *Server) handleDelayed(w http.ResponseWriter, r *http.Request) {
+	if slf._delayed == nil {
+		writeError(w, http.StatusNotFound, "delayed publish disabled")
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, delayedPath), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, slf._delayed.Scheduled())
+	case r.Method == http.MethodDelete && id != "":
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid delayed id")
+			return
+		}
+		if !slf._delayed.Cancel(n) {
+			writeError(w, http.StatusNotFound, "delayed message not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (slf *Server) handleOffline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	total, clients := slf._sessions.OfflineStats()
+	writeJSON(w, http.StatusOK, offlineResponse{Total: total, Clients: clients})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, map[string]string{"error": reason})
+}
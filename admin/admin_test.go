@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/delayed"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/sessions"
+)
+
+func TestDelayed(t *testing.T) {
+	srv := New(nil, "")
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	//未启用延迟发布
+	if w := request(http.MethodGet, "/delayed"); w.Code != http.StatusNotFound {
+		t.Fatalf("disabled store: %d", w.Code)
+	}
+
+	store, err := delayed.New("", 0, 0, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	srv.WithDelayed(store)
+
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = "a/b"
+	msg.Payload = []byte("x")
+	id, _ := store.Schedule("p1", msg, time.Hour)
+
+	w := request(http.MethodGet, "/delayed")
+	var scheduled []delayed.Scheduled
+	if err := json.NewDecoder(w.Body).Decode(&scheduled); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(scheduled) != 1 || scheduled[0].ID != id ||
+		scheduled[0].Topic != "a/b" || scheduled[0].Publisher != "p1" {
+		t.Fatalf("list %d %+v", w.Code, scheduled)
+	}
+
+	if w := request(http.MethodDelete, "/delayed/x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid id: %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/delayed/1"); w.Code != http.StatusNoContent {
+		t.Fatalf("cancel: %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/delayed/1"); w.Code != http.StatusNotFound {
+		t.Fatalf("cancel twice: %d", w.Code)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("%d pending after cancel", store.Len())
+	}
+}
+
+func TestOffline(t *testing.T) {
+	group := sessions.NewGroup()
+	s, _ := group.GetOrNew("c1", sessions.OfflineLimit{})
+	s.WriteMessage(message.SpawnPublishMessage())
+
+	srv := New(nil, "")
+	srv.WithSessions(group)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/offline", nil))
+
+	var resp offlineResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Total.Newest != 1 ||
+		len(resp.Clients) != 1 || resp.Clients[0].ClientID != "c1" {
+		t.Fatalf("offline %d %+v", w.Code, resp)
+	}
+}
@@ -1,6 +1,9 @@
 package auth
 
-import "github.com/yamakiller/magicMqtt/auth/authdb"
+import (
+	"github.com/yamakiller/magicMqtt/auth/authdb"
+	"github.com/yamakiller/magicMqtt/ratelimit"
+)
 
 const (
 	//AuthDB mysql 验证器
@@ -13,6 +16,10 @@ const (
 type Auth interface {
 	ACL(action, clientID, username, ip, topic string) (bool, error)
 	Connect(clientID, username, password string) (bool, error)
+	SessionExpiry(clientID, username string) (int, bool)
+	Mountpoint(clientID, username string) (string, bool)
+	PayloadLimit(clientID, username string) (int, bool)
+	RateLimit(clientID, username string) (ratelimit.Limit, bool)
 }
 
 //New 创建授权验证器
@@ -8,6 +8,7 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/yamakiller/magicLibs/dbs"
 	"github.com/yamakiller/magicMqtt/auth/code"
+	"github.com/yamakiller/magicMqtt/ratelimit"
 )
 
 //Init 创建一个MYSQL授权，验证器
@@ -28,13 +29,21 @@ func Init(configFile string) (*AuthMYSQL, error) {
 		return nil, err
 	}
 
-	return &AuthMYSQL{_sql: client, _ca: cache.New(5*time.Minute, 10*time.Minute)}, nil
+	return &AuthMYSQL{
+		_sql:   client,
+		_ca:    cache.New(5*time.Minute, 10*time.Minute),
+		_users: cache.New(userExpiration, 2*userExpiration),
+	}, nil
 }
 
+//userExpiration 用户记录的缓存时间, 一次连接中的多项配置查询共用一次SELECT
+const userExpiration = 30 * time.Second
+
 //AuthMYSQL mysql 授权验证器
 type AuthMYSQL struct {
-	_sql *dbs.MySQLGORM
-	_ca  *cache.Cache
+	_sql   *dbs.MySQLGORM
+	_ca    *cache.Cache
+	_users *cache.Cache
 }
 
 //Connect 验证连接请求
@@ -51,8 +60,8 @@ func (slf *AuthMYSQL) Connect(clientID, username, password string) (bool, error)
 		}
 	}
 
-	usr := AuthUser{}
-	if err := slf._sql.DB().Where("client_id = ?", clientID).First(&usr).Error; err != nil {
+	usr, err := slf.loadUser(clientID)
+	if err != nil {
 		return false, code.ErrAuthClientNot
 	}
 
@@ -65,11 +74,93 @@ func (slf *AuthMYSQL) Connect(clientID, username, password string) (bool, error)
 	return true, nil
 }
 
+//SessionExpiry 返回客户端会话过期时间(秒)
+func (slf *AuthMYSQL) SessionExpiry(clientID, username string) (int, bool) {
+	usr, err := slf.user(clientID)
+	if err != nil {
+		return 0, false
+	}
+
+	if usr.SessionExpiry <= 0 {
+		return 0, false
+	}
+
+	return usr.SessionExpiry, true
+}
+
+//Mountpoint 返回客户端的挂载点(主题前缀)
+func (slf *AuthMYSQL) Mountpoint(clientID, username string) (string, bool) {
+	usr, err := slf.user(clientID)
+	if err != nil {
+		return "", false
+	}
+
+	if usr.Mountpoint == "" {
+		return "", false
+	}
+
+	return usr.Mountpoint, true
+}
+
+//PayloadLimit 返回客户端的PUBLISH负载长度限制
+func (slf *AuthMYSQL) PayloadLimit(clientID, username string) (int, bool) {
+	usr, err := slf.user(clientID)
+	if err != nil {
+		return 0, false
+	}
+
+	if usr.PayloadLimit <= 0 {
+		return 0, false
+	}
+
+	return usr.PayloadLimit, true
+}
+
+//RateLimit 返回客户端的速率限制, 为0的限制使用全局配置, 小于0表示不限制
+func (slf *AuthMYSQL) RateLimit(clientID, username string) (ratelimit.Limit, bool) {
+	usr, err := slf.user(clientID)
+	if err != nil {
+		return ratelimit.Limit{}, false
+	}
+
+	limit := ratelimit.Limit{
+		Publish:   usr.RatePublish,
+		Bytes:     usr.RateBytes,
+		Subscribe: usr.RateSubscribe,
+		Burst:     usr.RateBurst,
+		Policy:    usr.RatePolicy,
+	}
+	if limit == (ratelimit.Limit{}) {
+		return limit, false
+	}
+
+	return limit, true
+}
+
 //ACL 验证访问主题授权
 func (slf *AuthMYSQL) ACL(action, clientID, username, ip, topic string) (bool, error) {
 	return true, nil
 }
 
+//user 返回客户端的用户记录, 优先使用Connect时读取的缓存
+func (slf *AuthMYSQL) user(clientID string) (*AuthUser, error) {
+	if usr, found := slf._users.Get(clientID); found {
+		return usr.(*AuthUser), nil
+	}
+	return slf.loadUser(clientID)
+}
+
+//loadUser 从数据库读取客户端的用户记录并更新缓存
+func (slf *AuthMYSQL) loadUser(clientID string) (*AuthUser, error) {
+	usr := &AuthUser{}
+	if err := slf._sql.DB().Where("client_id = ?", clientID).First(usr).Error; err != nil {
+		return nil, err
+	}
+
+	slf._users.Set(clientID, usr, cache.DefaultExpiration)
+	return usr, nil
+}
+
 func (slf *AuthMYSQL) doAuthCache(action, clientID, username, password, topic string) *authCache {
 	authc, found := slf._ca.Get(username)
 	if found {
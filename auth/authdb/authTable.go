@@ -4,9 +4,17 @@ import "time"
 
 //AuthUser 授权用户表
 type AuthUser struct {
-	ClientID string `gorm:"primary_key;type:varchar(64);not null;"`
-	UserName string `gorm:"type:varchar(32);not null;index:user_idx;"`
-	Password string `gorm:"type:varchar(32);not null;"`
-	CreateAt time.Time
-	UpdateAt time.Time
+	ClientID      string `gorm:"primary_key;type:varchar(64);not null;"`
+	UserName      string `gorm:"type:varchar(32);not null;index:user_idx;"`
+	Password      string `gorm:"type:varchar(32);not null;"`
+	SessionExpiry int    `gorm:"not null;default:0;"`
+	Mountpoint    string `gorm:"type:varchar(128);not null;default:'';"`
+	PayloadLimit  int    `gorm:"not null;default:0;"`
+	RatePublish   int    `gorm:"not null;default:0;"`
+	RateBytes     int    `gorm:"not null;default:0;"`
+	RateSubscribe int    `gorm:"not null;default:0;"`
+	RateBurst     int    `gorm:"not null;default:0;"`
+	RatePolicy    string `gorm:"type:varchar(16);not null;default:'';"`
+	CreateAt      time.Time
+	UpdateAt      time.Time
 }
@@ -1,5 +1,7 @@
 package auth
 
+import "github.com/yamakiller/magicMqtt/ratelimit"
+
 //Mock 模拟数据
 type Mock struct {
 }
@@ -9,6 +11,26 @@ func (slf *Mock) Connect(clientID, username, password string) (bool, error) {
 	return true, nil
 }
 
+//SessionExpiry ...
+func (slf *Mock) SessionExpiry(clientID, username string) (int, bool) {
+	return 0, false
+}
+
+//Mountpoint ...
+func (slf *Mock) Mountpoint(clientID, username string) (string, bool) {
+	return "", false
+}
+
+//PayloadLimit ...
+func (slf *Mock) PayloadLimit(clientID, username string) (int, bool) {
+	return 0, false
+}
+
+//RateLimit ...
+func (slf *Mock) RateLimit(clientID, username string) (ratelimit.Limit, bool) {
+	return ratelimit.Limit{}, false
+}
+
 //ACL ...
 func (slf *Mock) ACL(action, clientID, username, ip, topic string) (bool, error) {
 	return true, nil
@@ -5,8 +5,12 @@ import (
 
 	"github.com/yamakiller/magicLibs/log"
 	"github.com/yamakiller/magicMqtt/auth"
+	"github.com/yamakiller/magicMqtt/delayed"
+	"github.com/yamakiller/magicMqtt/dispatch"
+	"github.com/yamakiller/magicMqtt/ratelimit"
 	"github.com/yamakiller/magicMqtt/sessions"
 	"github.com/yamakiller/magicMqtt/topics"
+	"github.com/yamakiller/magicMqtt/trace"
 )
 
 var (
@@ -25,9 +29,15 @@ func Instance() *Board {
 
 //Board 黑板数据
 type Board struct {
-	Deploy   Config
-	Auth     auth.Auth
-	Log      log.LogAgent
-	Sessions *sessions.SessionGroup
-	Topics   *topics.Manager
+	Deploy     Config
+	Auth       auth.Auth
+	Log        log.LogAgent
+	Sessions   *sessions.SessionGroup
+	Topics     *topics.Manager
+	Dispatcher *dispatch.Dispatcher
+	Rewriter   *topics.Rewriter
+	Delayed    *delayed.Store
+	Validator  *topics.Validator
+	Tracer     *trace.Tracer
+	Throttle   *ratelimit.Metrics
 }
@@ -1,14 +1,65 @@
 package blackboard
 
+import "github.com/yamakiller/magicMqtt/topics"
+
 //Config 系统配置信息
 type Config struct {
 	WorkGroupID      int64  `yaml:"workGroup" json:"workGroup"`
 	WorkID           int64  `yaml:"work" json:"work"`
 	Keepalive        int    `yaml:"keepAlive" json:"keepAlive"`
 	OfflineQueueSize int    `yaml:"offlineQueueSize" json:"offlineQueueSize"`
+	OfflineQueueByte int    `yaml:"offlineQueueByte" json:"offlineQueueByte"`
+	OfflinePolicy    string `yaml:"offlinePolicy" json:"offlinePolicy"`
+	OfflineTTL       int    `yaml:"offlineTTL" json:"offlineTTL"`
+	OfflineSpillDir  string `yaml:"offlineSpillDir,omitempty" json:"offlineSpillDir,omitempty"`
+	OfflineSpillMem  int    `yaml:"offlineSpillMem" json:"offlineSpillMem"`
+	OfflineSpillSeg  int    `yaml:"offlineSpillSeg" json:"offlineSpillSeg"`
 	MessageQueueSize int    `yaml:"messageQueueSize" json:"messageQueueSize"`
+	MaxInflight      int    `yaml:"maxInflight" json:"maxInflight"`
+	MaxInflightQueue int    `yaml:"maxInflightQueue" json:"maxInflightQueue"`
+	QueueFullPolicy  string `yaml:"queueFullPolicy" json:"queueFullPolicy"`
+	QueueFullTimeout int    `yaml:"queueFullTimeout" json:"queueFullTimeout"`
+	WriteBatch       int    `yaml:"writeBatch" json:"writeBatch"`
+	FlushLatency     int    `yaml:"flushLatency" json:"flushLatency"`
+	DispatchShards   int    `yaml:"dispatchShards" json:"dispatchShards"`
+	DispatchQueue    int    `yaml:"dispatchQueue" json:"dispatchQueue"`
+	TopicCacheSize   int    `yaml:"topicCacheSize" json:"topicCacheSize"`
+	MaxTopicLength   int    `yaml:"maxTopicLength" json:"maxTopicLength"`
+	MaxTopicLevels   int    `yaml:"maxTopicLevels" json:"maxTopicLevels"`
+	MaxSubscriptions int    `yaml:"maxSubscriptions" json:"maxSubscriptions"`
+	MaxWildcardSubs  int    `yaml:"maxWildcardSubs" json:"maxWildcardSubs"`
+	RetainCount      int    `yaml:"retainCount" json:"retainCount"`
+	RetainByte       int    `yaml:"retainByte" json:"retainByte"`
+	RetainClientSize int    `yaml:"retainClientSize" json:"retainClientSize"`
+	RetainClientByte int    `yaml:"retainClientByte" json:"retainClientByte"`
+	RetainTTL        int    `yaml:"retainTTL" json:"retainTTL"`
+	DelayedEnable    bool   `yaml:"delayedEnable" json:"delayedEnable"`
+	DelayedDir       string `yaml:"delayedDir,omitempty" json:"delayedDir,omitempty"`
+	DelayedMax       int    `yaml:"delayedMax" json:"delayedMax"`
+	DelayedPending   int    `yaml:"delayedPending" json:"delayedPending"`
 	MessageSize      int    `yaml:"messageSize" json:"messageSize"`
+	PayloadLimit     int    `yaml:"payloadLimit" json:"payloadLimit"`
+	SpoolSize        int    `yaml:"spoolSize" json:"spoolSize"`
+	SpoolDir         string `yaml:"spoolDir,omitempty" json:"spoolDir,omitempty"`
 	BufferSize       int    `yaml:"bufferSize" json:"bufferSize"`
+	Reactor          bool   `yaml:"reactor" json:"reactor"`
+	ReactorWorkers   int    `yaml:"reactorWorkers" json:"reactorWorkers"`
+	SessionExpiry    int    `yaml:"sessionExpiry" json:"sessionExpiry"`
+	SessionReaper    int    `yaml:"sessionReaper" json:"sessionReaper"`
+	Mountpoint       string `yaml:"mountpoint,omitempty" json:"mountpoint,omitempty"`
 	AuthDB           string `yaml:"authDB,omitempty" json:"authDB,omitempty"`
 	AuthFile         string `yaml:"authFile,omitempty" json:"authFile,omitempty"`
+	AdminAddr        string `yaml:"adminAddr,omitempty" json:"adminAddr,omitempty"`
+	AdminToken       string `yaml:"adminToken,omitempty" json:"adminToken,omitempty"`
+	TraceFile        string `yaml:"traceFile,omitempty" json:"traceFile,omitempty"`
+	TracePayload     int    `yaml:"tracePayload" json:"tracePayload"`
+	RatePublish      int    `yaml:"ratePublish" json:"ratePublish"`
+	RateBytes        int    `yaml:"rateBytes" json:"rateBytes"`
+	RateSubscribe    int    `yaml:"rateSubscribe" json:"rateSubscribe"`
+	RateBurst        int    `yaml:"rateBurst" json:"rateBurst"`
+	RatePolicy       string `yaml:"ratePolicy" json:"ratePolicy"`
+
+	Rewrite       []topics.RewriteRule   `yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+	RetainPolicy  []topics.RetainPolicy  `yaml:"retainPolicy,omitempty" json:"retainPolicy,omitempty"`
+	AutoSubscribe []topics.AutoSubscribe `yaml:"autoSubscribe,omitempty" json:"autoSubscribe,omitempty"`
 }
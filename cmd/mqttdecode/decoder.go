@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const (
+	//dirIn 客户端发往服务端
+	dirIn = "in"
+	//dirOut 服务端发往客户端
+	dirOut = "out"
+
+	//errorBytes 错误记录中附带的原始字节数
+	errorBytes = 64
+
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+//record 输出的一条记录, 每行一个JSON对象
+type record struct {
+	Time   string          `json:"time,omitempty"`
+	Dir    string          `json:"dir,omitempty"`
+	Src    string          `json:"src,omitempty"`
+	Dst    string          `json:"dst,omitempty"`
+	Offset int64           `json:"offset"`
+	Length int             `json:"length,omitempty"`
+	Type   string          `json:"type,omitempty"`
+	Packet json.RawMessage `json:"packet,omitempty"`
+	Raw    string          `json:"raw,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+//printer 输出记录, 错误记录可以用颜色标出
+type printer struct {
+	_w     *bufio.Writer
+	_color bool
+	_raw   bool
+}
+
+func (slf *printer) print(rec *record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if rec.Error != "" && slf._color {
+		slf._w.WriteString(colorRed)
+		slf._w.Write(b)
+		slf._w.WriteString(colorReset)
+	} else {
+		slf._w.Write(b)
+	}
+	return slf._w.WriteByte('\n')
+}
+
+//decoder 把TCP报文段重组为MQTT报文并输出
+type decoder struct {
+	_port    uint16
+	_out     *printer
+	_streams map[string]*stream
+	_packets int
+	_errors  int
+}
+
+func newDecoder(port uint16, out *printer) *decoder {
+	return &decoder{
+		_port:    port,
+		_out:     out,
+		_streams: make(map[string]*stream),
+	}
+}
+
+//segment 处理抓包文件中的一个TCP报文段
+func (slf *decoder) segment(ts time.Time, seg *segment, truncated bool) {
+	if slf._port != 0 && seg._srcPort != slf._port && seg._dstPort != slf._port {
+		return
+	}
+
+	key := seg._src + ">" + seg._dst
+	st := slf._streams[key]
+	if st == nil || (seg._syn && st._synced) {
+		//端口复用时旧连接的数据先结束
+		if st != nil {
+			slf.finish(ts, st)
+		}
+		st = &stream{_src: seg._src, _dst: seg._dst}
+		switch {
+		case slf._port != 0 && seg._dstPort == slf._port:
+			st._dir = dirIn
+		case slf._port != 0 && seg._srcPort == slf._port:
+			st._dir = dirOut
+		}
+		slf._streams[key] = st
+	}
+
+	if !st._broken {
+		if truncated && len(seg._payload) > 0 {
+			slf.fail(ts, st, "tcp segment truncated by capture snaplen")
+		} else if err := st.push(seg); err != nil {
+			slf.fail(ts, st, err.Error())
+		} else {
+			slf.drain(ts, st)
+		}
+	}
+
+	if seg._fin || seg._rst {
+		slf.finish(ts, st)
+		delete(slf._streams, key)
+	}
+}
+
+//data 处理没有TCP信息的原始字节流
+func (slf *decoder) data(st *stream, data []byte) {
+	st._buf = append(st._buf, data...)
+	slf.drain(time.Time{}, st)
+}
+
+//drain 解码字节流中所有完整的报文
+func (slf *decoder) drain(ts time.Time, st *stream) {
+	for len(st._buf) > 0 && !st._broken {
+		if st._need == 0 {
+			st._need = packetLength(st._buf)
+		}
+		if st._need > len(st._buf) {
+			return
+		}
+
+		reader := bytes.NewReader(st._buf)
+		msg, err := message.Parse(reader, 0)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			slf.fail(ts, st, st.describe(err))
+			return
+		}
+
+		n := len(st._buf) - reader.Len()
+		rec := slf.record(ts, st)
+		rec.Length = n
+		rec.Type = msg.GetTypeAsString()
+		rec.Packet = packetJSON(msg)
+		if slf._out._raw {
+			rec.Raw = hex.EncodeToString(st._buf[:n])
+		}
+		slf._out.print(rec)
+		slf._packets++
+		st.consume(n)
+	}
+}
+
+//finish 字节流结束, 剩余的数据不足一个报文
+func (slf *decoder) finish(ts time.Time, st *stream) {
+	if len(st._buf) > 0 && !st._broken {
+		slf.fail(ts, st, fmt.Sprintf("stream ended inside a packet, %d bytes left", len(st._buf)))
+	}
+}
+
+//close 所有输入处理完毕, 报告未结束的连接中残留的数据
+func (slf *decoder) close() {
+	for key, st := range slf._streams {
+		slf.finish(time.Time{}, st)
+		delete(slf._streams, key)
+	}
+}
+
+//fail 输出错误记录, 之后的数据无法确定报文边界, 该方向不再解码
+func (slf *decoder) fail(ts time.Time, st *stream, reason string) {
+	rec := slf.record(ts, st)
+	rec.Error = reason
+	raw := st._buf
+	if len(raw) > errorBytes {
+		raw = raw[:errorBytes]
+	}
+	rec.Raw = hex.EncodeToString(raw)
+	slf._out.print(rec)
+
+	slf._errors++
+	st._broken = true
+	st._buf = nil
+	st._pending = nil
+}
+
+func (slf *decoder) record(ts time.Time, st *stream) *record {
+	rec := &record{Dir: st._dir, Src: st._src, Dst: st._dst, Offset: st._offset}
+	if !ts.IsZero() {
+		rec.Time = ts.UTC().Format(time.RFC3339Nano)
+	}
+	return rec
+}
+
+//packetLength 返回b开头的报文的总长度, 固定报头不完整时返回0
+func packetLength(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+
+	length, n, err := encoding.DecodeVarint(b[1:])
+	if err != nil {
+		//剩余长度溢出时交给Parse报告错误
+		return 0
+	}
+	return 1 + n + length
+}
+
+//packetJSON 使用消息的String方法输出JSON
+func packetJSON(msg message.Message) json.RawMessage {
+	s, ok := msg.(fmt.Stringer)
+	if !ok {
+		return nil
+	}
+
+	b := []byte(s.String())
+	if !json.Valid(b) {
+		b, _ = json.Marshal(s.String())
+	}
+	return b
+}
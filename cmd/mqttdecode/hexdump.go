@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//isHexDump 判断文件开头是否为文本格式的十六进制转储
+func isHexDump(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+
+	for _, c := range head {
+		if c != '\n' && c != '\r' && c != '\t' && (c < 0x20 || c > 0x7e) {
+			return false
+		}
+	}
+	return true
+}
+
+//parseHexDump 读取十六进制转储, 支持连续的十六进制串、0x前缀、xxd与hexdump -C格式
+//以#开头的行是注释
+func parseHexDump(r io.Reader) ([]byte, error) {
+	var data []byte
+	offsets := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text, offset := hexLine(scanner.Text())
+		//带偏移列的转储以只有偏移的一行结束
+		if offsets && !offset && len(text) >= 6 && !strings.ContainsAny(strings.TrimSpace(scanner.Text()), " \t") {
+			continue
+		}
+		offsets = offsets || offset
+		if text == "" {
+			continue
+		}
+
+		b, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		data = append(data, b...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//hexLine 去掉一行中的偏移、ASCII列与分隔符, 只保留十六进制数字, 返回该行是否带有偏移列
+func hexLine(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	//hexdump -C: 00000000  10 20 00 04 4d 51 54 54  |. ..MQTT|
+	if i := strings.IndexByte(line, '|'); i >= 0 {
+		line = line[:i]
+	}
+
+	offset := false
+	//xxd: 00000000: 1020 0004 4d51 5454  . ..MQTT
+	if i := strings.Index(line, ": "); i >= 0 && isHex(line[:i]) {
+		line = line[i+2:]
+		if j := strings.Index(line, "  "); j >= 0 {
+			line = line[:j]
+		}
+		offset = true
+	} else if fields := strings.Fields(line); len(fields) > 1 && len(fields[0]) >= 6 && isHex(fields[0]) &&
+		len(fields[1]) == 2 {
+		//hexdump -C的偏移列
+		line = strings.Join(fields[1:], " ")
+		offset = true
+	}
+
+	line = strings.Replace(line, "0x", "", -1)
+	line = strings.Replace(line, ",", "", -1)
+	return strings.Join(strings.Fields(line), ""), offset
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+//链路层类型, 参见 https://www.tcpdump.org/linktypes.html
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+const (
+	etherIPv4  = 0x0800
+	etherIPv6  = 0x86dd
+	etherVLAN  = 0x8100
+	etherQinQ  = 0x88a8
+	protoTCP   = 6
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+)
+
+//segment 一个TCP报文段
+type segment struct {
+	_src     string
+	_dst     string
+	_srcPort uint16
+	_dstPort uint16
+	_seq     uint32
+	_syn     bool
+	_fin     bool
+	_rst     bool
+	_payload []byte
+}
+
+//parseFrame 从链路层帧中取出TCP报文段, 不是TCP时返回nil
+func parseFrame(link uint32, data []byte) *segment {
+	var ip []byte
+	switch link {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		ether := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		for (ether == etherVLAN || ether == etherQinQ) && len(data) >= 4 {
+			ether = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if ether != etherIPv4 && ether != etherIPv6 {
+			return nil
+		}
+		ip = data
+	case linkNull, linkLoop:
+		//地址族在NULL中为主机字节序, 在LOOP中为网络字节序, 只需区分IPv4与IPv6
+		if len(data) < 4 {
+			return nil
+		}
+		ip = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+		ip = data
+	case linkSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		ip = data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		ip = data[20:]
+	default:
+		return nil
+	}
+
+	if len(ip) == 0 {
+		return nil
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		return parseIPv4(ip)
+	case 6:
+		return parseIPv6(ip)
+	}
+	return nil
+}
+
+func parseIPv4(ip []byte) *segment {
+	if len(ip) < 20 {
+		return nil
+	}
+
+	ihl := int(ip[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:]))
+	if ihl < 20 || total < ihl || len(ip) < ihl {
+		return nil
+	}
+	//以太网帧可能带有填充
+	if total < len(ip) {
+		ip = ip[:total]
+	}
+
+	//分片的报文不重组
+	if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 || ip[9] != protoTCP {
+		return nil
+	}
+
+	return parseTCP(net.IP(ip[12:16]), net.IP(ip[16:20]), ip[ihl:])
+}
+
+func parseIPv6(ip []byte) *segment {
+	if len(ip) < 40 {
+		return nil
+	}
+
+	length := int(binary.BigEndian.Uint16(ip[4:]))
+	next := ip[6]
+	src, dst := net.IP(ip[8:24]), net.IP(ip[24:40])
+	payload := ip[40:]
+	if length < len(payload) {
+		payload = payload[:length]
+	}
+
+	//跳过逐跳、路由与目的选项扩展头
+	for next == 0 || next == 43 || next == 60 {
+		if len(payload) < 8 {
+			return nil
+		}
+		n := (int(payload[1]) + 1) * 8
+		if len(payload) < n {
+			return nil
+		}
+		next, payload = payload[0], payload[n:]
+	}
+
+	if next != protoTCP {
+		return nil
+	}
+	return parseTCP(src, dst, payload)
+}
+
+func parseTCP(src, dst net.IP, tcp []byte) *segment {
+	if len(tcp) < 20 {
+		return nil
+	}
+
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || len(tcp) < offset {
+		return nil
+	}
+
+	seg := &segment{
+		_srcPort: binary.BigEndian.Uint16(tcp[0:]),
+		_dstPort: binary.BigEndian.Uint16(tcp[2:]),
+		_seq:     binary.BigEndian.Uint32(tcp[4:]),
+		_syn:     tcp[13]&tcpFlagSYN != 0,
+		_fin:     tcp[13]&tcpFlagFIN != 0,
+		_rst:     tcp[13]&tcpFlagRST != 0,
+		_payload: tcp[offset:],
+	}
+	seg._src = net.JoinHostPort(src.String(), strconv.Itoa(int(seg._srcPort)))
+	seg._dst = net.JoinHostPort(dst.String(), strconv.Itoa(int(seg._dstPort)))
+	return seg
+}
@@ -0,0 +1,148 @@
+//mqttdecode 使用服务端的编解码器解码抓包文件或十六进制转储中的MQTT报文
+//
+//	mqttdecode [-port 1883] [-format auto|pcap|hex|bin] [-dir in|out] [-color] [-raw] [file ...]
+//
+//每个报文输出一行JSON, 包含时间戳、方向、连接地址与消息内容; 解码错误输出error字段.
+//pcap与pcapng文件按TCP连接重组字节流, 转储文件作为一个方向的字节流解码.
+//没有指定文件或文件为-时从标准输入读取. 出现解码错误时退出码为1, 无法读取输入时为2.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	formatAuto = "auto"
+	formatPcap = "pcap"
+	formatHex  = "hex"
+	formatBin  = "bin"
+)
+
+//options 命令行参数
+type options struct {
+	_port   uint
+	_format string
+	_dir    string
+	_color  bool
+	_raw    bool
+}
+
+func main() {
+	opts := options{}
+	flag.UintVar(&opts._port, "port", 1883, "broker `port`, identifies direction in captures; 0 decodes every tcp stream")
+	flag.StringVar(&opts._format, "format", formatAuto, "input `format`: auto, pcap (pcap or pcapng), hex or bin")
+	flag.StringVar(&opts._dir, "dir", dirIn, "direction of hex and binary dumps: in (client to broker) or out")
+	flag.BoolVar(&opts._color, "color", false, "highlight decode errors with ANSI colors")
+	flag.BoolVar(&opts._raw, "raw", false, "include the raw bytes of every packet as hex")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if opts._port > 0xffff {
+		fmt.Fprintf(os.Stderr, "invalid port %d\n", opts._port)
+		os.Exit(2)
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	out := &printer{_w: bufio.NewWriter(os.Stdout), _color: opts._color, _raw: opts._raw}
+	dec := newDecoder(uint16(opts._port), out)
+	status := 0
+	for _, name := range files {
+		if err := decodeFile(dec, name, &opts); err != nil {
+			out._w.Flush()
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			status = 2
+		}
+	}
+	dec.close()
+	out._w.Flush()
+
+	if status == 0 && dec._errors > 0 {
+		status = 1
+	}
+	os.Exit(status)
+}
+
+//decodeFile 解码一个输入文件
+func decodeFile(dec *decoder, name string, opts *options) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	format := opts._format
+	if format == formatAuto {
+		head, _ := br.Peek(512)
+		switch {
+		case isCapture(head):
+			format = formatPcap
+		case isHexDump(head):
+			format = formatHex
+		default:
+			format = formatBin
+		}
+	}
+
+	switch format {
+	case formatPcap:
+		return decodeCapture(dec, br)
+	case formatHex, formatBin:
+		var data []byte
+		var err error
+		if format == formatHex {
+			data, err = parseHexDump(br)
+		} else {
+			data, err = ioutil.ReadAll(br)
+		}
+		if err != nil {
+			return err
+		}
+
+		st := &stream{_dir: opts._dir}
+		dec.data(st, data)
+		dec.finish(time.Time{}, st)
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+//decodeCapture 解码抓包文件中的所有TCP报文段
+func decodeCapture(dec *decoder, r *bufio.Reader) error {
+	c, err := openCapture(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		f, err := c.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if seg := parseFrame(f._link, f._data); seg != nil {
+			dec.segment(f._time, seg, f._truncated)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+var (
+	clientIP = []byte{192, 168, 1, 10}
+	brokerIP = []byte{10, 0, 0, 1}
+)
+
+//tcpFrame 构造以太网/IPv4/TCP帧
+func tcpFrame(src, dst []byte, sport, dport uint16, seq uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags | 0x10
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = protoTCP
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	ip = append(ip, tcp...)
+
+	eth := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(eth[12:], etherIPv4)
+	return append(eth, ip...)
+}
+
+type packet struct {
+	_time time.Time
+	_data []byte
+}
+
+func writePcap(packets []packet) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagicMicro)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	buf.Write(header)
+
+	for _, p := range packets {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:], uint32(p._time.Unix()))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(p._time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(p._data)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(p._data)))
+		buf.Write(rec)
+		buf.Write(p._data)
+	}
+	return buf.Bytes()
+}
+
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := make([]byte, 8, 12+len(body))
+	order.PutUint32(b[0:], typ)
+	order.PutUint32(b[4:], uint32(12+len(body)))
+	b = append(b, body...)
+	tail := make([]byte, 4)
+	order.PutUint32(tail, uint32(12+len(body)))
+	return append(b, tail...)
+}
+
+//writePcapng 大端字节序, 纳秒时间戳
+func writePcapng(packets []packet) []byte {
+	order := binary.BigEndian
+	var buf bytes.Buffer
+
+	shb := make([]byte, 16)
+	order.PutUint32(shb[0:], pcapngByteOrder)
+	order.PutUint16(shb[4:], 1)
+	binary.BigEndian.PutUint64(shb[8:], ^uint64(0))
+	buf.Write(pcapngBlock(order, pcapngSection, shb))
+
+	idb := make([]byte, 8)
+	order.PutUint16(idb[0:], linkEthernet)
+	opt := make([]byte, 4)
+	order.PutUint16(opt[0:], pcapngTsresol)
+	order.PutUint16(opt[2:], 1)
+	idb = append(idb, opt...)
+	idb = append(idb, 9, 0, 0, 0, 0, 0, 0, 0)
+	buf.Write(pcapngBlock(order, pcapngInterface, idb))
+
+	for _, p := range packets {
+		epb := make([]byte, 20)
+		ts := uint64(p._time.UnixNano())
+		order.PutUint32(epb[4:], uint32(ts>>32))
+		order.PutUint32(epb[8:], uint32(ts))
+		order.PutUint32(epb[12:], uint32(len(p._data)))
+		order.PutUint32(epb[16:], uint32(len(p._data)))
+		buf.Write(pcapngBlock(order, pcapngEnhancedPacket, append(epb, p._data...)))
+	}
+	return buf.Bytes()
+}
+
+func encode(t *testing.T, m message.Message) []byte {
+	b, err := message.Encode(nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//session 一个客户端会话: CONNECT被拆成两段且乱序到达, 其中一段被重传, 最后客户端发送了非法报文
+func session(t *testing.T, base time.Time) []packet {
+	connect := message.SpawnConnectMessage()
+	connect.Identifier = "sensor-17"
+	connect.CleanSession = true
+	connect.KeepAlive = 30
+	c := encode(t, connect)
+
+	pub := message.SpawnPublishMessage()
+	pub.TopicName = "sensors/17/temp"
+	pub.QosLevel = 1
+	pub.PacketIdentifier = 5
+	pub.Payload = []byte("21.5")
+	p := encode(t, pub)
+
+	ack := message.SpawnConnackMessage()
+	a := encode(t, ack)
+
+	const cseq, sseq = 1000, 5000
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	half := len(c) / 2
+	return []packet{
+		{at(0), tcpFrame(clientIP, brokerIP, 40000, 1883, cseq, tcpFlagSYN, nil)},
+		{at(1), tcpFrame(brokerIP, clientIP, 1883, 40000, sseq, tcpFlagSYN, nil)},
+		{at(2), tcpFrame(clientIP, brokerIP, 40000, 1883, cseq+1+uint32(half), 0, c[half:])},
+		{at(3), tcpFrame(clientIP, brokerIP, 40000, 1883, cseq+1, 0, c[:half])},
+		{at(4), tcpFrame(clientIP, brokerIP, 40000, 1883, cseq+1, 0, c[:half])},
+		{at(5), tcpFrame(brokerIP, clientIP, 1883, 40000, sseq+1, 0, a)},
+		{at(6), tcpFrame(clientIP, brokerIP, 40000, 1883, cseq+1+uint32(len(c)), 0, append(p, 0x00, 0x00))},
+		//与MQTT无关的连接
+		{at(7), tcpFrame(clientIP, brokerIP, 40001, 80, 1, 0, []byte("GET / HTTP/1.1\r\n"))},
+	}
+}
+
+func decodeRecords(t *testing.T, input []byte) ([]record, *decoder) {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	dec := newDecoder(1883, &printer{_w: w})
+	if err := decodeCapture(dec, bufio.NewReader(bytes.NewReader(input))); err != nil {
+		t.Fatal(err)
+	}
+	dec.close()
+	w.Flush()
+
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		rec := record{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, dec
+}
+
+func TestDecodeCapture(t *testing.T) {
+	base := time.Date(2026, 10, 19, 8, 30, 0, 123456789, time.UTC)
+	for name, input := range map[string][]byte{
+		"pcap":   writePcap(session(t, base)),
+		"pcapng": writePcapng(session(t, base)),
+	} {
+		records, dec := decodeRecords(t, input)
+		if len(records) != 4 || dec._packets != 3 || dec._errors != 1 {
+			t.Fatalf("%s: %d records, %d packets, %d errors: %+v", name, len(records), dec._packets, dec._errors, records)
+		}
+
+		want := []struct {
+			dir, typ string
+			offset   int64
+		}{
+			{dirIn, "connect", 0},
+			{dirOut, "connack", 0},
+			{dirIn, "publish", 23},
+		}
+		for i, w := range want {
+			r := records[i]
+			if r.Dir != w.dir || r.Type != w.typ || r.Offset != w.offset || r.Error != "" {
+				t.Fatalf("%s: record %d: %+v", name, i, r)
+			}
+		}
+
+		//CONNECT在第二段到达时才完整
+		if name == "pcapng" && records[0].Time != "2026-10-19T08:30:00.126456789Z" {
+			t.Fatalf("%s: connect time %s", name, records[0].Time)
+		}
+		if records[0].Src != "192.168.1.10:40000" || records[0].Dst != "10.0.0.1:1883" {
+			t.Fatalf("%s: connect %s > %s", name, records[0].Src, records[0].Dst)
+		}
+
+		var connect message.Connect
+		if err := json.Unmarshal(records[0].Packet, &connect); err != nil || connect.Identifier != "sensor-17" {
+			t.Fatalf("%s: connect packet %s: %v", name, records[0].Packet, err)
+		}
+
+		bad := records[3]
+		if bad.Dir != dirIn || bad.Error == "" || bad.Raw != "0000" {
+			t.Fatalf("%s: error record %+v", name, bad)
+		}
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	ping := "c000"
+	for name, dump := range map[string]string{
+		"plain":   "c0 00\n# comment\n0xc0,0x00\n",
+		"xxd":     "00000000: c000 c000                                ....\n",
+		"hexdump": "00000000  c0 00 c0 00                                       |....|\n00000004\n",
+	} {
+		data, err := parseHexDump(strings.NewReader(dump))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := hex.EncodeToString(data); got != ping+ping {
+			t.Fatalf("%s: got %s", name, got)
+		}
+	}
+}
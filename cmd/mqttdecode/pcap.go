@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+const (
+	//pcapMagicMicro pcap文件头, 时间戳精度为微秒
+	pcapMagicMicro = 0xa1b2c3d4
+	//pcapMagicNano pcap文件头, 时间戳精度为纳秒
+	pcapMagicNano = 0xa1b23c4d
+	//pcapngSection pcapng节头块类型
+	pcapngSection = 0x0a0d0d0a
+	//pcapngByteOrder pcapng节头块中的字节序标记
+	pcapngByteOrder = 0x1a2b3c4d
+
+	pcapngInterface      = 0x00000001
+	pcapngSimplePacket   = 0x00000003
+	pcapngEnhancedPacket = 0x00000006
+	//pcapngTsresol 接口描述块中的时间戳精度选项
+	pcapngTsresol = 9
+
+	//maxFrame 单个帧或块的最大长度, 超过时认为文件已损坏
+	maxFrame = 256 * 1024 * 1024
+)
+
+var errBadCapture = errors.New("not a pcap or pcapng file")
+
+//frame 抓包文件中的一个链路层帧
+type frame struct {
+	_time      time.Time
+	_link      uint32
+	_data      []byte
+	_truncated bool
+}
+
+//capture 抓包文件读取器, 读完时返回io.EOF
+type capture interface {
+	next() (*frame, error)
+}
+
+//isCapture 根据文件头判断是否为pcap或pcapng文件
+func isCapture(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case pcapMagicMicro, pcapMagicNano, pcapngSection:
+			return true
+		}
+	}
+	return false
+}
+
+//openCapture 读取文件头并返回对应格式的读取器
+func openCapture(r *bufio.Reader) (capture, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errBadCapture
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngSection {
+		return &pcapngReader{_r: r}, nil
+	}
+
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errBadCapture
+	}
+
+	p := &pcapReader{_r: r}
+	switch {
+	case binary.LittleEndian.Uint32(header[:]) == pcapMagicMicro:
+		p._order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[:]) == pcapMagicMicro:
+		p._order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header[:]) == pcapMagicNano:
+		p._order, p._nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header[:]) == pcapMagicNano:
+		p._order, p._nano = binary.BigEndian, true
+	default:
+		return nil, errBadCapture
+	}
+
+	//高16位可能携带FCS信息
+	p._link = p._order.Uint32(header[20:]) & 0xffff
+	return p, nil
+}
+
+//pcapReader 经典pcap格式
+type pcapReader struct {
+	_r     io.Reader
+	_order binary.ByteOrder
+	_nano  bool
+	_link  uint32
+}
+
+func (slf *pcapReader) next() (*frame, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(slf._r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated pcap record header")
+		}
+		return nil, err
+	}
+
+	sec := slf._order.Uint32(header[0:])
+	frac := slf._order.Uint32(header[4:])
+	caplen := slf._order.Uint32(header[8:])
+	origlen := slf._order.Uint32(header[12:])
+	if caplen > maxFrame {
+		return nil, fmt.Errorf("pcap record of %d bytes", caplen)
+	}
+
+	data := make([]byte, caplen)
+	if _, err := io.ReadFull(slf._r, data); err != nil {
+		return nil, fmt.Errorf("truncated pcap record")
+	}
+
+	if !slf._nano {
+		frac *= 1000
+	}
+	return &frame{
+		_time:      time.Unix(int64(sec), int64(frac)),
+		_link:      slf._link,
+		_data:      data,
+		_truncated: caplen < origlen,
+	}, nil
+}
+
+//pcapngInterfaceDesc pcapng接口描述
+type pcapngInterfaceDesc struct {
+	_link    uint32
+	_snaplen uint32
+	//时间戳单位为_num/_den纳秒
+	_num uint64
+	_den uint64
+}
+
+//nanos 把接口时间戳换算为纳秒
+func (slf *pcapngInterfaceDesc) nanos(ts uint64) int64 {
+	hi, lo := bits.Mul64(ts, slf._num)
+	if hi >= slf._den {
+		return 0
+	}
+	q, _ := bits.Div64(hi, lo, slf._den)
+	return int64(q)
+}
+
+//pcapngReader pcapng格式, 只处理接口描述块与数据包块
+type pcapngReader struct {
+	_r      io.Reader
+	_order  binary.ByteOrder
+	_ifaces []pcapngInterfaceDesc
+}
+
+func (slf *pcapngReader) next() (*frame, error) {
+	for {
+		typ, body, err := slf.block()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case pcapngSection:
+			//新的节重新定义接口
+			slf._ifaces = slf._ifaces[:0]
+		case pcapngInterface:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("short pcapng interface block")
+			}
+			num, den := slf.tsresol(body[8:])
+			slf._ifaces = append(slf._ifaces, pcapngInterfaceDesc{
+				_link:    uint32(slf._order.Uint16(body[0:])),
+				_snaplen: slf._order.Uint32(body[4:]),
+				_num:     num,
+				_den:     den,
+			})
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("short pcapng packet block")
+			}
+			id := slf._order.Uint32(body[0:])
+			if int(id) >= len(slf._ifaces) {
+				return nil, fmt.Errorf("pcapng packet on undefined interface %d", id)
+			}
+			iface := slf._ifaces[id]
+			ts := uint64(slf._order.Uint32(body[4:]))<<32 | uint64(slf._order.Uint32(body[8:]))
+			caplen := slf._order.Uint32(body[12:])
+			origlen := slf._order.Uint32(body[16:])
+			if uint64(caplen) > uint64(len(body)-20) {
+				return nil, fmt.Errorf("pcapng packet of %d bytes exceeds block", caplen)
+			}
+			return &frame{
+				_time:      time.Unix(0, iface.nanos(ts)),
+				_link:      iface._link,
+				_data:      body[20 : 20+caplen],
+				_truncated: caplen < origlen,
+			}, nil
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(slf._ifaces) == 0 {
+				return nil, fmt.Errorf("bad pcapng simple packet block")
+			}
+			iface := slf._ifaces[0]
+			origlen := slf._order.Uint32(body[0:])
+			caplen := origlen
+			if iface._snaplen > 0 && caplen > iface._snaplen {
+				caplen = iface._snaplen
+			}
+			if uint64(caplen) > uint64(len(body)-4) {
+				caplen = uint32(len(body) - 4)
+			}
+			return &frame{
+				_link:      iface._link,
+				_data:      body[4 : 4+caplen],
+				_truncated: caplen < origlen,
+			}, nil
+		}
+	}
+}
+
+//block 读取一个块, 返回块类型与块内容
+func (slf *pcapngReader) block() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(slf._r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("truncated pcapng block header")
+		}
+		return 0, nil, err
+	}
+
+	//节头块的字节序由块内的标记决定
+	if binary.LittleEndian.Uint32(header[:]) == pcapngSection {
+		var magic [4]byte
+		if _, err := io.ReadFull(slf._r, magic[:]); err != nil {
+			return 0, nil, fmt.Errorf("truncated pcapng section header")
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic[:]) == pcapngByteOrder:
+			slf._order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic[:]) == pcapngByteOrder:
+			slf._order = binary.BigEndian
+		default:
+			return 0, nil, errBadCapture
+		}
+
+		length := slf._order.Uint32(header[4:])
+		if length < 16 || length > maxFrame {
+			return 0, nil, fmt.Errorf("bad pcapng section length %d", length)
+		}
+		rest := make([]byte, length-12)
+		if _, err := io.ReadFull(slf._r, rest); err != nil {
+			return 0, nil, fmt.Errorf("truncated pcapng section header")
+		}
+		return pcapngSection, rest[:len(rest)-4], nil
+	}
+
+	if slf._order == nil {
+		return 0, nil, errBadCapture
+	}
+
+	length := slf._order.Uint32(header[4:])
+	if length < 12 || length%4 != 0 || length > maxFrame {
+		return 0, nil, fmt.Errorf("bad pcapng block length %d", length)
+	}
+
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(slf._r, body); err != nil {
+		return 0, nil, fmt.Errorf("truncated pcapng block")
+	}
+	return slf._order.Uint32(header[:]), body[:len(body)-4], nil
+}
+
+//tsresol 从接口描述块的选项中读取时间戳单位, 返回num/den纳秒, 默认微秒
+func (slf *pcapngReader) tsresol(options []byte) (uint64, uint64) {
+	for len(options) >= 4 {
+		code := slf._order.Uint16(options[0:])
+		length := int(slf._order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+
+		if code == pcapngTsresol && length >= 1 {
+			v := options[4]
+			if v&0x80 != 0 && v&0x7f < 64 {
+				return 1e9, 1 << (v & 0x7f)
+			}
+			if v <= 9 {
+				return pow10(9 - int(v)), 1
+			}
+			if v <= 19 {
+				return 1, pow10(int(v) - 9)
+			}
+			break
+		}
+
+		options = options[4+(length+3)&^3:]
+	}
+	return 1e3, 1
+}
+
+func pow10(n int) uint64 {
+	v := uint64(1)
+	for ; n > 0; n-- {
+		v *= 10
+	}
+	return v
+}
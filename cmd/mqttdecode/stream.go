@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	//maxPending 每个方向缓存的乱序报文段上限
+	maxPending = 4096
+)
+
+var errGap = errors.New("missing tcp segments, too many out of order segments")
+
+//stream TCP连接的一个方向, 按序号重组出字节流
+type stream struct {
+	_src     string
+	_dst     string
+	_dir     string
+	_synced  bool
+	_joined  bool
+	_next    uint32
+	_pending map[uint32][]byte
+	_buf     []byte
+	//_offset _buf[0]在字节流中的位置
+	_offset int64
+	//_need 下一个报文的总长度, 数据不足时不必重复解析
+	_need   int
+	_broken bool
+}
+
+//push 按序号把报文段追加到字节流, 重传的部分被丢弃, 乱序的报文段缓存到缺口补齐
+func (slf *stream) push(seg *segment) error {
+	if seg._syn {
+		slf._synced = true
+		slf._next = seg._seq + 1
+		return nil
+	}
+
+	if len(seg._payload) == 0 {
+		return nil
+	}
+
+	if !slf._synced {
+		//抓包开始时连接已经建立, 第一个报文段不一定从报文边界开始
+		slf._synced = true
+		slf._joined = true
+		slf._next = seg._seq
+	}
+
+	if int32(seg._seq-slf._next) > 0 {
+		if len(slf._pending) >= maxPending {
+			return errGap
+		}
+		if slf._pending == nil {
+			slf._pending = make(map[uint32][]byte)
+		}
+		if old, ok := slf._pending[seg._seq]; !ok || len(old) < len(seg._payload) {
+			slf._pending[seg._seq] = append([]byte(nil), seg._payload...)
+		}
+		return nil
+	}
+
+	slf.accept(seg._seq, seg._payload)
+	for progress := true; progress && len(slf._pending) > 0; {
+		progress = false
+		for seq, payload := range slf._pending {
+			if int32(seq-slf._next) <= 0 {
+				delete(slf._pending, seq)
+				slf.accept(seq, payload)
+				progress = true
+			}
+		}
+	}
+	return nil
+}
+
+//accept 追加从seq开始的数据中尚未收到的部分
+func (slf *stream) accept(seq uint32, payload []byte) {
+	skip := int(slf._next - seq)
+	if skip >= len(payload) {
+		return
+	}
+
+	slf._buf = append(slf._buf, payload[skip:]...)
+	slf._next = seq + uint32(len(payload))
+}
+
+//consume 丢弃已解码的n字节
+func (slf *stream) consume(n int) {
+	slf._offset += int64(n)
+	slf._buf = slf._buf[n:]
+	slf._need = 0
+	if len(slf._buf) == 0 {
+		slf._buf = nil
+	}
+}
+
+//describe 错误说明, 中途加入的连接附加提示
+func (slf *stream) describe(err error) string {
+	if slf._joined && slf._offset == 0 {
+		return fmt.Sprintf("%s (capture started mid-connection)", err.Error())
+	}
+	return err.Error()
+}
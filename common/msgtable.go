@@ -3,12 +3,18 @@ package common
 import (
 	"errors"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/yamakiller/magicMqtt/encoding/message"
 )
 
+var (
+	//ErrIDExhausted 所有消息ID都已被占用
+	ErrIDExhausted = errors.New("message id exhausted")
+)
+
 //MessageContainer 消息内容句柄
 type MessageContainer struct {
 	_message message.Message
@@ -41,26 +47,37 @@ func (slf *MessageTable) WithOnFinish(callback func(uint16, message.Message, int
 	slf._onFinish = callback
 }
 
-//NewID 创建一个新的ID
-func (slf *MessageTable) NewID() uint16 {
+//NewID 创建一个新的ID, ID范围为1~65535, 全部被占用时返回ErrIDExhausted
+func (slf *MessageTable) NewID() (uint16, error) {
 	slf.Lock()
 	defer slf.Unlock()
-	if slf._id == math.MaxUint16 {
-		slf._id = 0
+	if len(slf._used) >= math.MaxUint16 {
+		return 0, ErrIDExhausted
 	}
 
-	var id uint16
-	ok := false
-	for !ok {
-		if _, ok = slf._used[slf._id]; !ok {
-			id = slf._id
-			slf._used[slf._id] = true
-			slf._id++
-			break
+	for {
+		id := slf._id
+		slf._id++
+		if slf._id == 0 {
+			slf._id = 1
+		}
+
+		if id == 0 {
+			continue
+		}
+
+		if _, ok := slf._used[id]; !ok {
+			slf._used[id] = true
+			return id, nil
 		}
 	}
+}
 
-	return id
+//Len 返回等待确认的消息数
+func (slf *MessageTable) Len() int {
+	slf.RLock()
+	defer slf.RUnlock()
+	return len(slf._used)
 }
 
 //Clean 清除
@@ -68,6 +85,7 @@ func (slf *MessageTable) Clean() {
 	slf.Lock()
 	defer slf.Unlock()
 	slf._hash = make(map[uint16]*MessageContainer)
+	slf._used = make(map[uint16]bool)
 }
 
 //Get 返回一个消息
@@ -83,6 +101,32 @@ func (slf *MessageTable) Get(id uint16) (message.Message, error) {
 	return nil, errors.New("not found")
 }
 
+//Messages 按注册顺序返回所有等待确认的消息
+func (slf *MessageTable) Messages() []message.Message {
+	slf.RLock()
+	defer slf.RUnlock()
+
+	ids := make([]uint16, 0, len(slf._hash))
+	for id := range slf._hash {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		ci, cj := slf._hash[ids[i]], slf._hash[ids[j]]
+		if ci._created.Equal(cj._created) {
+			return ids[i] < ids[j]
+		}
+		return ci._created.Before(cj._created)
+	})
+
+	msgs := make([]message.Message, len(ids))
+	for i, id := range ids {
+		msgs[i] = slf._hash[id]._message
+	}
+
+	return msgs
+}
+
 //Register 注册一个消息
 func (slf *MessageTable) Register(id uint16, msg message.Message, opaque interface{}) {
 	slf.Lock()
@@ -111,6 +155,21 @@ func (slf *MessageTable) Register2(id uint16, msg message.Message, count int, op
 	}
 }
 
+//Replace 替换已注册的消息, 保留注册时间与计数器, id未注册时返回false
+func (slf *MessageTable) Replace(id uint16, msg message.Message) bool {
+	slf.Lock()
+	defer slf.Unlock()
+
+	v, ok := slf._hash[id]
+	if !ok {
+		return false
+	}
+
+	v._message = msg
+	v._updated = time.Now()
+	return true
+}
+
 //Unref 取消一个消息的引用
 func (slf *MessageTable) Unref(id uint16) {
 	slf.Lock()
@@ -137,4 +196,5 @@ func (slf *MessageTable) Remove(id uint16) {
 	if _, ok := slf._hash[id]; ok {
 		delete(slf._hash, id)
 	}
+	delete(slf._used, id)
 }
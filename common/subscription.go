@@ -4,4 +4,6 @@ type Subscription struct {
 	Client string
 	Topic  string
 	Qos    byte
+	//Hidden 客户端不能取消的订阅
+	Hidden bool
 }
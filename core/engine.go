@@ -3,18 +3,30 @@ package core
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/yamakiller/magicMqtt/blackboard"
 
 	"github.com/yamakiller/magicLibs/log"
 	"github.com/yamakiller/magicLibs/util"
+	"github.com/yamakiller/magicMqtt/admin"
 	"github.com/yamakiller/magicMqtt/auth"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/ratelimit"
 	"github.com/yamakiller/magicMqtt/server"
 	"github.com/yamakiller/magicMqtt/sessions"
 	"github.com/yamakiller/magicMqtt/topics"
+	"github.com/yamakiller/magicMqtt/trace"
+)
+
+const (
+	//defaultSessionReaper 默认会话回收间隔(秒)
+	defaultSessionReaper = 60
 )
 
 //Engine 系统引擎
@@ -26,6 +38,8 @@ type Engine struct {
 	_closed      chan bool
 	_broker      server.Broker
 	_signalWatch *util.SignalWatch
+	_admin       *admin.Server
+	_traceFile   *os.File
 }
 
 //Start 启动系统
@@ -82,8 +96,69 @@ func (slf *Engine) Start(addr string) error {
 		blackboard.Instance().Auth = au
 	}
 
+	//清除上次运行残留的离线溢出文件
+	if err := sessions.CleanSpill(cfg.OfflineSpillDir); err != nil {
+		return err
+	}
+
+	//清除上次运行残留的负载临时文件
+	if err := message.CleanSpool(cfg.SpoolDir); err != nil {
+		return err
+	}
+
 	blackboard.Instance().Sessions = sessions.NewGroup()
+	blackboard.Instance().Throttle = ratelimit.NewMetrics()
 	blackboard.Instance().Topics, _ = topics.NewManager("mem")
+	if cfg.TopicCacheSize != 0 {
+		blackboard.Instance().Topics.WithCacheSize(cfg.TopicCacheSize)
+	}
+	blackboard.Instance().Topics.WithRetainLimit(topics.RetainLimit{
+		Count:       cfg.RetainCount,
+		Bytes:       cfg.RetainByte,
+		ClientCount: cfg.RetainClientSize,
+		ClientBytes: cfg.RetainClientByte,
+		TTL:         time.Duration(cfg.RetainTTL) * time.Second,
+		Policies:    cfg.RetainPolicy,
+	})
+
+	if cfg.MaxTopicLength > 0 || cfg.MaxTopicLevels > 0 {
+		blackboard.Instance().Validator = &topics.Validator{
+			MaxLength: cfg.MaxTopicLength,
+			MaxLevels: cfg.MaxTopicLevels,
+		}
+	}
+
+	if len(cfg.Rewrite) > 0 {
+		rw, err := topics.NewRewriter(cfg.Rewrite)
+		if err != nil {
+			return err
+		}
+		blackboard.Instance().Rewriter = rw
+	}
+	//授权验证器可以为单个客户端设置过期时间, 未配置全局过期时间时也启动回收器
+	reaper := cfg.SessionReaper
+	if reaper <= 0 {
+		reaper = defaultSessionReaper
+	}
+	blackboard.Instance().Sessions.StartReaper(time.Duration(reaper)*time.Second,
+		slf.onSessionExpired)
+	if cfg.DispatchShards > 0 {
+		blackboard.Instance().Dispatcher = server.NewDispatcher(cfg.DispatchShards, cfg.DispatchQueue)
+	}
+	if cfg.DelayedEnable {
+		store, err := server.NewDelayed(cfg.DelayedDir,
+			time.Duration(cfg.DelayedMax)*time.Second,
+			cfg.DelayedPending)
+		if err != nil {
+			return err
+		}
+		blackboard.Instance().Delayed = store
+	}
+	if cfg.AdminAddr != "" {
+		if err := slf.startAdmin(&cfg); err != nil {
+			return err
+		}
+	}
 	//启动服务
 	slf._broker = &server.TCPBroker{}
 	if err := slf._broker.ListenAndServe(addr); err != nil {
@@ -99,10 +174,40 @@ func (slf *Engine) Start(addr string) error {
 	return nil
 }
 
+//startAdmin 启动管理接口, 跟踪记录写入TraceFile, 未配置时写入标准错误
+func (slf *Engine) startAdmin(cfg *blackboard.Config) error {
+	var sink io.Writer = os.Stderr
+	if cfg.TraceFile != "" {
+		f, err := os.OpenFile(cfg.TraceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		slf._traceFile = f
+		sink = f
+	}
+
+	blackboard.Instance().Tracer = trace.New(sink, cfg.TracePayload)
+	slf._admin = admin.New(blackboard.Instance().Tracer, cfg.AdminToken)
+	slf._admin.WithThrottle(blackboard.Instance().Throttle)
+	slf._admin.WithDelayed(blackboard.Instance().Delayed)
+	slf._admin.WithSessions(blackboard.Instance().Sessions)
+	return slf._admin.ListenAndServe(cfg.AdminAddr)
+}
+
 func (slf *Engine) signalClose() {
 	close(slf._closed)
 }
 
+//onSessionExpired 会话过期, 移除其所有订阅
+func (slf *Engine) onSessionExpired(s *sessions.Session) {
+	for _, sub := range s.Subscriptions() {
+		if err := blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub); err != nil {
+			slf.Error("Session/%s expired unsubscribe %s error, %s", s.GetClientID(), sub.Topic, err.Error())
+		}
+	}
+	slf.Debug("Session/%s expired", s.GetClientID())
+}
+
 //Info 输出消息级日志
 func (slf *Engine) Info(fmt string, args ...interface{}) {
 	blackboard.Instance().Log.Info(slf.getPrefix(), fmt, args...)
@@ -154,6 +259,34 @@ func (slf *Engine) Shutdown() {
 		slf._broker = nil
 	}
 
+	if slf._admin != nil {
+		slf._admin.Shutdown()
+		slf._admin = nil
+	}
+
+	if blackboard.Instance().Tracer != nil {
+		blackboard.Instance().Tracer = nil
+	}
+
+	if slf._traceFile != nil {
+		slf._traceFile.Close()
+		slf._traceFile = nil
+	}
+
+	if blackboard.Instance().Delayed != nil {
+		blackboard.Instance().Delayed.Close()
+		blackboard.Instance().Delayed = nil
+	}
+
+	if blackboard.Instance().Dispatcher != nil {
+		blackboard.Instance().Dispatcher.Close()
+		blackboard.Instance().Dispatcher = nil
+	}
+
+	if blackboard.Instance().Sessions != nil {
+		blackboard.Instance().Sessions.StopReaper()
+	}
+
 	if slf._signalWatch != nil {
 		slf._signalWatch.Wait()
 		slf._signalWatch = nil
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/common"
+	"github.com/yamakiller/magicMqtt/sessions"
+	"github.com/yamakiller/magicMqtt/topics"
+)
+
+//testLog 测试时输出到testing.T
+type testLog struct {
+	_t *testing.T
+}
+
+func (slf *testLog) WithHandle(interface{}) {}
+func (slf *testLog) Info(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Error(prefix, fmt string, args ...interface{}) {
+	slf._t.Errorf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Warning(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Debug(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Panic(prefix, fmt string, args ...interface{}) {
+	slf._t.Fatalf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Close() {}
+
+func TestSessionExpiredUnsubscribe(t *testing.T) {
+	bb := blackboard.Instance()
+	bb.Log = &testLog{_t: t}
+	bb.Sessions = sessions.NewGroup()
+	bb.Topics, _ = topics.NewManager("mem")
+
+	s := bb.Sessions.New("c1", sessions.OfflineLimit{})
+	for _, topic := range []string{"expiry/a", "expiry/+/b"} {
+		sub := &common.Subscription{Client: "c1", Topic: topic, Qos: 1}
+		if _, err := bb.Topics.Subscribe([]byte(topic), 1, sub); err != nil {
+			t.Fatal(err)
+		}
+		s.AddSubscription(sub)
+	}
+	kept := &common.Subscription{Client: "c2", Topic: "expiry/a", Qos: 1}
+	bb.Topics.Subscribe([]byte(kept.Topic), 1, kept)
+	defer bb.Topics.Unsubscribe([]byte(kept.Topic), kept)
+
+	engine := &Engine{}
+	engine.onSessionExpired(s)
+
+	//只移除过期会话的订阅
+	var subs []*common.Subscription
+	var qoss []byte
+	for topic, want := range map[string]int{"expiry/a": 1, "expiry/x/b": 0} {
+		if err := bb.Topics.Subscribers([]byte(topic), 1, &subs, &qoss); err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) != want || (want == 1 && subs[0] != kept) {
+			t.Fatalf("%s matched %d subscribers", topic, len(subs))
+		}
+	}
+}
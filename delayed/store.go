@@ -0,0 +1,486 @@
+package delayed
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const (
+	//Prefix 延迟发布主题前缀, 格式为 $delayed/{seconds}/{topic}
+	Prefix = "$delayed/"
+	//fileExt 延迟消息文件扩展名
+	fileExt = ".dly"
+	//recordHeader 记录头: 到期时间(8) + 发布者长度(2)
+	recordHeader = 10
+)
+
+var (
+	//ErrInvalidTopic 延迟发布主题格式错误
+	ErrInvalidTopic = errors.New("invalid delayed topic")
+	//ErrDelayTooLong 延迟时间超过上限
+	ErrDelayTooLong = errors.New("delay too long")
+	//ErrTooManyPending 等待中的延迟消息已达上限
+	ErrTooManyPending = errors.New("too many pending delayed messages")
+	//ErrStoreClosed 延迟存储已关闭
+	ErrStoreClosed = errors.New("delayed store closed")
+
+	errCorrupted = errors.New("corrupted delayed record")
+)
+
+//Parse 解析延迟发布主题, 返回延迟时间与实际主题
+func Parse(topic string) (time.Duration, string, error) {
+	if !strings.HasPrefix(topic, Prefix) {
+		return 0, topic, nil
+	}
+
+	rest := topic[len(Prefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return 0, "", ErrInvalidTopic
+	}
+
+	seconds, err := strconv.ParseUint(rest[:i], 10, 32)
+	if err != nil {
+		return 0, "", ErrInvalidTopic
+	}
+
+	return time.Duration(seconds) * time.Second, rest[i+1:], nil
+}
+
+//Release 延迟消息到期回调, publisher为发布者的client id, 回调持有msg并负责释放
+type Release func(publisher string, msg *message.Publish)
+
+//Scheduled 等待中的延迟消息信息
+type Scheduled struct {
+	ID        uint64    `json:"id"`
+	Publisher string    `json:"publisher"`
+	Topic     string    `json:"topic"`
+	Qos       int       `json:"qos"`
+	Retain    bool      `json:"retain"`
+	Size      int       `json:"size"`
+	Due       time.Time `json:"due"`
+}
+
+type entry struct {
+	_id        uint64
+	_publisher string
+	_msg       *message.Publish
+	_due       time.Time
+	_index     int
+}
+
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i]._due.Equal(h[j]._due) {
+		return h[i]._id < h[j]._id
+	}
+	return h[i]._due.Before(h[j]._due)
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i]._index = i
+	h[j]._index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e._index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e._index = -1
+	*h = old[:n-1]
+	return e
+}
+
+//Store 延迟消息存储
+//
+//每条消息保存为dir下的一个文件, 重启后重新装载, 到期后删除文件并回调release.
+//dir为空时只保存在内存中.
+type Store struct {
+	_dir        string
+	_maxDelay   time.Duration
+	_maxPending int
+	_release    Release
+	_parse      message.ParseOptions
+	_mu         sync.Mutex
+	_heap       entryHeap
+	_ids        map[uint64]*entry
+	_seq        uint64
+	_wakeup     chan bool
+	_closed     chan bool
+	_once       sync.Once
+	_wg         sync.WaitGroup
+}
+
+//New 创建延迟消息存储并装载dir中已保存的消息
+//maxDelay<=0 表示不限制延迟时间, maxPending<=0 表示不限制等待数量,
+//spool为装载时的解析选项, 大负载写入临时文件而不读入内存
+func New(dir string, maxDelay time.Duration, maxPending int, spool message.ParseOptions, release Release) (*Store, error) {
+	s := &Store{
+		_dir:        dir,
+		_maxDelay:   maxDelay,
+		_maxPending: maxPending,
+		_release:    release,
+		_parse:      spool,
+		_ids:        make(map[uint64]*entry),
+		_wakeup:     make(chan bool, 1),
+		_closed:     make(chan bool),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s._wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+//Schedule 计划在delay后发布publisher的消息, 返回延迟消息ID
+//存储保存持有负载引用的副本, 调用者仍持有msg
+func (slf *Store) Schedule(publisher string, msg *message.Publish, delay time.Duration) (uint64, error) {
+	if slf._maxDelay > 0 && delay > slf._maxDelay {
+		return 0, ErrDelayTooLong
+	}
+
+	slf._mu.Lock()
+	select {
+	case <-slf._closed:
+		slf._mu.Unlock()
+		return 0, ErrStoreClosed
+	default:
+	}
+
+	if slf._maxPending > 0 && len(slf._heap) >= slf._maxPending {
+		slf._mu.Unlock()
+		return 0, ErrTooManyPending
+	}
+
+	slf._seq++
+	e := &entry{
+		_id:        slf._seq,
+		_publisher: publisher,
+		_msg:       msg.Envelope(msg.QosLevel, msg.Retain > 0),
+		_due:       time.Now().Add(delay),
+	}
+	//记录中保留发布者的报文ID, QoS 1/2消息的ID为0时无法装载
+	e._msg.PacketIdentifier = msg.PacketIdentifier
+	if err := slf.save(e); err != nil {
+		slf._mu.Unlock()
+		e._msg.Release()
+		return 0, err
+	}
+
+	heap.Push(&slf._heap, e)
+	slf._ids[e._id] = e
+	first := e._index == 0
+	slf._mu.Unlock()
+
+	if first {
+		slf.wakeup()
+	}
+
+	return e._id, nil
+}
+
+//Cancel 取消一条延迟消息
+func (slf *Store) Cancel(id uint64) bool {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	e, ok := slf._ids[id]
+	if !ok {
+		return false
+	}
+
+	heap.Remove(&slf._heap, e._index)
+	delete(slf._ids, id)
+	slf.remove(e)
+	e._msg.Release()
+	return true
+}
+
+//Len 返回等待中的延迟消息数
+func (slf *Store) Len() int {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	return len(slf._heap)
+}
+
+//Scheduled 返回所有等待中的延迟消息, 按到期时间排序
+func (slf *Store) Scheduled() []Scheduled {
+	slf._mu.Lock()
+	result := make([]Scheduled, 0, len(slf._heap))
+	for _, e := range slf._heap {
+		result = append(result, Scheduled{
+			ID:        e._id,
+			Publisher: e._publisher,
+			Topic:     e._msg.TopicName,
+			Qos:       e._msg.QosLevel,
+			Retain:    e._msg.Retain > 0,
+			Size:      e._msg.PayloadSize(),
+			Due:       e._due,
+		})
+	}
+	slf._mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Due.Equal(result[j].Due) {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Due.Before(result[j].Due)
+	})
+
+	return result
+}
+
+//Close 停止延迟存储, 未到期的消息保留在磁盘中等待下次启动
+func (slf *Store) Close() {
+	slf._once.Do(func() {
+		slf._mu.Lock()
+		close(slf._closed)
+		slf._mu.Unlock()
+		slf._wg.Wait()
+
+		slf._mu.Lock()
+		for _, e := range slf._heap {
+			e._msg.Release()
+		}
+		slf._mu.Unlock()
+	})
+}
+
+func (slf *Store) wakeup() {
+	select {
+	case slf._wakeup <- true:
+	default:
+	}
+}
+
+func (slf *Store) run() {
+	defer slf._wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		for _, e := range slf.due(time.Now()) {
+			if slf._release != nil {
+				slf._release(e._publisher, e._msg)
+			} else {
+				e._msg.Release()
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(slf.next(time.Now()))
+
+		select {
+		case <-slf._closed:
+			return
+		case <-slf._wakeup:
+		case <-timer.C:
+		}
+	}
+}
+
+//due 取出所有已到期的消息并删除其文件
+func (slf *Store) due(now time.Time) []*entry {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	var result []*entry
+	for len(slf._heap) > 0 && !slf._heap[0]._due.After(now) {
+		e := heap.Pop(&slf._heap).(*entry)
+		delete(slf._ids, e._id)
+		slf.remove(e)
+		result = append(result, e)
+	}
+
+	return result
+}
+
+//next 返回距离下一条消息到期的时间
+func (slf *Store) next(now time.Time) time.Duration {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	if len(slf._heap) == 0 {
+		return time.Hour
+	}
+
+	d := slf._heap[0]._due.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (slf *Store) path(id uint64) string {
+	return filepath.Join(slf._dir, fmt.Sprintf("%020d%s", id, fileExt))
+}
+
+//save 先写入临时文件再重命名, 保证文件内容完整
+func (slf *Store) save(e *entry) error {
+	if slf._dir == "" {
+		return nil
+	}
+
+	path := slf.path(e._id)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = writeEntry(f, e); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//writeEntry 写入记录, 落盘的负载从临时文件流式复制
+func writeEntry(w io.Writer, e *entry) error {
+	writer := bufio.NewWriter(w)
+	var header [recordHeader]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(e._due.UnixNano()))
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(e._publisher)))
+	writer.Write(header[:])
+	writer.WriteString(e._publisher)
+	if _, err := message.WriteMessageTo(e._msg, writer); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func (slf *Store) remove(e *entry) {
+	if slf._dir == "" {
+		return
+	}
+	os.Remove(slf.path(e._id))
+}
+
+//load 装载磁盘中保存的延迟消息, 无法解析的文件被删除
+func (slf *Store) load() error {
+	if slf._dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(slf._dir, 0755); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(slf._dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(slf._dir, name)
+		if !strings.HasSuffix(name, fileExt) {
+			if strings.HasSuffix(name, fileExt+".tmp") {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		e, err := readEntry(path, id, &slf._parse)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+
+		heap.Push(&slf._heap, e)
+		slf._ids[id] = e
+		if id > slf._seq {
+			slf._seq = id
+		}
+	}
+
+	return nil
+}
+
+//readEntry 读取记录, 超过opts.SpoolSize的负载直接从文件写入临时文件
+func readEntry(path string, id uint64, opts *message.ParseOptions) (*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var header [recordHeader]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, errCorrupted
+	}
+
+	due := int64(binary.BigEndian.Uint64(header[0:8]))
+	publisher := make([]byte, binary.BigEndian.Uint16(header[8:10]))
+	if _, err := io.ReadFull(reader, publisher); err != nil {
+		return nil, errCorrupted
+	}
+
+	msg, err := message.ParseWith(reader, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := msg.(*message.Publish)
+	if !ok {
+		return nil, errCorrupted
+	}
+
+	return &entry{
+		_id:        id,
+		_publisher: string(publisher),
+		_msg:       pub,
+		_due:       time.Unix(0, due),
+	}, nil
+}
@@ -0,0 +1,189 @@
+package delayed
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func publish(topic string, payload string) *message.Publish {
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = topic
+	msg.QosLevel = 1
+	msg.PacketIdentifier = 9
+	msg.Retain = 1
+	msg.Payload = []byte(payload)
+	return msg
+}
+
+func records(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		topic string
+		delay time.Duration
+		want  string
+		err   error
+	}{
+		{"a/b", 0, "a/b", nil},
+		{"$delayed/10/a/b", 10 * time.Second, "a/b", nil},
+		{"$delayed/x/a", 0, "", ErrInvalidTopic},
+		{"$delayed/10/", 0, "", ErrInvalidTopic},
+		{"$delayed//a", 0, "", ErrInvalidTopic},
+	}
+
+	for _, c := range cases {
+		delay, topic, err := Parse(c.topic)
+		if delay != c.delay || topic != c.want || err != c.err {
+			t.Errorf("Parse(%q) = %v, %q, %v", c.topic, delay, topic, err)
+		}
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 0, 0, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Schedule("p1", publish("a", "first"), time.Hour)
+	id, _ := s.Schedule("p2", publish("b", "second"), 2*time.Hour)
+	s.Schedule("p3", publish("c", "third"), 3*time.Hour)
+	if !s.Cancel(id) {
+		t.Fatal("cancel failed")
+	}
+	s.Close()
+	if n := len(records(t, dir)); n != 2 {
+		t.Fatalf("%d records on disk", n)
+	}
+
+	//重启后装载未到期的消息, 新消息的ID不与已有的重复
+	s, err = New(dir, 0, 0, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got := s.Scheduled()
+	if len(got) != 2 || got[0].Topic != "a" || got[0].Publisher != "p1" || got[1].Topic != "c" ||
+		got[0].Qos != 1 || !got[0].Retain || got[0].Size != len("first") {
+		t.Fatalf("reloaded %+v", got)
+	}
+	if id, _ := s.Schedule("p4", publish("d", "fourth"), time.Hour); id != 4 {
+		t.Fatalf("new id %d after reload", id)
+	}
+}
+
+func TestStoreLoadCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000001"+fileExt), []byte("short"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000002"+fileExt+".tmp"), []byte("partial"), 0644)
+
+	//无法解析的记录与未完成的临时文件被删除
+	s, err := New(dir, 0, 0, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 0 {
+		t.Fatalf("%d corrupted records loaded", s.Len())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left", len(files))
+	}
+}
+
+func TestStoreSpooled(t *testing.T) {
+	dir, spoolDir := t.TempDir(), t.TempDir()
+	s, err := New(dir, 0, 0, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("x"), 4096)
+	s.Schedule("p1", publish("a", string(payload)), time.Hour)
+	s.Close()
+
+	//超过SpoolSize的负载装载时写入临时文件
+	released := make(chan *message.Publish, 1)
+	opts := message.ParseOptions{SpoolSize: 1024, SpoolDir: spoolDir}
+	s, err = New(dir, 0, 0, opts, func(publisher string, msg *message.Publish) {
+		released <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	id := s.Scheduled()[0].ID
+	s.Cancel(id)
+	if files, _ := ioutil.ReadDir(spoolDir); len(files) != 0 {
+		t.Fatalf("%d spool files after cancel", len(files))
+	}
+
+	s.Schedule("p1", publish("a", string(payload)), 0)
+	msg := <-released
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil || buf.Len() <= len(payload) {
+		t.Fatalf("released %d bytes, %v", buf.Len(), err)
+	}
+	msg.Release()
+}
+
+func TestStoreRelease(t *testing.T) {
+	dir := t.TempDir()
+	released := make(chan string, 2)
+	s, err := New(dir, 0, 0, message.ParseOptions{}, func(publisher string, msg *message.Publish) {
+		released <- publisher + ":" + msg.TopicName
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Schedule("p2", publish("b", "x"), 20*time.Millisecond)
+	s.Schedule("p1", publish("a", "x"), 0)
+	for _, want := range []string{"p1:a", "p2:b"} {
+		select {
+		case got := <-released:
+			if got != want {
+				t.Fatalf("released %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not released", want)
+		}
+	}
+
+	//到期的消息删除记录文件
+	if n := len(records(t, dir)); n != 0 {
+		t.Fatalf("%d records after release", n)
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	s, err := New("", time.Minute, 1, message.ParseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule("p", publish("a", "x"), time.Hour); err != ErrDelayTooLong {
+		t.Fatalf("max delay: %v", err)
+	}
+	if _, err := s.Schedule("p", publish("a", "x"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule("p", publish("b", "x"), time.Second); err != ErrTooManyPending {
+		t.Fatalf("max pending: %v", err)
+	}
+
+	s.Close()
+	if _, err := s.Schedule("p", publish("c", "x"), time.Second); err != ErrStoreClosed {
+		t.Fatalf("closed store: %v", err)
+	}
+}
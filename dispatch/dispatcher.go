@@ -0,0 +1,158 @@
+package dispatch
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+var (
+	//ErrDispatcherClosed 分发器已关闭
+	ErrDispatcherClosed = errors.New("dispatcher closed")
+	//ErrDispatcherFull 分片队列已满
+	ErrDispatcherFull = errors.New("dispatcher queue full")
+)
+
+//Target 投递目标
+type Target struct {
+	Client string
+	Msg    *message.Publish
+}
+
+//Matcher 匹配订阅者, 返回每个订阅者的投递消息
+type Matcher func(msg *message.Publish) []Target
+
+//Deliverer 投递消息给订阅者
+type Deliverer func(client string, msg *message.Publish)
+
+type worker struct {
+	_queue chan interface{}
+}
+
+//Dispatcher publish分发器
+//
+//匹配阶段按发布者分片, 保证同一发布者的消息按顺序匹配;
+//投递阶段按订阅者分片, 保证同一会话收到的消息按分发顺序投递.
+type Dispatcher struct {
+	_matchers   []*worker
+	_deliverers []*worker
+	_match      Matcher
+	_deliver    Deliverer
+	_closed     chan bool
+	_once       sync.Once
+	_wg         sync.WaitGroup
+}
+
+//New 创建分发器, shards为每个阶段的工作协程数, queueSize为每个工作协程的队列长度
+func New(shards, queueSize int, match Matcher, deliver Deliverer) *Dispatcher {
+	if shards <= 0 {
+		shards = 1
+	}
+
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+
+	d := &Dispatcher{
+		_matchers:   make([]*worker, shards),
+		_deliverers: make([]*worker, shards),
+		_match:      match,
+		_deliver:    deliver,
+		_closed:     make(chan bool),
+	}
+
+	for i := 0; i < shards; i++ {
+		d._matchers[i] = &worker{_queue: make(chan interface{}, queueSize)}
+		d._deliverers[i] = &worker{_queue: make(chan interface{}, queueSize)}
+		d._wg.Add(2)
+		go d.run(d._matchers[i], d.onMatch)
+		go d.run(d._deliverers[i], d.onDeliver)
+	}
+
+	return d
+}
+
+//Publish 提交一条发布消息, publisher用于选择匹配分片
+//分片队列已满时阻塞, 对发布者形成背压
+func (slf *Dispatcher) Publish(publisher string, msg *message.Publish) error {
+	w := slf._matchers[shard(publisher, len(slf._matchers))]
+	select {
+	case <-slf._closed:
+		return ErrDispatcherClosed
+	default:
+	}
+
+	select {
+	case w._queue <- msg:
+		return nil
+	case <-slf._closed:
+		return ErrDispatcherClosed
+	}
+}
+
+//TryPublish 与Publish相同, 分片队列已满时不等待, 返回ErrDispatcherFull
+func (slf *Dispatcher) TryPublish(publisher string, msg *message.Publish) error {
+	w := slf._matchers[shard(publisher, len(slf._matchers))]
+	select {
+	case <-slf._closed:
+		return ErrDispatcherClosed
+	default:
+	}
+
+	select {
+	case w._queue <- msg:
+		return nil
+	default:
+		return ErrDispatcherFull
+	}
+}
+
+//Close 关闭分发器, 等待所有工作协程退出
+func (slf *Dispatcher) Close() {
+	slf._once.Do(func() {
+		close(slf._closed)
+		slf._wg.Wait()
+	})
+}
+
+func (slf *Dispatcher) run(w *worker, f func(interface{})) {
+	defer slf._wg.Done()
+	for {
+		select {
+		case <-slf._closed:
+			goto Exit
+		case v := <-w._queue:
+			f(v)
+		}
+	}
+Exit:
+}
+
+func (slf *Dispatcher) onMatch(v interface{}) {
+	for _, t := range slf._match(v.(*message.Publish)) {
+		target := t
+		w := slf._deliverers[shard(target.Client, len(slf._deliverers))]
+		select {
+		case w._queue <- &target:
+		case <-slf._closed:
+			return
+		}
+	}
+}
+
+func (slf *Dispatcher) onDeliver(v interface{}) {
+	t := v.(*Target)
+	slf._deliver(t.Client, t.Msg)
+}
+
+func shard(key string, n int) int {
+	if n == 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,142 @@
+package dispatch
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func publish(topic string) *message.Publish {
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = topic
+	return msg
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	const publishers, messages = 4, 200
+	subscribers := []string{"s1", "s2", "s3"}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[string][]string)
+	match := func(msg *message.Publish) []Target {
+		targets := make([]Target, 0, len(subscribers))
+		for _, client := range subscribers {
+			targets = append(targets, Target{Client: client, Msg: msg})
+		}
+		return targets
+	}
+	deliver := func(client string, msg *message.Publish) {
+		mu.Lock()
+		received[client] = append(received[client], msg.TopicName)
+		mu.Unlock()
+		wg.Done()
+	}
+
+	d := New(4, 2, match, deliver)
+	defer d.Close()
+
+	wg.Add(publishers * messages * len(subscribers))
+	for p := 0; p < publishers; p++ {
+		go func(publisher string) {
+			for i := 0; i < messages; i++ {
+				d.Publish(publisher, publish(publisher+"/"+strconv.Itoa(i)))
+			}
+		}("p" + strconv.Itoa(p))
+	}
+	wg.Wait()
+
+	//每个订阅者按发布顺序收到同一发布者的消息
+	for _, client := range subscribers {
+		next := make(map[string]int)
+		for _, topic := range received[client] {
+			i := strings.Index(topic, "/")
+			publisher := topic[:i]
+			seq, _ := strconv.Atoi(topic[i+1:])
+			if seq != next[publisher] {
+				t.Fatalf("%s received %s, want %s/%d", client, topic, publisher, next[publisher])
+			}
+			next[publisher]++
+		}
+		if len(received[client]) != publishers*messages {
+			t.Fatalf("%s received %d messages", client, len(received[client]))
+		}
+	}
+}
+
+func TestDispatcherBackpressure(t *testing.T) {
+	entered, release := make(chan bool, 8), make(chan bool)
+	match := func(msg *message.Publish) []Target {
+		entered <- true
+		<-release
+		return nil
+	}
+	d := New(1, 1, match, func(string, *message.Publish) {})
+
+	//一条正在匹配, 一条在队列中, 第三条阻塞发布者
+	d.Publish("p", publish("a"))
+	<-entered
+	d.Publish("p", publish("b"))
+	done := make(chan error, 1)
+	go func() { done <- d.Publish("p", publish("c")) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("publish not blocked, %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- true
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish still blocked after the queue drained")
+	}
+
+	//关闭时阻塞的发布者返回ErrDispatcherClosed
+	go func() { done <- d.Publish("p", publish("d")) }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	d.Close()
+	if err := <-done; err != nil && err != ErrDispatcherClosed {
+		t.Fatal(err)
+	}
+	if err := d.Publish("p", publish("e")); err != ErrDispatcherClosed {
+		t.Fatalf("publish after close: %v", err)
+	}
+}
+
+func TestDispatcherTryPublish(t *testing.T) {
+	entered, release := make(chan bool, 8), make(chan bool)
+	match := func(msg *message.Publish) []Target {
+		entered <- true
+		<-release
+		return nil
+	}
+	d := New(1, 1, match, func(string, *message.Publish) {})
+
+	//一条正在匹配, 一条在队列中, 第三条不等待
+	if err := d.TryPublish("p", publish("a")); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	if err := d.TryPublish("p", publish("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.TryPublish("p", publish("c")); err != ErrDispatcherFull {
+		t.Fatalf("full queue: %v", err)
+	}
+
+	close(release)
+	d.Close()
+	if err := d.TryPublish("p", publish("d")); err != ErrDispatcherClosed {
+		t.Fatalf("publish after close: %v", err)
+	}
+}
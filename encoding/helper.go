@@ -1,51 +1,107 @@
 package encoding
 
 import (
-	"encoding/binary"
 	"errors"
 	"io"
 )
 
-//overflow error
-var errOverflow = errors.New("readvarint: varint overflows a 32-bit integer")
+const (
+	//MaxVarint 剩余长度的最大值
+	MaxVarint = 268435455
+)
+
+//ErrOverflow 剩余长度超过4个字节
+var ErrOverflow = errors.New("readvarint: varint overflows a 32-bit integer")
 
 //ReadVarint Return int
+//剩余长度跟在报文类型之后, 读到一半结束时返回io.ErrUnexpectedEOF
 func ReadVarint(reader io.Reader) (int, error) {
-	var RemainingLength uint8
 	m := 1
 	v := 0
 
 	for i := 0; i < 4; i++ {
-		binary.Read(reader, binary.BigEndian, &RemainingLength)
-		v += (int(RemainingLength) & 0x7F) * m
+		b, err := readByte(reader)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
 
+		v += (int(b) & 0x7F) * m
+		if (b & 0x80) == 0 {
+			return v, nil
+		}
 		m *= 0x80
-		if m > 0x200000 {
-			return 0, errOverflow
+	}
+
+	return 0, ErrOverflow
+}
+
+//DecodeVarint 从b中解码剩余长度, 返回长度与占用的字节数
+func DecodeVarint(b []byte) (int, int, error) {
+	m := 1
+	v := 0
+
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, io.ErrUnexpectedEOF
 		}
-		if (RemainingLength & 0x80) == 0 {
-			break
+
+		v += (int(b[i]) & 0x7F) * m
+		if (b[i] & 0x80) == 0 {
+			return v, i + 1, nil
 		}
+		m *= 0x80
 	}
 
-	return v, nil
+	return 0, 0, ErrOverflow
 }
 
 //WriteVarint write size
 func WriteVarint(writer io.Writer, size int) (int, error) {
-	var encodeByte uint8
-	x := size
-	var i int
-
-	for i = 0; x > 0 && i < 4; i++ {
-		encodeByte = uint8(x % 0x80)
-		x = x / 0x80
-		if x > 0 {
+	var buf [4]byte
+	return writer.Write(AppendVarint(buf[:0], size))
+}
+
+//AppendVarint 把剩余长度编码后追加到b
+func AppendVarint(b []byte, size int) []byte {
+	for {
+		encodeByte := uint8(size % 0x80)
+		size /= 0x80
+		if size > 0 {
 			encodeByte |= 0x80
 		}
 
-		binary.Write(writer, binary.BigEndian, encodeByte)
+		b = append(b, encodeByte)
+		if size == 0 {
+			return b
+		}
+	}
+}
+
+//VarintSize 返回剩余长度编码后的字节数
+func VarintSize(size int) int {
+	switch {
+	case size < 0x80:
+		return 1
+	case size < 0x4000:
+		return 2
+	case size < 0x200000:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func readByte(reader io.Reader) (byte, error) {
+	if br, ok := reader.(io.ByteReader); ok {
+		return br.ReadByte()
 	}
 
-	return i, nil
+	var b [1]byte
+	if _, err := io.ReadFull(reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
 }
@@ -0,0 +1,106 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	//defaultBufferSize 缓冲池中新建缓冲区的容量
+	defaultBufferSize = 512
+	//maxPooledBuffer 超过该容量的缓冲区不放回缓冲池
+	maxPooledBuffer = 64 * 1024
+	//readChunk 剩余长度超过该值时报文体分块读取
+	readChunk = 64 * 1024
+)
+
+var (
+	errShortBuffer = errors.New("message: short buffer")
+
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return &Buffer{B: make([]byte, 0, defaultBufferSize)}
+		},
+	}
+)
+
+//Buffer 可复用的编码缓冲区
+type Buffer struct {
+	B []byte
+}
+
+//GetBuffer 从缓冲池取出一个空的缓冲区
+func GetBuffer() *Buffer {
+	buf := bufferPool.Get().(*Buffer)
+	buf.B = buf.B[:0]
+	return buf
+}
+
+//PutBuffer 归还缓冲区, 过大的缓冲区直接丢弃
+func PutBuffer(buf *Buffer) {
+	if cap(buf.B) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+//appender 所有消息都实现该接口, 把完整编码的报文追加到b
+type appender interface {
+	appendTo(b []byte) []byte
+}
+
+//unmarshaler 所有消息都实现该接口, 从b解码报文体(固定报头之后的部分), 字节切片字段可能引用b
+type unmarshaler interface {
+	Message
+	unmarshal(b []byte) error
+}
+
+//writeAppender 把m编码到缓冲池中的缓冲区, 一次Write写出
+func writeAppender(w io.Writer, m appender) (int64, error) {
+	buf := GetBuffer()
+	buf.B = m.appendTo(buf.B)
+	n, err := w.Write(buf.B)
+	PutBuffer(buf)
+	return int64(n), err
+}
+
+//appendUint16 按大端序追加两字节整数
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+//appendString 追加带两字节长度前缀的字符串
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+//appendBytes 追加带两字节长度前缀的字节串
+func appendBytes(b []byte, s []byte) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+//readUint16 从offset读取大端序两字节整数, 返回新的偏移
+func readUint16(b []byte, offset int) (uint16, int, error) {
+	if offset+2 > len(b) {
+		return 0, offset, errTruncated
+	}
+	return binary.BigEndian.Uint16(b[offset:]), offset + 2, nil
+}
+
+//readBytes 读取带长度前缀的字段, 结果引用b
+func readBytes(b []byte, offset int) ([]byte, int, error) {
+	length, offset, err := readUint16(b, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	end := offset + int(length)
+	if end > len(b) {
+		return nil, offset, errTruncated
+	}
+	return b[offset:end:end], end, nil
+}
@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -13,25 +12,32 @@ type Connack struct {
 	ReturnCode uint8
 }
 
-func (slf *Connack) decode(reader io.Reader) error {
-	binary.Read(reader, binary.BigEndian, &slf.Reserved)
-	binary.Read(reader, binary.BigEndian, &slf.ReturnCode)
+func (slf *Connack) unmarshal(b []byte) error {
+	if len(b) != 2 {
+		return malformed("remaining length %d, want 2", len(b))
+	}
+
+	//[MQTT-3.2.2-1]
+	if b[0]&0xfe != 0 {
+		return violation("connack reserved bits %#x", b[0])
+	}
+	if b[1] > 5 {
+		return violation("connack return code %d", b[1])
+	}
 
+	slf.Reserved = b[0]
+	slf.ReturnCode = b[1]
 	return nil
 }
 
 //WriteTo Connack message write to io
-func (slf Connack) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 2
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
-
-	binary.Write(w, binary.BigEndian, slf.Reserved)
-	binary.Write(w, binary.BigEndian, slf.ReturnCode)
+func (slf *Connack) WriteTo(w io.Writer) (int64, error) {
+	return writeAppender(w, slf)
+}
 
-	return int64(fsize) + size, nil
+func (slf *Connack) appendTo(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, 2)
+	return append(b, slf.Reserved, slf.ReturnCode)
 }
 
 //String Returns Connack message object of string
@@ -1,10 +1,7 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
-	"fmt"
 	"io"
 )
 
@@ -24,9 +21,10 @@ type Connect struct {
 
 //WriteTo Write Connect message to io
 func (slf *Connect) WriteTo(w io.Writer) (int64, error) {
-	var headerLength uint16 = uint16(len(slf.Magic))
-	var size int = 0
+	return writeAppender(w, slf)
+}
 
+func (slf *Connect) appendTo(b []byte) []byte {
 	if slf.CleanSession {
 		slf.Flag |= 0x02
 	}
@@ -36,7 +34,10 @@ func (slf *Connect) WriteTo(w io.Writer) (int64, error) {
 		case 1:
 			slf.Flag |= 0x08
 		case 2:
-			slf.Flag |= 0x18
+			slf.Flag |= 0x10
+		}
+		if slf.Will.Retain {
+			slf.Flag |= 0x20
 		}
 	}
 	if len(slf.UserName) > 0 {
@@ -46,11 +47,9 @@ func (slf *Connect) WriteTo(w io.Writer) (int64, error) {
 		slf.Flag |= 0x40
 	}
 
-	size += 2 + len(slf.Magic)
+	size := 2 + len(slf.Magic)
 	size += 1 + 1 + 2
-	if slf.Identifier != "" {
-		size += 2 + len(slf.Identifier)
-	}
+	size += 2 + len(slf.Identifier)
 	if (int(slf.Flag)&0x04 > 0) && slf.Will != nil {
 		size += slf.Will.Size()
 	}
@@ -61,138 +60,110 @@ func (slf *Connect) WriteTo(w io.Writer) (int64, error) {
 		size += 2 + len(slf.Password)
 	}
 
-	slf.FixedHeader.writeTo(size, w)
-	err := binary.Write(w, binary.BigEndian, headerLength)
-	if err != nil {
-		return 0, err
-	}
-
-	w.Write(slf.Magic)
-	binary.Write(w, binary.BigEndian, slf.Version)
-	binary.Write(w, binary.BigEndian, slf.Flag)
-	binary.Write(w, binary.BigEndian, slf.KeepAlive)
-
-	var Length uint16 = 0
-
-	if slf.Identifier != "" {
-		Length = uint16(len(slf.Identifier))
-	}
-	binary.Write(w, binary.BigEndian, Length)
-	if Length > 0 {
-		w.Write([]byte(slf.Identifier))
-	}
+	b = slf.FixedHeader.appendTo(b, size)
+	b = appendBytes(b, slf.Magic)
+	b = append(b, slf.Version, slf.Flag)
+	b = appendUint16(b, slf.KeepAlive)
+	b = appendString(b, slf.Identifier)
 
 	if (int(slf.Flag)&0x04 > 0) && slf.Will != nil {
-		slf.Will.WriteTo(w)
+		b = slf.Will.appendTo(b)
 	}
 
 	if int(slf.Flag)&0x80 > 0 {
-		Length = uint16(len(slf.UserName))
-		err = binary.Write(w, binary.BigEndian, Length)
-		w.Write(slf.UserName)
+		b = appendBytes(b, slf.UserName)
 	}
 	if int(slf.Flag)&0x40 > 0 {
-		Length = uint16(len(slf.Password))
-		err = binary.Write(w, binary.BigEndian, Length)
-		w.Write(slf.Password)
+		b = appendBytes(b, slf.Password)
 	}
-	return int64(size), nil
-}
-
-func (slf *Connect) decode(reader io.Reader) error {
-	var Length uint16
 
-	offset := 0
-	buffer := make([]byte, slf.FixedHeader.RemainingLength)
-
-	w := bytes.NewBuffer(buffer)
-	w.Reset()
-	//TODO: should check error
-	io.CopyN(w, reader, int64(slf.FixedHeader.RemainingLength))
+	return b
+}
 
-	buffer = w.Bytes()
-	reader = bytes.NewReader(buffer)
+func (slf *Connect) unmarshal(b []byte) error {
+	var (
+		offset int
+		field  []byte
+		err    error
+	)
 
-	binary.Read(reader, binary.BigEndian, &Length)
-	offset += 2
+	if slf.Magic, offset, err = readBytes(b, 0); err != nil {
+		return err
+	}
 
-	if slf.FixedHeader.RemainingLength < offset+int(Length) {
-		return fmt.Errorf("Length overs buffer size. %d, %d",
-			slf.FixedHeader.RemainingLength, offset+int(Length))
+	//[MQTT-3.1.2-1] 3.1版本的协议名为MQIsdp
+	if magic := string(slf.Magic); magic != "MQTT" && magic != "MQIsdp" {
+		return violation("protocol name %q", slf.Magic)
 	}
 
-	slf.Magic = buffer[offset : offset+int(Length)]
-	offset += int(Length)
+	if offset+4 > len(b) {
+		return errTruncated
+	}
+	slf.Version = b[offset]
+	slf.Flag = b[offset+1]
+	slf.KeepAlive, offset, _ = readUint16(b, offset+2)
 
-	if offset > len(buffer) {
-		return fmt.Errorf("offset: %d, buffer: %d", offset, len(buffer))
+	//[MQTT-3.1.2-3]
+	if slf.Flag&0x01 != 0 {
+		return violation("connect reserved flag set")
 	}
 
-	nr := bytes.NewReader(buffer[offset:])
-	binary.Read(nr, binary.BigEndian, &slf.Version)
-	binary.Read(nr, binary.BigEndian, &slf.Flag)
-	binary.Read(nr, binary.BigEndian, &slf.KeepAlive)
-	offset += 1 + 1 + 2
+	willQos := (slf.Flag >> 3) & 0x03
+	willRetain := slf.Flag&0x20 != 0
+	if slf.Flag&0x04 == 0 && (willQos != 0 || willRetain) {
+		//[MQTT-3.1.2-11] [MQTT-3.1.2-13] [MQTT-3.1.2-15]
+		return violation("will qos or retain set without will flag")
+	}
+	if willQos == 3 {
+		//[MQTT-3.1.2-14]
+		return violation("will qos 3")
+	}
+	if slf.Flag&0x40 != 0 && slf.Flag&0x80 == 0 {
+		//[MQTT-3.1.2-22]
+		return violation("password flag set without user name flag")
+	}
 
 	// order Client ClientIdentifier, Will Topic, Will Message, User Name, Password
-	var ClientIdentifierLength uint16
-	binary.Read(nr, binary.BigEndian, &ClientIdentifierLength)
-	offset += 2
-
-	if ClientIdentifierLength > 0 {
-		slf.Identifier = string(buffer[offset : offset+int(ClientIdentifierLength)])
-		offset += int(ClientIdentifierLength)
+	if field, offset, err = readUTF8(b, offset); err != nil {
+		return err
 	}
+	slf.Identifier = string(field)
 
-	if int(slf.Flag)&0x04 > 0 {
-		will := &Will{}
-
-		nr := bytes.NewReader(buffer[offset:])
-		binary.Read(nr, binary.BigEndian, &ClientIdentifierLength)
-		offset += 2
-		will.Topic = string(buffer[offset : offset+int(ClientIdentifierLength)])
-		offset += int(ClientIdentifierLength)
-
-		nr = bytes.NewReader(buffer[offset:])
-		binary.Read(nr, binary.BigEndian, &ClientIdentifierLength)
-		offset += 2
-		will.Message = string(buffer[offset : offset+int(ClientIdentifierLength)])
-		offset += int(ClientIdentifierLength)
+	if slf.Flag&0x04 != 0 {
+		will := &Will{Qos: willQos, Retain: willRetain}
 
-		if int(slf.Flag)&0x32 > 0 {
-			will.Retain = true
+		if field, offset, err = readBytes(b, offset); err != nil {
+			return err
 		}
+		if err := CheckTopicName(field); err != nil {
+			return err
+		}
+		will.Topic = string(field)
 
-		q := (int(slf.Flag) >> 3)
-
-		if q&0x02 > 0 {
-			will.Qos = 2
-		} else if q&0x01 > 0 {
-			will.Qos = 1
+		if field, offset, err = readBytes(b, offset); err != nil {
+			return err
 		}
+		will.Message = string(field)
 		slf.Will = will
 	}
 
-	if int(slf.Flag)&0x80 > 0 {
-		nr := bytes.NewReader(buffer[offset:])
-		binary.Read(nr, binary.BigEndian, &Length)
-		offset += 2
-		slf.UserName = buffer[offset : offset+int(Length)]
-		offset += int(Length)
+	if slf.Flag&0x80 != 0 {
+		if slf.UserName, offset, err = readUTF8(b, offset); err != nil {
+			return err
+		}
 	}
 
-	if int(slf.Flag)&0x40 > 0 {
-		nr := bytes.NewReader(buffer[offset:])
-		offset += 2
-		binary.Read(nr, binary.BigEndian, &Length)
-		slf.Password = buffer[offset : offset+int(Length)]
-		offset += int(Length)
+	if slf.Flag&0x40 != 0 {
+		if slf.Password, offset, err = readBytes(b, offset); err != nil {
+			return err
+		}
 	}
 
-	if int(slf.Flag)&0x02 > 0 {
-		slf.CleanSession = true
+	if offset != len(b) {
+		return malformed("%d trailing bytes", len(b)-offset)
 	}
 
+	slf.CleanSession = slf.Flag&0x02 != 0
 	return nil
 }
 
@@ -11,14 +11,16 @@ type Disconnect struct {
 }
 
 //WriteTo Disconnect message to io
-func (slf Disconnect) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 0
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+func (slf *Disconnect) WriteTo(w io.Writer) (int64, error) {
+	return writeAppender(w, slf)
+}
+
+func (slf *Disconnect) appendTo(b []byte) []byte {
+	return slf.FixedHeader.appendTo(b, 0)
+}
 
-	return int64(fsize) + size, nil
+func (slf *Disconnect) unmarshal(b []byte) error {
+	return checkEmpty(b)
 }
 
 //String Returns Disconnect messge object of string
@@ -0,0 +1,156 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+//ErrMalformed 报文格式错误, 如字段被截断、长度不符、字符串不是合法的UTF-8
+type ErrMalformed struct {
+	Reason string
+}
+
+func (slf *ErrMalformed) Error() string {
+	return "malformed packet: " + slf.Reason
+}
+
+//ErrProtocolViolation 报文可以解析但违反MQTT 3.1.1协议, 如保留位非0、报文ID为0
+type ErrProtocolViolation struct {
+	Reason string
+}
+
+func (slf *ErrProtocolViolation) Error() string {
+	return "protocol violation: " + slf.Reason
+}
+
+//ErrPayloadTooLarge 报文长度超过限制, 或PUBLISH负载超过监听器或用户的负载限制
+type ErrPayloadTooLarge struct {
+	Size  int
+	Limit int
+}
+
+func (slf *ErrPayloadTooLarge) Error() string {
+	return fmt.Sprintf("payload %d bytes exceeds limit %d", slf.Size, slf.Limit)
+}
+
+//errTruncated 报文体中的字段超出了剩余长度
+var errTruncated = &ErrMalformed{Reason: "truncated field"}
+
+func malformed(format string, args ...interface{}) error {
+	return &ErrMalformed{Reason: fmt.Sprintf(format, args...)}
+}
+
+func violation(format string, args ...interface{}) error {
+	return &ErrProtocolViolation{Reason: fmt.Sprintf(format, args...)}
+}
+
+//checkFlags 校验固定报头的标志位 [MQTT-2.2.2-1] [MQTT-2.2.2-2]
+func checkFlags(first uint8) error {
+	t := first >> 4
+	flag := first & 0x0f
+	switch t {
+	case 0, 15:
+		return violation("reserved packet type %d", t)
+	case 3:
+		//[MQTT-3.3.1-4] [MQTT-3.3.1-2]
+		if flag&0x06 == 0x06 {
+			return malformed("publish qos 3")
+		}
+		if flag&0x06 == 0 && flag&0x08 != 0 {
+			return violation("publish dup flag set with qos 0")
+		}
+	case 6, 8, 10:
+		if flag != 0x02 {
+			return violation("packet type %d flags %#x, want 0x2", t, flag)
+		}
+	default:
+		if flag != 0 {
+			return violation("packet type %d flags %#x, want 0x0", t, flag)
+		}
+	}
+	return nil
+}
+
+//checkUTF8 校验UTF-8字符串, 不能包含U+0000 [MQTT-1.5.3-1] [MQTT-1.5.3-2]
+func checkUTF8(s []byte) error {
+	if !utf8.Valid(s) {
+		return malformed("invalid utf-8 string")
+	}
+	if bytes.IndexByte(s, 0) >= 0 {
+		return malformed("string contains U+0000")
+	}
+	return nil
+}
+
+//CheckTopicName 按协议校验主题名: 有效的UTF-8, 不为空, 不包含通配符 [MQTT-4.7.3-1] [MQTT-3.3.2-2]
+//解码PUBLISH主题与遗嘱主题时使用
+func CheckTopicName(topic []byte) error {
+	if err := checkUTF8(topic); err != nil {
+		return err
+	}
+	if len(topic) == 0 {
+		return violation("empty topic name")
+	}
+	if bytes.IndexAny(topic, "+#") >= 0 {
+		return violation("wildcard in topic name")
+	}
+	return nil
+}
+
+//CheckTopicFilter 按协议校验订阅过滤器: 有效的UTF-8, 不为空, 通配符占据整个层级且'#'只在最后一层
+//[MQTT-4.7.1-2] [MQTT-4.7.1-3]
+func CheckTopicFilter(filter []byte) error {
+	if err := checkUTF8(filter); err != nil {
+		return err
+	}
+	if len(filter) == 0 {
+		return violation("empty topic filter")
+	}
+
+	levels := bytes.Split(filter, []byte("/"))
+	for i, level := range levels {
+		if bytes.IndexAny(level, "+#") < 0 {
+			continue
+		}
+		if len(level) == 1 && (level[0] == '+' || i == len(levels)-1) {
+			continue
+		}
+		return violation("invalid wildcard in topic filter")
+	}
+	return nil
+}
+
+//readUTF8 读取带长度前缀的UTF-8字符串, 结果引用b
+func readUTF8(b []byte, offset int) ([]byte, int, error) {
+	s, offset, err := readBytes(b, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	if err := checkUTF8(s); err != nil {
+		return nil, offset, err
+	}
+	return s, offset, nil
+}
+
+//readPacketID 解码只包含非0报文ID的报文体 [MQTT-2.3.1-1]
+func readPacketID(b []byte) (uint16, error) {
+	if len(b) != 2 {
+		return 0, malformed("remaining length %d, want 2", len(b))
+	}
+
+	id := binary.BigEndian.Uint16(b)
+	if id == 0 {
+		return 0, violation("packet identifier 0")
+	}
+	return id, nil
+}
+
+//checkEmpty 校验没有报文体的报文
+func checkEmpty(b []byte) error {
+	if len(b) != 0 {
+		return malformed("remaining length %d, want 0", len(b))
+	}
+	return nil
+}
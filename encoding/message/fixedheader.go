@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 
@@ -62,7 +61,7 @@ func (slf *FixedHeader) GetTypeAsString() string {
 	}
 }
 
-func (slf *FixedHeader) writeTo(length int, w io.Writer) (int64, error) {
+func (slf *FixedHeader) flag() uint8 {
 	var flag uint8 = uint8(slf.Type << 0x04)
 
 	if slf.Retain > 0 {
@@ -81,48 +80,90 @@ func (slf *FixedHeader) writeTo(length int, w io.Writer) (int64, error) {
 		flag |= 0x08
 	}
 
-	err := binary.Write(w, binary.BigEndian, flag)
-	if err != nil {
-		return 0, err
-	}
+	return flag
+}
 
-	_, err = encoding.WriteVarint(w, length)
-	if err != nil {
-		return 0, err
-	}
+//appendTo 追加固定报头, length为剩余长度
+func (slf *FixedHeader) appendTo(b []byte, length int) []byte {
+	b = append(b, slf.flag())
+	return encoding.AppendVarint(b, length)
+}
 
-	return int64(2), nil
+//size 返回固定报头编码后的字节数
+func (slf *FixedHeader) size(length int) int {
+	return 1 + encoding.VarintSize(length)
 }
 
 func (slf *FixedHeader) decode(reader io.Reader) error {
-	var FirstByte uint8
-	err := binary.Read(reader, binary.BigEndian, &FirstByte)
-	if err != nil {
+	var first [1]byte
+	if br, ok := reader.(io.ByteReader); ok {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		first[0] = b
+	} else if _, err := io.ReadFull(reader, first[:]); err != nil {
 		return err
 	}
 
-	mt := FirstByte >> 4
-	flag := FirstByte & 0x0f
+	if err := checkFlags(first[0]); err != nil {
+		return err
+	}
 
 	length, err := encoding.ReadVarint(reader)
+	if err == encoding.ErrOverflow {
+		return malformed("remaining length overflow")
+	}
 	if err != nil {
 		return err
 	}
 
+	slf.setFlag(first[0])
+	slf.RemainingLength = length
+	return nil
+}
+
+//unmarshal 从b中解码固定报头, 返回占用的字节数, b不完整时返回errShortBuffer
+func (slf *FixedHeader) unmarshal(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, errShortBuffer
+	}
+
+	if err := checkFlags(b[0]); err != nil {
+		return 0, err
+	}
+
+	length, n, err := encoding.DecodeVarint(b[1:])
+	if err == encoding.ErrOverflow {
+		return 0, malformed("remaining length overflow")
+	}
+	if err != nil {
+		return 0, errShortBuffer
+	}
+
+	slf.setFlag(b[0])
+	slf.RemainingLength = length
+	return 1 + n, nil
+}
+
+func (slf *FixedHeader) setFlag(first uint8) {
+	mt := first >> 4
+	flag := first & 0x0f
+
 	slf.Type = encoding.PType(mt)
 	slf.Dupe = ((flag & 0x08) > 0)
 
+	slf.Retain = 0
 	if (flag & 0x01) > 0 {
 		slf.Retain = 1
 	}
 
+	slf.QosLevel = 0
 	if (flag & 0x04) > 0 {
 		slf.QosLevel = 2
 	} else if (flag & 0x02) > 0 {
 		slf.QosLevel = 1
 	}
-	slf.RemainingLength = length
-	return nil
 }
 
 //String Retuns string
@@ -0,0 +1,84 @@
+package message
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//frameVariants QoS(3) * Retain(2) * Dup(2)
+	frameVariants = 12
+)
+
+//Frames 同一条消息按(QoS, Retain, Dup)组合编码一次的报文, 由该消息的所有投递副本共享
+//报文ID在写入时替换, 共享的字节不会被修改.
+//共享Frames的消息必须拥有相同的主题与负载.
+type Frames struct {
+	_mu    sync.Mutex
+	_ready [frameVariants]uint32
+	_data  [frameVariants][]byte
+}
+
+//NewFrames 创建共享报文
+func NewFrames() *Frames {
+	return &Frames{}
+}
+
+func frameIndex(msg *Publish) int {
+	i := msg.QosLevel * 4
+	if msg.Retain > 0 {
+		i += 2
+	}
+	if msg.Dupe {
+		i++
+	}
+	return i
+}
+
+//frame 返回msg所属组合的报文, 首次使用时编码
+func (slf *Frames) frame(msg *Publish) []byte {
+	i := frameIndex(msg)
+	if atomic.LoadUint32(&slf._ready[i]) == 1 {
+		return slf._data[i]
+	}
+
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	if slf._ready[i] == 0 {
+		cp := *msg
+		cp.PacketIdentifier = 0
+		//共享报文只用于内存中的负载, 编码不会失败
+		slf._data[i], _ = cp.AppendTo(make([]byte, 0, cp.Size()))
+		atomic.StoreUint32(&slf._ready[i], 1)
+	}
+	return slf._data[i]
+}
+
+//writeTo 写入共享报文, QoS>0时替换报文ID
+func (slf *Frames) writeTo(msg *Publish, w io.Writer) (int64, error) {
+	frame := slf.frame(msg)
+	if msg.QosLevel == 0 {
+		n, err := w.Write(frame)
+		return int64(n), err
+	}
+
+	off := len(frame) - len(msg.Payload) - 2
+	n, err := w.Write(frame[:off])
+	if err != nil {
+		return int64(n), err
+	}
+
+	if bw, ok := w.(io.ByteWriter); ok {
+		bw.WriteByte(byte(msg.PacketIdentifier >> 8))
+		err = bw.WriteByte(byte(msg.PacketIdentifier))
+	} else {
+		_, err = w.Write([]byte{byte(msg.PacketIdentifier >> 8), byte(msg.PacketIdentifier)})
+	}
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := w.Write(frame[off+2:])
+	return int64(n + 2 + m), err
+}
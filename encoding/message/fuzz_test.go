@@ -0,0 +1,115 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/encoding"
+)
+
+func mustEncode(t *testing.T, m Message) []byte {
+	data, err := Encode(nil, m)
+	if err != nil {
+		t.Fatalf("encode %s: %v", m.GetTypeAsString(), err)
+	}
+	return data
+}
+
+//checkReencode 解码成功的报文重新编码后必须能再次解码, 且编码结果不变
+func checkReencode(t *testing.T, m Message) {
+	data := mustEncode(t, m)
+	again, n, err := Decode(data, 0)
+	if err != nil {
+		t.Fatalf("re-encoded %s % x does not decode: %v", m.GetTypeAsString(), data, err)
+	}
+	if n != len(data) {
+		t.Fatalf("re-encoded %s decoded %d of %d bytes", m.GetTypeAsString(), n, len(data))
+	}
+	if second := mustEncode(t, again); !bytes.Equal(data, second) {
+		t.Fatalf("%s encoding unstable:\n% x\n% x", m.GetTypeAsString(), data, second)
+	}
+}
+
+//FuzzParse 不可信的字节流交给Parse与Decode, 两者结果必须一致且不能崩溃
+func FuzzParse(f *testing.F) {
+	r := rand.New(rand.NewSource(1))
+	for _, typ := range packetTypes {
+		data, _ := Encode(nil, randomMessage(r, typ))
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		rest := data
+		for len(rest) > 0 {
+			decoded, n, derr := Decode(rest, 0)
+			parsed, perr := Parse(reader, 0)
+			if (derr == nil) != (perr == nil) {
+				t.Fatalf("Decode error %v, Parse error %v", derr, perr)
+			}
+			if derr != nil {
+				return
+			}
+
+			if n <= 0 || n > len(rest) {
+				t.Fatalf("Decode consumed %d of %d bytes", n, len(rest))
+			}
+			if !bytes.Equal(mustEncode(t, decoded), mustEncode(t, parsed)) {
+				t.Fatalf("Decode and Parse disagree on % x", rest[:n])
+			}
+
+			checkReencode(t, decoded)
+			rest = rest[n:]
+		}
+	})
+}
+
+//fuzzBody 对first类型报文的解码方法进行模糊测试
+func fuzzBody(f *testing.F, first byte) {
+	typ := encoding.PType(first >> 4)
+	r := rand.New(rand.NewSource(int64(first)))
+	for seeds := 0; seeds < 8; {
+		data, _ := Encode(nil, randomMessage(r, typ))
+		//PUBLISH的报文体结构取决于QoS
+		if data[0]&0x06 != first&0x06 {
+			continue
+		}
+
+		header := FixedHeader{}
+		n, _ := header.unmarshal(data)
+		f.Add(data[n:])
+		seeds++
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		header := FixedHeader{RemainingLength: len(body)}
+		header.setFlag(first)
+		m, err := newMessage(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.unmarshal(body); err != nil {
+			return
+		}
+		checkReencode(t, m)
+	})
+}
+
+func FuzzConnect(f *testing.F)     { fuzzBody(f, 0x10) }
+func FuzzConnack(f *testing.F)     { fuzzBody(f, 0x20) }
+func FuzzPublish(f *testing.F)     { fuzzBody(f, 0x30) }
+func FuzzPublishQos1(f *testing.F) { fuzzBody(f, 0x32) }
+func FuzzPublishQos2(f *testing.F) { fuzzBody(f, 0x34) }
+func FuzzPuback(f *testing.F)      { fuzzBody(f, 0x40) }
+func FuzzPubrec(f *testing.F)      { fuzzBody(f, 0x50) }
+func FuzzPubrel(f *testing.F)      { fuzzBody(f, 0x62) }
+func FuzzPubcomp(f *testing.F)     { fuzzBody(f, 0x70) }
+func FuzzSubscribe(f *testing.F)   { fuzzBody(f, 0x82) }
+func FuzzSuback(f *testing.F)      { fuzzBody(f, 0x90) }
+func FuzzUnsubscribe(f *testing.F) { fuzzBody(f, 0xa2) }
+func FuzzUnsuback(f *testing.F)    { fuzzBody(f, 0xb0) }
+func FuzzPingreq(f *testing.F)     { fuzzBody(f, 0xc0) }
+func FuzzPingresp(f *testing.F)    { fuzzBody(f, 0xd0) }
+func FuzzDisconnect(f *testing.F)  { fuzzBody(f, 0xe0) }
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -176,111 +177,352 @@ func SpawnConnackMessage() *Connack {
 	return message
 }
 
+//ParseOptions 解析选项
+type ParseOptions struct {
+	//MaxLength 在内存中解析的报文最大剩余长度, 0不限制
+	MaxLength int
+	//MaxPayload PUBLISH负载最大长度, 0不限制
+	MaxPayload int
+	//SpoolSize PUBLISH剩余长度超过该值时负载写入临时文件, 0不落盘
+	SpoolSize int
+	//SpoolDir 负载临时文件目录, 为空时使用系统临时目录
+	SpoolDir string
+}
+
+//Spooled 剩余长度为length的PUBLISH报文是否落盘
+func (slf *ParseOptions) Spooled(length int) bool {
+	return slf.SpoolSize > 0 && length > slf.SpoolSize
+}
+
+//CheckPayload 校验PUBLISH负载长度
+func (slf *ParseOptions) CheckPayload(size int) error {
+	if slf.MaxPayload > 0 && size > slf.MaxPayload {
+		return &ErrPayloadTooLarge{Size: size, Limit: slf.MaxPayload}
+	}
+	return nil
+}
+
 //Parse 解析接受到的消息
 func Parse(reader io.Reader, maxLen int) (Message, error) {
-	var message Message
-	var err error
 	header := FixedHeader{}
 
-	err = header.decode(reader)
+	err := header.decode(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBody(reader, header, maxLen)
+}
+
+//ParseWith 按opts解析接收到的消息, 超过opts.SpoolSize的PUBLISH负载直接从reader写入临时文件
+func ParseWith(reader io.Reader, opts *ParseOptions) (Message, error) {
+	header := FixedHeader{}
+
+	err := header.decode(reader)
 	if err != nil {
 		return nil, err
 	}
 
+	if header.Type != encoding.PTypePublish {
+		return parseBody(reader, header, opts.MaxLength)
+	}
+
+	if opts.Spooled(header.RemainingLength) {
+		return parseSpooled(reader, header, opts)
+	}
+
+	message, err := parseBody(reader, header, opts.MaxLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.CheckPayload(message.(*Publish).PayloadSize()); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+//parseSpooled 读取PUBLISH的可变报头, 负载写入临时文件
+func parseSpooled(reader io.Reader, header FixedHeader, opts *ParseOptions) (Message, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	vh := make([]byte, publishHeaderLength(header, prefix[:]))
+	if len(vh) > header.RemainingLength {
+		return nil, errTruncated
+	}
+
+	copy(vh, prefix[:])
+	if _, err := io.ReadFull(reader, vh[2:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	message, size, err := spooledPublish(header, vh, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := message.Spool()
+	if _, err := io.CopyN(spool, reader, int64(size)); err != nil {
+		spool.Remove()
+		return nil, unexpected(err)
+	}
+
+	return message, nil
+}
+
+//publishHeaderLength 按主题长度前缀计算PUBLISH可变报头长度
+func publishHeaderLength(header FixedHeader, prefix []byte) int {
+	n := 2 + int(binary.BigEndian.Uint16(prefix))
+	if header.QosLevel > 0 {
+		n += 2
+	}
+	return n
+}
+
+//spooledPublish 解码PUBLISH的可变报头并创建负载临时文件, 返回消息与待写入的负载长度
+func spooledPublish(header FixedHeader, vh []byte, opts *ParseOptions) (*Publish, int, error) {
+	message := &Publish{FixedHeader: header}
+	if err := message.unmarshal(vh); err != nil {
+		return nil, 0, err
+	}
+
+	size := header.RemainingLength - len(vh)
+	if err := opts.CheckPayload(size); err != nil {
+		return nil, 0, err
+	}
+
+	spool, err := NewSpool(opts.SpoolDir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	message.Payload = nil
+	message.WithSpool(spool)
+	return message, size, nil
+}
+
+//unexpected 报文中途结束时返回io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//parseBody 读取并解码header之后的报文体
+func parseBody(reader io.Reader, header FixedHeader, maxLen int) (Message, error) {
 	if maxLen > 0 && header.RemainingLength > maxLen {
-		return nil, fmt.Errorf("Payload exceedes limit. %d bytes", header.RemainingLength)
+		return nil, &ErrPayloadTooLarge{Size: header.RemainingLength, Limit: maxLen}
+	}
+
+	message, err := newMessage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	//报文体被消息引用时单独分配, 否则使用缓冲池
+	var body []byte
+	if retainsBody(header.Type) {
+		body, err = readBody(reader, nil, header.RemainingLength)
+	} else {
+		buf := GetBuffer()
+		body, err = readBody(reader, buf.B, header.RemainingLength)
+		buf.B = body[:0]
+		defer PutBuffer(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := message.unmarshal(body); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+//readBody 读取length字节的报文体, 尽量复用dst
+//剩余长度由对端声明, 较大时按收到的数据分块扩容, 伪造的剩余长度不会造成大量分配
+func readBody(reader io.Reader, dst []byte, length int) ([]byte, error) {
+	if length <= readChunk {
+		if cap(dst) < length {
+			dst = make([]byte, length)
+		}
+		dst = dst[:length]
+		if _, err := io.ReadFull(reader, dst); err != nil {
+			return dst[:0], err
+		}
+		return dst, nil
 	}
 
+	dst = dst[:0]
+	for len(dst) < length {
+		chunk := len(dst)
+		if chunk < readChunk {
+			chunk = readChunk
+		}
+		if chunk > length-len(dst) {
+			chunk = length - len(dst)
+		}
+
+		if cap(dst)-len(dst) < chunk {
+			grown := make([]byte, len(dst), len(dst)+chunk)
+			copy(grown, dst)
+			dst = grown
+		}
+
+		n, err := io.ReadFull(reader, dst[len(dst):len(dst)+chunk])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return dst[:0], err
+		}
+	}
+	return dst, nil
+}
+
+//Decode 从data中解码一个完整的报文, 返回消息与占用的字节数
+//消息中的负载等字节切片直接引用data, 调用者在使用消息期间不能修改data
+//data中的报文不完整时返回io.ErrUnexpectedEOF
+func Decode(data []byte, maxLen int) (Message, int, error) {
+	return decode(data, maxLen, false)
+}
+
+//DecodeCopy 与Decode相同, 但引用报文体的消息使用报文体的副本解码, 返回后data可被复用
+func DecodeCopy(data []byte, maxLen int) (Message, int, error) {
+	return decode(data, maxLen, true)
+}
+
+//DecodeSpooled 从data中解码剩余长度超过opts.SpoolSize的PUBLISH报头并创建负载临时文件
+//返回消息, 已占用的字节数与尚未写入临时文件的负载长度; data中的负载部分由调用者写入消息的Spool
+//data不是需要落盘的PUBLISH报文时返回nil, 报头不完整时返回io.ErrUnexpectedEOF
+func DecodeSpooled(data []byte, opts *ParseOptions) (*Publish, int, int, error) {
+	header := FixedHeader{}
+	n, err := header.unmarshal(data)
+	if err == errShortBuffer {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if header.Type != encoding.PTypePublish || !opts.Spooled(header.RemainingLength) {
+		return nil, 0, 0, nil
+	}
+
+	if len(data) < n+2 {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	length := publishHeaderLength(header, data[n:n+2])
+	if length > header.RemainingLength {
+		return nil, 0, 0, errTruncated
+	}
+	if len(data) < n+length {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	message, size, err := spooledPublish(header, data[n:n+length], opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return message, n + length, size, nil
+}
+
+func decode(data []byte, maxLen int, detach bool) (Message, int, error) {
+	header := FixedHeader{}
+	n, err := header.unmarshal(data)
+	if err == errShortBuffer {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if maxLen > 0 && header.RemainingLength > maxLen {
+		return nil, 0, &ErrPayloadTooLarge{Size: header.RemainingLength, Limit: maxLen}
+	}
+
+	if len(data) < n+header.RemainingLength {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	message, err := newMessage(header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := data[n : n+header.RemainingLength]
+	if detach && retainsBody(header.Type) {
+		body = append([]byte(nil), body...)
+	}
+
+	if err := message.unmarshal(body); err != nil {
+		return nil, 0, err
+	}
+
+	return message, n + header.RemainingLength, nil
+}
+
+//Encode 把编码后的报文追加到b
+func Encode(b []byte, message Message) ([]byte, error) {
+	if p, ok := message.(*Publish); ok {
+		return p.AppendTo(b)
+	}
+
+	m, ok := message.(appender)
+	if !ok {
+		return b, errors.New("Not supported message")
+	}
+
+	return m.appendTo(b), nil
+}
+
+//retainsBody 解码后的消息是否引用报文体
+func retainsBody(t encoding.PType) bool {
+	return t == encoding.PTypePublish ||
+		t == encoding.PTypeConnect ||
+		t == encoding.PTypeSuback
+}
+
+func newMessage(header FixedHeader) (unmarshaler, error) {
 	switch header.GetType() {
 	case encoding.PTypeConnect:
-		mm := &Connect{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Connect{FixedHeader: header}, nil
 	case encoding.PTypeConnack:
-		mm := &Connack{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Connack{FixedHeader: header}, nil
 	case encoding.PTypePublish:
-		mm := &Publish{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Publish{FixedHeader: header}, nil
 	case encoding.PTypeDisconnect:
-		mm := &Disconnect{
-			FixedHeader: header,
-		}
-		message = mm
+		return &Disconnect{FixedHeader: header}, nil
 	case encoding.PTypeSubscribe:
-		mm := &Subscribe{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Subscribe{FixedHeader: header}, nil
 	case encoding.PTypeSuback:
-		mm := &Suback{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Suback{FixedHeader: header}, nil
 	case encoding.PTypeUnsubscribe:
-		mm := &Unsubscribe{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Unsubscribe{FixedHeader: header}, nil
 	case encoding.PTypeUnsuback:
-		mm := &Unsuback{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Unsuback{FixedHeader: header}, nil
 	case encoding.PTypePingresp:
-		mm := &Pingresp{
-			FixedHeader: header,
-		}
-		message = mm
+		return &Pingresp{FixedHeader: header}, nil
 	case encoding.PTypePingreq:
-		mm := &Pingreq{
-			FixedHeader: header,
-		}
-		message = mm
+		return &Pingreq{FixedHeader: header}, nil
 	case encoding.PTypePuback:
-		mm := &Puback{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Puback{FixedHeader: header}, nil
 	case encoding.PTypePubrec:
-		mm := &Pubrec{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Pubrec{FixedHeader: header}, nil
 	case encoding.PTypePubrel:
-		mm := &Pubrel{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Pubrel{FixedHeader: header}, nil
 	case encoding.PTypePubcomp:
-		mm := &Pubcomp{
-			FixedHeader: header,
-		}
-		err = mm.decode(reader)
-		message = mm
+		return &Pubcomp{FixedHeader: header}, nil
 	default:
 		return nil, fmt.Errorf("Not supported: %d", header.GetType())
 	}
-	if err != nil {
-		return nil, err
-	}
-
-	return message, nil
 }
 
 //WriteMessageTo 输出消息
@@ -0,0 +1,180 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func connectPacket(patch func(b []byte)) []byte {
+	m := SpawnConnectMessage()
+	m.Identifier = "c1"
+	m.UserName = []byte("u")
+	m.Will = &Will{Topic: "w", Message: "bye"}
+	b, _ := Encode(nil, m)
+	if patch != nil {
+		patch(b)
+	}
+	return b
+}
+
+func TestDecodeStrict(t *testing.T) {
+	const (
+		ok = iota
+		isMalformed
+		isViolation
+	)
+
+	//connect packet layout: header(2) magic(6) version(1) flags(1) ...
+	const connectFlags = 9
+
+	cases := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"connect", connectPacket(nil), ok},
+		{"connect reserved flag", connectPacket(func(b []byte) { b[connectFlags] |= 0x01 }), isViolation},
+		{"connect will qos 3", connectPacket(func(b []byte) { b[connectFlags] |= 0x18 }), isViolation},
+		{"connect will retain without will", connectPacket(func(b []byte) {
+			b[connectFlags] = b[connectFlags]&^0x04 | 0x20
+		}), isViolation},
+		{"connect password without user", connectPacket(func(b []byte) {
+			b[connectFlags] = b[connectFlags]&^0x80 | 0x40
+		}), isViolation},
+		//遗嘱主题按PUBLISH主题名校验, 'w'位于客户端ID之后
+		{"connect will wildcard", connectPacket(func(b []byte) { b[18] = '#' }), isViolation},
+		{"connect will nul", connectPacket(func(b []byte) { b[18] = 0 }), isMalformed},
+		{"connect protocol name", connectPacket(func(b []byte) { b[4] = 'X' }), isViolation},
+		{"connect trailing bytes", append(connectPacket(func(b []byte) { b[1]++ }), 0), isMalformed},
+		{"connack reserved bits", []byte{0x20, 0x02, 0x02, 0x00}, isViolation},
+		{"connack return code", []byte{0x20, 0x02, 0x00, 0x06}, isViolation},
+		{"publish", []byte{0x32, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, ok},
+		{"publish qos 3", []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, isMalformed},
+		{"publish dup qos 0", []byte{0x38, 0x03, 0x00, 0x01, 'a'}, isViolation},
+		{"publish packet id 0", []byte{0x32, 0x05, 0x00, 0x01, 'a', 0x00, 0x00}, isViolation},
+		{"publish empty topic", []byte{0x30, 0x02, 0x00, 0x00}, isViolation},
+		{"publish wildcard", []byte{0x30, 0x03, 0x00, 0x01, '#'}, isViolation},
+		{"publish nul", []byte{0x30, 0x04, 0x00, 0x02, 'a', 0x00}, isMalformed},
+		{"publish invalid utf-8", []byte{0x30, 0x03, 0x00, 0x01, 0xff}, isMalformed},
+		{"publish truncated topic", []byte{0x30, 0x03, 0x00, 0x05, 'a'}, isMalformed},
+		{"puback", []byte{0x40, 0x02, 0x00, 0x01}, ok},
+		{"puback length", []byte{0x40, 0x03, 0x00, 0x01, 0x00}, isMalformed},
+		{"puback packet id 0", []byte{0x40, 0x02, 0x00, 0x00}, isViolation},
+		{"puback flags", []byte{0x42, 0x02, 0x00, 0x01}, isViolation},
+		{"pubrel", []byte{0x62, 0x02, 0x00, 0x01}, ok},
+		{"pubrel flags", []byte{0x60, 0x02, 0x00, 0x01}, isViolation},
+		{"subscribe", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x01}, ok},
+		{"subscribe flags", []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x01}, isViolation},
+		{"subscribe empty", []byte{0x82, 0x02, 0x00, 0x01}, isViolation},
+		{"subscribe qos 3", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03}, isMalformed},
+		{"subscribe reserved qos bits", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x41}, isMalformed},
+		{"subscribe missing qos", []byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'}, isMalformed},
+		{"subscribe empty filter", []byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00}, isViolation},
+		{"subscribe invalid utf-8", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 0xc0, 0x00}, isMalformed},
+		{"suback", []byte{0x90, 0x04, 0x00, 0x01, 0x00, 0x80}, ok},
+		{"suback return code", []byte{0x90, 0x03, 0x00, 0x01, 0x03}, isViolation},
+		{"suback empty", []byte{0x90, 0x02, 0x00, 0x01}, isMalformed},
+		{"unsubscribe", []byte{0xa2, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'}, ok},
+		{"unsubscribe empty", []byte{0xa2, 0x02, 0x00, 0x01}, isViolation},
+		{"pingreq", []byte{0xc0, 0x00}, ok},
+		{"pingreq body", []byte{0xc0, 0x01, 0x00}, isMalformed},
+		{"disconnect flags", []byte{0xe1, 0x00}, isViolation},
+		{"reserved type 0", []byte{0x00, 0x00}, isViolation},
+		{"reserved type 15", []byte{0xf0, 0x00}, isViolation},
+		{"remaining length overflow", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, isMalformed},
+	}
+
+	check := func(name, via string, err error, want int) {
+		got := ok
+		switch err.(type) {
+		case nil:
+		case *ErrMalformed:
+			got = isMalformed
+		case *ErrProtocolViolation:
+			got = isViolation
+		default:
+			t.Errorf("%s (%s): untyped error %v", name, via, err)
+			return
+		}
+		if got != want {
+			t.Errorf("%s (%s): got %v, want kind %d", name, via, err, want)
+		}
+	}
+
+	for _, c := range cases {
+		_, _, err := Decode(c.data, 0)
+		check(c.name, "Decode", err, c.want)
+
+		_, err = Parse(bufio.NewReader(bytes.NewReader(c.data)), 0)
+		check(c.name, "Parse", err, c.want)
+	}
+}
+
+func TestConnectWillFlags(t *testing.T) {
+	for _, qos := range []uint8{0, 1, 2} {
+		for _, retain := range []bool{false, true} {
+			m := SpawnConnectMessage()
+			m.Identifier = "c1"
+			m.Will = &Will{Qos: qos, Retain: retain, Topic: "w", Message: "bye"}
+			data, _ := Encode(nil, m)
+
+			got, _, err := Decode(data, 0)
+			if err != nil {
+				t.Fatalf("qos %d retain %v: %v", qos, retain, err)
+			}
+			will := got.(*Connect).Will
+			if will == nil || will.Qos != qos || will.Retain != retain {
+				t.Fatalf("qos %d retain %v: decoded will %+v", qos, retain, will)
+			}
+		}
+	}
+}
+
+//TestParseDeclaredLength 伪造的剩余长度不能导致按声明长度分配内存
+func TestParseDeclaredLength(t *testing.T) {
+	//PUBLISH声明剩余长度256MB, 实际只有几个字节
+	data := []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a', 'b', 'c'}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := Parse(bufio.NewReader(bytes.NewReader(data)), 0)
+	runtime.ReadMemStats(&after)
+
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes for a %d byte packet", n, len(data))
+	}
+}
+
+//TestParseLimits 超过长度限制的报文返回ErrPayloadTooLarge, 剩余长度被截断时返回io.ErrUnexpectedEOF
+func TestParseLimits(t *testing.T) {
+	msg := SpawnPublishMessage()
+	msg.TopicName = "a/b"
+	msg.Payload = bytes.Repeat([]byte("x"), 100)
+	data, _ := Encode(nil, msg)
+
+	_, err := Parse(bufio.NewReader(bytes.NewReader(data)), 16)
+	if e, ok := err.(*ErrPayloadTooLarge); !ok || e.Limit != 16 || e.Size != len(data)-2 {
+		t.Fatalf("parse: got %v, want ErrPayloadTooLarge", err)
+	}
+	if _, _, err := DecodeCopy(data, 16); err == nil {
+		t.Fatal("decode: no error")
+	} else if _, ok := err.(*ErrPayloadTooLarge); !ok {
+		t.Fatalf("decode: got %v, want ErrPayloadTooLarge", err)
+	}
+
+	for _, data := range [][]byte{{0x30}, {0x30, 0x80}, {0x30, 0xff, 0xff}} {
+		if _, err := Parse(bufio.NewReader(bytes.NewReader(data)), 0); err != io.ErrUnexpectedEOF {
+			t.Fatalf("% x: got %v, want %v", data, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if _, err := Parse(bufio.NewReader(bytes.NewReader(nil)), 0); err != io.EOF {
+		t.Fatalf("empty: got %v, want %v", err, io.EOF)
+	}
+}
@@ -12,13 +12,15 @@ type Pingreq struct {
 
 //WriteTo Pingreq message to io
 func (slf *Pingreq) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 0
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+	return writeAppender(w, slf)
+}
+
+func (slf *Pingreq) appendTo(b []byte) []byte {
+	return slf.FixedHeader.appendTo(b, 0)
+}
 
-	return int64(fsize) + size, nil
+func (slf *Pingreq) unmarshal(b []byte) error {
+	return checkEmpty(b)
 }
 
 //String Returns Pingreq object of message
@@ -11,14 +11,16 @@ type Pingresp struct {
 }
 
 //WriteTo Pingresp message write to io
-func (slf Pingresp) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 0
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+func (slf *Pingresp) WriteTo(w io.Writer) (int64, error) {
+	return writeAppender(w, slf)
+}
+
+func (slf *Pingresp) appendTo(b []byte) []byte {
+	return slf.FixedHeader.appendTo(b, 0)
+}
 
-	return int64(fsize) + size, nil
+func (slf *Pingresp) unmarshal(b []byte) error {
+	return checkEmpty(b)
 }
 
 //String Returns Pingresp object of string
@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -12,21 +11,20 @@ type Pubcomp struct {
 	PacketIdentifier uint16
 }
 
-func (slf *Pubcomp) decode(reader io.Reader) error {
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-	return nil
+func (slf *Pubcomp) unmarshal(b []byte) error {
+	var err error
+	slf.PacketIdentifier, err = readPacketID(b)
+	return err
 }
 
 //WriteTo Pubcomp message write to io
 func (slf *Pubcomp) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 2
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+	return writeAppender(w, slf)
+}
 
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
-	return int64(size) + int64(fsize), nil
+func (slf *Pubcomp) appendTo(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, 2)
+	return appendUint16(b, slf.PacketIdentifier)
 }
 
 //String Returns Pubcomp message object of string
@@ -1,10 +1,7 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
-	"fmt"
 	"io"
 )
 
@@ -15,79 +12,160 @@ type Publish struct {
 	PacketIdentifier uint16      `json:"identifier"`
 	Payload          []byte      `json:"payload"`
 	Opaque           interface{} `json:"-"`
-}
 
-func (slf *Publish) decode(reader io.Reader) error {
-	var length uint16
-	remaining := slf.FixedHeader.RemainingLength
-	binary.Read(reader, binary.BigEndian, &length)
-	remaining -= 2
+	_frames *Frames
+	_spool  *Spool
+}
 
-	if remaining < 1 {
-		return fmt.Errorf("something wrong. (probably crouppted data?)")
+func (slf *Publish) unmarshal(b []byte) error {
+	topic, offset, err := readBytes(b, 0)
+	if err != nil {
+		return err
+	}
+	if err := CheckTopicName(topic); err != nil {
+		return err
 	}
 
-	buffer := make([]byte, remaining)
-	offset := 0
-	for offset < remaining {
-		if offset > remaining {
-			panic("something went to wrong(offset overs remianing length)")
-		}
+	// Comparing does not allocate, a reused message keeps its topic string
+	// while consecutive packets are published to the same topic.
+	if string(topic) != slf.TopicName {
+		slf.TopicName = string(topic)
+	}
 
-		i, err := reader.Read(buffer[offset:])
-		offset += i
-		if err != nil && offset < remaining {
-			// if we read whole size of message, ignore error at this time.
+	slf.PacketIdentifier = 0
+	if slf.FixedHeader.QosLevel > 0 {
+		if slf.PacketIdentifier, offset, err = readUint16(b, offset); err != nil {
 			return err
 		}
+		if slf.PacketIdentifier == 0 {
+			return violation("packet identifier 0")
+		}
 	}
 
-	if int(length) > len(buffer) {
-		return fmt.Errorf("publish length: %d, buffer: %d", length, len(buffer))
+	slf.Payload = b[offset:len(b):len(b)]
+	slf._spool = nil
+	return nil
+}
+
+//Unmarshal 从data中解码一个完整的PUBLISH报文
+//Payload直接引用data, 重复使用同一个消息对象解码时不分配内存
+func (slf *Publish) Unmarshal(data []byte) error {
+	n, err := slf.FixedHeader.unmarshal(data)
+	if err != nil {
+		return err
 	}
 
-	slf.TopicName = string(buffer[0:length])
-	payloadOffset := length
-	if slf.FixedHeader.QosLevel > 0 {
-		binary.Read(bytes.NewReader(buffer[length:]), binary.BigEndian, &slf.PacketIdentifier)
-		payloadOffset += 2
+	if len(data) < n+slf.RemainingLength {
+		return errShortBuffer
 	}
-	slf.Payload = buffer[payloadOffset:]
-	return nil
+
+	return slf.unmarshal(data[n : n+slf.RemainingLength])
 }
 
-//WriteTo Publish message write to IO
-func (slf *Publish) WriteTo(w io.Writer) (int64, error) {
-	var size uint16 = uint16(len(slf.TopicName))
-	total := 2 + int(size)
+//remaining 返回剩余长度
+func (slf *Publish) remaining() int {
+	total := 2 + len(slf.TopicName) + slf.PayloadSize()
 	if slf.QosLevel > 0 {
 		total += 2
 	}
-	total += len(slf.Payload)
+	return total
+}
 
-	headerLen, e := slf.FixedHeader.writeTo(total, w)
-	if e != nil {
-		return 0, e
-	}
-	total += int(size)
+//Size 返回报文编码后的字节数
+func (slf *Publish) Size() int {
+	remaining := slf.remaining()
+	return slf.FixedHeader.size(remaining) + remaining
+}
 
-	e = binary.Write(w, binary.BigEndian, size)
-	if e != nil {
-		return 0, e
+//AppendTo 把编码后的报文追加到b, 落盘的负载读取失败时返回错误
+func (slf *Publish) AppendTo(b []byte) ([]byte, error) {
+	if slf._spool != nil {
+		return slf._spool.appendTo(slf.appendHeader(b))
 	}
-	w.Write([]byte(slf.TopicName))
+	return append(slf.appendHeader(b), slf.Payload...), nil
+}
+
+//appendHeader 追加负载之前的所有字段
+func (slf *Publish) appendHeader(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, slf.remaining())
+	b = appendString(b, slf.TopicName)
 	if slf.QosLevel > 0 {
-		e = binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
+		b = appendUint16(b, slf.PacketIdentifier)
 	}
-	if e != nil {
-		return 0, e
+	return b
+}
+
+//Envelope 返回投递给单个订阅者的消息副本
+//副本拥有独立的QoS、Retain与报文ID, 与原消息共享主题与负载, 负载不可被修改,
+//副本持有落盘负载的一个引用, 不再投递后调用Release
+func (slf *Publish) Envelope(qos int, retain bool) *Publish {
+	env := SpawnPublishMessage()
+	env.QosLevel = qos
+	if retain {
+		env.Retain = 1
 	}
-	_, e = w.Write(slf.Payload)
-	if e != nil {
-		return 0, e
+	env.TopicName = slf.TopicName
+	env.Payload = slf.Payload
+	env._spool = slf._spool
+	if env._spool != nil {
+		env._spool.Ref()
+	}
+	return env
+}
+
+//Release 消息不再被投递时释放落盘负载的引用, 释放后的消息不能再写出
+func (slf *Publish) Release() {
+	if slf._spool != nil {
+		slf._spool.Unref()
+		slf._spool = nil
+	}
+}
+
+//PayloadSize 返回负载长度, 负载落盘时返回文件中的负载长度
+func (slf *Publish) PayloadSize() int {
+	if slf._spool != nil {
+		return slf._spool.Size()
+	}
+	return len(slf.Payload)
+}
+
+//WithSpool 设置落盘的负载, 设置后Payload被忽略
+func (slf *Publish) WithSpool(spool *Spool) {
+	slf._spool = spool
+}
+
+//Spool 返回落盘的负载, 负载在内存中时返回nil
+func (slf *Publish) Spool() *Spool {
+	return slf._spool
+}
+
+//WithFrames 设置共享报文, 修改主题或负载前须设置为nil
+func (slf *Publish) WithFrames(frames *Frames) {
+	slf._frames = frames
+}
+
+//WriteTo Publish message write to IO
+//负载不经过缓冲区复制, 直接写入w; 落盘的负载从文件流式写入
+func (slf *Publish) WriteTo(w io.Writer) (int64, error) {
+	if slf._frames != nil && slf._spool == nil && slf.QosLevel <= 2 {
+		return slf._frames.writeTo(slf, w)
+	}
+
+	buf := GetBuffer()
+	buf.B = slf.appendHeader(buf.B)
+	n, err := w.Write(buf.B)
+	PutBuffer(buf)
+	if err != nil {
+		return int64(n), err
+	}
+
+	if slf._spool != nil {
+		m, err := slf._spool.WriteTo(w)
+		return int64(n) + m, err
 	}
 
-	return int64(int(total) + int(headerLen)), nil
+	m, err := w.Write(slf.Payload)
+	return int64(n + m), err
 }
 
 //String Returns Publish message object of string
@@ -0,0 +1,166 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func newBenchPublish() *Publish {
+	msg := SpawnPublishMessage()
+	msg.TopicName = "devices/0001/telemetry"
+	msg.QosLevel = 1
+	msg.PacketIdentifier = 42
+	msg.Payload = bytes.Repeat([]byte{0x5a}, 256)
+	return msg
+}
+
+func TestPublishZeroAlloc(t *testing.T) {
+	msg := newBenchPublish()
+	buf := make([]byte, 0, msg.Size())
+	w := bufio.NewWriterSize(ioutil.Discard, 64*1024)
+	data, _ := msg.AppendTo(nil)
+	var decoded Publish
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		fn   func()
+	}{
+		{"AppendTo", func() { buf, _ = msg.AppendTo(buf[:0]) }},
+		{"WriteTo", func() { msg.WriteTo(w) }},
+		{"Unmarshal", func() { decoded.Unmarshal(data) }},
+	}
+
+	for _, c := range cases {
+		if n := testing.AllocsPerRun(1000, c.fn); n != 0 {
+			t.Errorf("%s: %v allocs/op, want 0", c.name, n)
+		}
+	}
+}
+
+func BenchmarkPublishAppendTo(b *testing.B) {
+	msg := newBenchPublish()
+	buf := make([]byte, 0, msg.Size())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(msg.Size()))
+	for i := 0; i < b.N; i++ {
+		buf, _ = msg.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkPublishWriteTo(b *testing.B) {
+	msg := newBenchPublish()
+	w := bufio.NewWriterSize(ioutil.Discard, 64*1024)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(msg.Size()))
+	for i := 0; i < b.N; i++ {
+		if _, err := WriteMessageTo(msg, w); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishUnmarshal(b *testing.B) {
+	data, _ := newBenchPublish().AppendTo(nil)
+	var msg Publish
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if err := msg.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishParse(b *testing.B) {
+	data, _ := newBenchPublish().AppendTo(nil)
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		br.Reset(r)
+		if _, err := Parse(br, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPublishFrames(t *testing.T) {
+	src := newBenchPublish()
+	frames := NewFrames()
+
+	for _, qos := range []int{0, 1, 2} {
+		for _, retain := range []bool{false, true} {
+			for _, dupe := range []bool{false, true} {
+				for _, id := range []uint16{1, 0x1234, 0xffff} {
+					plain := src.Envelope(qos, retain)
+					plain.Dupe = dupe
+					plain.PacketIdentifier = id
+
+					shared := src.Envelope(qos, retain)
+					shared.WithFrames(frames)
+					shared.Dupe = dupe
+					shared.PacketIdentifier = id
+
+					var want, got bytes.Buffer
+					plain.WriteTo(&want)
+					n, err := shared.WriteTo(&got)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if int(n) != got.Len() || !bytes.Equal(want.Bytes(), got.Bytes()) {
+						t.Fatalf("qos %d retain %v dupe %v id %d: got % x, want % x",
+							qos, retain, dupe, id, got.Bytes(), want.Bytes())
+					}
+				}
+			}
+		}
+	}
+
+	shared := src.Envelope(1, false)
+	shared.WithFrames(frames)
+	w := bufio.NewWriterSize(ioutil.Discard, 64*1024)
+	if n := testing.AllocsPerRun(1000, func() { shared.WriteTo(w) }); n != 0 {
+		t.Errorf("shared WriteTo: %v allocs/op, want 0", n)
+	}
+}
+
+func benchmarkFanout(b *testing.B, share bool) {
+	const subscribers = 1000
+	src := newBenchPublish()
+	w := bufio.NewWriterSize(ioutil.Discard, 64*1024)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var frames *Frames
+		if share {
+			frames = NewFrames()
+		}
+		for j := 0; j < subscribers; j++ {
+			env := src.Envelope(1, false)
+			env.WithFrames(frames)
+			env.PacketIdentifier = uint16(j + 1)
+			if _, err := env.WriteTo(w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPublishFanout(b *testing.B) {
+	benchmarkFanout(b, false)
+}
+
+func BenchmarkPublishFanoutShared(b *testing.B) {
+	benchmarkFanout(b, true)
+}
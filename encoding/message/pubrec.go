@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -14,19 +13,18 @@ type Pubrec struct {
 
 //WriteTo Pubrec message write to io
 func (slf *Pubrec) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 2
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+	return writeAppender(w, slf)
+}
 
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
-	return int64(size) + int64(fsize), nil
+func (slf *Pubrec) appendTo(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, 2)
+	return appendUint16(b, slf.PacketIdentifier)
 }
 
-func (slf *Pubrec) decode(reader io.Reader) error {
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-	return nil
+func (slf *Pubrec) unmarshal(b []byte) error {
+	var err error
+	slf.PacketIdentifier, err = readPacketID(b)
+	return err
 }
 
 //String Returns Pubrec message object of string
@@ -0,0 +1,242 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/yamakiller/magicMqtt/encoding"
+)
+
+//packetTypes 所有客户端与服务端之间可以传输的报文类型
+var packetTypes = []encoding.PType{
+	encoding.PTypeConnect,
+	encoding.PTypeConnack,
+	encoding.PTypePublish,
+	encoding.PTypePuback,
+	encoding.PTypePubrec,
+	encoding.PTypePubrel,
+	encoding.PTypePubcomp,
+	encoding.PTypeSubscribe,
+	encoding.PTypeSuback,
+	encoding.PTypeUnsubscribe,
+	encoding.PTypeUnsuback,
+	encoding.PTypePingreq,
+	encoding.PTypePingresp,
+	encoding.PTypeDisconnect,
+}
+
+var randomRunes = []rune("abcxyz019/-_.$ éß中文🙂")
+
+func randomString(r *rand.Rand, min, max int) string {
+	n := min + r.Intn(max-min+1)
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = randomRunes[r.Intn(len(randomRunes))]
+	}
+	return string(runes)
+}
+
+func randomBytes(r *rand.Rand, max int) []byte {
+	b := make([]byte, r.Intn(max+1))
+	r.Read(b)
+	return b
+}
+
+func randomFilter(r *rand.Rand) string {
+	switch r.Intn(4) {
+	case 0:
+		return randomString(r, 1, 8) + "/#"
+	case 1:
+		return "+/" + randomString(r, 1, 8)
+	default:
+		return randomString(r, 1, 16)
+	}
+}
+
+func randomID(r *rand.Rand) uint16 {
+	return uint16(1 + r.Intn(0xffff))
+}
+
+//randomMessage 生成一个符合协议的随机报文
+func randomMessage(r *rand.Rand, t encoding.PType) Message {
+	switch t {
+	case encoding.PTypeConnect:
+		m := SpawnConnectMessage()
+		m.KeepAlive = uint16(r.Intn(0x10000))
+		m.Identifier = randomString(r, 0, 23)
+		m.CleanSession = m.Identifier == "" || r.Intn(2) == 0
+		if r.Intn(2) == 0 {
+			m.Will = &Will{
+				Qos:     uint8(r.Intn(3)),
+				Retain:  r.Intn(2) == 0,
+				Topic:   randomString(r, 1, 16),
+				Message: string(randomBytes(r, 32)),
+			}
+		}
+		if r.Intn(2) == 0 {
+			m.UserName = []byte(randomString(r, 1, 12))
+			if r.Intn(2) == 0 {
+				m.Password = randomBytes(r, 12)
+				m.Password = append(m.Password, 0)
+			}
+		}
+		return m
+	case encoding.PTypeConnack:
+		m := SpawnConnackMessage()
+		m.Reserved = uint8(r.Intn(2))
+		m.ReturnCode = uint8(r.Intn(6))
+		return m
+	case encoding.PTypePublish:
+		m := SpawnPublishMessage()
+		m.TopicName = randomString(r, 1, 32)
+		m.QosLevel = r.Intn(3)
+		m.Retain = r.Intn(2)
+		if m.QosLevel > 0 {
+			m.PacketIdentifier = randomID(r)
+			m.Dupe = r.Intn(2) == 0
+		}
+		m.Payload = randomBytes(r, 512)
+		return m
+	case encoding.PTypePuback:
+		m := SpawnPubackMessage()
+		m.PacketIdentifier = randomID(r)
+		return m
+	case encoding.PTypePubrec:
+		m := SpawnPubrecMessage()
+		m.PacketIdentifier = randomID(r)
+		return m
+	case encoding.PTypePubrel:
+		m := SpawnPubrelMessage()
+		m.PacketIdentifier = randomID(r)
+		return m
+	case encoding.PTypePubcomp:
+		m := SpawnPubcompMessage()
+		m.PacketIdentifier = randomID(r)
+		return m
+	case encoding.PTypeSubscribe:
+		m := SpawnSubscribeMessage()
+		m.PacketIdentifier = randomID(r)
+		for i := 1 + r.Intn(4); i > 0; i-- {
+			m.Payload = append(m.Payload, SubscribePayload{
+				TopicPath:    randomFilter(r),
+				RequestedQos: uint8(r.Intn(3)),
+			})
+		}
+		return m
+	case encoding.PTypeSuback:
+		m := SpawnSubackMessage()
+		m.PacketIdentifier = randomID(r)
+		codes := []byte{0, 1, 2, 0x80}
+		for i := 1 + r.Intn(4); i > 0; i-- {
+			m.Qos = append(m.Qos, codes[r.Intn(len(codes))])
+		}
+		return m
+	case encoding.PTypeUnsubscribe:
+		m := SpawnUnsubscribeMessage()
+		m.PacketIdentifier = randomID(r)
+		for i := 1 + r.Intn(4); i > 0; i-- {
+			m.Payload = append(m.Payload, SubscribePayload{TopicPath: randomFilter(r)})
+		}
+		return m
+	case encoding.PTypeUnsuback:
+		m := SpawnUnsubackMessage()
+		m.PacketIdentifier = randomID(r)
+		return m
+	case encoding.PTypePingreq:
+		return SpawnPingreqMessage()
+	case encoding.PTypePingresp:
+		return SpawnPingrespMessage()
+	case encoding.PTypeDisconnect:
+		return SpawnDisconnectMessage()
+	}
+	panic("unknown packet type")
+}
+
+//clearLength 清除解码时填充的剩余长度, 以便与编码前的消息比较
+func clearLength(m Message) {
+	reflect.ValueOf(m).Elem().FieldByName("FixedHeader").FieldByName("RemainingLength").SetInt(0)
+}
+
+//TestRoundTrip WriteMessageTo之后Parse得到与原消息相同的消息
+func TestRoundTrip(t *testing.T) {
+	for _, typ := range packetTypes {
+		typ := typ
+		property := func(seed int64) bool {
+			want := randomMessage(rand.New(rand.NewSource(seed)), typ)
+
+			var buf bytes.Buffer
+			if _, err := WriteMessageTo(want, &buf); err != nil {
+				t.Logf("%s: write: %v", want.GetTypeAsString(), err)
+				return false
+			}
+			data := append([]byte(nil), buf.Bytes()...)
+
+			got, err := Parse(bufio.NewReader(&buf), 0)
+			if err != nil {
+				t.Logf("%s: parse % x: %v", want.GetTypeAsString(), data, err)
+				return false
+			}
+			if buf.Len() != 0 {
+				t.Logf("%s: %d bytes left after parse", want.GetTypeAsString(), buf.Len())
+				return false
+			}
+
+			clearLength(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Logf("%s:\n got %+v\nwant %+v", want.GetTypeAsString(), got, want)
+				return false
+			}
+
+			decoded, n, err := Decode(data, 0)
+			if err != nil || n != len(data) {
+				t.Logf("%s: decode consumed %d of %d: %v", want.GetTypeAsString(), n, len(data), err)
+				return false
+			}
+			clearLength(decoded)
+			return reflect.DeepEqual(decoded, want)
+		}
+
+		if err := quick.Check(property, &quick.Config{MaxCount: 300}); err != nil {
+			t.Errorf("packet type %d: %v", typ, err)
+		}
+	}
+}
+
+//TestParseStream 连续的报文逐个解析, 不会多读或少读
+func TestParseStream(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var stream bytes.Buffer
+	var want []Message
+	for i := 0; i < 200; i++ {
+		m := randomMessage(r, packetTypes[r.Intn(len(packetTypes))])
+		if _, err := WriteMessageTo(m, &stream); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, m)
+	}
+
+	data := append([]byte(nil), stream.Bytes()...)
+	reader := bufio.NewReaderSize(&stream, 16)
+	for i, w := range want {
+		got, err := Parse(reader, 0)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+
+		decoded, n, err := Decode(data, 0)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		data = data[n:]
+
+		clearLength(got)
+		clearLength(decoded)
+		if !reflect.DeepEqual(got, w) || !reflect.DeepEqual(decoded, w) {
+			t.Fatalf("packet %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package message
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//spoolPrefix 负载临时文件前缀
+	spoolPrefix = "payload-"
+	//spoolDefaultDir 未配置目录时使用的系统临时目录下的子目录, 多个实例共用同一主机时应分别配置目录
+	spoolDefaultDir = "magicMqtt-spool"
+)
+
+//SpoolPath 返回负载临时文件目录, dir为空时为系统临时目录下的专用子目录
+func SpoolPath(dir string) string {
+	if dir == "" {
+		return filepath.Join(os.TempDir(), spoolDefaultDir)
+	}
+	return dir
+}
+
+//Spool 写入临时文件的PUBLISH负载
+//大负载不在内存中保留, 投递时从文件读取; 所有投递副本共享同一个文件,
+//每个副本持有一个引用, 最后一个引用释放后文件被删除
+type Spool struct {
+	_file *os.File
+	_size int64
+	_refs int32
+	_once sync.Once
+}
+
+//NewSpool 在dir下创建负载临时文件, dir为空时使用系统临时目录下的专用子目录
+func NewSpool(dir string) (*Spool, error) {
+	dir = SpoolPath(dir)
+	f, err := ioutil.TempFile(dir, spoolPrefix)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			f, err = ioutil.TempFile(dir, spoolPrefix)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{_file: f, _refs: 1}
+	//引用计数之外的兜底, 遗漏释放的负载在不可达后由回收器删除
+	runtime.SetFinalizer(s, (*Spool).Remove)
+	return s, nil
+}
+
+//CleanSpool 清除目录中残留的负载临时文件, dir为空时清除默认目录
+func CleanSpool(dir string) error {
+	dir = SpoolPath(dir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), spoolPrefix) {
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//Ref 增加一个引用, 创建者持有第一个引用
+func (slf *Spool) Ref() {
+	atomic.AddInt32(&slf._refs, 1)
+}
+
+//Unref 释放一个引用, 最后一个引用释放后删除临时文件
+func (slf *Spool) Unref() {
+	if atomic.AddInt32(&slf._refs, -1) == 0 {
+		slf.Remove()
+	}
+}
+
+//Write 追加负载, 只能在负载交给其他协程之前调用
+func (slf *Spool) Write(p []byte) (int, error) {
+	n, err := slf._file.Write(p)
+	slf._size += int64(n)
+	return n, err
+}
+
+//Size 返回负载长度
+func (slf *Spool) Size() int {
+	return int(slf._size)
+}
+
+//WriteTo 把负载写入w, 多个协程可以同时写出同一个负载
+func (slf *Spool) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, io.NewSectionReader(slf._file, 0, slf._size))
+	//复制期间只引用文件, 防止回收器提前删除
+	runtime.KeepAlive(slf)
+	return n, err
+}
+
+//appendTo 把负载追加到b, 读取失败时返回错误, 不能发出与报头长度不一致的报文
+func (slf *Spool) appendTo(b []byte) ([]byte, error) {
+	n, size := len(b), int(slf._size)
+	if cap(b)-n < size {
+		grown := make([]byte, n, n+size)
+		copy(grown, b)
+		b = grown
+	}
+
+	b = b[:n+size]
+	m, err := slf._file.ReadAt(b[n:], 0)
+	runtime.KeepAlive(slf)
+	if m < size {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return b[:n], err
+	}
+	return b, nil
+}
+
+//Remove 关闭并删除临时文件, 不再等待其它引用, 负载交给其他协程后应使用Unref
+func (slf *Spool) Remove() {
+	slf._once.Do(func() {
+		runtime.SetFinalizer(slf, nil)
+		slf._file.Close()
+		os.Remove(slf._file.Name())
+	})
+}
@@ -0,0 +1,250 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func spooledPacket(t *testing.T, size int) (*Publish, []byte) {
+	msg := SpawnPublishMessage()
+	msg.TopicName = "firmware/v2/image"
+	msg.QosLevel = 1
+	msg.PacketIdentifier = 7
+	msg.Payload = make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(msg.Payload)
+	return msg, mustEncode(t, msg)
+}
+
+func spoolFiles(t *testing.T, dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(infos)
+}
+
+//checkSpooled 落盘的消息重新编码后与原报文一致
+func checkSpooled(t *testing.T, got *Publish, want *Publish, data []byte) {
+	if got.Spool() == nil || got.Payload != nil {
+		t.Fatal("payload not spooled")
+	}
+	if got.PayloadSize() != len(want.Payload) || got.TopicName != want.TopicName ||
+		got.PacketIdentifier != want.PacketIdentifier {
+		t.Fatalf("got %s %d size %d", got.TopicName, got.PacketIdentifier, got.PayloadSize())
+	}
+	if got.Size() != len(data) {
+		t.Fatalf("size %d, want %d", got.Size(), len(data))
+	}
+
+	//投递副本共享临时文件
+	env := got.Envelope(1, false)
+	env.PacketIdentifier = want.PacketIdentifier
+	var buf bytes.Buffer
+	if _, err := env.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("WriteTo differs from the received packet")
+	}
+	if b, err := got.AppendTo(nil); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("AppendTo differs from the received packet, %v", err)
+	}
+}
+
+func TestParseSpooled(t *testing.T) {
+	dir := t.TempDir()
+	want, data := spooledPacket(t, 1<<20)
+	ping := mustEncode(t, SpawnPingreqMessage())
+
+	reader := bufio.NewReaderSize(bytes.NewReader(append(data, ping...)), 4096)
+	opts := &ParseOptions{MaxLength: 64 * 1024, SpoolSize: 64 * 1024, SpoolDir: dir}
+	msg, err := ParseWith(reader, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := msg.(*Publish)
+	checkSpooled(t, got, want, data)
+	if n := spoolFiles(t, dir); n != 1 {
+		t.Fatalf("%d spool files, want 1", n)
+	}
+
+	//落盘的负载之后的报文不受影响
+	if next, err := ParseWith(reader, opts); err != nil || next.GetType() != SpawnPingreqMessage().GetType() {
+		t.Fatalf("next packet %v, %v", next, err)
+	}
+
+	got.Spool().Remove()
+	if n := spoolFiles(t, dir); n != 0 {
+		t.Fatalf("%d spool files left after Remove", n)
+	}
+}
+
+func TestDecodeSpooled(t *testing.T) {
+	dir := t.TempDir()
+	want, data := spooledPacket(t, 300*1024)
+	opts := &ParseOptions{SpoolSize: 1024, SpoolDir: dir}
+
+	if _, _, _, err := DecodeSpooled(data[:3], opts); err == nil {
+		t.Fatal("incomplete header decoded")
+	}
+
+	got, n, size, err := DecodeSpooled(data[:4096], opts)
+	if err != nil || got == nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if n+size != len(data) {
+		t.Fatalf("header %d + payload %d, want %d", n, size, len(data))
+	}
+	for rest := data[n:]; len(rest) > 0; {
+		chunk := 1000
+		if chunk > len(rest) {
+			chunk = len(rest)
+		}
+		got.Spool().Write(rest[:chunk])
+		rest = rest[chunk:]
+	}
+	checkSpooled(t, got, want, data)
+
+	//小于SpoolSize的报文不落盘
+	small := mustEncode(t, SpawnPingreqMessage())
+	if msg, _, _, err := DecodeSpooled(small, opts); msg != nil || err != nil {
+		t.Fatalf("small packet spooled: %v, %v", msg, err)
+	}
+	got.Spool().Remove()
+}
+
+func TestParsePayloadLimit(t *testing.T) {
+	dir := t.TempDir()
+	_, data := spooledPacket(t, 8192)
+
+	for _, spool := range []int{0, 1024} {
+		opts := &ParseOptions{MaxPayload: 4096, SpoolSize: spool, SpoolDir: dir}
+		_, err := ParseWith(bytes.NewReader(data), opts)
+		if _, ok := err.(*ErrPayloadTooLarge); !ok {
+			t.Fatalf("spool %d: got %v, want ErrPayloadTooLarge", spool, err)
+		}
+
+		opts.MaxPayload = 8192
+		msg, err := ParseWith(bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatalf("spool %d: %v", spool, err)
+		}
+		if s := msg.(*Publish).Spool(); s != nil {
+			s.Remove()
+		}
+	}
+
+	//负载被截断时不残留临时文件
+	opts := &ParseOptions{SpoolSize: 1024, SpoolDir: dir}
+	if _, err := ParseWith(bytes.NewReader(data[:len(data)-1]), opts); err == nil {
+		t.Fatal("truncated payload parsed")
+	}
+	if n := spoolFiles(t, dir); n != 0 {
+		t.Fatalf("%d spool files left", n)
+	}
+}
+
+//gcWriter 每次写入时触发回收
+type gcWriter struct {
+	_n int
+}
+
+func (slf *gcWriter) Write(p []byte) (int, error) {
+	runtime.GC()
+	time.Sleep(time.Millisecond)
+	slf._n += len(p)
+	return len(p), nil
+}
+
+//TestSpoolKeepAlive 写出期间不再被引用的负载不会被回收器删除
+func TestSpoolKeepAlive(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Write(make([]byte, 256*1024))
+
+	w := &gcWriter{}
+	if _, err := spool.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if w._n != 256*1024 {
+		t.Fatalf("wrote %d bytes", w._n)
+	}
+}
+
+func TestSpoolRefs(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Write([]byte("payload"))
+	msg := SpawnPublishMessage()
+	msg.WithSpool(spool)
+
+	//每个副本持有一个引用, 重复释放同一个消息不影响其它副本
+	a, b := msg.Envelope(0, false), msg.Envelope(1, false)
+	msg.Release()
+	msg.Release()
+	a.Release()
+	if n := spoolFiles(t, dir); n != 1 {
+		t.Fatalf("%d spool files with a live envelope", n)
+	}
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if n := spoolFiles(t, dir); n != 0 {
+		t.Fatalf("%d spool files after the last release", n)
+	}
+}
+
+func TestSpoolReadError(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Remove()
+	spool.Write(bytes.Repeat([]byte{1}, 64))
+
+	msg := SpawnPublishMessage()
+	msg.TopicName = "a"
+	msg.WithSpool(spool)
+
+	//临时文件被截断时不能发出与报头长度不一致的报文
+	if err := spool._file.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.AppendTo(nil); err == nil {
+		t.Fatal("truncated spool encoded")
+	}
+	if _, err := Encode(nil, msg); err == nil {
+		t.Fatal("truncated spool encoded")
+	}
+}
+
+func TestCleanDefaultSpool(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	spool, err := NewSpool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolFiles(t, SpoolPath("")); n != 1 {
+		t.Fatalf("%d spool files in the default dir", n)
+	}
+
+	if err := CleanSpool(""); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolFiles(t, SpoolPath("")); n != 0 {
+		t.Fatalf("%d spool files left", n)
+	}
+	spool.Remove()
+}
@@ -1,8 +1,6 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -16,34 +14,39 @@ type Suback struct {
 
 //WriteTo Suback message write to io
 func (slf *Suback) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 2 + len(slf.Qos)
+	return writeAppender(w, slf)
+}
 
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+func (slf *Suback) appendTo(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, 2+len(slf.Qos))
+	b = appendUint16(b, slf.PacketIdentifier)
+	return append(b, slf.Qos...)
+}
 
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
-	io.Copy(w, bytes.NewReader(slf.Qos))
+func (slf *Suback) unmarshal(b []byte) error {
+	var (
+		offset int
+		err    error
+	)
 
-	return int64(size) + int64(fsize), nil
-}
+	if slf.PacketIdentifier, offset, err = readUint16(b, 0); err != nil {
+		return err
+	}
+	if slf.PacketIdentifier == 0 {
+		return violation("packet identifier 0")
+	}
 
-func (slf *Suback) decode(reader io.Reader) error {
-	var remaining uint8
-	remaining = uint8(slf.FixedHeader.RemainingLength)
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-
-	remaining -= 2
-	buffer := bytes.NewBuffer(nil)
-	for i := 0; i <= int(remaining); i++ {
-		var value uint8 = 0
-		binary.Read(reader, binary.BigEndian, &value)
-		binary.Write(buffer, binary.BigEndian, value)
-		remaining--
+	slf.Qos = b[offset:len(b):len(b)]
+	if len(slf.Qos) == 0 {
+		return malformed("suback without return codes")
 	}
 
-	slf.Qos = buffer.Bytes()
+	//[MQTT-3.9.3-2]
+	for _, code := range slf.Qos {
+		if code > 2 && code != 0x80 {
+			return violation("suback return code %#x", code)
+		}
+	}
 	return nil
 }
 
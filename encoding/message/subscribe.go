@@ -1,8 +1,6 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -22,49 +20,66 @@ type Subscribe struct {
 
 //WriteTo Subscribe message write to io
 func (slf *Subscribe) WriteTo(w io.Writer) (int64, error) {
-	var total int = 0
-	total += 2
+	return writeAppender(w, slf)
+}
 
+func (slf *Subscribe) appendTo(b []byte) []byte {
+	total := 2
 	for i := 0; i < len(slf.Payload); i++ {
-		var length uint16 = uint16(len(slf.Payload[i].TopicPath))
-		total += 2 + int(length) + 1
+		total += 2 + len(slf.Payload[i].TopicPath) + 1
 	}
 
-	headerLen, _ := slf.FixedHeader.writeTo(total, w)
-	total += total + int(headerLen)
-
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
+	b = slf.FixedHeader.appendTo(b, total)
+	b = appendUint16(b, slf.PacketIdentifier)
 	for i := 0; i < len(slf.Payload); i++ {
-		var length uint16 = uint16(len(slf.Payload[i].TopicPath))
-		binary.Write(w, binary.BigEndian, length)
-		w.Write([]byte(slf.Payload[i].TopicPath))
-		binary.Write(w, binary.BigEndian, slf.Payload[i].RequestedQos)
+		b = appendString(b, slf.Payload[i].TopicPath)
+		b = append(b, slf.Payload[i].RequestedQos)
 	}
 
-	return int64(total), nil
+	return b
 }
 
-func (slf *Subscribe) decode(reader io.Reader) error {
-	remaining := slf.RemainingLength
-
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-	remaining -= int(2)
-
-	buffer := bytes.NewBuffer(nil)
-	for remaining > 0 {
-		var length uint16
+func (slf *Subscribe) unmarshal(b []byte) error {
+	var (
+		offset int
+		err    error
+	)
 
-		m := SubscribePayload{}
-		binary.Read(reader, binary.BigEndian, &length)
-
-		_, _ = io.CopyN(buffer, reader, int64(length))
+	if slf.PacketIdentifier, offset, err = readUint16(b, 0); err != nil {
+		return err
+	}
+	if slf.PacketIdentifier == 0 {
+		return violation("packet identifier 0")
+	}
 
-		m.TopicPath = string(buffer.Bytes())
-		binary.Read(reader, binary.BigEndian, &m.RequestedQos)
-		slf.Payload = append(slf.Payload, m)
+	for offset < len(b) {
+		var topic []byte
+		if topic, offset, err = readUTF8(b, offset); err != nil {
+			return err
+		}
+		if len(topic) == 0 {
+			return violation("empty topic filter")
+		}
+
+		if offset >= len(b) {
+			return errTruncated
+		}
+
+		//[MQTT-3-8.3-4]
+		if b[offset] > 2 {
+			return malformed("requested qos %#x", b[offset])
+		}
+
+		slf.Payload = append(slf.Payload, SubscribePayload{
+			TopicPath:    string(topic),
+			RequestedQos: b[offset],
+		})
+		offset++
+	}
 
-		buffer.Reset()
-		remaining -= (int(length) + 1 + 2)
+	//[MQTT-3.8.3-3]
+	if len(slf.Payload) == 0 {
+		return violation("subscribe without topic filters")
 	}
 
 	return nil
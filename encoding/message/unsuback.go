@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -14,19 +13,18 @@ type Unsuback struct {
 
 //WriteTo 写协议数据包
 func (slf *Unsuback) WriteTo(w io.Writer) (int64, error) {
-	var fsize = 2
-	size, err := slf.FixedHeader.writeTo(fsize, w)
-	if err != nil {
-		return 0, err
-	}
+	return writeAppender(w, slf)
+}
 
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
-	return int64(size) + int64(fsize), nil
+func (slf *Unsuback) appendTo(b []byte) []byte {
+	b = slf.FixedHeader.appendTo(b, 2)
+	return appendUint16(b, slf.PacketIdentifier)
 }
 
-func (slf *Unsuback) decode(reader io.Reader) error {
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-	return nil
+func (slf *Unsuback) unmarshal(b []byte) error {
+	var err error
+	slf.PacketIdentifier, err = readPacketID(b)
+	return err
 }
 
 //String unsuback 转换为json字符串
@@ -1,8 +1,6 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -15,23 +13,34 @@ type Unsubscribe struct {
 	Payload          []SubscribePayload
 }
 
-func (slf *Unsubscribe) decode(reader io.Reader) error {
-	remaining := slf.RemainingLength
+func (slf *Unsubscribe) unmarshal(b []byte) error {
+	var (
+		offset int
+		err    error
+	)
 
-	binary.Read(reader, binary.BigEndian, &slf.PacketIdentifier)
-	remaining -= int(2)
+	if slf.PacketIdentifier, offset, err = readUint16(b, 0); err != nil {
+		return err
+	}
+	if slf.PacketIdentifier == 0 {
+		return violation("packet identifier 0")
+	}
 
-	buffer := bytes.NewBuffer(nil)
-	for remaining > 0 {
-		var length uint16 = 0
+	for offset < len(b) {
+		var topic []byte
+		if topic, offset, err = readUTF8(b, offset); err != nil {
+			return err
+		}
+		if len(topic) == 0 {
+			return violation("empty topic filter")
+		}
+
+		slf.Payload = append(slf.Payload, SubscribePayload{TopicPath: string(topic)})
+	}
 
-		m := SubscribePayload{}
-		binary.Read(reader, binary.BigEndian, &length)
-		_, _ = io.CopyN(buffer, reader, int64(length))
-		m.TopicPath = string(buffer.Bytes())
-		buffer.Reset()
-		slf.Payload = append(slf.Payload, m)
-		remaining -= (int(length) + 1 + 2)
+	//[MQTT-3.10.3-2]
+	if len(slf.Payload) == 0 {
+		return violation("unsubscribe without topic filters")
 	}
 
 	return nil
@@ -39,24 +48,22 @@ func (slf *Unsubscribe) decode(reader io.Reader) error {
 
 //WriteTo Unsubscribe message write to io
 func (slf *Unsubscribe) WriteTo(w io.Writer) (int64, error) {
-	var total = 2
+	return writeAppender(w, slf)
+}
+
+func (slf *Unsubscribe) appendTo(b []byte) []byte {
+	total := 2
 	for i := 0; i < len(slf.Payload); i++ {
-		length := uint16(len(slf.Payload[i].TopicPath))
-		total += 2 + int(length)
+		total += 2 + len(slf.Payload[i].TopicPath)
 	}
 
-	headerLen, _ := slf.FixedHeader.writeTo(total, w)
-	total += total + int(headerLen)
-
-	binary.Write(w, binary.BigEndian, slf.PacketIdentifier)
+	b = slf.FixedHeader.appendTo(b, total)
+	b = appendUint16(b, slf.PacketIdentifier)
 	for i := 0; i < len(slf.Payload); i++ {
-		var length uint16 = 0
-		length = uint16(len(slf.Payload[i].TopicPath))
-		binary.Write(w, binary.BigEndian, length)
-		w.Write([]byte(slf.Payload[i].TopicPath))
+		b = appendString(b, slf.Payload[i].TopicPath)
 	}
 
-	return int64(total), nil
+	return b
 }
 
 //String Returns Unsubscribe message object of string
@@ -1,7 +1,6 @@
 package message
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"io"
 )
@@ -16,20 +15,12 @@ type Will struct {
 
 //WriteTo Wirte will protocol message to io
 func (slf *Will) WriteTo(w io.Writer) (int64, error) {
-	var topicLen uint16
-	var size int = 0
-
-	topicLen = uint16(len(slf.Topic))
-	err := binary.Write(w, binary.BigEndian, topicLen)
-	w.Write([]byte(slf.Topic))
-	size += 2 + int(topicLen)
-
-	msgLen := uint16(len(slf.Message))
-	err = binary.Write(w, binary.BigEndian, msgLen)
-	w.Write([]byte(slf.Message))
-	size += 2 + int(msgLen)
+	return writeAppender(w, slf)
+}
 
-	return int64(size), err
+func (slf *Will) appendTo(b []byte) []byte {
+	b = appendString(b, slf.Topic)
+	return appendString(b, slf.Message)
 }
 
 //Size Returns will protocol message size
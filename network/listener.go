@@ -1,10 +1,14 @@
 package network
 
 import (
+	"errors"
 	"net"
 	"sync"
+	"syscall"
 )
 
+var errNoRawConn = errors.New("network: raw connection unsupported")
+
 //IListener 监听接口
 type IListener interface {
 	Accept() (net.Conn, error)
@@ -47,3 +51,11 @@ func (slf *MConn) Close() error {
 	slf._wg = nil
 	return slf.Conn.Close()
 }
+
+//SyscallConn 返回底层连接的原始连接, 用于事件驱动模式
+func (slf *MConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := slf.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNoRawConn
+}
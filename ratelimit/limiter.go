@@ -0,0 +1,242 @@
+package ratelimit
+
+import (
+	"strings"
+	"time"
+)
+
+//Action 超出限制时的处理方式
+type Action int
+
+const (
+	//Pass 未超出限制
+	Pass Action = iota
+	//Delay 处理报文后暂停读取, 直到令牌补足
+	Delay
+	//Drop 丢弃报文
+	Drop
+	//Disconnect 断开连接
+	Disconnect
+)
+
+//ParseAction 解析处理方式, 默认为Delay
+func ParseAction(name string) Action {
+	switch strings.ToLower(name) {
+	case "drop":
+		return Drop
+	case "disconnect":
+		return Disconnect
+	default:
+		return Delay
+	}
+}
+
+func (slf Action) String() string {
+	switch slf {
+	case Pass:
+		return "pass"
+	case Delay:
+		return "delay"
+	case Drop:
+		return "drop"
+	default:
+		return "disconnect"
+	}
+}
+
+//Kind 被超出的限制
+type Kind int
+
+const (
+	//KindPublish 每秒PUBLISH报文数
+	KindPublish Kind = iota
+	//KindBytes 每秒PUBLISH负载字节数
+	KindBytes
+	//KindSubscribe 每秒订阅过滤器数
+	KindSubscribe
+)
+
+func (slf Kind) String() string {
+	switch slf {
+	case KindPublish:
+		return "publish"
+	case KindBytes:
+		return "bytes"
+	default:
+		return "subscribe"
+	}
+}
+
+//Limit 客户端速率限制, 0表示不限制
+type Limit struct {
+	Publish   int    `json:"publish"`
+	Bytes     int    `json:"bytes"`
+	Subscribe int    `json:"subscribe"`
+	Burst     int    `json:"burst"`
+	Policy    string `json:"policy"`
+}
+
+//Merge 合并授权验证器中的限制, o中大于0的值替换当前值, 小于0表示不限制, Policy非空时替换
+func (slf Limit) Merge(o Limit) Limit {
+	merge := func(v, o int) int {
+		switch {
+		case o > 0:
+			return o
+		case o < 0:
+			return 0
+		default:
+			return v
+		}
+	}
+
+	slf.Publish = merge(slf.Publish, o.Publish)
+	slf.Bytes = merge(slf.Bytes, o.Bytes)
+	slf.Subscribe = merge(slf.Subscribe, o.Subscribe)
+	if o.Burst > 0 {
+		slf.Burst = o.Burst
+	}
+	if o.Policy != "" {
+		slf.Policy = o.Policy
+	}
+	return slf
+}
+
+//Result 限流检查结果
+type Result struct {
+	Kind   Kind
+	Action Action
+	Wait   time.Duration
+}
+
+//Bucket 令牌桶, 非并发安全
+type Bucket struct {
+	_rate   float64
+	_burst  float64
+	_tokens float64
+	_last   time.Time
+}
+
+//NewBucket 创建令牌桶, 每秒补充rate个令牌, 最多容纳burst个, 初始为满
+func NewBucket(rate, burst float64, now time.Time) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+
+	return &Bucket{_rate: rate, _burst: burst, _tokens: burst, _last: now}
+}
+
+func (slf *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(slf._last); elapsed > 0 {
+		slf._tokens += elapsed.Seconds() * slf._rate
+		if slf._tokens > slf._burst {
+			slf._tokens = slf._burst
+		}
+	}
+	slf._last = now
+}
+
+//Available 补充令牌后是否有n个令牌可以取出, 超过桶容量的请求永远不可用
+func (slf *Bucket) Available(n float64, now time.Time) bool {
+	slf.refill(now)
+	return slf._tokens >= n
+}
+
+//Take 取出n个令牌, 令牌不足时透支, 返回令牌补足前需要等待的时间
+//超过桶容量的请求按实际大小透支, 不能借此绕过限制
+func (slf *Bucket) Take(n float64, now time.Time) time.Duration {
+	slf.refill(now)
+	slf._tokens -= n
+	if slf._tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-slf._tokens / slf._rate * float64(time.Second))
+}
+
+//Limiter 单个客户端的限流器, 只由连接的读协程调用, nil时不限制
+type Limiter struct {
+	_action    Action
+	_publish   *Bucket
+	_bytes     *Bucket
+	_subscribe *Bucket
+}
+
+//New 创建限流器, 所有限制都为0时返回nil
+//桶容量为Burst秒的流量, Burst<=0时为1秒
+func New(limit Limit) *Limiter {
+	if limit.Publish <= 0 && limit.Bytes <= 0 && limit.Subscribe <= 0 {
+		return nil
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	now := time.Now()
+	bucket := func(rate int) *Bucket {
+		if rate <= 0 {
+			return nil
+		}
+		return NewBucket(float64(rate), float64(rate*burst), now)
+	}
+
+	return &Limiter{
+		_action:    ParseAction(limit.Policy),
+		_publish:   bucket(limit.Publish),
+		_bytes:     bucket(limit.Bytes),
+		_subscribe: bucket(limit.Subscribe),
+	}
+}
+
+//Publish 检查一个负载为size字节的PUBLISH报文
+func (slf *Limiter) Publish(size int, now time.Time) Result {
+	if slf == nil {
+		return Result{}
+	}
+
+	return slf.check(now, usage{slf._publish, KindPublish, 1}, usage{slf._bytes, KindBytes, float64(size)})
+}
+
+//Subscribe 检查一个包含n个订阅过滤器的SUBSCRIBE报文
+func (slf *Limiter) Subscribe(n int, now time.Time) Result {
+	if slf == nil {
+		return Result{}
+	}
+
+	return slf.check(now, usage{slf._subscribe, KindSubscribe, float64(n)}, usage{})
+}
+
+//usage 一个报文对一个令牌桶的消耗
+type usage struct {
+	_bucket *Bucket
+	_kind   Kind
+	_cost   float64
+}
+
+//check Delay方式总是取出令牌并返回最长的等待时间, 其他方式只在所有桶都有足够令牌时取出
+func (slf *Limiter) check(now time.Time, usages ...usage) Result {
+	result := Result{}
+	if slf._action == Delay {
+		for _, c := range usages {
+			if c._bucket == nil {
+				continue
+			}
+			if wait := c._bucket.Take(c._cost, now); wait > result.Wait {
+				result = Result{Kind: c._kind, Action: Delay, Wait: wait}
+			}
+		}
+		return result
+	}
+
+	for _, c := range usages {
+		if c._bucket != nil && !c._bucket.Available(c._cost, now) {
+			return Result{Kind: c._kind, Action: slf._action}
+		}
+	}
+	for _, c := range usages {
+		if c._bucket != nil {
+			c._bucket.Take(c._cost, now)
+		}
+	}
+	return result
+}
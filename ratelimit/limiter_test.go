@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 20, now)
+
+	for i := 0; i < 20; i++ {
+		if !b.Available(1, now) {
+			t.Fatalf("token %d not available", i)
+		}
+		b.Take(1, now)
+	}
+	if b.Available(1, now) {
+		t.Fatal("empty bucket available")
+	}
+
+	//透支的令牌按速率补足
+	if wait := b.Take(5, now); wait != 500*time.Millisecond {
+		t.Fatalf("wait %s", wait)
+	}
+	if wait := b.Take(0, now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("wait %s after refill", wait)
+	}
+
+	//超过容量的请求按实际大小透支
+	now = now.Add(time.Hour)
+	if b.Available(1000, now) {
+		t.Fatal("full bucket accepts a request larger than burst")
+	}
+	if wait := b.Take(1000, now); wait != 98*time.Second {
+		t.Fatalf("wait %s for a large request", wait)
+	}
+	if b.Available(1, now.Add(97*time.Second)) {
+		t.Fatal("debt not repaid")
+	}
+}
+
+func TestLimiterLargePayload(t *testing.T) {
+	now := time.Now()
+	delay := New(Limit{Bytes: 1000})
+	r := delay.Publish(5000, now)
+	if r.Action != Delay || r.Kind != KindBytes || r.Wait != 4*time.Second {
+		t.Fatalf("delay %+v", r)
+	}
+	if r := delay.Publish(1000, now.Add(5*time.Second)); r.Action != Pass {
+		t.Fatalf("publish after debt %+v", r)
+	}
+
+	drop := New(Limit{Bytes: 1000, Policy: "drop"})
+	for i := 0; i < 3; i++ {
+		if r := drop.Publish(5000, now.Add(time.Duration(i)*time.Hour)); r.Action != Drop || r.Kind != KindBytes {
+			t.Fatalf("payload larger than burst %+v", r)
+		}
+	}
+	if r := drop.Publish(1000, now); r.Action != Pass {
+		t.Fatalf("payload of burst size %+v", r)
+	}
+}
+
+func TestLimiterDelay(t *testing.T) {
+	if New(Limit{Burst: 5, Policy: "drop"}) != nil {
+		t.Fatal("limiter without limits")
+	}
+
+	var unlimited *Limiter
+	if r := unlimited.Publish(1<<20, time.Now()); r.Action != Pass {
+		t.Fatalf("nil limiter %+v", r)
+	}
+
+	l := New(Limit{Publish: 100, Bytes: 1000})
+	now := time.Now()
+	if r := l.Publish(500, now); r.Action != Pass {
+		t.Fatalf("first publish %+v", r)
+	}
+
+	r := l.Publish(1000, now)
+	if r.Action != Delay || r.Kind != KindBytes || r.Wait != 500*time.Millisecond {
+		t.Fatalf("bytes exceeded %+v", r)
+	}
+	if r := l.Subscribe(100, now); r.Action != Pass {
+		t.Fatalf("subscribe without limit %+v", r)
+	}
+}
+
+func TestLimiterDrop(t *testing.T) {
+	l := New(Limit{Publish: 2, Bytes: 100, Subscribe: 1, Policy: "Drop"})
+	now := time.Now()
+
+	if r := l.Publish(60, now); r.Action != Pass {
+		t.Fatalf("first publish %+v", r)
+	}
+	//字节数超限时不消耗报文数令牌
+	if r := l.Publish(60, now); r.Action != Drop || r.Kind != KindBytes {
+		t.Fatalf("bytes exceeded %+v", r)
+	}
+	if r := l.Publish(10, now); r.Action != Pass {
+		t.Fatalf("second publish %+v", r)
+	}
+	if r := l.Publish(0, now); r.Action != Drop || r.Kind != KindPublish {
+		t.Fatalf("publish exceeded %+v", r)
+	}
+	if r := l.Publish(0, now.Add(time.Second)); r.Action != Pass {
+		t.Fatalf("publish after refill %+v", r)
+	}
+
+	if r := l.Subscribe(1, now); r.Action != Pass {
+		t.Fatalf("first subscribe %+v", r)
+	}
+	if r := l.Subscribe(1, now); r.Action != Drop || r.Kind != KindSubscribe {
+		t.Fatalf("subscribe exceeded %+v", r)
+	}
+}
+
+func TestLimitMerge(t *testing.T) {
+	global := Limit{Publish: 10, Bytes: 1000, Subscribe: 5, Policy: "delay"}
+	got := global.Merge(Limit{Publish: 50, Bytes: -1, Policy: "disconnect"})
+	want := Limit{Publish: 50, Bytes: 0, Subscribe: 5, Policy: "disconnect"}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var none *Metrics
+	none.Record("c", Result{Action: Drop})
+	if none.Clients() != nil {
+		t.Fatal("nil metrics recorded")
+	}
+
+	m := NewMetrics()
+	m.Record("a", Result{Kind: KindPublish, Action: Delay, Wait: time.Second})
+	m.Record("a", Result{Kind: KindBytes, Action: Drop})
+	m.Record("b", Result{Kind: KindSubscribe, Action: Disconnect})
+	m.Record("c", Result{})
+
+	if s := m.Stats(); s != (Stats{Delayed: 1, Dropped: 1, Disconnected: 1}) {
+		t.Fatalf("stats %+v", s)
+	}
+	clients := map[string]ClientStats{}
+	for _, c := range m.Clients() {
+		clients[c.ClientID] = c
+	}
+	if len(clients) != 2 || clients["b"].Subscribe != 1 || clients["b"].Disconnected != 1 {
+		t.Fatalf("clients %+v", clients)
+	}
+	if a := clients["a"]; a.Publish != 1 || a.Bytes != 1 || a.Delayed != 1 || a.Dropped != 1 {
+		t.Fatalf("client a %+v", a)
+	}
+
+	for i := 0; i < maxClients+10; i++ {
+		m.Record(strconv.Itoa(i), Result{Action: Drop})
+	}
+	if n := len(m.Clients()); n != maxClients {
+		t.Fatalf("%d clients kept", n)
+	}
+}
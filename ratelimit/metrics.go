@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//maxClients 统计中保留的客户端数, 超出时丢弃最早被限流的客户端
+const maxClients = 1024
+
+//Stats 限流次数统计
+type Stats struct {
+	Delayed      uint64 `json:"delayed"`
+	Dropped      uint64 `json:"dropped"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+func (slf *Stats) add(action Action) {
+	switch action {
+	case Delay:
+		slf.Delayed++
+	case Drop:
+		slf.Dropped++
+	case Disconnect:
+		slf.Disconnected++
+	}
+}
+
+//ClientStats 客户端的限流统计, Publish、Bytes与Subscribe为各项限制被超出的次数
+type ClientStats struct {
+	ClientID  string `json:"clientId"`
+	Publish   uint64 `json:"publish"`
+	Bytes     uint64 `json:"bytes"`
+	Subscribe uint64 `json:"subscribe"`
+	Stats
+	Last time.Time `json:"last"`
+}
+
+//Metrics 限流统计, nil时不统计
+type Metrics struct {
+	_mu      sync.Mutex
+	_total   Stats
+	_clients map[string]*ClientStats
+}
+
+//NewMetrics 创建限流统计
+func NewMetrics() *Metrics {
+	return &Metrics{_clients: make(map[string]*ClientStats)}
+}
+
+//Record 记录一次超出限制
+func (slf *Metrics) Record(clientID string, r Result) {
+	if slf == nil || r.Action == Pass {
+		return
+	}
+
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	slf._total.add(r.Action)
+	c := slf._clients[clientID]
+	if c == nil {
+		if len(slf._clients) >= maxClients {
+			slf.evict()
+		}
+		c = &ClientStats{ClientID: clientID}
+		slf._clients[clientID] = c
+	}
+
+	switch r.Kind {
+	case KindPublish:
+		c.Publish++
+	case KindBytes:
+		c.Bytes++
+	case KindSubscribe:
+		c.Subscribe++
+	}
+	c.add(r.Action)
+	c.Last = time.Now()
+}
+
+//evict 丢弃最早被限流的客户端, 调用者持有锁
+func (slf *Metrics) evict() {
+	var oldest *ClientStats
+	for _, c := range slf._clients {
+		if oldest == nil || c.Last.Before(oldest.Last) {
+			oldest = c
+		}
+	}
+	if oldest != nil {
+		delete(slf._clients, oldest.ClientID)
+	}
+}
+
+//Stats 返回所有客户端的限流次数
+func (slf *Metrics) Stats() Stats {
+	if slf == nil {
+		return Stats{}
+	}
+
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	return slf._total
+}
+
+//Clients 返回被限流的客户端, 最近被限流的在前
+func (slf *Metrics) Clients() []ClientStats {
+	if slf == nil {
+		return nil
+	}
+
+	slf._mu.Lock()
+	result := make([]ClientStats, 0, len(slf._clients))
+	for _, c := range slf._clients {
+		result = append(result, *c)
+	}
+	slf._mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Last.After(result[j].Last) })
+	return result
+}
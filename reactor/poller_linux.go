@@ -0,0 +1,228 @@
+//go:build linux
+// +build linux
+
+package reactor
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+//Read 从非阻塞的连接读取一次, 没有数据可读时返回syscall.EAGAIN
+func Read(raw syscall.RawConn, buf []byte) (int, error) {
+	var n int
+	var rerr error
+	if err := raw.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), buf)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	return n, rerr
+}
+
+//readEvents 连接注册的事件, ONESHOT保证同一连接同时只由一个工作协程处理
+const readEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+type registration struct {
+	_fd      int
+	_handler Handler
+	_busy    int32
+}
+
+//Poller 基于epoll的反应器
+//连接可读时交给工作协程处理, 处理完成后重新监听, 空闲连接不占用协程与缓冲区
+type Poller struct {
+	_epfd     int
+	_wake     [2]int
+	_mu       sync.RWMutex
+	_handlers map[int]*registration
+	_ready    chan *registration
+	_closed   chan bool
+	_once     sync.Once
+	_wg       sync.WaitGroup
+}
+
+//New 创建反应器
+//workers: 工作协程数, 小于等于0时使用CPU数
+//bufferSize: 每个工作协程读缓冲区的大小
+func New(workers, bufferSize int) (*Poller, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	slf := &Poller{
+		_epfd:     epfd,
+		_handlers: make(map[int]*registration),
+		_ready:    make(chan *registration, workers),
+		_closed:   make(chan bool),
+	}
+
+	if err := syscall.Pipe2(slf._wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(slf._wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, slf._wake[0], &ev); err != nil {
+		slf.closeFds()
+		return nil, err
+	}
+
+	slf._wg.Add(workers + 1)
+	go slf.loop()
+	for i := 0; i < workers; i++ {
+		go slf.worker(bufferSize)
+	}
+	return slf, nil
+}
+
+//Add 注册连接, fd必须为非阻塞模式
+func (slf *Poller) Add(fd int, h Handler) error {
+	select {
+	case <-slf._closed:
+		return ErrClosed
+	default:
+	}
+
+	slf._mu.Lock()
+	slf._handlers[fd] = &registration{_fd: fd, _handler: h}
+	slf._mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: readEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(slf._epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		slf._mu.Lock()
+		delete(slf._handlers, fd)
+		slf._mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+//Remove 注销连接, 须在关闭fd之前调用
+func (slf *Poller) Remove(fd int) error {
+	slf._mu.Lock()
+	delete(slf._handlers, fd)
+	slf._mu.Unlock()
+
+	return syscall.EpollCtl(slf._epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+//Resume 把暂停读取的连接交给工作协程处理, 处理完成后重新监听
+//h须为注册时的处理器, 连接已注销或fd已被其他连接复用时返回ErrNotRegistered
+func (slf *Poller) Resume(fd int, h Handler) error {
+	slf._mu.RLock()
+	reg := slf._handlers[fd]
+	slf._mu.RUnlock()
+	if reg == nil || reg._handler != h {
+		return ErrNotRegistered
+	}
+
+	select {
+	case slf._ready <- reg:
+		return nil
+	case <-slf._closed:
+		return ErrClosed
+	}
+}
+
+//Close 关闭反应器, 已注册的连接不会被关闭
+func (slf *Poller) Close() error {
+	slf._once.Do(func() {
+		close(slf._closed)
+		syscall.Write(slf._wake[1], []byte{0})
+		slf._wg.Wait()
+		slf.closeFds()
+	})
+	return nil
+}
+
+func (slf *Poller) closeFds() {
+	syscall.Close(slf._wake[0])
+	syscall.Close(slf._wake[1])
+	syscall.Close(slf._epfd)
+}
+
+//loop 等待事件并分发给工作协程
+func (slf *Poller) loop() {
+	defer slf._wg.Done()
+
+	events := make([]syscall.EpollEvent, maxEvents)
+	for {
+		n, err := syscall.EpollWait(slf._epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == slf._wake[0] {
+				return
+			}
+
+			slf._mu.RLock()
+			reg := slf._handlers[fd]
+			slf._mu.RUnlock()
+			if reg == nil {
+				continue
+			}
+
+			select {
+			case slf._ready <- reg:
+			case <-slf._closed:
+				return
+			}
+		}
+	}
+}
+
+//worker 处理可读的连接
+func (slf *Poller) worker(bufferSize int) {
+	defer slf._wg.Done()
+
+	buf := make([]byte, bufferSize)
+	for {
+		select {
+		case <-slf._closed:
+			return
+		case reg := <-slf._ready:
+			slf.handle(reg, buf)
+		}
+	}
+}
+
+func (slf *Poller) handle(reg *registration, buf []byte) {
+	//fd被复用时遗留的事件可能与新事件同时到达, 同一连接只由一个工作协程处理, 结束后重新监听
+	if !atomic.CompareAndSwapInt32(&reg._busy, 0, 1) {
+		return
+	}
+
+	keep := reg._handler.OnReadable(buf)
+	atomic.StoreInt32(&reg._busy, 0)
+	if !keep {
+		return
+	}
+
+	slf._mu.RLock()
+	current := slf._handlers[reg._fd] == reg
+	slf._mu.RUnlock()
+	if !current {
+		return
+	}
+
+	ev := syscall.EpollEvent{Events: readEvents, Fd: int32(reg._fd)}
+	syscall.EpollCtl(slf._epfd, syscall.EPOLL_CTL_MOD, reg._fd, &ev)
+}
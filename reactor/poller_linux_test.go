@@ -0,0 +1,210 @@
+package reactor
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// collector records everything read from a connection and reports when
+// want bytes have arrived.
+type collector struct {
+	_raw    syscall.RawConn
+	_mu     sync.Mutex
+	_data   []byte
+	_want   int
+	_done   chan bool
+	_active int32
+	_racing bool
+}
+
+func (slf *collector) OnReadable(buf []byte) bool {
+	slf._mu.Lock()
+	slf._active++
+	if slf._active > 1 {
+		slf._racing = true
+	}
+	slf._mu.Unlock()
+
+	n, err := Read(slf._raw, buf)
+
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf._active--
+	if err == syscall.EAGAIN {
+		return true
+	}
+	if err != nil || n == 0 {
+		return false
+	}
+
+	slf._data = append(slf._data, buf[:n]...)
+	if len(slf._data) >= slf._want && slf._done != nil {
+		close(slf._done)
+		slf._done = nil
+	}
+	return true
+}
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	client, err := net.Dial("tcp", lst.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lst.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestPollerRead(t *testing.T) {
+	p, err := New(4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	raw, err := server.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fd int
+	raw.Control(func(s uintptr) { fd = int(s) })
+
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	done := make(chan bool)
+	c := &collector{_raw: raw, _want: len(payload), _done: done}
+	if err := p.Add(fd, c); err != nil {
+		t.Fatal(err)
+	}
+
+	//small worker buffers force many readiness rounds for one connection
+	for i := 0; i < len(payload); i += 1000 {
+		if _, err := client.Write(payload[i : i+1000]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read %d of %d bytes", len(c._data), len(payload))
+	}
+
+	c._mu.Lock()
+	defer c._mu.Unlock()
+	if !bytes.Equal(c._data, payload) {
+		t.Fatal("payload mismatch")
+	}
+	if c._racing {
+		t.Fatal("connection handled by two workers at once")
+	}
+}
+
+func TestPollerRemove(t *testing.T) {
+	p, err := New(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	raw, _ := server.SyscallConn()
+	var fd int
+	raw.Control(func(s uintptr) { fd = int(s) })
+
+	c := &collector{_raw: raw, _want: 1}
+	if err := p.Add(fd, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Remove(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("x"))
+	time.Sleep(50 * time.Millisecond)
+
+	c._mu.Lock()
+	defer c._mu.Unlock()
+	if len(c._data) != 0 {
+		t.Fatal("removed connection still dispatched")
+	}
+}
+
+// pauser stops listening after every read until resumed.
+type pauser struct {
+	_raw   syscall.RawConn
+	_calls chan int
+}
+
+func (slf *pauser) OnReadable(buf []byte) bool {
+	n, _ := Read(slf._raw, buf)
+	slf._calls <- n
+	return false
+}
+
+func TestPollerResume(t *testing.T) {
+	p, err := New(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	raw, _ := server.SyscallConn()
+	var fd int
+	raw.Control(func(s uintptr) { fd = int(s) })
+
+	h := &pauser{_raw: raw, _calls: make(chan int, 4)}
+	if err := p.Add(fd, h); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("x"))
+	if n := <-h._calls; n != 1 {
+		t.Fatalf("first read %d bytes", n)
+	}
+
+	//paused: new data is not dispatched
+	client.Write([]byte("y"))
+	select {
+	case n := <-h._calls:
+		t.Fatalf("paused connection dispatched, read %d bytes", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := p.Resume(fd, &pauser{}); err != ErrNotRegistered {
+		t.Fatalf("resume with another handler: %v", err)
+	}
+	if err := p.Resume(fd, h); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-h._calls:
+		if n != 1 {
+			t.Fatalf("resumed read %d bytes", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed connection not dispatched")
+	}
+}
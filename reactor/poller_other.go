@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+package reactor
+
+import "syscall"
+
+//Poller 非Linux平台不支持事件驱动模式
+type Poller struct{}
+
+//New 非Linux平台始终返回ErrUnsupported
+func New(workers, bufferSize int) (*Poller, error) {
+	return nil, ErrUnsupported
+}
+
+//Read 非Linux平台始终返回ErrUnsupported
+func Read(raw syscall.RawConn, buf []byte) (int, error) {
+	return 0, ErrUnsupported
+}
+
+//Add 注册连接
+func (slf *Poller) Add(fd int, h Handler) error {
+	return ErrUnsupported
+}
+
+//Remove 注销连接
+func (slf *Poller) Remove(fd int) error {
+	return ErrUnsupported
+}
+
+//Resume 恢复读取
+func (slf *Poller) Resume(fd int, h Handler) error {
+	return ErrUnsupported
+}
+
+//Close 关闭反应器
+func (slf *Poller) Close() error {
+	return nil
+}
@@ -0,0 +1,26 @@
+package reactor
+
+import "errors"
+
+const (
+	//defaultBufferSize 工作协程读缓冲区的默认大小
+	defaultBufferSize = 32 * 1024
+	//maxEvents 每次等待返回的最大事件数
+	maxEvents = 256
+)
+
+var (
+	//ErrUnsupported 当前平台不支持事件驱动模式
+	ErrUnsupported = errors.New("reactor: unsupported platform")
+	//ErrClosed 反应器已关闭
+	ErrClosed = errors.New("reactor: closed")
+	//ErrNotRegistered 连接未注册
+	ErrNotRegistered = errors.New("reactor: not registered")
+)
+
+//Handler 连接事件处理器
+type Handler interface {
+	//OnReadable 连接可读时在工作协程中调用, buf为工作协程的读缓冲区, 返回后即被复用
+	//返回false表示不再监听该连接: 连接已关闭, 或者暂停读取, 之后由处理器调用Resume恢复
+	OnReadable(buf []byte) bool
+}
@@ -2,10 +2,14 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/yamakiller/magicMqtt/auth/code"
@@ -13,22 +17,77 @@ import (
 
 	"github.com/yamakiller/magicMqtt/blackboard"
 	"github.com/yamakiller/magicMqtt/common"
+	"github.com/yamakiller/magicMqtt/delayed"
+	"github.com/yamakiller/magicMqtt/ratelimit"
+	"github.com/yamakiller/magicMqtt/reactor"
 	"github.com/yamakiller/magicMqtt/sessions"
+	"github.com/yamakiller/magicMqtt/trace"
 
+	"github.com/yamakiller/magicMqtt/dispatch"
 	"github.com/yamakiller/magicMqtt/encoding"
 	"github.com/yamakiller/magicMqtt/encoding/message"
 	"github.com/yamakiller/magicMqtt/network"
 )
 
+//队列已满时publish消息的处理方式
+const (
+	//fullDrop 直接丢弃
+	fullDrop = iota
+	//fullBlock 阻塞等待, 超时后丢弃
+	fullBlock
+	//fullDisconnect 断开订阅者连接
+	fullDisconnect
+)
+
+//parseFullPolicy 解析队列已满时的处理方式, 默认为丢弃
+func parseFullPolicy(name string) int {
+	switch strings.ToLower(name) {
+	case "block":
+		return fullBlock
+	case "disconnect":
+		return fullDisconnect
+	default:
+		return fullDrop
+	}
+}
+
+const (
+	//defaultWriteBatch 默认每批写入的最大消息数
+	defaultWriteBatch = 64
+	//defaultFullTimeout 未配置超时时block方式的默认等待时间, 慢订阅者不能无限期阻塞发布者
+	defaultFullTimeout = time.Second
+	//autoClientPrefix 服务端分配的客户端ID前缀, 客户端不能使用
+	autoClientPrefix = "$auto-"
+)
+
+var (
+	errConnClosed       = errors.New("connection closed")
+	errQueueFull        = errors.New("connection queue full")
+	errTooManySubs      = errors.New("too many subscriptions")
+	errTooManyWildcards = errors.New("too many wildcard subscriptions")
+)
+
 //NewBrokerConn 创建一个连接器
 func NewBrokerConn() *ConBroker {
 	c := &ConBroker{
 		_keepalive:    blackboard.Instance().Deploy.Keepalive,
 		_queue:        make(chan message.Message, blackboard.Instance().Deploy.MessageQueueSize),
 		_closed:       make(chan bool),
-		_subscription: make(map[string]*common.Subscription),
-		_activity:     time.Now(),
+		_activity:     time.Now().UnixNano(),
 		_state:        network.StateInit,
+		_fullPolicy:   parseFullPolicy(blackboard.Instance().Deploy.QueueFullPolicy),
+		_fullTimeout:  time.Duration(blackboard.Instance().Deploy.QueueFullTimeout) * time.Millisecond,
+		_writeBatch:   blackboard.Instance().Deploy.WriteBatch,
+		_flushLatency: time.Duration(blackboard.Instance().Deploy.FlushLatency) * time.Microsecond,
+		_parse: message.ParseOptions{
+			MaxLength: blackboard.Instance().Deploy.MessageSize,
+			SpoolDir:  blackboard.Instance().Deploy.SpoolDir,
+		},
+		_spoolSize: blackboard.Instance().Deploy.SpoolSize,
+	}
+
+	if c._writeBatch <= 0 {
+		c._writeBatch = defaultWriteBatch
 	}
 
 	if c._keepalive > 0 {
@@ -48,16 +107,36 @@ type ConBroker struct {
 	_reader       *bufio.Reader
 	_writer       *bufio.Writer
 	_session      *sessions.Session
+	_username     string
+	_mountpoint   string
+	_parse        message.ParseOptions
+	_spoolSize    int
+	_limiter      *ratelimit.Limiter
+	_pause        time.Duration
+	_handoff      func()
 	_willMsg      *message.Will
-	_subscription map[string]*common.Subscription
 	_closed       chan bool
 	_connected    bool
 	_cleanSession bool
 	_ping         int
-	_activity     time.Time
+	_activity     int64
+	_overflow     int32
 	_state        network.State
+	_fullPolicy   int
+	_fullTimeout  time.Duration
+	_writeBatch   int
+	_flushLatency time.Duration
 	_once         sync.Once
 	_wg           sync.WaitGroup
+	//事件驱动模式
+	_poller  *reactor.Poller
+	_raw     syscall.RawConn
+	_fd      int
+	_pending []byte
+	_spooled *message.Publish
+	_spoolN  int
+	_wmu     sync.Mutex
+	_writing bool
 }
 
 //WithID 设置ID
@@ -80,6 +159,22 @@ func (slf *ConBroker) GetAddr() string {
 	return slf._addr
 }
 
+//WithMountpoint 设置挂载点, 客户端的所有主题都位于该前缀之下
+//支持%c(client id)与%u(username)占位符
+func (slf *ConBroker) WithMountpoint(mountpoint string) {
+	slf._mountpoint = mountpoint
+}
+
+//GetMountpoint 返回挂载点
+func (slf *ConBroker) GetMountpoint() string {
+	return slf._mountpoint
+}
+
+//WithPayloadLimit 设置监听器的PUBLISH负载长度限制, 0不限制
+func (slf *ConBroker) WithPayloadLimit(limit int) {
+	slf._parse.MaxPayload = limit
+}
+
 //WithSession 设置session对象
 func (slf *ConBroker) WithSession(session *sessions.Session) {
 	slf._session = session
@@ -93,9 +188,27 @@ func (slf *ConBroker) GetSession() *sessions.Session {
 //WithConn 设置连接器关键通信句柄
 func (slf *ConBroker) WithConn(conn io.ReadWriteCloser) {
 	slf._conn = conn
-	slf._reader = bufio.NewReaderSize(slf._conn, blackboard.Instance().Deploy.BufferSize)
+	slf._reader = bufio.NewReaderSize(slf.spoolReader(conn), blackboard.Instance().Deploy.BufferSize)
 	slf._writer = bufio.NewWriterSize(slf._conn, blackboard.Instance().Deploy.BufferSize)
-	slf._state = network.StateConnected
+	slf.setState(network.StateConnected)
+}
+
+//getState 返回连接状态, 读写协程与关闭连接的协程并发访问
+func (slf *ConBroker) getState() network.State {
+	return network.State(atomic.LoadInt32((*int32)(&slf._state)))
+}
+
+func (slf *ConBroker) setState(state network.State) {
+	atomic.StoreInt32((*int32)(&slf._state), int32(state))
+}
+
+//touch 记录连接的最后活动时间, 读写协程与心跳定时器并发访问
+func (slf *ConBroker) touch() {
+	atomic.StoreInt64(&slf._activity, time.Now().UnixNano())
+}
+
+func (slf *ConBroker) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&slf._activity))
 }
 
 func (slf *ConBroker) invalidateTimer() {
@@ -108,15 +221,59 @@ func (slf *ConBroker) invalidateTimer() {
 func (slf *ConBroker) ParseMessage() (message.Message, error) {
 	if slf._keepalive > 0 {
 		if cn, ok := slf._conn.(net.Conn); ok {
-			cn.SetReadDeadline(slf._activity.Add(time.Duration(int(float64(slf._keepalive)*1.5)) * time.Second))
+			cn.SetReadDeadline(slf.lastActivity().Add(time.Duration(int(float64(slf._keepalive)*1.5)) * time.Second))
 		}
 	}
 
-	msg, err := message.Parse(slf._reader, blackboard.Instance().Deploy.MessageSize)
+	msg, err := message.ParseWith(slf._reader, &slf._parse)
 	if err != nil {
+		slf.decodeError(err)
 		return nil, err
 	}
 
+	slf.handleMessage(msg)
+	slf.pauseReading()
+	return msg, nil
+}
+
+//pauseReading 超出速率限制时暂停读取, 客户端的数据积压在TCP缓冲区中
+func (slf *ConBroker) pauseReading() {
+	if slf._pause <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(slf._pause)
+	slf._pause = 0
+	select {
+	case <-timer.C:
+	case <-slf._closed:
+		timer.Stop()
+	}
+	slf.touch()
+}
+
+//decodeError 记录解码错误, 调用者随后关闭连接
+func (slf *ConBroker) decodeError(err error) {
+	switch err.(type) {
+	case *message.ErrMalformed, *message.ErrProtocolViolation, *message.ErrPayloadTooLarge:
+		slf.Warning("Close connection, %s", err.Error())
+	default:
+		slf.Debug("Read error, %s", err.Error())
+	}
+}
+
+//handleMessage 处理客户端发来的消息
+func (slf *ConBroker) handleMessage(msg message.Message) {
+	blackboard.Instance().Tracer.Packet(trace.In, slf.getClientID(), slf._addr, msg)
+
+	//第一个报文必须是CONNECT, 且只能发送一次 [MQTT-3.1.0-1] [MQTT-3.1.0-2]
+	connect := msg.GetType() == encoding.PTypeConnect
+	if connect == slf._connected {
+		slf.Warning("Close connection, protocol violation: unexpected %s", msg.GetTypeAsString())
+		slf.Close()
+		return
+	}
+
 	switch msg.GetType() {
 	case encoding.PTypePublish:
 		slf.onPublish(msg.(*message.Publish))
@@ -153,26 +310,98 @@ func (slf *ConBroker) ParseMessage() (message.Message, error) {
 	}
 
 	slf.invalidateTimer()
-	slf._activity = time.Now()
-	return msg, err
+	slf.touch()
 }
 
 //WriteMessage 写入消息
+//事件驱动模式下应答等报文在共享的工作协程中写入, 不能等待: 队列已满说明客户端不读取数据,
+//标记连接溢出, 由工作协程关闭连接
 func (slf *ConBroker) WriteMessage(msg message.Message) error {
-	slf._queue <- msg
-	return nil
+	var err error
+	if msg.GetType() == encoding.PTypePublish {
+		err = slf.writePublish(msg)
+	} else if slf._poller != nil {
+		select {
+		case slf._queue <- msg:
+		case <-slf._closed:
+			err = errConnClosed
+		default:
+			if atomic.CompareAndSwapInt32(&slf._overflow, 0, 1) {
+				slf.Warning("Queue full, disconnect client not reading")
+			}
+			err = errQueueFull
+		}
+	} else {
+		select {
+		case slf._queue <- msg:
+		case <-slf._closed:
+			err = errConnClosed
+		}
+	}
+
+	if err == nil {
+		slf.wakeWriter()
+	}
+	return err
 }
 
-func (slf *ConBroker) write(msg message.Message) error {
-	slf._activity = time.Now()
-	_, err := message.WriteMessageTo(msg, slf._writer)
-	if err != nil {
-		return err
+//writePublish 写入publish消息, 队列已满时按配置的策略处理
+func (slf *ConBroker) writePublish(msg message.Message) error {
+	select {
+	case slf._queue <- msg:
+		return nil
+	case <-slf._closed:
+		return errConnClosed
+	default:
 	}
 
-	slf.flusher()
-	slf._activity = time.Now()
-	return nil
+	switch slf._fullPolicy {
+	case fullDrop:
+		return errQueueFull
+	case fullDisconnect:
+		slf.Warning("Queue full, disconnect slow client")
+		go slf.Terminate()
+		return errQueueFull
+	}
+
+	timeout := slf._fullTimeout
+	if timeout <= 0 {
+		timeout = defaultFullTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slf._queue <- msg:
+		return nil
+	case <-slf._closed:
+		return errConnClosed
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+//Unsent 返回并清空写队列中尚未写出的消息, 由会话在解除绑定时调用
+func (slf *ConBroker) Unsent() []message.Message {
+	var msgs []message.Message
+	for {
+		select {
+		case msg := <-slf._queue:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+//write 把消息编码到写缓冲区, 由写协程在每批结束时flush
+//负载在编码时已复制到写缓冲区, 写出后释放QoS 0消息的负载
+func (slf *ConBroker) write(msg message.Message) error {
+	out := slf.unmountMessage(msg)
+	blackboard.Instance().Tracer.Packet(trace.Out, slf.getClientID(), slf._addr, out)
+	_, err := message.WriteMessageTo(out, slf._writer)
+	sessions.Delivered(msg)
+	return err
 }
 
 func (slf *ConBroker) flusher() {
@@ -185,21 +414,30 @@ func (slf *ConBroker) flusher() {
 }
 
 func (slf *ConBroker) onConnect(msg *message.Connect) {
-	if slf._connected {
-		slf.Debug("Client is connected")
-		return
-	}
-
 	name := string(msg.UserName)
 	pwd := string(msg.Password)
 	connack := message.SpawnConnackMessage()
 	connack.ReturnCode = 0
 
-	defer func() {
-		if err := slf.WriteMessage(connack); err != nil {
-			slf.Error("Response/connack error, %s", err.Error())
-		}
-	}()
+	//[MQTT-3.1.2-2] [MQTT-3.1.3-8]
+	if msg.Version != 3 && msg.Version != 4 {
+		connack.ReturnCode = 0x01
+	} else if msg.Identifier == "" && !msg.CleanSession {
+		connack.ReturnCode = 0x02
+	} else if strings.HasPrefix(msg.Identifier, autoClientPrefix) {
+		//保留给服务端分配的ID, 避免接管分配给其它连接的会话
+		connack.ReturnCode = 0x02
+	}
+	if connack.ReturnCode != 0 {
+		slf.Debug("Refuse connect version/%d identifier/%q, code %d", msg.Version, msg.Identifier, connack.ReturnCode)
+		slf.refuse(connack)
+		return
+	}
+
+	//[MQTT-3.1.3-6] 空的客户端ID由服务端分配唯一的ID, 不能共用同一个会话
+	if msg.Identifier == "" {
+		msg.Identifier = fmt.Sprintf("%s%x", autoClientPrefix, slf._id)
+	}
 
 	if _, err := blackboard.Instance().Auth.Connect(msg.Identifier, name, pwd); err != nil {
 
@@ -209,68 +447,284 @@ func (slf *ConBroker) onConnect(msg *message.Connect) {
 			connack.ReturnCode = 0x04
 		}
 		slf.Debug("Auth/%s/%s/%s connect fail, %s", msg.Identifier, name, pwd, err.Error())
+		slf.refuse(connack)
 		return
 	}
 
-	if msg.CleanSession {
-		session := blackboard.Instance().Sessions.Get(msg.Identifier)
-		if session != nil {
-			session.DoDisconnect()
-		}
-		session = blackboard.Instance().Sessions.New(msg.Identifier, blackboard.Instance().Deploy.OfflineQueueSize)
-		slf._session = session
-	} else {
-		session, org := blackboard.Instance().Sessions.GetOrNew(msg.Identifier, blackboard.Instance().Deploy.OfflineQueueSize)
-		if org {
-			session.DoDisconnect()
+	var willTopic string
+	if msg.Will != nil {
+		if err := blackboard.Instance().Validator.Topic(msg.Will.Topic); err != nil {
+			slf.Warning("Will topic/%q rejected, %s", msg.Will.Topic, err.Error())
+			slf.Close()
+			return
 		}
-		slf._session = session
-		ts, qos, err := slf._session.Topics()
-		if err != nil {
-			for i, topic := range ts {
-				sub := &common.Subscription{
-					Topic:  topic,
-					Qos:    qos[i],
-					Client: slf._session.GetClientID(),
-				}
 
-				slf._subscription[topic] = sub
-				blackboard.Instance().Topics.Subscribe([]byte(topic), qos[i], sub)
-			}
+		topic, err := blackboard.Instance().Rewriter.Publish(msg.Will.Topic, msg.Identifier, name)
+		if err != nil {
+			slf.Warning("Will topic/%q rewrite error, %s", msg.Will.Topic, err.Error())
+			slf.Close()
+			return
 		}
+		willTopic = topic
+	}
 
-		offlineMessage := slf._session.OfflineMessages()
+	mountpoint, err := slf.mountpoint(msg.Identifier, name)
+	if err != nil {
+		connack.ReturnCode = 0x05
+		slf.Debug("Refuse connect identifier/%q username/%q, mountpoint %s", msg.Identifier, name, err.Error())
+		slf.refuse(connack)
+		return
+	}
 
-		for _, offMsg := range offlineMessage {
-			slf.WriteMessage(offMsg)
+	session, prev := blackboard.Instance().Sessions.Takeover(msg.Identifier,
+		msg.CleanSession,
+		offlineLimit(),
+		slf)
+	if prev != nil && prev != session {
+		//旧会话已被丢弃, 移除其订阅
+		for _, sub := range prev.Subscriptions() {
+			if err := blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub); err != nil {
+				slf.Error("Takeover unsubscribe %s error, %s", sub.Topic, err.Error())
+			}
 		}
+	} else if prev != nil {
+		connack.Reserved = 0x01
 	}
 
-	slf._session.WithOnDisconnect(slf.Terminate)
-	slf._session.WithOnWrite(slf.WriteMessage)
-	slf._session.WithClientID(msg.Identifier)
+	slf._session = session
+	slf._username = name
+	slf._mountpoint = mountpoint
+	slf._parse.MaxPayload = slf.payloadLimit(msg.Identifier, name)
+	//连接建立后才允许负载落盘, 未认证的客户端不能写入磁盘
+	slf._parse.SpoolSize = slf._spoolSize
+	slf._limiter = ratelimit.New(slf.rateLimit(msg.Identifier, name))
 	slf._cleanSession = msg.CleanSession
+	if !msg.CleanSession {
+		session.WithExpiry(slf.sessionExpiry(msg.Identifier, name))
+	}
+	session.WithMaxInflight(blackboard.Instance().Deploy.MaxInflight)
+	session.WithMaxWaiting(blackboard.Instance().Deploy.MaxInflightQueue)
 
 	if msg.Will != nil {
+		msg.Will.Topic = slf.mount(willTopic)
 		slf._willMsg = msg.Will
 	}
 
+	slf.autoSubscribe(msg.Identifier, name)
 	slf._connected = true
+
+	if err := slf.WriteMessage(connack); err != nil {
+		slf.Error("Response/connack error, %s", err.Error())
+		return
+	}
+
+	//重发未确认消息与离线消息, 之后的消息直接写入当前连接
+	if err := session.Attach(slf); err != nil {
+		slf.Debug("Attach session error, %s", err.Error())
+	}
 }
 
-func (slf *ConBroker) onDisconnect(msg *message.Disconnect) {
-	if slf._session != nil {
-		slf._session.WithOnDisconnect(nil)
-		slf._willMsg = nil
+//refuse 写出非0的CONNACK后关闭连接 [MQTT-3.2.2-5]
+//连接尚未建立时队列中没有其它消息, 直接写入连接, 确保关闭前CONNACK已发出
+func (slf *ConBroker) refuse(connack *message.Connack) {
+	blackboard.Instance().Tracer.Packet(trace.Out, slf.getClientID(), slf._addr, connack)
+	if _, err := message.WriteMessageTo(connack, slf._conn); err != nil {
+		slf.Error("Response/connack error, %s", err.Error())
 	}
 	slf.Close()
 }
 
+//offlineLimit 返回配置的离线队列限制
+func offlineLimit() sessions.OfflineLimit {
+	deploy := &blackboard.Instance().Deploy
+	return sessions.OfflineLimit{
+		Count:  deploy.OfflineQueueSize,
+		Bytes:  deploy.OfflineQueueByte,
+		Policy: sessions.ParseOfflinePolicy(deploy.OfflinePolicy),
+		TTL:    time.Duration(deploy.OfflineTTL) * time.Second,
+
+		SpillDir:     deploy.OfflineSpillDir,
+		SpillAfter:   deploy.OfflineSpillMem,
+		SpillSegment: deploy.OfflineSpillSeg,
+		SpoolSize:    deploy.SpoolSize,
+		SpoolDir:     deploy.SpoolDir,
+	}
+}
+
+//sessionExpiry 返回会话过期时间, 授权验证器中的配置优先于全局配置
+//MQTT 3.1.1的CONNECT没有Session Expiry Interval属性, 支持MQTT 5后再由客户端指定
+func (slf *ConBroker) sessionExpiry(clientID, username string) time.Duration {
+	expiry := blackboard.Instance().Deploy.SessionExpiry
+	if v, ok := blackboard.Instance().Auth.SessionExpiry(clientID, username); ok {
+		expiry = v
+	}
+
+	return time.Duration(expiry) * time.Second
+}
+
+//mountpoint 返回客户端的挂载点, 授权验证器中的配置优先于监听器配置
+//非空的挂载点总是以'/'结尾, 避免"t/a"与"t/ab"两个挂载点下的主题互相可见
+func (slf *ConBroker) mountpoint(clientID, username string) (string, error) {
+	mountpoint := slf._mountpoint
+	if v, ok := blackboard.Instance().Auth.Mountpoint(clientID, username); ok {
+		mountpoint = v
+	}
+
+	mountpoint, err := topics.Placeholders(mountpoint, clientID, username)
+	if err != nil {
+		return "", err
+	}
+
+	if mountpoint != "" && !strings.HasSuffix(mountpoint, topics.SEP) {
+		mountpoint += topics.SEP
+	}
+	return mountpoint, nil
+}
+
+//payloadLimit 返回客户端的PUBLISH负载长度限制, 授权验证器中的配置优先于监听器配置
+func (slf *ConBroker) payloadLimit(clientID, username string) int {
+	if v, ok := blackboard.Instance().Auth.PayloadLimit(clientID, username); ok {
+		return v
+	}
+
+	return slf._parse.MaxPayload
+}
+
+//rateLimit 返回客户端的速率限制, 授权验证器中的配置优先于全局配置
+func (slf *ConBroker) rateLimit(clientID, username string) ratelimit.Limit {
+	deploy := &blackboard.Instance().Deploy
+	limit := ratelimit.Limit{
+		Publish:   deploy.RatePublish,
+		Bytes:     deploy.RateBytes,
+		Subscribe: deploy.RateSubscribe,
+		Burst:     deploy.RateBurst,
+		Policy:    deploy.RatePolicy,
+	}
+	if v, ok := blackboard.Instance().Auth.RateLimit(clientID, username); ok {
+		limit = limit.Merge(v)
+	}
+
+	return limit
+}
+
+//throttle 处理超出速率限制的报文, 返回处理方式
+func (slf *ConBroker) throttle(r ratelimit.Result) ratelimit.Action {
+	if r.Action == ratelimit.Pass {
+		return r.Action
+	}
+
+	blackboard.Instance().Throttle.Record(slf.getClientID(), r)
+	switch r.Action {
+	case ratelimit.Delay:
+		if r.Wait > slf._pause {
+			slf._pause = r.Wait
+		}
+		slf.Debug("Rate limit/%s exceeded, pause reading %s", r.Kind, r.Wait)
+	case ratelimit.Drop:
+		slf.Debug("Rate limit/%s exceeded, drop message", r.Kind)
+	case ratelimit.Disconnect:
+		slf.Warning("Close connection, rate limit/%s exceeded", r.Kind)
+		slf.Close()
+	}
+	return r.Action
+}
+
+//spoolReader 负载落盘模式下返回收到数据即延长读超时的reader, 传输大负载期间连接不会因心跳超时被关闭
+func (slf *ConBroker) spoolReader(conn io.ReadWriteCloser) io.Reader {
+	cn, ok := conn.(net.Conn)
+	if !ok || slf._spoolSize <= 0 {
+		return conn
+	}
+
+	return &keepaliveReader{_conn: cn, _broker: slf}
+}
+
+//keepaliveReader 每次读到数据时按心跳间隔延长读超时
+type keepaliveReader struct {
+	_conn   net.Conn
+	_broker *ConBroker
+}
+
+func (slf *keepaliveReader) Read(p []byte) (int, error) {
+	n, err := slf._conn.Read(p)
+	if n > 0 && slf._broker._keepalive > 0 {
+		slf._conn.SetReadDeadline(time.Now().Add(time.Duration(int(float64(slf._broker._keepalive)*1.5)) * time.Second))
+	}
+	return n, err
+}
+
+func (slf *ConBroker) onDisconnect(msg *message.Disconnect) {
+	slf._willMsg = nil
+	slf.Close()
+}
+
+//rewritePublish 按重写规则转换PUBLISH主题
+func (slf *ConBroker) rewritePublish(topic string) (string, error) {
+	return blackboard.Instance().Rewriter.Publish(topic, slf.getClientID(), slf._username)
+}
+
+//rewriteSubscribe 按重写规则转换订阅过滤器
+func (slf *ConBroker) rewriteSubscribe(filter string) (string, error) {
+	return blackboard.Instance().Rewriter.Subscribe(filter, slf.getClientID(), slf._username)
+}
+
+//mount 把客户端可见的主题转换为带挂载点的完整主题
+func (slf *ConBroker) mount(topic string) string {
+	return slf._mountpoint + topic
+}
+
+//mountFilter 把客户端可见的订阅过滤器转换为带挂载点的完整过滤器, 挂载点位于排他前缀之后
+func (slf *ConBroker) mountFilter(filter string) string {
+	if strings.HasPrefix(filter, topics.ExclusivePrefix) {
+		return topics.ExclusivePrefix + slf.mount(filter[len(topics.ExclusivePrefix):])
+	}
+	return slf.mount(filter)
+}
+
+//unmountMessage 发送给客户端的publish消息去掉挂载点
+//消息可能被重发或与其它连接共享, 因此复制后修改
+func (slf *ConBroker) unmountMessage(msg message.Message) message.Message {
+	if slf._mountpoint == "" || msg.GetType() != encoding.PTypePublish {
+		return msg
+	}
+
+	m := msg.(*message.Publish)
+	if !strings.HasPrefix(m.TopicName, slf._mountpoint) {
+		return msg
+	}
+
+	cp := *m
+	cp.TopicName = m.TopicName[len(slf._mountpoint):]
+	cp.WithFrames(nil)
+	return &cp
+}
+
+func (slf *ConBroker) getClientID() string {
+	if session := slf._session; session != nil {
+		return session.GetClientID()
+	}
+	return ""
+}
+
+//onPublish 处理客户端的PUBLISH, 保留、延迟与分发各自持有消息的副本, 返回时释放原消息
 func (slf *ConBroker) onPublish(msg *message.Publish) {
-	//topic := msg.TopicName
+	defer msg.Release()
+
+	action := slf.throttle(slf._limiter.Publish(msg.PayloadSize(), time.Now()))
+	if action == ratelimit.Disconnect {
+		return
+	}
+
+	delay, topic, err := slf.publishTopic(msg.TopicName)
+	if err != nil {
+		//主题超出限制的消息仍然应答, 避免客户端重发, 但不发布
+		//违反协议的主题在解码时已被拒绝
+		slf.Error("Publish topic/%s error, %s", msg.TopicName, err.Error())
+	}
+	msg.TopicName = slf.mount(topic)
+
 	switch byte(msg.QosLevel) {
 	case topics.QosAtMostOnce:
-		slf.procPublish(msg)
 	case topics.QosAtLeastOnce:
 		puback := message.SpawnPubackMessage()
 		puback.PacketIdentifier = msg.PacketIdentifier
@@ -278,7 +732,6 @@ func (slf *ConBroker) onPublish(msg *message.Publish) {
 			slf.Error("Response/puback error, %s", err.Error())
 			return
 		}
-		slf.procPublish(msg)
 	case topics.QosExactlyOnce:
 		pubrec := message.SpawnPubrecMessage()
 		pubrec.PacketIdentifier = msg.PacketIdentifier
@@ -286,84 +739,150 @@ func (slf *ConBroker) onPublish(msg *message.Publish) {
 			slf.Error("Response/pubrec error, %s", err.Error())
 			return
 		}
-		slf.procPublish(msg)
+		//收到PUBREL之前重发的消息只应答, 不再发布
+		if session := slf._session; session != nil && !session.ReceiveQos2(msg.PacketIdentifier) {
+			return
+		}
 	default:
 		slf.Error("publish message qos level error: %d", msg.QosLevel)
 		return
 	}
+
+	//超出速率限制被丢弃的消息同样应答, 避免客户端重发
+	if err != nil || action == ratelimit.Drop {
+		return
+	}
+
+	if delay > 0 {
+		slf.procDelayed(msg, delay)
+		return
+	}
+	slf.procPublish(msg)
+}
+
+//publishTopic 校验并转换客户端的PUBLISH主题, 返回延迟时间与转换后的主题
+func (slf *ConBroker) publishTopic(topic string) (time.Duration, string, error) {
+	if err := blackboard.Instance().Validator.Topic(topic); err != nil {
+		return 0, topic, err
+	}
+
+	rewritten, err := slf.rewritePublish(topic)
+	if err != nil {
+		return 0, topic, err
+	}
+
+	return slf.delayedTopic(rewritten)
+}
+
+//delayedTopic 解析延迟发布主题, 未启用延迟发布时主题保持不变
+func (slf *ConBroker) delayedTopic(topic string) (time.Duration, string, error) {
+	if blackboard.Instance().Delayed == nil {
+		return 0, topic, nil
+	}
+
+	return delayed.Parse(topic)
+}
+
+//procDelayed 把延迟发布的消息交给延迟存储
+func (slf *ConBroker) procDelayed(msg *message.Publish, delay time.Duration) {
+	if _, err := blackboard.Instance().Delayed.Schedule(slf.getClientID(), msg, delay); err != nil {
+		slf.Error("Delayed topic/%s error, %s", msg.TopicName, err.Error())
+	}
 }
 
 func (slf *ConBroker) onPuback(msg *message.Puback) {
 	session := slf._session
 	if session != nil {
-		session.UnRefMessage(msg.PacketIdentifier)
+		if err := session.UnRefMessage(msg.PacketIdentifier); err != nil {
+			slf.Error("Session write error, %s", err.Error())
+		}
 	}
 }
 
+//onPubrec 记录QoS 2消息已被接收, 重新连接时重发PUBREL
 func (slf *ConBroker) onPubrec(msg *message.Pubrec) {
 	ack := message.SpawnPubrelMessage()
 	ack.PacketIdentifier = msg.PacketIdentifier
+	if session := slf._session; session != nil {
+		session.ReceivePubrec(ack)
+	}
 	slf.WriteMessage(ack)
 }
 
+//onPubrel 客户端发来的QoS 2消息完成, PUBREL中是客户端的报文ID, 与发送窗口无关
 func (slf *ConBroker) onPubrel(msg *message.Pubrel) {
-	ack := message.SpawnPubcompMessage()
-	ack.PacketIdentifier = msg.PacketIdentifier
-	slf.WriteMessage(ack)
 	session := slf._session
 	if session != nil {
-		session.UnRefMessage(msg.PacketIdentifier)
+		session.ReleaseQos2(msg.PacketIdentifier)
 	}
+
+	ack := message.SpawnPubcompMessage()
+	ack.PacketIdentifier = msg.PacketIdentifier
+	slf.WriteMessage(ack)
 }
 
 func (slf *ConBroker) onPubcomp(msg *message.Pubcomp) {
 	session := slf._session
 	if session != nil {
-		session.UnRefMessage(msg.PacketIdentifier)
+		if err := session.UnRefMessage(msg.PacketIdentifier); err != nil {
+			slf.Error("Session write error, %s", err.Error())
+		}
 	}
 }
 
 func (slf *ConBroker) onSubscribe(msg *message.Subscribe) {
 	ts := msg.Payload
+	action := slf.throttle(slf._limiter.Subscribe(len(ts), time.Now()))
+	if action == ratelimit.Disconnect {
+		return
+	}
 
 	suback := message.SpawnSubackMessage()
 	suback.PacketIdentifier = msg.PacketIdentifier
 	var retcodes []byte
 	var remsg []*message.Publish
 	for _, topic := range ts {
-		if oldSub, exist := slf._subscription[topic.TopicPath]; exist {
-			blackboard.Instance().Topics.Unsubscribe([]byte(oldSub.Topic), oldSub)
-			delete(slf._subscription, topic.TopicPath)
+		if action == ratelimit.Drop {
+			retcodes = append(retcodes, topics.QosFailure)
+			continue
 		}
 
-		sub := &common.Subscription{
-			Topic:  topic.TopicPath,
-			Qos:    topic.RequestedQos,
-			Client: slf._session.GetClientID(),
+		if err := blackboard.Instance().Validator.Filter(topic.TopicPath); err != nil {
+			slf.Debug("Sub %q rejected, %s", topic.TopicPath, err.Error())
+			retcodes = append(retcodes, topics.QosFailure)
+			continue
 		}
 
-		rqos, err := blackboard.Instance().Topics.Subscribe([]byte(topic.TopicPath),
-			topic.RequestedQos, sub)
+		filter, err := slf.rewriteSubscribe(topic.TopicPath)
 		if err != nil {
-			slf.Error("Sub %s error, %s", topic.TopicPath, err.Error())
+			slf.Debug("Sub %q rejected, %s", topic.TopicPath, err.Error())
 			retcodes = append(retcodes, topics.QosFailure)
 			continue
 		}
 
-		slf._subscription[topic.TopicPath] = sub
-		slf._session.AddTopics(topic.TopicPath, topic.RequestedQos)
+		topic.TopicPath = slf.mountFilter(filter)
+		if err := slf.subscribeLimit(topic.TopicPath); err != nil {
+			slf.Debug("Sub %s rejected, %s", topic.TopicPath, err.Error())
+			retcodes = append(retcodes, topics.QosFailure)
+			continue
+		}
+
+		rqos, retained := slf.subscribe(topic.TopicPath, topic.RequestedQos, false)
 		retcodes = append(retcodes, rqos)
-		blackboard.Instance().Topics.Retained([]byte(topic.TopicPath), &remsg)
+		remsg = append(remsg, retained...)
 	}
 	suback.Qos = retcodes
 	err := slf.WriteMessage(suback)
 	if err != nil {
 		slf.Error("Response sub ack error, %s", err.Error())
+		for _, rm := range remsg {
+			rm.Release()
+		}
 		return
 	}
 
 	for _, rm := range remsg {
-		if err := slf.WriteMessage(rm); err != nil {
+		if err := slf._session.WriteMessage(rm); err != nil {
 			slf.Error("Response/Retained %s error, %s", rm.TopicName, err.Error())
 		} else {
 			slf.Debug("Response/Retained %s success", rm.TopicName)
@@ -371,22 +890,139 @@ func (slf *ConBroker) onSubscribe(msg *message.Subscribe) {
 	}
 }
 
+//subscribe 订阅过滤器并记录到会话, 返回授权的QoS与需要发送的保留消息
+//替换已有订阅时保留其hidden属性, 新订阅失败时保留原有的订阅
+func (slf *ConBroker) subscribe(filter string, qos byte, hidden bool) (byte, []*message.Publish) {
+	oldSub := slf._session.Subscription(filter)
+	if oldSub != nil {
+		hidden = hidden || oldSub.Hidden
+	}
+
+	sub := &common.Subscription{
+		Topic:  filter,
+		Qos:    qos,
+		Client: slf._session.GetClientID(),
+		Hidden: hidden,
+	}
+
+	rqos, err := blackboard.Instance().Topics.Subscribe([]byte(filter), qos, sub)
+	if err == topics.ErrExclusiveTaken {
+		slf.Debug("Sub %s rejected, %s", filter, err.Error())
+		return topics.QosFailure, nil
+	} else if err != nil {
+		slf.Error("Sub %s error, %s", filter, err.Error())
+		return topics.QosFailure, nil
+	}
+
+	//新订阅生效后再移除被替换的订阅, 独占订阅的持有者由主题管理器替换, 期间不释放
+	if oldSub != nil && !strings.HasPrefix(filter, topics.ExclusivePrefix) {
+		blackboard.Instance().Topics.Unsubscribe([]byte(oldSub.Topic), oldSub)
+	}
+	slf._session.AddSubscription(sub)
+
+	//返回的保留消息是调用者持有的副本
+	var retained []*message.Publish
+	blackboard.Instance().Topics.Retained([]byte(filter), &retained)
+	for _, rm := range retained {
+		if rm.QosLevel > int(rqos) {
+			rm.QosLevel = int(rqos)
+		}
+	}
+
+	return rqos, retained
+}
+
+//autoSubscribe 按自动订阅规则订阅, 会话中已存在相同的订阅时跳过
+//保留消息写入会话, 在Attach之后发送
+func (slf *ConBroker) autoSubscribe(clientID, username string) {
+	for _, rule := range blackboard.Instance().Deploy.AutoSubscribe {
+		filter, err := topics.Placeholders(rule.Filter, clientID, username)
+		if err != nil {
+			slf.Error("Auto sub %q error, %s", rule.Filter, err.Error())
+			continue
+		}
+
+		if err := blackboard.Instance().Validator.Filter(filter); err != nil {
+			slf.Error("Auto sub %q error, %s", filter, err.Error())
+			continue
+		}
+
+		filter = slf.mountFilter(filter)
+		if sub := slf._session.Subscription(filter); sub != nil && sub.Qos == rule.Qos && sub.Hidden == rule.Hidden {
+			continue
+		}
+
+		rqos, retained := slf.subscribe(filter, rule.Qos, rule.Hidden)
+		if rqos == topics.QosFailure {
+			continue
+		}
+
+		for _, rm := range retained {
+			if err := slf._session.WriteMessage(rm); err != nil {
+				slf.Error("Auto sub/Retained %s error, %s", rm.TopicName, err.Error())
+			}
+		}
+	}
+}
+
+//subscribeLimit 检查客户端的订阅数限制, 替换已有订阅时不受限制
+func (slf *ConBroker) subscribeLimit(filter string) error {
+	deploy := &blackboard.Instance().Deploy
+	if deploy.MaxSubscriptions <= 0 && deploy.MaxWildcardSubs <= 0 {
+		return nil
+	}
+
+	if slf._session.Subscription(filter) != nil {
+		return nil
+	}
+
+	subs := slf._session.Subscriptions()
+	if deploy.MaxSubscriptions > 0 && len(subs) >= deploy.MaxSubscriptions {
+		return errTooManySubs
+	}
+
+	if deploy.MaxWildcardSubs > 0 && topics.IsWildcard(filter) {
+		n := 0
+		for _, sub := range subs {
+			if topics.IsWildcard(sub.Topic) {
+				n++
+			}
+		}
+
+		if n >= deploy.MaxWildcardSubs {
+			return errTooManyWildcards
+		}
+	}
+
+	return nil
+}
+
 func (slf *ConBroker) onUnSubscribe(msg *message.Unsubscribe) {
 	topics := msg.Payload
 
+	session := slf._session
 	for _, topic := range topics {
-		sub, exist := slf._subscription[topic.TopicPath]
-		if exist {
+		if session == nil {
+			break
+		}
+
+		filter, err := slf.rewriteSubscribe(topic.TopicPath)
+		if err != nil {
+			continue
+		}
+
+		filter = slf.mountFilter(filter)
+		if sub := session.Subscription(filter); sub != nil && sub.Hidden {
+			//自动订阅规则创建的隐藏订阅不能被客户端取消
+			continue
+		}
+
+		if sub := session.RemoveSubscription(filter); sub != nil {
 			blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub)
-			session := slf._session
-			if session != nil {
-				session.RemoveTopics(topic.TopicPath)
-				delete(slf._subscription, topic.TopicPath)
-			}
 		}
 	}
 
-	unsuback := message.SpawnSubackMessage()
+	unsuback := message.SpawnUnsubackMessage()
 	unsuback.PacketIdentifier = msg.PacketIdentifier
 	if err := slf.WriteMessage(unsuback); err != nil {
 		slf.Error("Response unsub ack error, %s", err.Error())
@@ -399,39 +1035,15 @@ func (slf *ConBroker) onPingresp(msg *message.Pingresp) {
 
 func (slf *ConBroker) procPublish(msg *message.Publish) {
 	if msg.Retain > 0 {
-		if err := blackboard.Instance().Topics.Retain(msg); err != nil {
-			slf.Error("Sub topic error, %s", err.Error())
+		err := blackboard.Instance().Topics.Retain(slf.getClientID(), msg)
+		if err == topics.ErrRetainDisabled {
+			slf.Debug("Retain topic/%s rejected, %s", msg.TopicName, err.Error())
+		} else if err != nil {
+			slf.Error("Retain topic/%s error, %s", msg.TopicName, err.Error())
 		}
 	}
 
-	var subs []interface{}
-	var qoss []byte
-
-	err := blackboard.Instance().Topics.Subscribers([]byte(msg.TopicName),
-		byte(msg.QosLevel), &subs, &qoss)
-	if err != nil {
-		slf.Error("Sub topic/%s error, %s", msg.TopicName, err.Error())
-		return
-	}
-
-	if len(subs) == 0 {
-		return
-	}
-
-	for _, sub := range subs {
-		s, ok := sub.(*common.Subscription)
-		if ok {
-			ss := blackboard.Instance().Sessions.Get(s.Client)
-			if ss == nil {
-				slf.Debug("No client/%s associated sessions were found", s.Client)
-				continue
-			}
-
-			if err := ss.WriteMessage(msg); err != nil {
-				slf.Error("Distribution/%+v to client/%s error, %s", msg, s.Client, err.Error())
-			}
-		}
-	}
+	slf.SendPublishMessage(msg)
 }
 
 //Kicker 处理心跳
@@ -444,7 +1056,7 @@ func (slf *ConBroker) Kicker() {
 
 //Ping 发送Ping给客户端
 func (slf *ConBroker) Ping() {
-	if slf._state == network.StateClosed {
+	if slf.getState() == network.StateClosed {
 		return
 	}
 
@@ -458,39 +1070,50 @@ func (slf *ConBroker) Will() {
 	msg.TopicName = will.Topic
 	msg.Payload = []byte(will.Message)
 	msg.QosLevel = int(will.Qos)
+	if will.Retain {
+		msg.Retain = 1
+	}
 	//发送Publish消息
-	slf.SendPublishMessage(msg)
+	slf.procPublish(msg)
 }
 
 //SendPublishMessage 发送publish消息
 func (slf *ConBroker) SendPublishMessage(msg *message.Publish) {
-	var subs []interface{}
-	var qoss []byte
-
-	err := blackboard.Instance().Topics.Subscribers([]byte(msg.TopicName),
-		byte(msg.QosLevel), &subs, &qoss)
+	var err error
+	if slf._poller != nil && !slf.isClosed() {
+		err = slf.publishReactor(msg)
+	} else {
+		err = publishMessage(slf.getClientID(), msg)
+	}
 	if err != nil {
-		slf.Error("Search sub client error, %s", err.Error())
-		return
+		slf.Error("Dispatch topic/%s error, %s", msg.TopicName, err.Error())
 	}
+}
 
-	for _, sub := range subs {
-		if sub != nil {
-
-		}
-		s, ok := sub.(*common.Subscription)
-		if ok {
-			ss := blackboard.Instance().Sessions.Get(s.Client)
-			if ss == nil {
-				slf.Debug("No client/%s associated sessions were found", s.Client)
-				continue
-			}
+//publishReactor 事件驱动模式下提交发布消息, 工作协程不等待分发器队列
+//队列已满时暂停读取, 由独立协程等待提交, 对发布者形成背压
+func (slf *ConBroker) publishReactor(msg *message.Publish) error {
+	d := blackboard.Instance().Dispatcher
+	if d == nil {
+		return publishMessage(slf.getClientID(), msg)
+	}
 
-			if err := ss.WriteMessage(msg); err != nil {
-				slf.Error("Distribution/%+v to client/%s error, %s", msg, s.Client, err.Error())
+	publisher := slf.getClientID()
+	queued := msg.Envelope(msg.QosLevel, msg.Retain > 0)
+	err := d.TryPublish(publisher, queued)
+	if err == dispatch.ErrDispatcherFull {
+		slf._handoff = func() {
+			if err := d.Publish(publisher, queued); err != nil {
+				queued.Release()
+				slf.Error("Dispatch topic/%s error, %s", queued.TopicName, err.Error())
 			}
 		}
+		return nil
+	}
+	if err != nil {
+		queued.Release()
 	}
+	return err
 }
 
 //Terminate 终止连接器
@@ -505,48 +1128,52 @@ func (slf *ConBroker) Close() error {
 	var err error
 	slf._once.Do(func() {
 		slf.Debug("closed connection")
+		slf.setState(network.StateClosed)
+		close(slf._closed)
+		if slf._poller != nil {
+			slf.detachReactor()
+		}
+		err = slf._conn.Close()
+		slf._wg.Wait()
+
+		session := slf._session
+		//会话被其它连接接管时, 订阅与会话由接管者负责
+		//解除绑定时会话在锁内取走写队列中未发送的消息, 排在之后写入的离线消息之前
+		owned := session != nil && session.Detach(slf)
 		if slf._willMsg != nil {
 			slf.Will()
 		}
 
 		if slf._cleanSession {
-			if slf._session != nil {
-				blackboard.Instance().Sessions.Remove(slf._session.GetClientID())
-			} else {
-				slf.Warning("Closing [clean session:true] client unconnect")
-			}
-		} else if slf._session != nil {
-			for msg := range slf._queue {
-				switch msg.GetType() {
-				case encoding.PTypeConnect:
-				case encoding.PTypeDisconnect:
-				case encoding.PTypePingreq:
-				case encoding.PTypePingresp:
-				default:
-					slf._session.PushOfflineMessage(msg)
+			if owned {
+				//开始移除订阅的主题
+				for _, sub := range session.Subscriptions() {
+					if err := blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub); err != nil {
+						slf.Error("Closing unsubscribe error:%s", err.Error())
+					}
 				}
+				blackboard.Instance().Sessions.Release(session)
+			} else if session == nil {
+				slf.Warning("Closing [clean session:true] client unconnect")
 			}
 		}
 
-		slf._state = network.StateClosed
-		slf._closed <- true
-		err = slf._conn.Close()
-		slf._wg.Wait()
-		//开始移除订阅的主题
-		subs := slf._subscription
-		for _, sub := range subs {
-			err = blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub)
-			if err != nil {
-				slf.Error("Closing unsubscribe error:%s", err.Error())
+		//会话已被接管时, 接管后仍写入本连接的消息迁移到会话离线队列, clean session的消息被丢弃
+		for {
+			select {
+			case msg := <-slf._queue:
+				if slf._cleanSession || session == nil || msg.GetType() != encoding.PTypePublish {
+					sessions.Delivered(msg)
+				} else if err := session.PushOfflineMessage(msg); err != nil {
+					slf.Error("Closing push offline message error:%s", err.Error())
+				}
+			default:
+				goto Drained
 			}
 		}
+	Drained:
 
-		close(slf._queue)
-		if slf._session != nil {
-			slf._session.WithOnDisconnect(nil)
-			slf._session.WithOnWrite(nil)
-			slf._session = nil
-		}
+		slf._session = nil
 		slf.Debug("closed connected complate")
 	})
 	return err
@@ -0,0 +1,689 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/auth"
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/common"
+	"github.com/yamakiller/magicMqtt/encoding"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/network"
+	"github.com/yamakiller/magicMqtt/sessions"
+	"github.com/yamakiller/magicMqtt/topics"
+)
+
+//testLog 测试时输出到testing.T
+type testLog struct {
+	_t *testing.T
+}
+
+func (slf *testLog) WithHandle(interface{}) {}
+func (slf *testLog) Info(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Error(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Warning(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Debug(prefix, fmt string, args ...interface{}) {
+	slf._t.Logf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Panic(prefix, fmt string, args ...interface{}) {
+	slf._t.Fatalf(prefix+" "+fmt, args...)
+}
+func (slf *testLog) Close() {}
+
+//testBoard 重置黑板, 使用内存主题与默认配置
+func testBoard(t *testing.T) *blackboard.Board {
+	bb := blackboard.Instance()
+	bb.Log = &testLog{_t: t}
+	bb.Deploy = blackboard.Config{}
+	bb.Sessions = sessions.NewGroup()
+	bb.Topics, _ = topics.NewManager("mem")
+	bb.Rewriter = nil
+	bb.Validator = nil
+	return bb
+}
+
+//testClient 创建一个已连接的客户端, 测试结束时取消它的所有订阅
+func testClient(t *testing.T, clientID string) *ConBroker {
+	c := testConn(nil)
+	session, _ := blackboard.Instance().Sessions.Takeover(clientID, false, sessions.OfflineLimit{}, c)
+	c._session = session
+	if err := session.Attach(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, sub := range session.Subscriptions() {
+			blackboard.Instance().Topics.Unsubscribe([]byte(sub.Topic), sub)
+		}
+	})
+	return c
+}
+
+//subscribers 返回匹配topic的订阅
+func subscribers(t *testing.T, topic string) []*common.Subscription {
+	var subs []*common.Subscription
+	var qoss []byte
+	if err := blackboard.Instance().Topics.Subscribers([]byte(topic), 0, &subs, &qoss); err != nil {
+		t.Fatal(err)
+	}
+	return subs
+}
+
+//testConn 不经过网络的连接, 写入的消息留在队列中
+func testConn(session *sessions.Session) *ConBroker {
+	return &ConBroker{
+		_queue:     make(chan message.Message, 64),
+		_closed:    make(chan bool),
+		_state:     network.StateConnected,
+		_session:   session,
+		_connected: true,
+	}
+}
+
+func TestAckPaths(t *testing.T) {
+	group := sessions.NewGroup()
+	c := testConn(nil)
+	session, _ := group.Takeover("c1", false, sessions.OfflineLimit{}, c)
+	c._session = session
+	session.WithMaxInflight(2)
+	if err := session.Attach(c); err != nil {
+		t.Fatal(err)
+	}
+
+	qos := []int{1, 2}
+	var out []*message.Publish
+	for _, q := range qos {
+		p := message.SpawnPublishMessage()
+		p.TopicName = "t"
+		p.QosLevel = q
+		session.WriteMessage(p)
+		out = append(out, (<-c._queue).(*message.Publish))
+	}
+
+	//客户端发来的QoS 2消息使用与发送窗口相同的ID, PUBREL不能释放发送窗口
+	in := message.SpawnPubrelMessage()
+	in.PacketIdentifier = out[0].PacketIdentifier
+	c.onPubrel(in)
+	if ack := <-c._queue; ack.GetType() != encoding.PTypePubcomp {
+		t.Fatalf("pubrel answered with %s", ack.GetTypeAsString())
+	}
+	if session.Inflight() != 2 {
+		t.Fatalf("inflight %d after inbound PUBREL", session.Inflight())
+	}
+
+	puback := message.SpawnPubackMessage()
+	puback.PacketIdentifier = out[0].PacketIdentifier
+	c.onPuback(puback)
+
+	pubrec := message.SpawnPubrecMessage()
+	pubrec.PacketIdentifier = out[1].PacketIdentifier
+	c.onPubrec(pubrec)
+	if ack := <-c._queue; ack.GetType() != encoding.PTypePubrel {
+		t.Fatalf("pubrec answered with %s", ack.GetTypeAsString())
+	}
+	if session.Inflight() != 1 {
+		t.Fatalf("inflight %d before PUBCOMP", session.Inflight())
+	}
+
+	pubcomp := message.SpawnPubcompMessage()
+	pubcomp.PacketIdentifier = out[1].PacketIdentifier
+	c.onPubcomp(pubcomp)
+	if session.Inflight() != 0 {
+		t.Fatalf("inflight %d after PUBCOMP", session.Inflight())
+	}
+}
+
+func TestAutoSubscribePlaceholders(t *testing.T) {
+	bb := testBoard(t)
+	bb.Deploy.AutoSubscribe = []topics.AutoSubscribe{{Filter: "cmd/%c", Qos: 1, Hidden: true}}
+
+	//客户端ID包含通配符时不展开规则, 否则会得到客户端无法取消的cmd/#
+	for _, id := range []string{"#", "+", "a/b"} {
+		c := testClient(t, id)
+		c.autoSubscribe(id, "")
+		if subs := c._session.Subscriptions(); len(subs) != 0 {
+			t.Fatalf("client %q subscribed %+v", id, subs)
+		}
+	}
+	if subs := subscribers(t, "cmd/other"); len(subs) != 0 {
+		t.Fatalf("cmd/other subscribers %+v", subs)
+	}
+
+	c := testClient(t, "dev1")
+	c.autoSubscribe("dev1", "")
+	if subs := subscribers(t, "cmd/dev1"); len(subs) != 1 || !subs[0].Hidden {
+		t.Fatalf("cmd/dev1 subscribers %+v", subs)
+	}
+
+	unsub := message.SpawnUnsubscribeMessage()
+	unsub.Payload = []message.SubscribePayload{{TopicPath: "cmd/dev1"}}
+	c.onUnSubscribe(unsub)
+	<-c._queue
+	if subs := subscribers(t, "cmd/dev1"); len(subs) != 1 {
+		t.Fatal("hidden subscription removed by client")
+	}
+}
+
+func TestMountpointIsolation(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+
+	mounted := func(clientID string) *ConBroker {
+		c := testClient(t, clientID)
+		c.WithMountpoint("t/%c")
+		mountpoint, err := c.mountpoint(clientID, "")
+		if err != nil {
+			t.Fatalf("client %q: %v", clientID, err)
+		}
+		c.WithMountpoint(mountpoint)
+		return c
+	}
+
+	for _, id := range []string{"+", "#", "x/y", ""} {
+		c := testConn(nil)
+		c.WithMountpoint("t/%c")
+		if mountpoint, err := c.mountpoint(id, ""); err != topics.ErrUnsafePlaceholder {
+			t.Fatalf("client %q mountpoint %q, %v", id, mountpoint, err)
+		}
+	}
+
+	a, ab := mounted("a"), mounted("ab")
+	if a.GetMountpoint() != "t/a/" {
+		t.Fatalf("mountpoint %q", a.GetMountpoint())
+	}
+
+	sub := message.SpawnSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []message.SubscribePayload{{TopicPath: "#"}}
+	ab.onSubscribe(sub)
+	<-ab._queue
+
+	//"a"的主题"b/x"不能落到"ab"的挂载点下
+	topic := a.mount("b/x")
+	if topic != "t/a/b/x" {
+		t.Fatalf("mounted topic %q", topic)
+	}
+	if subs := subscribers(t, topic); len(subs) != 0 {
+		t.Fatalf("%s subscribers %+v", topic, subs)
+	}
+	if subs := subscribers(t, ab.mount("x")); len(subs) != 1 || subs[0].Client != "ab" {
+		t.Fatalf("t/ab/x subscribers %+v", subs)
+	}
+}
+
+func TestQueueFullPolicy(t *testing.T) {
+	if parseFullPolicy("") != fullDrop || parseFullPolicy("Block") != fullBlock {
+		t.Fatal("default queue full policy is not drop")
+	}
+
+	c := testConn(nil)
+	c._queue = make(chan message.Message, 1)
+	if err := c.writePublish(message.SpawnPublishMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writePublish(message.SpawnPublishMessage()); err != errQueueFull {
+		t.Fatalf("drop: %v", err)
+	}
+
+	c._fullPolicy = fullBlock
+	c._fullTimeout = 10 * time.Millisecond
+	start := time.Now()
+	if err := c.writePublish(message.SpawnPublishMessage()); err != errQueueFull || time.Since(start) < c._fullTimeout {
+		t.Fatalf("block: %v after %s", err, time.Since(start))
+	}
+}
+
+//testPipe 记录写入数据的连接
+type testPipe struct {
+	bytes.Buffer
+	_closed bool
+}
+
+func (slf *testPipe) Close() error {
+	slf._closed = true
+	return nil
+}
+
+func TestConnectRefused(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+
+	cases := []struct {
+		version  byte
+		clientID string
+		clean    bool
+		code     byte
+	}{
+		{5, "c1", true, 0x01},
+		{4, "", false, 0x02},
+	}
+	for _, v := range cases {
+		pipe := &testPipe{}
+		c := testConn(nil)
+		c._session, c._connected, c._state = nil, false, network.StateConnecting
+		c.WithConn(pipe)
+
+		connect := message.SpawnConnectMessage()
+		connect.Version = v.version
+		connect.Identifier = v.clientID
+		connect.CleanSession = v.clean
+		c.onConnect(connect)
+
+		//拒绝后CONNACK已写出, 连接被关闭
+		msg, err := message.Parse(&pipe.Buffer, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack, ok := msg.(*message.Connack); !ok || ack.ReturnCode != v.code {
+			t.Fatalf("version %d: %+v", v.version, msg)
+		}
+		if !pipe._closed || !c.isClosed() || c._connected {
+			t.Fatalf("version %d: connection kept open", v.version)
+		}
+	}
+}
+
+func TestEmptyClientID(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+
+	var conns []*ConBroker
+	for i := 1; i <= 2; i++ {
+		c := testConn(nil)
+		c._session, c._connected, c._state = nil, false, network.StateConnecting
+		c.WithID(int64(i))
+		connect := message.SpawnConnectMessage()
+		connect.Version = 4
+		connect.CleanSession = true
+		c.onConnect(connect)
+		if ack := (<-c._queue).(*message.Connack); ack.ReturnCode != 0 || ack.Reserved != 0 {
+			t.Fatalf("connack %+v", ack)
+		}
+		conns = append(conns, c)
+	}
+
+	//[MQTT-3.1.3-6] 每个连接分配唯一的客户端ID, 不会接管其它连接的会话
+	a, b := conns[0]._session, conns[1]._session
+	if a == b || a.GetClientID() == "" || a.GetClientID() == b.GetClientID() {
+		t.Fatalf("client ids %q and %q", a.GetClientID(), b.GetClientID())
+	}
+
+	//客户端不能使用分配ID的前缀, 否则可以接管分配给其它连接的会话
+	pipe := &testPipe{}
+	c := testConn(nil)
+	c._session, c._connected, c._state = nil, false, network.StateConnecting
+	c.WithConn(pipe)
+	connect := message.SpawnConnectMessage()
+	connect.Version = 4
+	connect.Identifier = a.GetClientID()
+	connect.CleanSession = true
+	c.onConnect(connect)
+	msg, err := message.Parse(&pipe.Buffer, 0)
+	if ack, ok := msg.(*message.Connack); err != nil || !ok || ack.ReturnCode != 0x02 {
+		t.Fatalf("reserved client id connack %+v, %v", msg, err)
+	}
+	if bb.Sessions.Get(a.GetClientID()) != a {
+		t.Fatal("reserved client id took over the session")
+	}
+}
+
+func TestSpoolBeforeConnect(t *testing.T) {
+	testBoard(t)
+	dir := t.TempDir()
+
+	pub := message.SpawnPublishMessage()
+	pub.TopicName = "a"
+	pub.Payload = make([]byte, 4096)
+	data, _ := message.Encode(nil, pub)
+	pipe := &testPipe{}
+	pipe.Write(data)
+
+	c := testConn(nil)
+	c._session, c._connected, c._state = nil, false, network.StateConnecting
+	c._spoolSize = 1024
+	c._parse.SpoolDir = dir
+	c.WithConn(pipe)
+
+	//CONNECT之前的PUBLISH不落盘, 连接被关闭
+	c.ParseMessage()
+	if !c.isClosed() {
+		t.Fatal("publish before connect accepted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d payloads spooled before connect", len(files))
+	}
+}
+
+func TestSpoolReleased(t *testing.T) {
+	testBoard(t)
+	dir := t.TempDir()
+	s0, s1 := testClient(t, "s0"), testClient(t, "s1")
+	s0.subscribe("big", 0, false)
+	s1.subscribe("big", 1, false)
+	for _, c := range []*ConBroker{s0, s1} {
+		c._writer = bufio.NewWriter(ioutil.Discard)
+	}
+
+	spool, err := message.NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Write(make([]byte, 4096))
+	pub := message.SpawnPublishMessage()
+	pub.TopicName = "big"
+	pub.QosLevel = 1
+	pub.PacketIdentifier = 1
+	pub.WithSpool(spool)
+
+	spooled := func() int {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files)
+	}
+
+	//发布者处理完后释放原消息, 订阅者的副本仍持有负载
+	testClient(t, "p").onPublish(pub)
+	if n := spooled(); n != 1 {
+		t.Fatalf("%d spool files after publish", n)
+	}
+
+	//QoS 0副本写出后释放
+	if err := s0.write(<-s0._queue); err != nil {
+		t.Fatal(err)
+	}
+	if n := spooled(); n != 1 {
+		t.Fatalf("%d spool files after qos 0 write", n)
+	}
+
+	//QoS 1副本在确认后释放, 最后一个引用释放后删除文件
+	out := (<-s1._queue).(*message.Publish)
+	if err := s1.write(out); err != nil {
+		t.Fatal(err)
+	}
+	if n := spooled(); n != 1 {
+		t.Fatalf("%d spool files before puback", n)
+	}
+	puback := message.SpawnPubackMessage()
+	puback.PacketIdentifier = out.PacketIdentifier
+	s1.onPuback(puback)
+	if n := spooled(); n != 0 {
+		t.Fatalf("%d spool files after puback", n)
+	}
+}
+
+func TestReactorConnectHandoff(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+
+	connect := message.SpawnConnectMessage()
+	connect.Identifier = "c1"
+	connect.CleanSession = true
+	data, _ := message.Encode(nil, connect)
+	ping, _ := message.Encode(nil, message.SpawnPingrespMessage())
+
+	c := testConn(nil)
+	c._session, c._connected, c._state = nil, false, network.StateConnecting
+
+	//CONNECT不在工作协程中处理, 之后的报文等待CONNECT处理完成
+	used, err := c.decodeMessages(append(data, ping...))
+	if err != nil || used != len(data) || c._handoff == nil || c._connected {
+		t.Fatalf("used %d of %d, %v, connected %v", used, len(data), err, c._connected)
+	}
+
+	handle := c._handoff
+	c._handoff = nil
+	handle()
+	if !c._connected || c._session == nil {
+		t.Fatal("connect not handled")
+	}
+	if used, err := c.decodeMessages(ping); err != nil || used != len(ping) || c._ping != 1 {
+		t.Fatalf("used %d, %v, ping %d", used, err, c._ping)
+	}
+	blackboard.Instance().Sessions.Release(c._session)
+}
+
+//expiryAuth 为client "device"单独配置会话过期时间
+type expiryAuth struct {
+	auth.Mock
+}
+
+func (slf *expiryAuth) SessionExpiry(clientID, username string) (int, bool) {
+	if clientID == "device" {
+		return 3600, true
+	}
+	return 0, false
+}
+
+func TestSessionExpiryOverride(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth = &expiryAuth{}
+	bb.Deploy.SessionExpiry = 60
+
+	//授权验证器中的配置优先于全局配置
+	for clientID, want := range map[string]time.Duration{
+		"device": time.Hour,
+		"other":  time.Minute,
+	} {
+		connect := message.SpawnConnectMessage()
+		connect.Identifier = clientID
+		data, _ := message.Encode(nil, connect)
+
+		c := testConn(nil)
+		c._session, c._connected, c._state = nil, false, network.StateConnecting
+		if _, err := c.decodeMessages(data); err != nil || c._handoff == nil {
+			t.Fatalf("%s: %v", clientID, err)
+		}
+		c._handoff()
+		if c._session == nil || c._session.GetExpiry() != want {
+			t.Fatalf("%s: session %v", clientID, c._session)
+		}
+		bb.Sessions.Release(c._session)
+	}
+}
+
+//subscribeAck 通过SUBSCRIBE报文订阅filter, 返回SUBACK中的返回码
+func subscribeAck(t *testing.T, c *ConBroker, filter string) byte {
+	sub := message.SpawnSubscribeMessage()
+	sub.PacketIdentifier = 1
+	sub.Payload = []message.SubscribePayload{{TopicPath: filter, RequestedQos: 1}}
+	c.onSubscribe(sub)
+	ack, ok := (<-c._queue).(*message.Suback)
+	if !ok || len(ack.Qos) != 1 {
+		t.Fatalf("subscribe %s: %+v", filter, ack)
+	}
+	return ack.Qos[0]
+}
+
+func TestExclusiveSubscribe(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+	const filter = topics.ExclusivePrefix + "jobs/+"
+
+	a, b := testClient(t, "a"), testClient(t, "b")
+	a._cleanSession = true
+	a.WithConn(&testPipe{})
+
+	//第一个订阅者获得独占订阅, 其它客户端被拒绝, 持有者可以重复订阅
+	if code := subscribeAck(t, a, filter); code != 1 {
+		t.Fatalf("first subscriber got %#x", code)
+	}
+	if code := subscribeAck(t, b, filter); code != topics.QosFailure {
+		t.Fatalf("second subscriber got %#x", code)
+	}
+	if code := subscribeAck(t, a, filter); code != 1 {
+		t.Fatalf("holder resubscribe got %#x", code)
+	}
+	if subs := subscribers(t, "jobs/1"); len(subs) != 1 || subs[0].Client != "a" {
+		t.Fatalf("jobs/1 subscribers %+v", subs)
+	}
+
+	//取消订阅后释放
+	unsub := message.SpawnUnsubscribeMessage()
+	unsub.PacketIdentifier = 2
+	unsub.Payload = []message.SubscribePayload{{TopicPath: filter}}
+	a.onUnSubscribe(unsub)
+	<-a._queue
+	if code := subscribeAck(t, b, filter); code != 1 {
+		t.Fatalf("subscribe after unsubscribe got %#x", code)
+	}
+	if code := subscribeAck(t, a, filter); code != topics.QosFailure {
+		t.Fatalf("previous holder got %#x", code)
+	}
+
+	//会话结束后释放
+	b._cleanSession = true
+	b.WithConn(&testPipe{})
+	b.Close()
+	if code := subscribeAck(t, a, filter); code != 1 {
+		t.Fatalf("subscribe after session end got %#x", code)
+	}
+	a.Close()
+	if subs := subscribers(t, "jobs/1"); len(subs) != 0 {
+		t.Fatalf("jobs/1 subscribers %+v after close", subs)
+	}
+}
+
+func TestSubscribeLimits(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+	bb.Validator = &topics.Validator{MaxLength: 16, MaxLevels: 3}
+	bb.Deploy.MaxSubscriptions = 3
+	bb.Deploy.MaxWildcardSubs = 1
+	c := testClient(t, "c1")
+
+	for _, v := range []struct {
+		filter string
+		code   byte
+	}{
+		//超过长度与层级限制的过滤器被拒绝
+		{"limits/too/long/filter", topics.QosFailure},
+		{"l/a/b/c", topics.QosFailure},
+		{"l/a/#", 1},
+		//通配符订阅数限制, 替换已有订阅不受限制
+		{"l/+", topics.QosFailure},
+		{"l/a/#", 1},
+		{"l/a", 1},
+		{"l/b", 1},
+		//订阅数限制
+		{"l/c", topics.QosFailure},
+	} {
+		if code := subscribeAck(t, c, v.filter); code != v.code {
+			t.Fatalf("subscribe %s got %#x, want %#x", v.filter, code, v.code)
+		}
+	}
+	if n := len(c._session.Subscriptions()); n != 3 {
+		t.Fatalf("%d subscriptions", n)
+	}
+}
+
+func TestPublishTopicLimit(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+	bb.Validator = &topics.Validator{MaxLength: 16}
+	sub := testClient(t, "sub")
+	subscribeAck(t, sub, "#")
+
+	//超过配置的长度限制时应答但不发布, 连接保持
+	c := testClient(t, "pub")
+	c.WithConn(&testPipe{})
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = "limits/too/long/topic"
+	msg.QosLevel = 1
+	msg.PacketIdentifier = 1
+	c.onPublish(msg)
+	if c.isClosed() {
+		t.Fatal("connection closed on a too long topic")
+	}
+	if ack := <-c._queue; ack.GetType() != encoding.PTypePuback {
+		t.Fatalf("too long topic answered with %s", ack.GetTypeAsString())
+	}
+	if len(sub._queue) != 0 {
+		t.Fatal("too long topic published")
+	}
+}
+
+func TestExclusiveResubscribe(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+	const filter = topics.ExclusivePrefix + "leader"
+
+	a, b := testClient(t, "a"), testClient(t, "b")
+	if code := subscribeAck(t, a, filter); code != 1 {
+		t.Fatalf("first subscriber got %#x", code)
+	}
+
+	//持有者修改QoS重新订阅时不释放独占订阅
+	sub := message.SpawnSubscribeMessage()
+	sub.PacketIdentifier = 2
+	sub.Payload = []message.SubscribePayload{{TopicPath: filter, RequestedQos: 2}}
+	a.onSubscribe(sub)
+	if ack := (<-a._queue).(*message.Suback); len(ack.Qos) != 1 || ack.Qos[0] != 2 {
+		t.Fatalf("resubscribe got %+v", ack.Qos)
+	}
+	if code := subscribeAck(t, b, filter); code != topics.QosFailure {
+		t.Fatalf("second subscriber got %#x", code)
+	}
+
+	//重新订阅失败时保留原有的订阅
+	sub.Payload = []message.SubscribePayload{{TopicPath: filter, RequestedQos: 3}}
+	a.onSubscribe(sub)
+	if ack := (<-a._queue).(*message.Suback); len(ack.Qos) != 1 || ack.Qos[0] != topics.QosFailure {
+		t.Fatalf("invalid resubscribe got %+v", ack.Qos)
+	}
+	if code := subscribeAck(t, b, filter); code != topics.QosFailure {
+		t.Fatalf("subscriber after failed resubscribe got %#x", code)
+	}
+
+	subs := subscribers(t, "leader")
+	if len(subs) != 1 || subs[0].Client != "a" || subs[0].Qos != 2 || subs[0] != a._session.Subscription(filter) {
+		t.Fatalf("leader subscribers %+v", subs)
+	}
+}
+
+func TestTakeoverMovesQueued(t *testing.T) {
+	bb := testBoard(t)
+	limit := sessions.OfflineLimit{Count: 10}
+
+	old := testConn(nil)
+	old.WithConn(&testPipe{})
+	session, _ := bb.Sessions.Takeover("c1", false, limit, old)
+	old._session = session
+	if err := session.Attach(old); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"a", "b"} {
+		msg := message.SpawnPublishMessage()
+		msg.TopicName = topic
+		session.WriteMessage(msg)
+	}
+
+	//旧连接队列中未写出的消息转入持久会话的离线队列, 由新连接收到
+	c := testConn(nil)
+	resumed, prev := bb.Sessions.Takeover("c1", false, limit, c)
+	if resumed != session || prev != session || !old.isClosed() {
+		t.Fatal("persistent session not taken over")
+	}
+	c._session = resumed
+	if err := resumed.Attach(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case msg := <-c._queue:
+			if p, ok := msg.(*message.Publish); !ok || p.TopicName != want {
+				t.Fatalf("got %+v, want %s", msg, want)
+			}
+		default:
+			t.Fatalf("%s not moved to the new connection", want)
+		}
+	}
+	bb.Sessions.Release(resumed)
+}
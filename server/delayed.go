@@ -0,0 +1,33 @@
+package server
+
+import (
+	"time"
+
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/delayed"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const delayedPrefix = "mqtt@delayed"
+
+//NewDelayed 创建延迟消息存储, 到期的消息按正常的publish流程发布
+func NewDelayed(dir string, maxDelay time.Duration, maxPending int) (*delayed.Store, error) {
+	deploy := blackboard.Instance().Deploy
+	spool := message.ParseOptions{SpoolSize: deploy.SpoolSize, SpoolDir: deploy.SpoolDir}
+	return delayed.New(dir, maxDelay, maxPending, spool, releaseDelayed)
+}
+
+//releaseDelayed 发布到期的延迟消息, 发布后释放消息
+func releaseDelayed(publisher string, msg *message.Publish) {
+	defer msg.Release()
+
+	if msg.Retain > 0 {
+		if err := blackboard.Instance().Topics.Retain(publisher, msg); err != nil {
+			blackboard.Instance().Log.Error(delayedPrefix, "Retain topic/%s error, %s", msg.TopicName, err.Error())
+		}
+	}
+
+	if err := publishMessage(publisher, msg); err != nil {
+		blackboard.Instance().Log.Error(delayedPrefix, "Dispatch topic/%s error, %s", msg.TopicName, err.Error())
+	}
+}
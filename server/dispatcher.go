@@ -0,0 +1,103 @@
+package server
+
+import (
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/common"
+	"github.com/yamakiller/magicMqtt/dispatch"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const dispatchPrefix = "mqtt@dispatch"
+
+//NewDispatcher 创建publish分发器
+func NewDispatcher(shards, queueSize int) *dispatch.Dispatcher {
+	return dispatch.New(shards, queueSize, matchQueued, deliverMessage)
+}
+
+//publishMessage 发布消息到所有订阅者, 调用者仍持有msg
+//配置了分发器时异步匹配与投递, 排队的是持有负载引用的副本, 否则在当前协程中完成
+func publishMessage(publisher string, msg *message.Publish) error {
+	if d := blackboard.Instance().Dispatcher; d != nil {
+		queued := msg.Envelope(msg.QosLevel, msg.Retain > 0)
+		if err := d.Publish(publisher, queued); err != nil {
+			queued.Release()
+			return err
+		}
+		return nil
+	}
+
+	for _, t := range matchSubscribers(msg) {
+		deliverMessage(t.Client, t.Msg)
+	}
+	return nil
+}
+
+//matchQueued 匹配分发器队列中的消息, 匹配后释放排队的副本
+func matchQueued(msg *message.Publish) []dispatch.Target {
+	targets := matchSubscribers(msg)
+	msg.Release()
+	return targets
+}
+
+//matchSubscribers 匹配订阅者
+//每个订阅者收到独立的消息副本, QoS为发布QoS与订阅授权QoS中的较小值,
+//同一客户端的多个订阅匹配时只投递一次, 使用其中最大的QoS
+func matchSubscribers(msg *message.Publish) []dispatch.Target {
+	var subs []*common.Subscription
+	var qoss []byte
+
+	err := blackboard.Instance().Topics.Subscribers([]byte(msg.TopicName),
+		byte(msg.QosLevel), &subs, &qoss)
+	if err != nil {
+		blackboard.Instance().Log.Error(dispatchPrefix, "Sub topic/%s error, %s", msg.TopicName, err.Error())
+		return nil
+	}
+
+	if len(subs) == 0 {
+		return nil
+	}
+
+	targets := make(map[string]byte, len(subs))
+	var clients []string
+	for i, s := range subs {
+		qos, exist := targets[s.Client]
+		if !exist {
+			clients = append(clients, s.Client)
+		}
+		if !exist || qoss[i] > qos {
+			targets[s.Client] = qoss[i]
+		}
+	}
+
+	//多个订阅者共享编码后的报文, 落盘的负载直接从文件写出
+	var frames *message.Frames
+	if len(clients) > 1 && msg.Spool() == nil {
+		frames = message.NewFrames()
+	}
+
+	result := make([]dispatch.Target, len(clients))
+	for i, client := range clients {
+		env := msg.Envelope(int(targets[client]), false)
+		env.WithFrames(frames)
+		result[i] = dispatch.Target{
+			Client: client,
+			Msg:    env,
+		}
+	}
+
+	return result
+}
+
+//deliverMessage 投递消息到订阅者会话, 会话持有投递的消息
+func deliverMessage(client string, msg *message.Publish) {
+	ss := blackboard.Instance().Sessions.Get(client)
+	if ss == nil {
+		blackboard.Instance().Log.Debug(dispatchPrefix, "No client/%s associated sessions were found", client)
+		msg.Release()
+		return
+	}
+
+	if err := ss.WriteMessage(msg); err != nil {
+		blackboard.Instance().Log.Error(dispatchPrefix, "Distribution/%s to client/%s error, %s", msg.TopicName, client, err.Error())
+	}
+}
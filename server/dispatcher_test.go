@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/common"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+//subscribe 为客户端添加一个订阅
+func subscribe(t *testing.T, c *ConBroker, filter string, qos byte) {
+	sub := &common.Subscription{Client: c.getClientID(), Topic: filter, Qos: qos}
+	if _, err := blackboard.Instance().Topics.Subscribe([]byte(filter), qos, sub); err != nil {
+		t.Fatal(err)
+	}
+	c._session.AddSubscription(sub)
+}
+
+func TestMatchSubscribersQos(t *testing.T) {
+	testBoard(t)
+	subscribe(t, testClient(t, "q0"), "match/qos", 0)
+	subscribe(t, testClient(t, "q2"), "match/qos", 2)
+	both := testClient(t, "both")
+	subscribe(t, both, "match/+", 0)
+	subscribe(t, both, "match/#", 1)
+
+	for _, pubQos := range []int{0, 1, 2} {
+		msg := message.SpawnPublishMessage()
+		msg.TopicName = "match/qos"
+		msg.QosLevel = pubQos
+		msg.Retain = 1
+		msg.Payload = []byte("x")
+
+		//QoS取发布QoS与授权QoS中的较小值, 同一客户端取匹配订阅中最大的授权QoS
+		want := map[string]int{"q0": 0, "q2": pubQos, "both": pubQos}
+		if pubQos > 1 {
+			want["both"] = 1
+		}
+		targets := matchSubscribers(msg)
+		if len(targets) != len(want) {
+			t.Fatalf("qos %d: %d targets", pubQos, len(targets))
+		}
+		for _, target := range targets {
+			env := target.Msg
+			if env == msg || env.QosLevel != want[target.Client] || env.Retain != 0 ||
+				string(env.Payload) != "x" {
+				t.Errorf("qos %d: %s got qos %d retain %d", pubQos, target.Client, env.QosLevel, env.Retain)
+			}
+			env.Release()
+		}
+	}
+}
+
+func TestDeliverPacketIDs(t *testing.T) {
+	bb := testBoard(t)
+	bb.Dispatcher = nil
+	a := testClient(t, "a")
+	b := testClient(t, "b")
+	subscribe(t, a, "ids/t", 1)
+	subscribe(t, b, "ids/t", 1)
+
+	//先给b发送一条消息, 两个会话的下一个报文ID不同
+	first := message.SpawnPublishMessage()
+	first.TopicName = "other"
+	first.QosLevel = 1
+	b._session.WriteMessage(first)
+	<-b._queue
+
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = "ids/t"
+	msg.QosLevel = 1
+	msg.PacketIdentifier = 99
+	if err := publishMessage("p", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	//每个订阅者的副本使用各自会话分配的报文ID, 发布者的消息不被修改
+	pa := (<-a._queue).(*message.Publish)
+	pb := (<-b._queue).(*message.Publish)
+	if pa == pb || pa == msg || pb == msg {
+		t.Fatal("subscribers share one publish")
+	}
+	if pa.PacketIdentifier == 0 || pb.PacketIdentifier == 0 || pa.PacketIdentifier == pb.PacketIdentifier {
+		t.Fatalf("packet ids %d and %d", pa.PacketIdentifier, pb.PacketIdentifier)
+	}
+	if msg.PacketIdentifier != 99 {
+		t.Fatalf("publisher packet id changed to %d", msg.PacketIdentifier)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"errors"
 	"time"
 
-	"github.com/yamakiller/magicMqtt/encoding"
 	"github.com/yamakiller/magicMqtt/encoding/message"
 	"github.com/yamakiller/magicMqtt/network"
+	"github.com/yamakiller/magicMqtt/sessions"
 )
 
 //HandleConnection 处理句柄
@@ -15,7 +15,7 @@ func HandleConnection(conn *ConBroker) {
 	go func() {
 		for {
 			_, err := conn.ParseMessage()
-			if conn._state == network.StateClosed {
+			if conn.getState() == network.StateClosed {
 				err = errors.New("error disconnect")
 			}
 
@@ -27,45 +27,72 @@ func HandleConnection(conn *ConBroker) {
 
 	}()
 
-	go func() {
-		defer func() {
-			conn._conn.Close()
-			conn._wg.Done()
-		}()
-		for {
-			select {
-			case <-conn._closed:
-				goto Exit
-			case <-conn._kicker.C:
-				conn.Kicker()
-			case msg := <-conn._queue:
-				state := conn._state
-				if state == network.StateConnected ||
-					state == network.StateConnecting {
-					if msg.GetType() == encoding.PTypePublish {
-						sb := msg.(*message.Publish)
-						if sb.QosLevel > 0 {
-							//注册
-							session := conn._session
-							if session != nil {
-								sb.PacketIdentifier = session.RegisterMessage(sb)
-							}
-						}
-					}
+	go writeLoop(conn)
+}
 
-					if err := conn.write(msg); err != nil {
-						conn.Error("Write buffer error, %s", err.Error())
-					}
-					conn.invalidateTimer()
-					conn._activity = time.Now()
-				} else {
-					ss := conn._session
-					if ss != nil {
-						ss.PushOfflineMessage(msg)
-					}
-				}
-			}
-		}
-	Exit:
+//writeLoop 连接写协程
+//取出队列中所有可立即获得的消息编码到缓冲区后一次性flush, 每批最多writeBatch条,
+//批次持续时间超过flushLatency时立即flush, 以限制消息在缓冲区中的延迟
+func writeLoop(conn *ConBroker) {
+	defer func() {
+		conn._conn.Close()
+		conn._wg.Done()
 	}()
+
+	var kicker <-chan time.Time
+	if conn._kicker != nil {
+		kicker = conn._kicker.C
+	}
+
+	for {
+		select {
+		case <-conn._closed:
+			return
+		case <-kicker:
+			conn.Kicker()
+		case msg := <-conn._queue:
+			conn.writeBatch(msg)
+		}
+	}
+}
+
+//writeBatch 编码msg与队列中已有的消息, 每批flush一次
+func (slf *ConBroker) writeBatch(msg message.Message) {
+	start := time.Now()
+	slf.writeQueued(msg)
+Batch:
+	for n := 1; n < slf._writeBatch; n++ {
+		if slf._flushLatency > 0 && time.Since(start) >= slf._flushLatency {
+			break
+		}
+
+		select {
+		case msg := <-slf._queue:
+			slf.writeQueued(msg)
+		default:
+			break Batch
+		}
+	}
+
+	slf.flusher()
+	slf.invalidateTimer()
+	slf.touch()
+}
+
+//writeQueued 编码一条队列中的消息, 连接已不可写时转入会话离线队列
+func (slf *ConBroker) writeQueued(msg message.Message) {
+	state := slf.getState()
+	if state == network.StateConnected ||
+		state == network.StateConnecting {
+		if err := slf.write(msg); err != nil {
+			slf.Error("Write buffer error, %s", err.Error())
+		}
+		return
+	}
+
+	if ss := slf._session; ss != nil {
+		ss.PushOfflineMessage(msg)
+	} else {
+		sessions.Delivered(msg)
+	}
 }
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"sync"
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/network"
+)
+
+// countConn counts the Write calls reaching the connection, each of them is
+// one syscall on a real socket.
+type countConn struct {
+	_mu     sync.Mutex
+	_writes int
+	_bytes  int
+	_want   int
+	_done   chan bool
+}
+
+func (slf *countConn) Read(p []byte) (int, error) { select {} }
+
+func (slf *countConn) Write(p []byte) (int, error) {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf._writes++
+	slf._bytes += len(p)
+	if slf._bytes >= slf._want && slf._done != nil {
+		close(slf._done)
+		slf._done = nil
+	}
+	return len(p), nil
+}
+
+func (slf *countConn) Close() error { return nil }
+
+func benchmarkWriteLoop(b *testing.B, batch int) {
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = "devices/0001/telemetry"
+	msg.Payload = make([]byte, 64)
+	size := 2 + 2 + len(msg.TopicName) + len(msg.Payload)
+
+	done := make(chan bool)
+	conn := &countConn{_want: size * b.N, _done: done}
+	c := &ConBroker{
+		_conn:       conn,
+		_writer:     bufio.NewWriterSize(conn, 64*1024),
+		_queue:      make(chan message.Message, 1024),
+		_closed:     make(chan bool),
+		_state:      network.StateConnected,
+		_writeBatch: batch,
+	}
+
+	c._wg.Add(1)
+	go writeLoop(c)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c._queue <- msg
+	}
+	<-done
+	b.StopTimer()
+
+	close(c._closed)
+	c._wg.Wait()
+	b.ReportMetric(float64(conn._writes)/float64(b.N), "writes/msg")
+}
+
+func BenchmarkWriteLoopUnbatched(b *testing.B) {
+	benchmarkWriteLoop(b, 1)
+}
+
+func BenchmarkWriteLoopBatched(b *testing.B) {
+	benchmarkWriteLoop(b, defaultWriteBatch)
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/encoding"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/network"
+	"github.com/yamakiller/magicMqtt/reactor"
+)
+
+var (
+	errNoRawConn = errors.New("connection has no file descriptor")
+
+	//writerPool 事件驱动模式下写协程临时使用的写缓冲区
+	writerPool = sync.Pool{
+		New: func() interface{} {
+			return bufio.NewWriterSize(nil, blackboard.Instance().Deploy.BufferSize)
+		},
+	}
+)
+
+//HandleReactor 以事件驱动方式处理连接
+//连接可读时由反应器工作协程解析报文, 写队列非空时才启动写协程,
+//空闲连接不占用协程与读写缓冲区
+//
+//工作协程由所有连接共享, 处理报文时不能阻塞: CONNECT的认证可能访问数据库, 转交独立协程处理;
+//订阅者队列已满时block方式按丢弃处理, 分发器队列已满时暂停读取发布者的数据
+func HandleReactor(conn *ConBroker, poller *reactor.Poller, c net.Conn) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return errNoRawConn
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return err
+	}
+
+	conn._conn = c
+	conn._raw = raw
+	conn._fd = fd
+	conn._poller = poller
+	conn.setState(network.StateConnected)
+	if conn._fullPolicy == fullBlock {
+		conn._fullPolicy = fullDrop
+	}
+	if conn._kicker != nil {
+		conn._kicker.Stop()
+		conn._kicker = time.AfterFunc(time.Duration(conn._keepalive)*time.Second, conn.reactorKick)
+	}
+
+	if err := poller.Add(fd, conn); err != nil {
+		if conn._kicker != nil {
+			conn._kicker.Stop()
+		}
+		return err
+	}
+	return nil
+}
+
+//OnReadable 连接可读, 读取数据并处理其中完整的报文, 不完整的部分保留到下一次
+func (slf *ConBroker) OnReadable(buf []byte) bool {
+	n, err := reactor.Read(slf._raw, buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		//暂停读取后恢复时可能没有新数据, 继续处理积压的报文
+		if len(slf._pending) == 0 {
+			return true
+		}
+		n, err = 0, nil
+	} else if err == nil && n <= 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		slf.Close()
+		return false
+	}
+
+	data := buf[:n]
+	if len(slf._pending) > 0 {
+		slf._pending = append(slf._pending, data...)
+		data = slf._pending
+	}
+
+	used, err := slf.decodeMessages(data)
+	if err == nil && (slf.isClosed() || slf.overflowed()) {
+		err = errConnClosed
+	}
+	if err != nil {
+		slf.Close()
+		return false
+	}
+
+	rest := data[used:]
+	switch {
+	case len(rest) == 0:
+		slf._pending = nil
+	case len(slf._pending) > 0:
+		slf._pending = slf._pending[:copy(slf._pending, rest)]
+	default:
+		slf._pending = append([]byte(nil), rest...)
+	}
+
+	if slf._pause > 0 {
+		slf.pauseReactor()
+		return false
+	}
+	if slf._handoff != nil {
+		slf.handoffReactor()
+		return false
+	}
+	return true
+}
+
+//pauseReactor 超出速率限制时暂停监听连接, 到期后由工作协程继续处理积压的数据
+func (slf *ConBroker) pauseReactor() {
+	wait := slf._pause
+	slf._pause = 0
+	time.AfterFunc(wait, slf.resumeReactor)
+}
+
+//handoffReactor 在独立协程中处理可能阻塞的报文, 期间暂停监听连接, 完成后继续处理积压的数据
+func (slf *ConBroker) handoffReactor() {
+	handle := slf._handoff
+	slf._handoff = nil
+	go func() {
+		handle()
+		slf.resumeReactor()
+	}()
+}
+
+//resumeReactor 恢复监听暂停的连接, 暂停期间写队列溢出的连接在此关闭
+func (slf *ConBroker) resumeReactor() {
+	if slf.isClosed() {
+		return
+	}
+	if slf.overflowed() {
+		slf.Close()
+		return
+	}
+
+	slf.touch()
+	if err := slf._poller.Resume(slf._fd, slf); err != nil {
+		slf.Debug("Reactor resume error, %s", err.Error())
+	}
+}
+
+//decodeMessages 处理data中所有完整的报文, 返回已处理的字节数
+//落盘的PUBLISH负载随收到的数据写入临时文件, 不在_pending中积累; 需要暂停读取时剩余的数据留到恢复后处理
+//CONNECT交给独立协程处理, 之后的报文在处理完成后继续
+func (slf *ConBroker) decodeMessages(data []byte) (int, error) {
+	used := 0
+	for used < len(data) && !slf.isClosed() && !slf.overflowed() && slf._pause == 0 && slf._handoff == nil {
+		if slf._spooled != nil {
+			n, err := slf.fillSpool(data[used:])
+			if err != nil {
+				return used, err
+			}
+			used += n
+			continue
+		}
+
+		spooled, n, size, err := message.DecodeSpooled(data[used:], &slf._parse)
+		if err == nil && spooled != nil {
+			slf._spooled, slf._spoolN = spooled, size
+			used += n
+			if size == 0 {
+				slf.fillSpool(nil)
+			}
+			continue
+		}
+
+		var msg message.Message
+		if err == nil {
+			msg, n, err = message.DecodeCopy(data[used:], slf._parse.MaxLength)
+		}
+		if err == nil {
+			if p, ok := msg.(*message.Publish); ok {
+				err = slf._parse.CheckPayload(p.PayloadSize())
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			slf.decodeError(err)
+			return used, err
+		}
+
+		used += n
+		if msg.GetType() == encoding.PTypeConnect {
+			slf._handoff = func() { slf.handleMessage(msg) }
+			continue
+		}
+		slf.handleMessage(msg)
+	}
+	return used, nil
+}
+
+//fillSpool 把data中属于当前落盘负载的部分写入临时文件, 负载完整后处理消息
+func (slf *ConBroker) fillSpool(data []byte) (int, error) {
+	n := len(data)
+	if n > slf._spoolN {
+		n = slf._spoolN
+	}
+
+	spool := slf._spooled.Spool()
+	if _, err := spool.Write(data[:n]); err != nil {
+		slf.Error("Spool payload error, %s", err.Error())
+		slf._spooled.Release()
+		slf._spooled = nil
+		return 0, err
+	}
+
+	slf._spoolN -= n
+	slf.touch()
+	if slf._spoolN == 0 {
+		msg := slf._spooled
+		slf._spooled = nil
+		slf.handleMessage(msg)
+	}
+	return n, nil
+}
+
+//overflowed 事件驱动模式下写队列是否已溢出
+func (slf *ConBroker) overflowed() bool {
+	return atomic.LoadInt32(&slf._overflow) != 0
+}
+
+func (slf *ConBroker) isClosed() bool {
+	select {
+	case <-slf._closed:
+		return true
+	default:
+		return false
+	}
+}
+
+//reactorKick 事件驱动模式的心跳定时器, 超过1.5倍心跳时间没有活动时断开连接
+func (slf *ConBroker) reactorKick() {
+	if slf.isClosed() {
+		return
+	}
+
+	idle := time.Duration(float64(slf._keepalive)*1.5) * time.Second
+	if time.Since(slf.lastActivity()) > idle {
+		slf.Debug("Keepalive timeout")
+		slf.Terminate()
+		return
+	}
+	slf.Kicker()
+}
+
+//wakeWriter 事件驱动模式下队列中有消息时启动写协程, 队列写空后写协程退出
+func (slf *ConBroker) wakeWriter() {
+	if slf._poller == nil {
+		return
+	}
+
+	slf._wmu.Lock()
+	defer slf._wmu.Unlock()
+	if slf._writing || slf.isClosed() {
+		return
+	}
+
+	slf._writing = true
+	slf._wg.Add(1)
+	go slf.drainQueue()
+}
+
+//drainQueue 写出队列中的消息, 写缓冲区只在写协程存活期间占用
+func (slf *ConBroker) drainQueue() {
+	defer slf._wg.Done()
+
+	w := writerPool.Get().(*bufio.Writer)
+	w.Reset(slf._conn)
+	slf._writer = w
+
+	for {
+		select {
+		case msg := <-slf._queue:
+			//连接已关闭时writeBatch把消息转入会话离线队列
+			slf.writeBatch(msg)
+			if !slf.isClosed() {
+				continue
+			}
+		default:
+		}
+
+		//持有锁确认队列为空, 之后入队的消息会启动新的写协程
+		slf._wmu.Lock()
+		if len(slf._queue) == 0 || slf.isClosed() {
+			slf._writer = nil
+			w.Reset(nil)
+			writerPool.Put(w)
+			slf._writing = false
+			slf._wmu.Unlock()
+			return
+		}
+		slf._wmu.Unlock()
+	}
+}
+
+//detachReactor 关闭连接前注销反应器并停止心跳定时器
+func (slf *ConBroker) detachReactor() {
+	if err := slf._poller.Remove(slf._fd); err != nil {
+		slf.Debug("Reactor remove error, %s", err.Error())
+	}
+
+	if slf._kicker != nil {
+		slf._kicker.Stop()
+	}
+
+	//等待正在启动的写协程完成登记, 此后不会再启动写协程
+	slf._wmu.Lock()
+	slf._wmu.Unlock()
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/auth"
+	"github.com/yamakiller/magicMqtt/blackboard"
+	"github.com/yamakiller/magicMqtt/dispatch"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/reactor"
+)
+
+//reactorConn 创建一对TCP连接, 服务端由反应器处理, 返回客户端连接
+func reactorConn(t *testing.T, poller *reactor.Poller, clientID string) (*net.TCPConn, *ConBroker) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	client, err := net.Dial("tcp", lst.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lst.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//缩小缓冲区, 不读取的客户端很快填满服务端的写队列
+	client.(*net.TCPConn).SetReadBuffer(1024)
+	server.(*net.TCPConn).SetWriteBuffer(1024)
+
+	c := NewBrokerConn()
+	if err := HandleReactor(c, poller, server); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		c.Close()
+	})
+
+	connect := message.SpawnConnectMessage()
+	connect.Identifier = clientID
+	connect.CleanSession = true
+	if _, err := message.WriteMessageTo(connect, client); err != nil {
+		t.Fatal(err)
+	}
+	return client.(*net.TCPConn), c
+}
+
+func TestReactorPeerNotReading(t *testing.T) {
+	bb := testBoard(t)
+	bb.Auth, _ = auth.New("mock", "")
+	bb.Deploy.MessageQueueSize = 4
+	bb.Deploy.BufferSize = 1024
+	bb.Dispatcher = nil
+
+	poller, err := reactor.New(1, 4096)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer poller.Close()
+
+	//只发送QoS 1消息, 从不读取PUBACK
+	flood, slow := reactorConn(t, poller, "flood")
+	go func() {
+		msg := message.SpawnPublishMessage()
+		msg.TopicName = "t"
+		msg.QosLevel = 1
+		w := bufio.NewWriter(flood)
+		for i := 0; i < 200000; i++ {
+			msg.PacketIdentifier = uint16(i%65535 + 1)
+			if _, err := message.WriteMessageTo(msg, w); err != nil {
+				return
+			}
+		}
+		w.Flush()
+	}()
+
+	//写队列已满时关闭不读取的连接, 共享的工作协程继续处理其它连接
+	deadline := time.Now().Add(5 * time.Second)
+	for !slow.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("client not reading kept open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other, _ := reactorConn(t, poller, "other")
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := message.Parse(bufio.NewReader(other), 0)
+	if err != nil {
+		t.Fatalf("other connection not served, %v", err)
+	}
+	if _, ok := msg.(*message.Connack); !ok {
+		t.Fatalf("other connection got %s", msg.GetTypeAsString())
+	}
+}
+
+func TestReactorDispatcherFull(t *testing.T) {
+	testBoard(t)
+	entered, release := make(chan bool, 8), make(chan bool)
+	matched := make(chan string, 8)
+	d := dispatch.New(1, 1, func(msg *message.Publish) []dispatch.Target {
+		entered <- true
+		<-release
+		matched <- msg.TopicName
+		msg.Release()
+		return nil
+	}, func(string, *message.Publish) {})
+	blackboard.Instance().Dispatcher = d
+	defer func() {
+		close(release)
+		d.Close()
+		blackboard.Instance().Dispatcher = nil
+	}()
+
+	c := testConn(nil)
+	c._poller = &reactor.Poller{}
+	publish := func(topic string) {
+		msg := message.SpawnPublishMessage()
+		msg.TopicName = topic
+		c.SendPublishMessage(msg)
+	}
+
+	//分发器队列已满时不阻塞工作协程, 转交独立协程提交并暂停读取
+	publish("a")
+	<-entered
+	publish("b")
+	publish("c")
+	if c._handoff == nil {
+		t.Fatal("full dispatcher not handed off")
+	}
+
+	handle := c._handoff
+	c._handoff = nil
+	done := make(chan bool)
+	go func() {
+		handle()
+		close(done)
+	}()
+	release <- true
+	<-done
+	release <- true
+	release <- true
+	for _, want := range []string{"a", "b", "c"} {
+		if got := <-matched; got != want {
+			t.Fatalf("matched %s, want %s", got, want)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/yamakiller/magicLibs/util"
 	"github.com/yamakiller/magicMqtt/blackboard"
 	"github.com/yamakiller/magicMqtt/network"
+	"github.com/yamakiller/magicMqtt/reactor"
 )
 
 //TCPBroker mqtt tcp 服务
@@ -17,6 +18,12 @@ type TCPBroker struct {
 	_lst      network.IListener
 	_wg       sync.WaitGroup
 	_sn       *util.SnowFlake
+	//监听器挂载点, 授权验证器未指定时使用
+	_mountpoint string
+	//监听器PUBLISH负载长度限制, 授权验证器未指定时使用
+	_payloadLimit int
+	//事件驱动反应器, 未启用时每个连接使用独立的读写协程
+	_poller *reactor.Poller
 }
 
 //ListenAndServe 启动监听并启动服务
@@ -31,6 +38,21 @@ func (slf *TCPBroker) ListenAndServe(address string) error {
 	slf._sn = util.NewSnowFlake(blackboard.Instance().Deploy.WorkGroupID,
 		blackboard.Instance().Deploy.WorkID)
 
+	slf._mountpoint = blackboard.Instance().Deploy.Mountpoint
+	slf._payloadLimit = blackboard.Instance().Deploy.PayloadLimit
+	if blackboard.Instance().Deploy.Reactor {
+		poller, err := reactor.New(blackboard.Instance().Deploy.ReactorWorkers,
+			blackboard.Instance().Deploy.BufferSize)
+		if err != nil {
+			slf.Warning("Reactor unavailable, fallback to goroutine per connection, %s", err.Error())
+		} else {
+			slf._poller = poller
+			if parseFullPolicy(blackboard.Instance().Deploy.QueueFullPolicy) == fullBlock {
+				slf.Warning("Queue full policy block would stall reactor workers, drop instead")
+			}
+		}
+	}
+
 	slf._shutdown = make(chan bool)
 	slf._lst = &network.MListener{Listener: lst}
 	slf._wg.Add(1)
@@ -84,6 +106,16 @@ func (slf *TCPBroker) Serve() error {
 			cuid, _ := slf._sn.NextID()
 			conn.WithID(cuid)
 			conn.WithAddr(c.RemoteAddr().String())
+			conn.WithMountpoint(slf._mountpoint)
+			conn.WithPayloadLimit(slf._payloadLimit)
+			if slf._poller != nil {
+				if err := HandleReactor(conn, slf._poller, c); err != nil {
+					slf.Error("Reactor register error, %s", err.Error())
+					c.Close()
+				}
+				continue
+			}
+
 			conn.WithConn(c)
 			HandleConnection(conn)
 		}
@@ -103,6 +135,9 @@ func (slf *TCPBroker) Shutdown() {
 	close(slf._shutdown)
 	slf._lst.Close()
 	slf._wg.Wait()
+	if slf._poller != nil {
+		slf._poller.Close()
+	}
 }
 
 //Info 输出等级为Info的日志
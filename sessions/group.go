@@ -1,7 +1,9 @@
 package sessions
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
 func NewGroup() *SessionGroup {
@@ -10,8 +12,10 @@ func NewGroup() *SessionGroup {
 
 //SessionGroup session 管理器
 type SessionGroup struct {
-	_ss map[string]*Session
-	_sy sync.RWMutex
+	_ss     map[string]*Session
+	_sy     sync.RWMutex
+	_reaper chan bool
+	_wg     sync.WaitGroup
 }
 
 //Remove 删除指定的session
@@ -23,6 +27,16 @@ func (slf *SessionGroup) Remove(clientID string) {
 	}
 }
 
+//Release 删除session, 如果该clientID已关联其它session则忽略
+func (slf *SessionGroup) Release(s *Session) {
+	slf._sy.Lock()
+	defer slf._sy.Unlock()
+	if cur, ok := slf._ss[s.GetClientID()]; ok && cur == s {
+		delete(slf._ss, s.GetClientID())
+	}
+	s.discard()
+}
+
 //Get 返回一个Session
 func (slf *SessionGroup) Get(clientID string) *Session {
 	slf._sy.RLock()
@@ -34,16 +48,16 @@ func (slf *SessionGroup) Get(clientID string) *Session {
 }
 
 //New 创建一个新的Session
-func (slf *SessionGroup) New(clientID string, offlineLimit int) *Session {
+func (slf *SessionGroup) New(clientID string, offlineLimit OfflineLimit) *Session {
 	slf._sy.Lock()
 	defer slf._sy.Unlock()
-	s := newSession(offlineLimit)
+	s := newSession(clientID, true, offlineLimit)
 	slf._ss[clientID] = s
 	return s
 }
 
 //GetOrNew 返回一个或创建一个Session
-func (slf *SessionGroup) GetOrNew(clientID string, offlineLimit int) (*Session, bool) {
+func (slf *SessionGroup) GetOrNew(clientID string, offlineLimit OfflineLimit) (*Session, bool) {
 	slf._sy.RLock()
 	if s, ok := slf._ss[clientID]; ok {
 		slf._sy.RUnlock()
@@ -53,9 +67,131 @@ func (slf *SessionGroup) GetOrNew(clientID string, offlineLimit int) (*Session,
 
 	slf._sy.Lock()
 	defer slf._sy.Unlock()
+	if s, ok := slf._ss[clientID]; ok {
+		return s, true
+	}
 
-	s := newSession(offlineLimit)
+	s := newSession(clientID, false, offlineLimit)
 	slf._ss[clientID] = s
 
 	return s, false
 }
+
+//Takeover 由新连接接管clientID对应的会话
+//
+//在组锁内原子的把会话预留给owner并解除旧连接的绑定, 旧连接中排队的消息在解除绑定时
+//迁移到会话的离线队列, 随后同步关闭旧连接. 返回owner使用的会话与之前存在的会话,
+//当两者不同时(clean session或旧会话为clean session), 调用者负责清理旧会话的订阅.
+//owner须在之后调用Session.Attach开始接收消息.
+func (slf *SessionGroup) Takeover(clientID string,
+	cleanSession bool,
+	offlineLimit OfflineLimit,
+	owner Owner) (*Session, *Session) {
+	slf._sy.Lock()
+	prev := slf._ss[clientID]
+	var kick Owner
+	if prev != nil {
+		kick = prev.claim(nil)
+	}
+
+	s := prev
+	if s == nil || cleanSession || s.IsCleanSession() {
+		s = newSession(clientID, cleanSession, offlineLimit)
+		slf._ss[clientID] = s
+	}
+	s.claim(owner)
+	slf._sy.Unlock()
+
+	if kick != nil && kick != owner {
+		kick.Terminate()
+	}
+
+	if prev != nil && prev != s {
+		prev.discard()
+	}
+
+	return s, prev
+}
+
+//OfflineStats 返回所有会话离线队列丢弃统计的合计, 以及有消息被丢弃的会话, 按client id排序
+func (slf *SessionGroup) OfflineStats() (OfflineStats, []ClientOfflineStats) {
+	slf._sy.RLock()
+	ss := make([]*Session, 0, len(slf._ss))
+	for _, s := range slf._ss {
+		ss = append(ss, s)
+	}
+	slf._sy.RUnlock()
+
+	var total OfflineStats
+	clients := []ClientOfflineStats{}
+	for _, s := range ss {
+		stats := s.OfflineStats()
+		if stats == (OfflineStats{}) {
+			continue
+		}
+		total.add(stats)
+		clients = append(clients, ClientOfflineStats{ClientID: s.GetClientID(), OfflineStats: stats})
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+	return total, clients
+}
+
+//Reap 移除所有已过期的会话, 返回被移除的会话
+func (slf *SessionGroup) Reap(now time.Time) []*Session {
+	slf._sy.Lock()
+	defer slf._sy.Unlock()
+
+	var expired []*Session
+	for id, s := range slf._ss {
+		if s.Expired(now) {
+			delete(slf._ss, id)
+			s.discard()
+			expired = append(expired, s)
+		}
+	}
+
+	return expired
+}
+
+//StartReaper 启动会话回收器, 每隔interval回收一次过期会话并回调onExpired
+func (slf *SessionGroup) StartReaper(interval time.Duration, onExpired func(*Session)) {
+	if interval <= 0 || slf._reaper != nil {
+		return
+	}
+
+	closed := make(chan bool)
+	slf._reaper = closed
+	slf._wg.Add(1)
+	go func() {
+		defer slf._wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				goto Exit
+			case now := <-ticker.C:
+				for _, s := range slf.Reap(now) {
+					if onExpired != nil {
+						onExpired(s)
+					}
+				}
+			}
+		}
+	Exit:
+	}()
+}
+
+//StopReaper 停止会话回收器
+func (slf *SessionGroup) StopReaper() {
+	if slf._reaper == nil {
+		return
+	}
+
+	close(slf._reaper)
+	slf._wg.Wait()
+	slf._reaper = nil
+}
@@ -0,0 +1,163 @@
+package sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//detached 创建一个连接后又断开的会话
+func detached(t *testing.T, group *SessionGroup, clientID string, expiry time.Duration) *Session {
+	o := &owner{}
+	s, _ := group.Takeover(clientID, false, OfflineLimit{}, o)
+	s.WithExpiry(expiry)
+	if err := s.Attach(o); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Detach(o) {
+		t.Fatalf("%s not detached", clientID)
+	}
+	return s
+}
+
+func TestReap(t *testing.T) {
+	group := NewGroup()
+	short := detached(t, group, "short", time.Minute)
+	detached(t, group, "long", time.Hour)
+	detached(t, group, "never", 0)
+	online, _ := group.Takeover("online", false, OfflineLimit{}, &owner{})
+	online.WithExpiry(time.Second)
+
+	if expired := group.Reap(time.Now()); len(expired) != 0 {
+		t.Fatalf("reaped %d sessions before expiry", len(expired))
+	}
+
+	//只回收断开时间超过各自过期时间的会话, 在线与永不过期的会话保留
+	expired := group.Reap(time.Now().Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0] != short || group.Get("short") != nil {
+		t.Fatalf("reaped %v", expired)
+	}
+	for _, id := range []string{"long", "never", "online"} {
+		if group.Get(id) == nil {
+			t.Fatalf("%s reaped", id)
+		}
+	}
+
+	//重新连接的会话不再计时
+	o := &owner{}
+	long, _ := group.Takeover("long", false, OfflineLimit{}, o)
+	if err := long.Attach(o); err != nil {
+		t.Fatal(err)
+	}
+	if expired := group.Reap(time.Now().Add(2 * time.Hour)); len(expired) != 0 {
+		t.Fatalf("reaped %d attached sessions", len(expired))
+	}
+}
+
+func TestStartReaper(t *testing.T) {
+	group := NewGroup()
+	s := detached(t, group, "c1", time.Millisecond)
+
+	expired := make(chan *Session, 1)
+	group.StartReaper(5*time.Millisecond, func(s *Session) {
+		expired <- s
+	})
+	defer group.StopReaper()
+
+	select {
+	case got := <-expired:
+		if got != s || group.Get("c1") != nil {
+			t.Fatalf("reaped %s", got.GetClientID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not reaped")
+	}
+}
+
+func TestTakeoverConcurrent(t *testing.T) {
+	const n = 32
+	group := NewGroup()
+	owners := make([]*owner, n)
+	var wg sync.WaitGroup
+	for i := range owners {
+		owners[i] = &owner{}
+		wg.Add(1)
+		go func(o *owner) {
+			defer wg.Done()
+			s, _ := group.Takeover("c1", false, OfflineLimit{}, o)
+			if err := s.Attach(o); err != nil && err != ErrSessionTakenOver {
+				t.Error(err)
+			}
+		}(owners[i])
+	}
+	wg.Wait()
+
+	//只剩一个持有者, 其它连接各被关闭一次
+	s := group.Get("c1")
+	var survivors int
+	for _, o := range owners {
+		switch o.terminated() {
+		case 0:
+			survivors++
+			if s._owner != Owner(o) {
+				t.Fatal("surviving connection does not own the session")
+			}
+		case 1:
+		default:
+			t.Fatalf("connection terminated %d times", o.terminated())
+		}
+	}
+	if survivors != 1 {
+		t.Fatalf("%d connections left", survivors)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	group := NewGroup()
+	first := &owner{}
+	s, prev := group.Takeover("c1", false, OfflineLimit{Count: 10}, first)
+	if prev != nil {
+		t.Fatal("new client has a previous session")
+	}
+	if err := s.Attach(first); err != nil {
+		t.Fatal(err)
+	}
+
+	//持久会话由新连接接管, 旧连接被关闭, 接管期间的消息进入离线队列
+	second := &owner{}
+	resumed, prev := group.Takeover("c1", false, OfflineLimit{Count: 10}, second)
+	if resumed != s || prev != s || first.terminated() != 1 || second.terminated() != 0 {
+		t.Fatalf("persistent takeover: resumed %v, terminated %d", resumed == s, first.terminated())
+	}
+	if err := s.Attach(first); err != ErrSessionTakenOver {
+		t.Fatalf("old connection attach: %v", err)
+	}
+	s.WriteMessage(qosPublish("a", 0))
+	if len(s._offline._items) != 1 {
+		t.Fatalf("%d offline messages during takeover", len(s._offline._items))
+	}
+	if err := s.Attach(second); err != nil {
+		t.Fatal(err)
+	}
+	if got := second.publishes(); len(got) != 1 || got[0].TopicName != "a" {
+		t.Fatalf("new connection got %d messages", len(got))
+	}
+
+	//clean session接管时丢弃之前的会话
+	s.Detach(second)
+	s.WriteMessage(qosPublish("b", 1))
+	third := &owner{}
+	clean, prev := group.Takeover("c1", true, OfflineLimit{Count: 10}, third)
+	if clean == s || prev != s || group.Get("c1") != clean || !clean.IsCleanSession() {
+		t.Fatal("clean session reused the previous session")
+	}
+	if len(s._offline._items) != 0 {
+		t.Fatalf("previous session kept %d offline messages", len(s._offline._items))
+	}
+	if err := clean.Attach(third); err != nil {
+		t.Fatal(err)
+	}
+	if got := third.publishes(); len(got) != 0 {
+		t.Fatalf("clean session got %d messages", len(got))
+	}
+}
@@ -0,0 +1,382 @@
+package sessions
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+var (
+	//ErrOfflineQueueFull 离线队列已满
+	ErrOfflineQueueFull = errors.New("Offline Queue full")
+)
+
+//OfflinePolicy 离线队列溢出策略
+type OfflinePolicy int
+
+const (
+	//DropNewest 丢弃新到的消息
+	DropNewest OfflinePolicy = iota
+	//DropOldest 丢弃最早的消息
+	DropOldest
+	//DropQos0 优先丢弃最早的QoS 0消息, 没有QoS 0消息时丢弃最早的消息
+	DropQos0
+)
+
+//ParseOfflinePolicy 解析离线队列溢出策略, 无法识别时返回DropNewest
+func ParseOfflinePolicy(name string) OfflinePolicy {
+	switch strings.ToLower(name) {
+	case "oldest":
+		return DropOldest
+	case "qos0":
+		return DropQos0
+	default:
+		return DropNewest
+	}
+}
+
+//OfflineLimit 离线队列限制
+type OfflineLimit struct {
+	//Count 最大消息数, <=0 表示不保存离线消息
+	Count int
+	//Bytes 最大字节数, <=0 表示不限制
+	Bytes int
+	//Policy 溢出策略
+	Policy OfflinePolicy
+	//TTL 消息有效期, <=0 表示永不过期
+	TTL time.Duration
+	//SpillDir 溢出目录, 为空时不溢出到磁盘
+	SpillDir string
+	//SpillAfter 内存中保留的消息数, 超出后写入磁盘段日志
+	SpillAfter int
+	//SpillSegment 磁盘段文件大小
+	SpillSegment int
+	//SpoolSize 读回时超过该长度的PUBLISH负载写入临时文件, 0表示读回内存
+	SpoolSize int
+	//SpoolDir 负载临时文件目录
+	SpoolDir string
+}
+
+//OfflineStats 离线队列丢弃统计
+type OfflineStats struct {
+	//Newest 因队列已满被拒绝的新消息数
+	Newest uint64 `json:"newest"`
+	//Oldest 为腾出空间被丢弃的最早消息数
+	Oldest uint64 `json:"oldest"`
+	//Qos0 为腾出空间被丢弃的QoS 0消息数
+	Qos0 uint64 `json:"qos0"`
+	//Expired 过期被丢弃的消息数
+	Expired uint64 `json:"expired"`
+	//Lost 磁盘段读取失败丢失的消息数
+	Lost uint64 `json:"lost"`
+	//Exhausted 报文ID耗尽无法发送被丢弃的消息数
+	Exhausted uint64 `json:"exhausted"`
+}
+
+//ClientOfflineStats 会话的离线队列丢弃统计
+type ClientOfflineStats struct {
+	ClientID string `json:"clientId"`
+	OfflineStats
+}
+
+func (slf *OfflineStats) add(o OfflineStats) {
+	slf.Newest += o.Newest
+	slf.Oldest += o.Oldest
+	slf.Qos0 += o.Qos0
+	slf.Expired += o.Expired
+	slf.Lost += o.Lost
+	slf.Exhausted += o.Exhausted
+}
+
+type offlineItem struct {
+	_msg    message.Message
+	_size   int
+	_expire time.Time
+	//消息读回前所在的磁盘段
+	_seg *spillSegment
+}
+
+//offlineQueue 会话离线消息队列, 由Session加锁保护
+//内存中的消息总是早于磁盘中的消息
+type offlineQueue struct {
+	_limit OfflineLimit
+	_items []offlineItem
+	_bytes int
+	_spill *spillLog
+	_stats OfflineStats
+	//已取出等待确认的磁盘消息, 确认后释放所在的段
+	_unacked map[message.Message]*spillSegment
+}
+
+func newOfflineQueue(clientID string, limit OfflineLimit) *offlineQueue {
+	q := &offlineQueue{
+		_limit:   limit,
+		_items:   make([]offlineItem, 0),
+		_unacked: make(map[message.Message]*spillSegment),
+	}
+
+	if limit.SpillDir != "" {
+		q._spill = newSpillLog(limit.SpillDir, clientID, limit.SpillSegment)
+		q._spill._parse = message.ParseOptions{SpoolSize: limit.SpoolSize, SpoolDir: limit.SpoolDir}
+	}
+
+	return q
+}
+
+//push 追加一条消息, 被拒绝或写入磁盘的消息释放负载
+func (slf *offlineQueue) push(msg message.Message, now time.Time) error {
+	slf.expire(now)
+
+	size := messageSize(msg)
+	if slf._limit.Count <= 0 ||
+		(slf._limit.Bytes > 0 && size > slf._limit.Bytes) {
+		slf._stats.Newest++
+		releaseMessage(msg)
+		return ErrOfflineQueueFull
+	}
+
+	for slf.full(size) {
+		switch slf._limit.Policy {
+		case DropOldest:
+			slf.dropOldest()
+			slf._stats.Oldest++
+		case DropQos0:
+			if i := slf.firstQos0(); i >= 0 {
+				slf.removeAt(i)
+				slf._stats.Qos0++
+			} else if messageQos(msg) == 0 {
+				slf._stats.Qos0++
+				releaseMessage(msg)
+				return ErrOfflineQueueFull
+			} else {
+				slf.dropOldest()
+				slf._stats.Oldest++
+			}
+		default:
+			slf._stats.Newest++
+			releaseMessage(msg)
+			return ErrOfflineQueueFull
+		}
+	}
+
+	item := offlineItem{_msg: msg, _size: size}
+	if slf._limit.TTL > 0 {
+		item._expire = now.Add(slf._limit.TTL)
+	}
+
+	if slf.spilling() {
+		//磁盘中保存了完整的负载, 读回时重新创建
+		err := slf._spill.append(msg, item._expire, size)
+		releaseMessage(msg)
+		if err != nil {
+			slf._stats.Newest++
+			return err
+		}
+		return nil
+	}
+
+	slf._items = append(slf._items, item)
+	slf._bytes += size
+	return nil
+}
+
+//drain 返回所有未过期的消息并清空队列, 返回的消息视为已交付
+func (slf *offlineQueue) drain(now time.Time) ([]message.Message, error) {
+	var result error
+	slf.expire(now)
+	for slf._spill != nil && len(slf._spill._segs) > 0 {
+		if err := slf.load(now); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	msgs := make([]message.Message, len(slf._items))
+	for i, item := range slf._items {
+		msgs[i] = item._msg
+		item.release()
+	}
+	slf._items = slf._items[:0]
+	slf._bytes = 0
+
+	return msgs, result
+}
+
+//pop 取出最早的一条未过期消息, 队列为空时返回nil
+//磁盘中的QoS 1/2消息在ack之前保留所在的段, QoS 0消息取出即释放
+//磁盘段读取失败时跳过该段继续取出, 返回消息的同时返回错误
+func (slf *offlineQueue) pop(now time.Time) (message.Message, error) {
+	var result error
+	slf.expire(now)
+	for len(slf._items) == 0 && slf._spill != nil && len(slf._spill._segs) > 0 {
+		if err := slf.load(now); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	if len(slf._items) == 0 {
+		return nil, result
+	}
+
+	item := slf._items[0]
+	slf._bytes -= item._size
+	slf._items[0] = offlineItem{}
+	slf._items = slf._items[1:]
+	if item._seg != nil {
+		if messageQos(item._msg) > 0 {
+			slf._unacked[item._msg] = item._seg
+		} else {
+			item._seg.release()
+		}
+	}
+
+	return item._msg, result
+}
+
+//ack 取出的消息已被确认, 释放所在的磁盘段
+func (slf *offlineQueue) ack(msg message.Message) {
+	if seg, ok := slf._unacked[msg]; ok {
+		delete(slf._unacked, msg)
+		seg.release()
+	}
+}
+
+//load 将最早的一个磁盘段读回内存
+func (slf *offlineQueue) load(now time.Time) error {
+	items, expired, lost, err := slf._spill.load(now)
+	slf._stats.Expired += uint64(expired)
+	slf._stats.Lost += uint64(lost)
+	for _, item := range items {
+		slf._items = append(slf._items, item)
+		slf._bytes += item._size
+	}
+	return err
+}
+
+//discard 丢弃所有消息并回收磁盘文件
+func (slf *offlineQueue) discard() {
+	for _, item := range slf._items {
+		releaseMessage(item._msg)
+	}
+	slf._items = slf._items[:0]
+	slf._bytes = 0
+	slf._unacked = make(map[message.Message]*spillSegment)
+	if slf._spill != nil {
+		slf._spill.reset()
+	}
+}
+
+//spilling 是否应写入磁盘, 一旦开始溢出新消息都写入磁盘以保证顺序
+func (slf *offlineQueue) spilling() bool {
+	if slf._spill == nil {
+		return false
+	}
+
+	return slf._spill.count() > 0 || len(slf._items) >= slf._limit.SpillAfter
+}
+
+func (slf *offlineQueue) full(size int) bool {
+	count, bytes := len(slf._items), slf._bytes
+	if slf._spill != nil {
+		count += slf._spill.count()
+		bytes += slf._spill._bytes
+	}
+
+	if count >= slf._limit.Count {
+		return true
+	}
+
+	return slf._limit.Bytes > 0 && bytes+size > slf._limit.Bytes
+}
+
+func (slf *offlineQueue) dropOldest() {
+	if len(slf._items) > 0 {
+		slf.removeAt(0)
+		return
+	}
+
+	if slf._spill != nil {
+		slf._spill.dropHead()
+	}
+}
+
+func (slf *offlineQueue) expire(now time.Time) {
+	if slf._limit.TTL <= 0 {
+		return
+	}
+
+	n := 0
+	for _, item := range slf._items {
+		if !item._expire.After(now) {
+			slf._bytes -= item._size
+			slf._stats.Expired++
+			item.drop()
+			continue
+		}
+		slf._items[n] = item
+		n++
+	}
+	slf._items = slf._items[:n]
+}
+
+func (slf *offlineQueue) firstQos0() int {
+	for i, item := range slf._items {
+		if messageQos(item._msg) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+//removeAt 丢弃一条消息
+func (slf *offlineQueue) removeAt(i int) {
+	slf._bytes -= slf._items[i]._size
+	slf._items[i].drop()
+	slf._items = append(slf._items[:i], slf._items[i+1:]...)
+}
+
+//release 消息已交付或被丢弃, 释放所在的磁盘段
+func (slf offlineItem) release() {
+	if slf._seg != nil {
+		slf._seg.release()
+	}
+}
+
+//drop 消息被丢弃, 释放负载与所在的磁盘段
+func (slf offlineItem) drop() {
+	releaseMessage(slf._msg)
+	slf.release()
+}
+
+//Delivered 消息已写出或被丢弃, 释放QoS 0消息的负载
+//QoS 1/2消息在等待确认池中, 确认后由会话释放
+func Delivered(msg message.Message) {
+	if m, ok := msg.(*message.Publish); ok && m.QosLevel == 0 {
+		m.Release()
+	}
+}
+
+//releaseMessage 消息不再被会话引用, 释放负载
+func releaseMessage(msg message.Message) {
+	if m, ok := msg.(*message.Publish); ok {
+		m.Release()
+	}
+}
+
+func messageQos(msg message.Message) int {
+	if m, ok := msg.(*message.Publish); ok {
+		return m.QosLevel
+	}
+	return 0
+}
+
+//messageSize 返回消息占用的近似字节数
+func messageSize(msg message.Message) int {
+	if msg.GetType() == encoding.PTypePublish {
+		m := msg.(*message.Publish)
+		return 2 + len(m.TopicName) + 2 + m.PayloadSize()
+	}
+	return 4
+}
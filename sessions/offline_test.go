@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func queued(q *offlineQueue) string {
+	var topics string
+	for _, item := range q._items {
+		topics += item._msg.(*message.Publish).TopicName
+	}
+	return topics
+}
+
+func TestOfflinePolicies(t *testing.T) {
+	cases := []struct {
+		policy OfflinePolicy
+		qos    []int
+		want   string
+		stats  OfflineStats
+	}{
+		//队列已满时拒绝新消息
+		{DropNewest, []int{1, 0, 1, 1}, "abc", OfflineStats{Newest: 1}},
+		//丢弃最早的消息
+		{DropOldest, []int{1, 0, 1, 1}, "bcd", OfflineStats{Oldest: 1}},
+		//优先丢弃最早的QoS 0消息
+		{DropQos0, []int{1, 0, 1, 1}, "acd", OfflineStats{Qos0: 1}},
+		//没有QoS 0消息时丢弃最早的消息
+		{DropQos0, []int{1, 1, 1, 1}, "bcd", OfflineStats{Oldest: 1}},
+		//没有QoS 0消息时新的QoS 0消息被拒绝
+		{DropQos0, []int{1, 1, 1, 0}, "abc", OfflineStats{Qos0: 1}},
+	}
+
+	for i, c := range cases {
+		q := newOfflineQueue("c1", OfflineLimit{Count: 3, Policy: c.policy})
+		now := time.Now()
+		for j, topic := range []string{"a", "b", "c", "d"} {
+			err := q.push(qosPublish(topic, c.qos[j]), now)
+			if j < 3 && err != nil {
+				t.Fatalf("case %d: push %s, %v", i, topic, err)
+			}
+		}
+		if got := queued(q); got != c.want || q._stats != c.stats {
+			t.Errorf("case %d: queued %s, stats %+v", i, got, q._stats)
+		}
+	}
+}
+
+func TestOfflineBytesAndTTL(t *testing.T) {
+	//单条消息超过字节限制时直接拒绝
+	q := newOfflineQueue("c1", OfflineLimit{Count: 10, Bytes: 10, Policy: DropOldest})
+	now := time.Now()
+	if err := q.push(qosPublish("too-long-topic", 1), now); err != ErrOfflineQueueFull {
+		t.Fatalf("oversized message: %v", err)
+	}
+
+	q = newOfflineQueue("c1", OfflineLimit{Count: 10, TTL: time.Minute})
+	q.push(qosPublish("a", 1), now)
+	q.push(qosPublish("b", 1), now.Add(time.Minute))
+	msg, _ := q.pop(now.Add(time.Minute + time.Second))
+	if msg.(*message.Publish).TopicName != "b" || q._stats != (OfflineStats{Expired: 1}) {
+		t.Fatalf("popped %+v, stats %+v", msg, q._stats)
+	}
+}
+
+func TestGroupOfflineStats(t *testing.T) {
+	group := NewGroup()
+	limit := OfflineLimit{Count: 1}
+	a, _ := group.GetOrNew("a", limit)
+	b, _ := group.GetOrNew("b", limit)
+	group.GetOrNew("c", limit)
+	for _, s := range []*Session{b, a, b} {
+		s.WriteMessage(qosPublish("x", 1))
+		s.WriteMessage(qosPublish("y", 1))
+	}
+
+	//只列出有消息被丢弃的会话
+	total, clients := group.OfflineStats()
+	if total.Newest != 4 || len(clients) != 2 ||
+		clients[0].ClientID != "a" || clients[0].Newest != 1 ||
+		clients[1].ClientID != "b" || clients[1].Newest != 3 {
+		t.Fatalf("total %+v, clients %+v", total, clients)
+	}
+}
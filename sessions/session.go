@@ -2,21 +2,43 @@ package sessions
 
 import (
 	"errors"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/yamakiller/magicMqtt/common"
 	"github.com/yamakiller/magicMqtt/encoding/message"
 )
 
-func newSession(offlineLimit int) *Session {
+var (
+	//ErrSessionTakenOver 会话已被其它连接接管
+	ErrSessionTakenOver = errors.New("session taken over")
+	//ErrInflightQueueFull 等待发送窗口的消息已达上限
+	ErrInflightQueueFull = errors.New("inflight queue full")
+)
+
+//Owner 会话持有者(连接)
+//WriteMessage接受的消息写出后或连接关闭时未写出的消息由持有者调用Delivered
+//Unsent返回并清空已接受但尚未写出的消息, 会话在解除绑定时于锁内调用
+type Owner interface {
+	WriteMessage(message.Message) error
+	Unsent() []message.Message
+	Terminate()
+}
+
+func newSession(clientID string, cleanSession bool, offlineLimit OfflineLimit) *Session {
 	ss := &Session{
+		_clientid:     clientID,
+		_cleanSession: cleanSession,
 		_waitAck:      common.NewMessageTable(),
-		_offlineQueue: make([]message.Message, 0),
-		_offlineLimit: offlineLimit,
-		_topics:       make(map[string]byte),
+		_offline:      newOfflineQueue(clientID, offlineLimit),
+		_subs:         make(map[string]*common.Subscription),
+		_received:     make(map[uint16]bool),
 		_sync:         sync.Mutex{},
 	}
 	ss._waitAck.WithOnFinish(func(id uint16, msg message.Message, opaque interface{}) {
+		//已确认的消息不再重发, 释放负载
+		releaseMessage(msg)
 		if m, ok := msg.(*message.Publish); ok {
 			if m.QosLevel == 1 {
 				if b, ok := opaque.(chan bool); ok {
@@ -36,12 +58,20 @@ func newSession(offlineLimit int) *Session {
 //Session 连接会话状态
 type Session struct {
 	_clientid     string
-	_onWrite      func(message.Message) error
-	_offlineQueue []message.Message
+	_cleanSession bool
+	_owner        Owner
+	_attached     bool
+	_offline      *offlineQueue
+	_waiting      []message.Message
+	_maxWaiting   int
 	_waitAck      *common.MessageTable
-	_topics       map[string]byte
-	_offlineLimit int
-	_onDisconnect func()
+	_outgoing     []message.Message
+	_flushing     bool
+	_received     map[uint16]bool
+	_subs         map[string]*common.Subscription
+	_expiry       time.Duration
+	_detached     time.Time
+	_maxInflight  int
 	_sync         sync.Mutex
 }
 
@@ -55,104 +85,334 @@ func (slf *Session) GetClientID() string {
 	return slf._clientid
 }
 
-//WithOnDisconnect 设置断开连接函数
-func (slf *Session) WithOnDisconnect(f func()) {
+//IsCleanSession 是否为clean session会话
+func (slf *Session) IsCleanSession() bool {
+	return slf._cleanSession
+}
+
+//WithExpiry 设置会话过期时间, 断开连接超过该时间后会话被回收, 0表示永不过期
+func (slf *Session) WithExpiry(expiry time.Duration) {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	slf._onDisconnect = f
+	slf._expiry = expiry
 }
 
-//AddTopics 添加主题
-func (slf *Session) AddTopics(topic string, qos byte) {
+//GetExpiry 返回会话过期时间
+func (slf *Session) GetExpiry() time.Duration {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	slf._topics[topic] = qos
+	return slf._expiry
 }
 
-//RemoveTopics 删除一个主题
-func (slf *Session) RemoveTopics(topic string) {
+//Expired 会话是否已过期
+func (slf *Session) Expired(now time.Time) bool {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	if _, ok := slf._topics[topic]; ok {
-		delete(slf._topics, topic)
+	if slf._owner != nil || slf._expiry <= 0 || slf._detached.IsZero() {
+		return false
 	}
+	return now.Sub(slf._detached) >= slf._expiry
+}
+
+//WithMaxInflight 设置未确认的QoS 1/2消息上限, 超出的消息在队列中等待, 0表示不限制
+//MQTT 3.1.1没有Receive Maximum属性, 上限只来自服务端配置
+func (slf *Session) WithMaxInflight(max int) {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	slf._maxInflight = max
+}
+
+//WithMaxWaiting 设置在线时等待发送窗口的消息上限, 超出时WriteMessage返回ErrInflightQueueFull, 0表示不限制
+func (slf *Session) WithMaxWaiting(max int) {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	slf._maxWaiting = max
 }
 
-//Topics 返回所有主题
-func (slf *Session) Topics() ([]string, []byte, error) {
+//Waiting 返回在线时等待发送窗口的消息数
+func (slf *Session) Waiting() int {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
+	return len(slf._waiting)
+}
 
-	var (
-		topics []string
-		qoss   []byte
-	)
+//Inflight 返回未确认的消息数
+func (slf *Session) Inflight() int {
+	return slf._waitAck.Len()
+}
 
-	for k, v := range slf._topics {
-		topics = append(topics, k)
-		qoss = append(qoss, v)
+//AddSubscription 添加订阅
+func (slf *Session) AddSubscription(sub *common.Subscription) {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	slf._subs[sub.Topic] = sub
+}
+
+//RemoveSubscription 删除一个订阅, 返回被删除的订阅
+func (slf *Session) RemoveSubscription(topic string) *common.Subscription {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	sub, ok := slf._subs[topic]
+	if !ok {
+		return nil
 	}
+	delete(slf._subs, topic)
+	return sub
+}
 
-	return topics, qoss, nil
+//Subscription 返回指定主题的订阅
+func (slf *Session) Subscription(topic string) *common.Subscription {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	return slf._subs[topic]
 }
 
-//DoDisconnect 执行断开连接操作
-func (slf *Session) DoDisconnect() {
+//Subscriptions 返回所有订阅
+func (slf *Session) Subscriptions() []*common.Subscription {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	if slf._onDisconnect == nil {
-		return
+
+	subs := make([]*common.Subscription, 0, len(slf._subs))
+	for _, sub := range slf._subs {
+		subs = append(subs, sub)
 	}
-	slf._onDisconnect()
+
+	return subs
 }
 
-//WithOnWrite 设置写数据函数
-func (slf *Session) WithOnWrite(f func(message.Message) error) {
+//claim 将会话预留给新的持有者, 返回旧持有者
+//在Attach之前所有写入的消息都进入离线队列
+func (slf *Session) claim(owner Owner) Owner {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	slf._onWrite = f
+	prev := slf._owner
+	slf._owner = owner
+	slf._attached = false
+	//未写出的消息属于旧持有者, QoS 1/2消息仍在等待确认池中, 在Attach时重发
+	slf.dropOutgoing()
+	if prev != nil && prev != owner {
+		slf.reclaim(prev)
+	}
+	if owner == nil {
+		slf._detached = time.Now()
+	} else {
+		slf._detached = time.Time{}
+	}
+	return prev
 }
 
-//WriteMessage 写消息数据
-func (slf *Session) WriteMessage(msg message.Message) error {
+//Attach 绑定持有者, 依次重发未确认消息与离线消息
+//已收到PUBREC的QoS 2消息重发PUBREL
+func (slf *Session) Attach(owner Owner) error {
+	slf._sync.Lock()
+	if slf._owner != owner {
+		slf._sync.Unlock()
+		return ErrSessionTakenOver
+	}
+
+	for _, msg := range slf._waitAck.Messages() {
+		if m, ok := msg.(*message.Publish); ok {
+			m.Dupe = true
+		}
+		slf._outgoing = append(slf._outgoing, msg)
+	}
+
+	slf._attached = true
+	err := slf.pump()
+	slf._sync.Unlock()
+	if ferr := slf.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+//Detach 解除持有者绑定, 如果owner已不是当前持有者返回false
+func (slf *Session) Detach(owner Owner) bool {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	if slf._onWrite == nil {
-		if len(slf._offlineQueue) >= slf._offlineLimit {
-			return errors.New("Offline Queue full")
+	if slf._owner != owner {
+		return false
+	}
+	slf._owner = nil
+	slf._attached = false
+	slf.dropOutgoing()
+	slf.reclaim(owner)
+	slf._detached = time.Now()
+	//等待发送窗口的消息转入离线队列, 受离线队列的限制
+	for _, msg := range slf._waiting {
+		slf._offline.push(msg, time.Now())
+	}
+	slf._waiting = nil
+	return true
+}
+
+//WriteMessage 写消息数据, 会话持有写入的消息, 返回错误时消息已被丢弃
+func (slf *Session) WriteMessage(msg message.Message) error {
+	var err error
+	slf._sync.Lock()
+	if !slf._attached {
+		defer slf._sync.Unlock()
+		return slf._offline.push(msg, time.Now())
+	}
+
+	if m, ok := msg.(*message.Publish); ok && m.QosLevel > 0 {
+		//QoS 1/2消息按顺序经过等待队列, 受发送窗口限制
+		if slf._maxWaiting > 0 && len(slf._waiting) >= slf._maxWaiting {
+			slf._sync.Unlock()
+			releaseMessage(msg)
+			return ErrInflightQueueFull
 		}
-		slf._offlineQueue = append(slf._offlineQueue, msg)
+		slf._waiting = append(slf._waiting, msg)
+		err = slf.pump()
+	} else {
+		slf._outgoing = append(slf._outgoing, msg)
+	}
+	slf._sync.Unlock()
+
+	if ferr := slf.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+//flush 在锁外把待写出的消息按顺序写入持有者, 持有者的写入可能阻塞
+//同一时刻只有一个调用者写出, 其它调用者追加的消息由正在写出的调用者一并写出
+func (slf *Session) flush() error {
+	var result error
+	slf._sync.Lock()
+	if slf._flushing {
+		slf._sync.Unlock()
 		return nil
 	}
 
-	return slf._onWrite(msg)
+	slf._flushing = true
+	for len(slf._outgoing) > 0 && slf._owner != nil {
+		msgs, owner := slf._outgoing, slf._owner
+		slf._outgoing = nil
+		slf._sync.Unlock()
+
+		for _, msg := range msgs {
+			if err := owner.WriteMessage(msg); err != nil {
+				Delivered(msg)
+				if result == nil {
+					result = err
+				}
+			}
+		}
+		slf._sync.Lock()
+	}
+	slf._flushing = false
+	slf._sync.Unlock()
+
+	return result
+}
+
+//pump 在发送窗口允许时把队列中的消息移入待写出队列, 调用者持有锁
+//离线队列中的消息早于在线时等待窗口的消息, 先发送
+//离线队列的磁盘段读取失败时继续发送其余消息, 返回第一个错误
+func (slf *Session) pump() error {
+	var result error
+	for slf._attached && !slf.windowFull() {
+		msg, err := slf._offline.pop(time.Now())
+		if err != nil && result == nil {
+			result = err
+		}
+		if msg == nil && len(slf._waiting) > 0 {
+			msg = slf._waiting[0]
+			slf._waiting[0] = nil
+			slf._waiting = slf._waiting[1:]
+		}
+		if msg == nil {
+			break
+		}
+
+		if m, ok := msg.(*message.Publish); ok && m.QosLevel > 0 {
+			if _, err := slf.RegisterMessage(m); err != nil {
+				//没有可用的报文ID, 已取出的消息无法发送, 丢弃并计数
+				slf._offline.ack(msg)
+				slf._offline._stats.Exhausted++
+				releaseMessage(msg)
+				return err
+			}
+		}
+
+		slf._outgoing = append(slf._outgoing, msg)
+	}
+
+	return result
+}
+
+//windowFull 发送窗口是否已满
+func (slf *Session) windowFull() bool {
+	n := slf._waitAck.Len()
+	if n >= math.MaxUint16 {
+		return true
+	}
+
+	return slf._maxInflight > 0 && n >= slf._maxInflight
 }
 
 //PushOfflineMessage 插入离线消息
+//已在等待确认池中的消息会在重新连接时重发, 不再重复入队
 func (slf *Session) PushOfflineMessage(msg message.Message) error {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	if len(slf._offlineQueue) >= slf._offlineLimit {
-		return errors.New("Offline Queue full")
+	if m, ok := msg.(*message.Publish); ok && slf.registered(m) {
+		return nil
 	}
-	slf._offlineQueue = append(slf._offlineQueue, msg)
-	return nil
+	return slf._offline.push(msg, time.Now())
+}
+
+//OfflineMessages 返回并清空所有离线消息
+func (slf *Session) OfflineMessages() ([]message.Message, error) {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	return slf._offline.drain(time.Now())
 }
 
-//OfflineMessages 返回所有离线消息
-func (slf *Session) OfflineMessages() []message.Message {
+//discard 会话被丢弃, 清空离线队列并释放所有未确认的消息
+func (slf *Session) discard() {
 	slf._sync.Lock()
 	defer slf._sync.Unlock()
-	nlen := len(slf._offlineQueue)
-	rs := make([]message.Message, nlen)
-	if nlen == 0 {
-		return rs
+	slf._offline.discard()
+	for _, msg := range slf._waiting {
+		releaseMessage(msg)
 	}
-	for i, msg := range slf._offlineQueue {
-		rs[i] = msg
+	slf._waiting = nil
+	slf.dropOutgoing()
+	for _, msg := range slf._waitAck.Messages() {
+		releaseMessage(msg)
 	}
-	slf._offlineQueue = slf._offlineQueue[nlen:]
-	return rs
+	slf._waitAck.Clean()
+}
+
+//reclaim 把持有者已接受但未写出的消息按原顺序转入离线队列, 调用者持有锁
+//与解除绑定在同一次加锁内完成, 之后写入的消息排在它们之后
+func (slf *Session) reclaim(owner Owner) {
+	for _, msg := range owner.Unsent() {
+		m, ok := msg.(*message.Publish)
+		if !ok || slf.registered(m) {
+			//QoS 1/2消息仍在等待确认池中, 在Attach时重发
+			Delivered(msg)
+			continue
+		}
+		slf._offline.push(msg, time.Now())
+	}
+}
+
+//dropOutgoing 丢弃未写出的消息, 调用者持有锁
+func (slf *Session) dropOutgoing() {
+	for _, msg := range slf._outgoing {
+		Delivered(msg)
+	}
+	slf._outgoing = nil
+}
+
+//OfflineStats 返回离线队列丢弃统计
+func (slf *Session) OfflineStats() OfflineStats {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	return slf._offline._stats
 }
 
 //WithOnFinish 设置消息完成回掉函数
@@ -161,14 +421,80 @@ func (slf *Session) WithOnFinish(callback func(uint16, message.Message, interfac
 }
 
 //RegisterMessage 注册一个消息到等待确认池
-func (slf *Session) RegisterMessage(msg *message.Publish) uint16 {
-	id := slf._waitAck.NewID()
+//重发的消息已在等待确认池中, 沿用原有的ID
+func (slf *Session) RegisterMessage(msg *message.Publish) (uint16, error) {
+	if slf.registered(msg) {
+		return msg.PacketIdentifier, nil
+	}
+
+	id, err := slf._waitAck.NewID()
+	if err != nil {
+		return 0, err
+	}
 	msg.PacketIdentifier = id
 	slf._waitAck.Register(id, msg, nil)
-	return id
+	return id, nil
+}
+
+func (slf *Session) registered(msg *message.Publish) bool {
+	if msg.PacketIdentifier == 0 {
+		return false
+	}
+
+	m, err := slf._waitAck.Get(msg.PacketIdentifier)
+	return err == nil && m == msg
+}
+
+//ReceiveQos2 记录客户端发来的QoS 2消息ID, 在收到PUBREL之前同一ID的消息是重发, 返回false
+func (slf *Session) ReceiveQos2(id uint16) bool {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	if slf._received[id] {
+		return false
+	}
+	slf._received[id] = true
+	return true
+}
+
+//ReleaseQos2 收到PUBREL, 释放客户端的QoS 2消息ID
+func (slf *Session) ReleaseQos2(id uint16) {
+	slf._sync.Lock()
+	defer slf._sync.Unlock()
+	delete(slf._received, id)
 }
 
-//UnRefMessage 取消一个消息的引用
-func (slf *Session) UnRefMessage(id uint16) {
+//ReceivePubrec 收到QoS 2消息的PUBREC, 等待确认池中的消息替换为pubrel
+//接收方已保存消息, 重新连接时只重发PUBREL, 消息的负载与所在的磁盘段随即释放
+func (slf *Session) ReceivePubrec(pubrel *message.Pubrel) {
+	msg, err := slf._waitAck.Get(pubrel.PacketIdentifier)
+	if err != nil {
+		return
+	}
+
+	m, ok := msg.(*message.Publish)
+	if !ok || m.QosLevel != 2 || !slf._waitAck.Replace(pubrel.PacketIdentifier, pubrel) {
+		return
+	}
+
+	slf._sync.Lock()
+	slf._offline.ack(m)
+	slf._sync.Unlock()
+	releaseMessage(m)
+}
+
+//UnRefMessage 取消一个消息的引用, 释放发送窗口, 返回发送后续消息时的错误
+func (slf *Session) UnRefMessage(id uint16) error {
+	msg, _ := slf._waitAck.Get(id)
 	slf._waitAck.Unref(id)
+
+	slf._sync.Lock()
+	if msg != nil {
+		slf._offline.ack(msg)
+	}
+	err := slf.pump()
+	slf._sync.Unlock()
+	if ferr := slf.flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
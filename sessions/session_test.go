@@ -0,0 +1,290 @@
+package sessions
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+// owner records the messages written to a connection.
+type owner struct {
+	_mu         sync.Mutex
+	_msgs       []message.Message
+	_unsent     []message.Message
+	_terminated int
+}
+
+func (slf *owner) WriteMessage(msg message.Message) error {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf._msgs = append(slf._msgs, msg)
+	return nil
+}
+
+func (slf *owner) Unsent() []message.Message {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	unsent := slf._unsent
+	slf._unsent = nil
+	return unsent
+}
+
+func (slf *owner) Terminate() {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf._terminated++
+}
+
+func (slf *owner) terminated() int {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	return slf._terminated
+}
+
+func (slf *owner) publishes() []*message.Publish {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	var result []*message.Publish
+	for _, msg := range slf._msgs {
+		if p, ok := msg.(*message.Publish); ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func qosPublish(topic string, qos int) *message.Publish {
+	p := message.SpawnPublishMessage()
+	p.TopicName = topic
+	p.QosLevel = qos
+	return p
+}
+
+func attached(t *testing.T, limit OfflineLimit, inflight int) (*Session, *owner) {
+	o := &owner{}
+	s := newSession("c1", false, limit)
+	s.WithMaxInflight(inflight)
+	s.claim(o)
+	if err := s.Attach(o); err != nil {
+		t.Fatal(err)
+	}
+	return s, o
+}
+
+func TestInflightWindow(t *testing.T) {
+	//在线时QoS 1/2消息不受离线队列限制
+	s, o := attached(t, OfflineLimit{}, 2)
+
+	topics := []string{"a", "b", "c", "d", "e"}
+	for _, topic := range topics {
+		if err := s.WriteMessage(qosPublish(topic, 1)); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+	}
+	//QoS 0消息不受发送窗口限制
+	s.WriteMessage(qosPublish("zero", 0))
+
+	sent := o.publishes()
+	if len(sent) != 3 || sent[0].TopicName != "a" || sent[1].TopicName != "b" || sent[2].TopicName != "zero" {
+		t.Fatalf("sent %d messages before ack", len(sent))
+	}
+	if s.Inflight() != 2 || s.Waiting() != 3 {
+		t.Fatalf("inflight %d, waiting %d", s.Inflight(), s.Waiting())
+	}
+
+	//确认后按顺序发送等待中的消息
+	s.UnRefMessage(sent[0].PacketIdentifier)
+	s.UnRefMessage(sent[1].PacketIdentifier)
+	sent = o.publishes()
+	if len(sent) != 5 || sent[3].TopicName != "c" || sent[4].TopicName != "d" {
+		t.Fatalf("sent %+v", sent)
+	}
+	s.UnRefMessage(sent[3].PacketIdentifier)
+	s.UnRefMessage(sent[4].PacketIdentifier)
+	if sent = o.publishes(); len(sent) != 6 || sent[5].TopicName != "e" {
+		t.Fatalf("sent %d messages after drain", len(sent))
+	}
+	if s.Waiting() != 0 || s.OfflineStats() != (OfflineStats{}) {
+		t.Fatalf("waiting %d, offline stats %+v", s.Waiting(), s.OfflineStats())
+	}
+}
+
+func TestInflightWaitingLimit(t *testing.T) {
+	s, _ := attached(t, OfflineLimit{}, 1)
+	s.WithMaxWaiting(1)
+
+	s.WriteMessage(qosPublish("a", 1))
+	s.WriteMessage(qosPublish("b", 1))
+	if err := s.WriteMessage(qosPublish("c", 1)); err != ErrInflightQueueFull {
+		t.Fatalf("waiting limit: %v", err)
+	}
+}
+
+func TestInflightDetach(t *testing.T) {
+	s, o := attached(t, OfflineLimit{Count: 10}, 1)
+	s.WriteMessage(qosPublish("a", 1))
+	s.WriteMessage(qosPublish("b", 2))
+
+	//断开后等待中的消息转入离线队列, 重新连接时先重发未确认的消息
+	s.Detach(o)
+	if s.Waiting() != 0 {
+		t.Fatalf("waiting %d after detach", s.Waiting())
+	}
+
+	o2 := &owner{}
+	s.claim(o2)
+	if err := s.Attach(o2); err != nil {
+		t.Fatal(err)
+	}
+	sent := o2.publishes()
+	if len(sent) != 1 || sent[0].TopicName != "a" || !sent[0].Dupe {
+		t.Fatalf("resent %+v", sent)
+	}
+	s.UnRefMessage(sent[0].PacketIdentifier)
+	if sent = o2.publishes(); len(sent) != 2 || sent[1].TopicName != "b" {
+		t.Fatalf("sent %+v", sent)
+	}
+}
+
+func TestDetachUnsent(t *testing.T) {
+	s, o := attached(t, OfflineLimit{Count: 10}, 0)
+	o._unsent = []message.Message{qosPublish("a", 0), qosPublish("b", 0)}
+
+	//解除绑定时取走持有者未写出的消息, 排在之后写入的离线消息之前
+	s.Detach(o)
+	s.WriteMessage(qosPublish("c", 0))
+
+	//接管时旧持有者未写出的消息同样先于接管期间的消息
+	next := &owner{}
+	s.claim(next)
+	next._unsent = []message.Message{qosPublish("d", 0)}
+	s.claim(nil)
+	s.WriteMessage(qosPublish("e", 0))
+
+	last := &owner{}
+	s.claim(last)
+	if err := s.Attach(last); err != nil {
+		t.Fatal(err)
+	}
+	sent := last.publishes()
+	var got string
+	for _, p := range sent {
+		got += p.TopicName
+	}
+	if got != "abcde" {
+		t.Fatalf("sent %s", got)
+	}
+}
+
+func TestPubrecResend(t *testing.T) {
+	s, o := attached(t, OfflineLimit{Count: 10}, 0)
+	s.WriteMessage(qosPublish("a", 2))
+	s.WriteMessage(qosPublish("b", 2))
+	sent := o.publishes()
+	id := sent[0].PacketIdentifier
+
+	//收到PUBREC后重新连接, 重发PUBREL而不是PUBLISH
+	pubrel := message.SpawnPubrelMessage()
+	pubrel.PacketIdentifier = id
+	s.ReceivePubrec(pubrel)
+	s.Detach(o)
+
+	o2 := &owner{}
+	s.claim(o2)
+	if err := s.Attach(o2); err != nil {
+		t.Fatal(err)
+	}
+	if len(o2._msgs) != 2 {
+		t.Fatalf("resent %d messages", len(o2._msgs))
+	}
+	if m, ok := o2._msgs[0].(*message.Pubrel); !ok || m.PacketIdentifier != id {
+		t.Fatalf("resent %+v, want pubrel %d", o2._msgs[0], id)
+	}
+	if m, ok := o2._msgs[1].(*message.Publish); !ok || m.TopicName != "b" || !m.Dupe {
+		t.Fatalf("resent %+v", o2._msgs[1])
+	}
+
+	//PUBCOMP之后释放发送窗口
+	s.UnRefMessage(id)
+	if s.Inflight() != 1 {
+		t.Fatalf("inflight %d after pubcomp", s.Inflight())
+	}
+
+	//QoS 1消息与未知ID的PUBREC被忽略
+	s.WriteMessage(qosPublish("c", 1))
+	sent = o2.publishes()
+	pubrel = message.SpawnPubrelMessage()
+	pubrel.PacketIdentifier = sent[len(sent)-1].PacketIdentifier
+	s.ReceivePubrec(pubrel)
+	if m, _ := s._waitAck.Get(pubrel.PacketIdentifier); m != sent[len(sent)-1] {
+		t.Fatalf("qos 1 message replaced by %+v", m)
+	}
+}
+
+func TestReceiveQos2(t *testing.T) {
+	s, o := attached(t, OfflineLimit{}, 1)
+	s.WriteMessage(qosPublish("out", 2))
+	out := o.publishes()[0]
+
+	if !s.ReceiveQos2(out.PacketIdentifier) {
+		t.Fatal("first receive reported as duplicate")
+	}
+	if s.ReceiveQos2(out.PacketIdentifier) {
+		t.Fatal("duplicate receive before PUBREL")
+	}
+
+	//客户端的报文ID与发送窗口无关
+	s.ReleaseQos2(out.PacketIdentifier)
+	if s.Inflight() != 1 {
+		t.Fatalf("inflight %d after PUBREL", s.Inflight())
+	}
+	if !s.ReceiveQos2(out.PacketIdentifier) {
+		t.Fatal("id not released by PUBREL")
+	}
+}
+
+//blockingOwner 第一次写入阻塞, 直到release被关闭
+type blockingOwner struct {
+	owner
+	_entered chan bool
+	_release chan bool
+	_once    sync.Once
+}
+
+func (slf *blockingOwner) WriteMessage(msg message.Message) error {
+	slf._once.Do(func() {
+		close(slf._entered)
+		<-slf._release
+	})
+	return slf.owner.WriteMessage(msg)
+}
+
+func TestWriteOutsideLock(t *testing.T) {
+	o := &blockingOwner{_entered: make(chan bool), _release: make(chan bool)}
+	s := newSession("c1", false, OfflineLimit{})
+	s.claim(o)
+	if err := s.Attach(o); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.WriteMessage(qosPublish("a", 0)) }()
+	<-o._entered
+
+	//持有者阻塞时会话仍可访问, 后续消息由正在写出的调用者按顺序写出
+	s.WriteMessage(qosPublish("b", 1))
+	s.WriteMessage(qosPublish("c", 0))
+	if s.Subscription("x") != nil || s.Inflight() != 1 {
+		t.Fatalf("inflight %d", s.Inflight())
+	}
+
+	close(o._release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	sent := o.publishes()
+	if len(sent) != 3 || sent[0].TopicName != "a" || sent[1].TopicName != "b" || sent[2].TopicName != "c" {
+		t.Fatalf("sent %+v", sent)
+	}
+}
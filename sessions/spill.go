@@ -0,0 +1,327 @@
+package sessions
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const (
+	//spillPrefix 会话溢出目录前缀
+	spillPrefix = "session-"
+	//spillDefaultSegment 默认段文件大小
+	spillDefaultSegment = 4 * 1024 * 1024
+	//spillRecordHeader 记录头: 长度(4) + 过期时间(8)
+	spillRecordHeader = 12
+	//spillPacketID 未分配ID的QoS 1/2消息写入磁盘时的占位ID, 读回后清除
+	spillPacketID = 1
+)
+
+var spillSeq uint64
+
+//CleanSpill 清除目录中残留的会话溢出文件
+func CleanSpill(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), spillPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type spillSegment struct {
+	_path  string
+	_file  *os.File
+	_size  int64
+	_count int
+	//已读回内存但尚未确认或丢弃的消息数, 为0时删除段文件
+	_pending int
+}
+
+//spillLog 离线消息磁盘段日志, 记录按写入顺序回放
+type spillLog struct {
+	_dir     string
+	_segSize int64
+	//尚未读回内存的段
+	_segs []*spillSegment
+	_seq  int
+	//未读回记录的大小, 用于字节限制与丢弃最早记录
+	_sizes []int
+	_bytes int
+	//首段中已被丢弃的记录数
+	_skip int
+	//读回记录的解析选项, 大负载不读入内存
+	_parse message.ParseOptions
+}
+
+func newSpillLog(root, clientID string, segSize int) *spillLog {
+	if segSize <= 0 {
+		segSize = spillDefaultSegment
+	}
+
+	name := fmt.Sprintf("%s%x-%d", spillPrefix, sha1.Sum([]byte(clientID)), atomic.AddUint64(&spillSeq, 1))
+	return &spillLog{
+		_dir:     filepath.Join(root, name),
+		_segSize: int64(segSize),
+	}
+}
+
+func (slf *spillLog) count() int {
+	return len(slf._sizes)
+}
+
+//append 追加一条记录, 报文直接写入段文件, 落盘的负载从临时文件流式复制
+func (slf *spillLog) append(msg message.Message, expire time.Time, size int) error {
+	//QoS 1/2消息在发送时才分配报文ID, 写入磁盘时使用占位ID以通过解析检查
+	if m, ok := msg.(*message.Publish); ok && m.QosLevel > 0 && m.PacketIdentifier == 0 {
+		cp := *m
+		cp.PacketIdentifier = spillPacketID
+		msg = &cp
+	}
+
+	seg, err := slf.tail()
+	if err != nil {
+		return err
+	}
+
+	var header [spillRecordHeader]byte
+	var expireAt int64
+	if !expire.IsZero() {
+		expireAt = expire.UnixNano()
+	}
+	binary.BigEndian.PutUint64(header[4:12], uint64(expireAt))
+
+	n, err := seg.write(header[:], msg)
+	if err != nil {
+		return err
+	}
+
+	seg._size += n
+	seg._count++
+	slf._sizes = append(slf._sizes, size)
+	slf._bytes += size
+	return nil
+}
+
+func (slf *spillLog) tail() (*spillSegment, error) {
+	if n := len(slf._segs); n > 0 && slf._segs[n-1]._size < slf._segSize {
+		return slf._segs[n-1], nil
+	}
+
+	if err := os.MkdirAll(slf._dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if n := len(slf._segs); n > 0 {
+		if err := slf._segs[n-1].close(); err != nil {
+			return nil, err
+		}
+	}
+
+	slf._seq++
+	path := filepath.Join(slf._dir, fmt.Sprintf("%020d.seg", slf._seq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &spillSegment{_path: path, _file: f}
+	slf._segs = append(slf._segs, seg)
+	return seg, nil
+}
+
+//dropHead 丢弃最早的一条记录, 整段都被丢弃时回收段文件
+func (slf *spillLog) dropHead() {
+	if len(slf._sizes) == 0 {
+		return
+	}
+
+	slf._bytes -= slf._sizes[0]
+	slf._sizes = slf._sizes[1:]
+	slf._skip++
+
+	head := slf._segs[0]
+	if slf._skip >= head._count && len(slf._segs) > 1 {
+		head.close()
+		os.Remove(head._path)
+		slf._segs = slf._segs[1:]
+		slf._skip = 0
+	}
+}
+
+//load 读回最早的一个段, 返回未过期的消息、过期数量与因读取失败丢失的数量
+//段文件保留到读回的消息都被确认或丢弃, 读取失败时该段剩余的记录被丢弃
+func (slf *spillLog) load(now time.Time) ([]offlineItem, int, int, error) {
+	if len(slf._segs) == 0 {
+		return nil, 0, 0, nil
+	}
+
+	seg, skip := slf._segs[0], slf._skip
+	n := seg._count - skip
+	sizes := slf._sizes[:n]
+	slf._segs = slf._segs[1:]
+	slf._sizes = slf._sizes[n:]
+	slf._skip = 0
+	for _, size := range sizes {
+		slf._bytes -= size
+	}
+
+	items, expired, err := seg.replay(skip, now, sizes, &slf._parse)
+	lost := 0
+	if err != nil {
+		lost = n - len(items) - expired
+		err = fmt.Errorf("offline spill %s: %s", seg._path, err.Error())
+	}
+
+	seg._pending = len(items)
+	for i := range items {
+		items[i]._seg = seg
+	}
+	if seg._pending == 0 {
+		seg.remove()
+	}
+
+	return items, expired, lost, err
+}
+
+func (slf *spillSegment) close() error {
+	if slf._file == nil {
+		return nil
+	}
+
+	err := slf._file.Close()
+	slf._file = nil
+	return err
+}
+
+//write 在段尾写入记录头与报文, 报文长度在写入后回填, 失败时截断到写入前的长度
+func (slf *spillSegment) write(header []byte, msg message.Message) (int64, error) {
+	n, err := slf._file.Write(header)
+	if err == nil {
+		var m int64
+		m, err = message.WriteMessageTo(msg, slf._file)
+		binary.BigEndian.PutUint32(header[0:4], uint32(m))
+		if err == nil {
+			_, err = slf._file.WriteAt(header[0:4], slf._size)
+		}
+		n += int(m)
+	}
+
+	if err != nil {
+		slf._file.Truncate(slf._size)
+		slf._file.Seek(slf._size, io.SeekStart)
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+//release 读回的一条消息已确认或被丢弃
+func (slf *spillSegment) release() {
+	slf._pending--
+	if slf._pending == 0 {
+		slf.remove()
+	}
+}
+
+func (slf *spillSegment) remove() {
+	slf.close()
+	os.Remove(slf._path)
+}
+
+func (slf *spillSegment) replay(skip int, now time.Time, sizes []int, opts *message.ParseOptions) ([]offlineItem, int, error) {
+	if err := slf.close(); err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(slf._path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var (
+		msgs    []offlineItem
+		expired int
+		header  [spillRecordHeader]byte
+	)
+
+	reader := bufio.NewReader(f)
+	for i := 0; i < slf._count; i++ {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return msgs, expired, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		expireAt := int64(binary.BigEndian.Uint64(header[4:12]))
+		if i < skip {
+			if _, err := reader.Discard(int(length)); err != nil {
+				return msgs, expired, err
+			}
+			continue
+		}
+
+		if expireAt != 0 && expireAt <= now.UnixNano() {
+			if _, err := reader.Discard(int(length)); err != nil {
+				return msgs, expired, err
+			}
+			expired++
+			continue
+		}
+
+		msg, err := message.ParseWith(io.LimitReader(reader, length), opts)
+		if err != nil {
+			return msgs, expired, err
+		}
+		if m, ok := msg.(*message.Publish); ok && m.QosLevel > 0 {
+			m.PacketIdentifier = 0
+		}
+
+		item := offlineItem{_msg: msg, _size: sizes[i-skip]}
+		if expireAt != 0 {
+			item._expire = time.Unix(0, expireAt)
+		}
+		msgs = append(msgs, item)
+	}
+
+	return msgs, expired, nil
+}
+
+//reset 删除所有段文件
+func (slf *spillLog) reset() {
+	for _, seg := range slf._segs {
+		seg.close()
+	}
+
+	//已读回的段也在目录中
+	os.RemoveAll(slf._dir)
+
+	slf._segs = nil
+	slf._sizes = nil
+	slf._bytes = 0
+	slf._skip = 0
+}
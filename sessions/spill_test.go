@@ -0,0 +1,193 @@
+package sessions
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func segments(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func spillQueue(t *testing.T, limit OfflineLimit) (*offlineQueue, string) {
+	dir := t.TempDir()
+	limit.SpillDir = dir
+	if limit.Count == 0 {
+		limit.Count = 100
+	}
+	//每条记录单独一个段
+	limit.SpillSegment = 1
+	return newOfflineQueue("c1", limit), dir
+}
+
+func TestSpillReplay(t *testing.T) {
+	q, dir := spillQueue(t, OfflineLimit{SpillAfter: 1})
+	now := time.Now()
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		qos := 1
+		if topic == "c" {
+			qos = 0
+		}
+		if err := q.push(qosPublish(topic, qos), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(segments(t, dir)); n != 3 {
+		t.Fatalf("%d segments", n)
+	}
+
+	var popped []*message.Publish
+	for {
+		msg, err := q.pop(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			break
+		}
+		popped = append(popped, msg.(*message.Publish))
+	}
+	if len(popped) != 4 || popped[0].TopicName != "a" || popped[1].TopicName != "b" ||
+		popped[2].TopicName != "c" || popped[3].TopicName != "d" {
+		t.Fatalf("popped %+v", popped)
+	}
+
+	//QoS 0消息取出即释放, QoS 1消息的段保留到ack
+	if n := len(segments(t, dir)); n != 2 {
+		t.Fatalf("%d segments before ack", n)
+	}
+	q.ack(popped[1])
+	if n := len(segments(t, dir)); n != 1 {
+		t.Fatalf("%d segments after ack", n)
+	}
+	q.ack(popped[3])
+	if n := len(segments(t, dir)); n != 0 {
+		t.Fatalf("%d segments after all acks", n)
+	}
+}
+
+func TestSpillReload(t *testing.T) {
+	q, dir := spillQueue(t, OfflineLimit{SpillAfter: 1, TTL: time.Minute})
+	now := time.Now()
+	q.push(qosPublish("a", 1), now)
+	q.push(qosPublish("b", 1), now)
+	q.push(qosPublish("c", 1), now.Add(time.Minute))
+
+	//重新连接时过期的磁盘消息不再发送
+	msgs, err := q.drain(now.Add(time.Minute + time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].(*message.Publish).TopicName != "c" {
+		t.Fatalf("drained %+v", msgs)
+	}
+	if q._stats.Expired != 2 {
+		t.Fatalf("stats %+v", q._stats)
+	}
+	if n := len(segments(t, dir)); n != 0 {
+		t.Fatalf("%d segments after drain", n)
+	}
+}
+
+func TestSpillSpooled(t *testing.T) {
+	spoolDir := t.TempDir()
+	q, _ := spillQueue(t, OfflineLimit{SpillAfter: 1, SpoolSize: 16, SpoolDir: spoolDir})
+	now := time.Now()
+	payload := bytes.Repeat([]byte("x"), 64)
+	q.push(qosPublish("a", 1), now)
+	big := qosPublish("b", 1)
+	big.Payload = payload
+	q.push(big, now)
+
+	q.pop(now)
+	msg, err := q.pop(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//超过SpoolSize的负载读回时写入临时文件, 不读入内存
+	p := msg.(*message.Publish)
+	if p.Spool() == nil || len(p.Payload) != 0 {
+		t.Fatalf("payload not spooled, %d bytes in memory", len(p.Payload))
+	}
+	var buf bytes.Buffer
+	if _, err := p.Spool().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatalf("spooled payload %q", buf.Bytes())
+	}
+	p.Spool().Remove()
+}
+
+func TestSpillCorruption(t *testing.T) {
+	q, dir := spillQueue(t, OfflineLimit{SpillAfter: 1})
+	now := time.Now()
+	q.push(qosPublish("a", 1), now)
+	q.push(qosPublish("b", 1), now)
+	q.push(qosPublish("c", 1), now)
+
+	//截断第二个段, 其中的记录无法读取
+	files := segments(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("%d segments", len(files))
+	}
+	if err := os.Truncate(files[0], 5); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := q.pop(now)
+	if msg.(*message.Publish).TopicName != "a" || err != nil {
+		t.Fatalf("pop %+v, %v", msg, err)
+	}
+	msg, err = q.pop(now)
+	if err == nil {
+		t.Fatal("corrupted segment not reported")
+	}
+	if msg == nil || msg.(*message.Publish).TopicName != "c" {
+		t.Fatalf("pop after corruption %+v", msg)
+	}
+	if q._stats.Lost != 1 {
+		t.Fatalf("stats %+v", q._stats)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Fatalf("corrupted segment kept, %v", err)
+	}
+}
+
+func TestSessionSpillAck(t *testing.T) {
+	dir := t.TempDir()
+	s := newSession("c1", false, OfflineLimit{Count: 10, SpillDir: dir, SpillAfter: 1, SpillSegment: 1})
+	s.WithMaxInflight(1)
+	s.WriteMessage(qosPublish("a", 1))
+	s.WriteMessage(qosPublish("b", 1))
+	s.WriteMessage(qosPublish("c", 1))
+
+	o := &owner{}
+	s.claim(o)
+	if err := s.Attach(o); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"a", "b", "c"} {
+		sent := o.publishes()
+		p := sent[len(sent)-1]
+		if p.TopicName != topic {
+			t.Fatalf("sent %s, want %s", p.TopicName, topic)
+		}
+		if err := s.UnRefMessage(p.PacketIdentifier); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(segments(t, dir)); n != 0 {
+		t.Fatalf("%d segments after ack", n)
+	}
+}
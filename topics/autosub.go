@@ -0,0 +1,10 @@
+package topics
+
+//AutoSubscribe 连接时自动订阅的规则
+//Filter中%c替换为客户端ID, %u替换为用户名
+type AutoSubscribe struct {
+	Filter string `yaml:"filter" json:"filter"`
+	Qos    byte   `yaml:"qos" json:"qos"`
+	//Hidden 客户端不能取消该订阅
+	Hidden bool `yaml:"hidden" json:"hidden"`
+}
@@ -0,0 +1,94 @@
+package topics
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/yamakiller/magicMqtt/common"
+)
+
+const (
+	//defaultCacheSize 默认匹配缓存条目数
+	defaultCacheSize = 4096
+)
+
+// A cached match result. The subscriber and granted QoS slices are never
+// modified once the entry is stored, so they can be shared by readers.
+type matchEntry struct {
+	_topic string
+	_subs  []*common.Subscription
+	_qos   []byte
+	_gens  [3]uint64
+}
+
+// matchCache is a LRU cache of topic -> subscriber sets. Entries carry the
+// generations of the shards they were computed from and are treated as stale
+// once any of those shards changed.
+type matchCache struct {
+	_mu    sync.Mutex
+	_size  int
+	_ll    *list.List
+	_items map[string]*list.Element
+}
+
+func newMatchCache(size int) *matchCache {
+	return &matchCache{
+		_size:  size,
+		_ll:    list.New(),
+		_items: make(map[string]*list.Element),
+	}
+}
+
+func (slf *matchCache) get(topic string, gens [3]uint64) *matchEntry {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	e, ok := slf._items[topic]
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*matchEntry)
+	if entry._gens != gens {
+		slf._ll.Remove(e)
+		delete(slf._items, topic)
+		return nil
+	}
+
+	slf._ll.MoveToFront(e)
+	return entry
+}
+
+func (slf *matchCache) put(entry *matchEntry) {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	if slf._size <= 0 {
+		return
+	}
+
+	if e, ok := slf._items[entry._topic]; ok {
+		e.Value = entry
+		slf._ll.MoveToFront(e)
+		return
+	}
+
+	slf._items[entry._topic] = slf._ll.PushFront(entry)
+	for slf._ll.Len() > slf._size {
+		last := slf._ll.Back()
+		slf._ll.Remove(last)
+		delete(slf._items, last.Value.(*matchEntry)._topic)
+	}
+}
+
+func (slf *matchCache) resize(size int) {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	slf._size = size
+	for slf._ll.Len() > 0 && slf._ll.Len() > size {
+		last := slf._ll.Back()
+		slf._ll.Remove(last)
+		delete(slf._items, last.Value.(*matchEntry)._topic)
+	}
+}
@@ -1,10 +1,15 @@
 package topics
 
 import (
+	"bytes"
+	"container/list"
 	"fmt"
-	"reflect"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/yamakiller/magicMqtt/common"
 	"github.com/yamakiller/magicMqtt/encoding/message"
 )
 
@@ -21,16 +26,56 @@ const (
 
 var _ TopicsProvider = (*memTopics)(nil)
 
+const (
+	// Number of shards the subscription tree is split into by leading topic levels
+	subShards = 64
+)
+
 type memTopics struct {
-	// Sub/unsub mutex
-	_smu sync.RWMutex
-	// Subscription tree
-	_sroot *snode
+	// Subscription trees, sharded by the first two topic levels
+	_shards [subShards]*subShard
+	// Subscription trees for filters whose second level is a wildcard, sharded
+	// by the first topic level
+	_prefix [subShards]*subShard
+	// Subscription tree for filters whose first level is a wildcard, these
+	// are matched against every topic
+	_wild *subShard
+	// Cache of topic -> subscribers
+	_cache *matchCache
+
+	// Exclusive subscription mutex, taken before any shard mutex
+	_emu sync.Mutex
+	// Holders of exclusive filters, keyed by the filter without the prefix
+	_exclusive map[string]*common.Subscription
 
 	// Retained message mutex
 	_rmu sync.RWMutex
 	// Retained messages topic tree
 	_rroot *rnode
+	// Retained limits and accounting, guarded by _rmu
+	_rlimit   RetainLimit
+	_rstats   RetainStats
+	_retained map[string]*retainEntry
+	_rlist    *list.List
+	_rclients map[string]*retainUsage
+	// Retained messages with a TTL, earliest expiry first
+	_rexpiry retainHeap
+}
+
+// A subscription shard. _gen is bumped on every change so that cached match
+// results computed from an older tree are discarded.
+type subShard struct {
+	_mu   sync.RWMutex
+	_root *snode
+	_gen  uint64
+}
+
+func newSubShard() *subShard {
+	return &subShard{_root: newSNode()}
+}
+
+func (slf *subShard) generation() uint64 {
+	return atomic.LoadUint64(&slf._gen)
 }
 
 func init() {
@@ -42,10 +87,22 @@ func init() {
 // subscriptions and retained messages in memory. The content is not persistend so
 // when the server goes, everything will be gone. Use with care.
 func newMemProvider() *memTopics {
-	return &memTopics{
-		_sroot: newSNode(),
-		_rroot: newRNode(),
+	m := &memTopics{
+		_wild:      newSubShard(),
+		_cache:     newMatchCache(defaultCacheSize),
+		_exclusive: make(map[string]*common.Subscription),
+		_rroot:     newRNode(),
+		_retained:  make(map[string]*retainEntry),
+		_rlist:     list.New(),
+		_rclients:  make(map[string]*retainUsage),
 	}
+
+	for i := range m._shards {
+		m._shards[i] = newSubShard()
+		m._prefix[i] = newSubShard()
+	}
+
+	return m
 }
 
 //ValidQos Qos 是否有效
@@ -53,8 +110,87 @@ func ValidQos(qos byte) bool {
 	return qos == QosAtMostOnce || qos == QosAtLeastOnce || qos == QosExactlyOnce
 }
 
+//WithCacheSize 设置匹配缓存大小, 0表示关闭缓存
+func (slf *memTopics) WithCacheSize(size int) {
+	slf._cache.resize(size)
+}
+
+// shard returns the subscription shard that holds the filter. Filters are
+// sharded by their first two levels so that topics sharing the first level,
+// such as devices/{id}/cmd, spread over all shards. Filters with a wildcard in
+// the first level live in the wildcard shard, filters with a wildcard in the
+// second level in the prefix shard of their first level.
+func (slf *memTopics) shard(filter []byte) (*subShard, error) {
+	first, rem, err := nextTopicLevel(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	level := string(first)
+	if level == MWC || level == SWC {
+		return slf._wild, nil
+	}
+
+	if len(rem) == 0 {
+		return slf._shards[shardHash(first, nil)], nil
+	}
+
+	second, _, err := nextTopicLevel(rem)
+	if err != nil {
+		return nil, err
+	}
+
+	level = string(second)
+	if level == MWC || level == SWC {
+		return slf._prefix[shardHash(first, nil)], nil
+	}
+
+	return slf._shards[shardHash(first, second)], nil
+}
+
+// shards returns the subscription shards a topic has to be matched against,
+// the shard of its first two levels, the prefix shard of its first level and
+// the wildcard shard.
+func (slf *memTopics) shards(topic []byte) ([3]*subShard, error) {
+	first, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return [3]*subShard{}, err
+	}
+
+	level := string(first)
+	if level == MWC || level == SWC {
+		// Empty first level, only filters in the wildcard shard can match
+		return [3]*subShard{slf._wild, slf._wild, slf._wild}, nil
+	}
+
+	var second []byte
+	if len(rem) != 0 {
+		if second, _, err = nextTopicLevel(rem); err != nil {
+			return [3]*subShard{}, err
+		}
+	}
+
+	return [3]*subShard{
+		slf._shards[shardHash(first, second)],
+		slf._prefix[shardHash(first, nil)],
+		slf._wild,
+	}, nil
+}
+
+// shardHash returns the shard index of the first and, if not nil, the second
+// topic level.
+func shardHash(first, second []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(first)
+	if second != nil {
+		h.Write([]byte{'/'})
+		h.Write(second)
+	}
+	return h.Sum32() % subShards
+}
+
 //Subscribe 订阅
-func (slf *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte, error) {
+func (slf *memTopics) Subscribe(topic []byte, qos byte, sub *common.Subscription) (byte, error) {
 	if !ValidQos(qos) {
 		return QosFailure, fmt.Errorf("Invalid QoS %d", qos)
 	}
@@ -63,74 +199,235 @@ func (slf *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte,
 		return QosFailure, fmt.Errorf("Subscriber cannot be nil")
 	}
 
-	slf._smu.Lock()
-	defer slf._smu.Unlock()
+	if filter, ok := exclusiveFilter(topic); ok {
+		return slf.subscribeExclusive(filter, qos, sub)
+	}
+
+	return slf.subscribe(topic, qos, sub)
+}
+
+// subscribeExclusive grants the filter to the first subscriber, others are
+// rejected until the holder unsubscribes.
+func (slf *memTopics) subscribeExclusive(filter []byte, qos byte, sub *common.Subscription) (byte, error) {
+	if len(filter) == 0 {
+		return QosFailure, fmt.Errorf("Exclusive filter cannot be empty")
+	}
+
+	slf._emu.Lock()
+	defer slf._emu.Unlock()
 
-	if qos > QosExactlyOnce {
-		qos = QosExactlyOnce
+	key := string(filter)
+	if holder, ok := slf._exclusive[key]; ok && holder != sub && holder.Client != sub.Client {
+		return QosFailure, ErrExclusiveTaken
 	}
 
-	if err := slf._sroot.sinsert(topic, qos, sub); err != nil {
+	rqos, err := slf.subscribe(filter, qos, sub)
+	if err != nil {
+		return rqos, err
+	}
+
+	if holder, ok := slf._exclusive[key]; ok && holder != sub {
+		// The same client subscribed again with a new subscription
+		slf.unsubscribe(filter, holder)
+	}
+	slf._exclusive[key] = sub
+
+	return rqos, nil
+}
+
+func (slf *memTopics) subscribe(topic []byte, qos byte, sub *common.Subscription) (byte, error) {
+	shard, err := slf.shard(topic)
+	if err != nil {
 		return QosFailure, err
 	}
 
+	shard._mu.Lock()
+	defer shard._mu.Unlock()
+
+	if err := shard._root.sinsert(topic, qos, sub); err != nil {
+		return QosFailure, err
+	}
+	atomic.AddUint64(&shard._gen, 1)
+
 	return qos, nil
 }
 
-func (slf *memTopics) Unsubscribe(topic []byte, sub interface{}) error {
-	slf._smu.Lock()
-	defer slf._smu.Unlock()
+func (slf *memTopics) Unsubscribe(topic []byte, sub *common.Subscription) error {
+	if filter, ok := exclusiveFilter(topic); ok {
+		return slf.unsubscribeExclusive(filter, sub)
+	}
 
-	return slf._sroot.sremove(topic, sub)
+	return slf.unsubscribe(topic, sub)
+}
+
+func (slf *memTopics) unsubscribeExclusive(filter []byte, sub *common.Subscription) error {
+	slf._emu.Lock()
+	defer slf._emu.Unlock()
+
+	key := string(filter)
+	if holder, ok := slf._exclusive[key]; ok && holder == sub {
+		delete(slf._exclusive, key)
+	}
+
+	return slf.unsubscribe(filter, sub)
+}
+
+func (slf *memTopics) unsubscribe(topic []byte, sub *common.Subscription) error {
+	shard, err := slf.shard(topic)
+	if err != nil {
+		return err
+	}
+
+	shard._mu.Lock()
+	defer shard._mu.Unlock()
+
+	if err := shard._root.sremove(topic, sub); err != nil {
+		return err
+	}
+	atomic.AddUint64(&shard._gen, 1)
+
+	return nil
 }
 
 // Returned values will be invalidated by the next Subscribers call
-func (slf *memTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+func (slf *memTopics) Subscribers(topic []byte, qos byte, subs *[]*common.Subscription, qoss *[]byte) error {
 	if !ValidQos(qos) {
 		return fmt.Errorf("Invalid QoS %d", qos)
 	}
 
-	slf._smu.RLock()
-	defer slf._smu.RUnlock()
-
 	*subs = (*subs)[0:0]
 	*qoss = (*qoss)[0:0]
 
-	return slf._sroot.smatch(topic, qos, subs, qoss)
+	shards, err := slf.shards(topic)
+	if err != nil {
+		return err
+	}
+
+	// Generations are read before matching, a change racing with the match
+	// leaves an entry that is already stale.
+	var gens [3]uint64
+	for i, s := range shards {
+		gens[i] = s.generation()
+	}
+	key := string(topic)
+	entry := slf._cache.get(key, gens)
+	if entry == nil {
+		entry = &matchEntry{_topic: key, _gens: gens}
+		for i, s := range shards {
+			if i > 0 && s == shards[i-1] {
+				continue
+			}
+
+			s._mu.RLock()
+			err := s._root.smatch(topic, &entry._subs, &entry._qos)
+			s._mu.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+		slf._cache.put(entry)
+	}
+
+	for i, sub := range entry._subs {
+		*subs = append(*subs, sub)
+		if qos > entry._qos[i] {
+			*qoss = append(*qoss, entry._qos[i])
+		} else {
+			*qoss = append(*qoss, qos)
+		}
+	}
+
+	return nil
 }
 
-func (slf *memTopics) Retain(msg *message.Publish) error {
+// Retain stores the retained message published by client, an empty client is
+// not subject to the per client limits.
+func (slf *memTopics) Retain(client string, msg *message.Publish) error {
 	slf._rmu.Lock()
 	defer slf._rmu.Unlock()
 
+	now := time.Now()
+	slf.expireRetained(now)
+
 	// So apparently, at least according to the MQTT Conformance/Interoperability
 	// Testing, that a payload of 0 means delete the retain message.
 	// https://eclipse.org/paho/clients/testing/
-	if len(msg.Payload) == 0 {
-		return slf._rroot.rremove([]byte(msg.TopicName))
+	if msg.PayloadSize() == 0 {
+		return slf.unretain(msg.TopicName)
 	}
 
-	return slf._rroot.rinsertOrUpdate([]byte(msg.TopicName), msg)
+	return slf.retain(client, msg, now)
 }
 
+// Retained appends copies of the retained messages matching the filter, the
+// caller owns the copies and releases them once delivered.
+//
+// Expired messages are purged first, which needs the write lock; the read lock
+// is enough when nothing has expired.
 func (slf *memTopics) Retained(topic []byte, msgs *[]*message.Publish) error {
+	now := time.Now()
 	slf._rmu.RLock()
-	defer slf._rmu.RUnlock()
+	if slf._rexpiry.due(now) {
+		slf._rmu.RUnlock()
+		slf._rmu.Lock()
+		defer slf._rmu.Unlock()
+		slf.expireRetained(now)
+	} else {
+		defer slf._rmu.RUnlock()
+	}
+
+	if filter, ok := exclusiveFilter(topic); ok {
+		topic = filter
+	}
 
-	return slf._rroot.rmatch(topic, msgs)
+	n := len(*msgs)
+	err := slf._rroot.rmatch(topic, msgs, now)
+	for i := n; i < len(*msgs); i++ {
+		m := (*msgs)[i]
+		(*msgs)[i] = m.Envelope(m.QosLevel, true)
+	}
+	return err
 }
 
 //Close 关闭
 func (slf *memTopics) Close() error {
-	slf._sroot = nil
+	for i := range slf._shards {
+		slf._shards[i] = newSubShard()
+		slf._prefix[i] = newSubShard()
+	}
+	slf._wild = newSubShard()
+	slf._cache.resize(0)
+	slf._emu.Lock()
+	slf._exclusive = make(map[string]*common.Subscription)
+	slf._emu.Unlock()
+	slf._rmu.Lock()
+	for _, entry := range slf._retained {
+		entry._msg.Release()
+	}
 	slf._rroot = nil
+	slf._retained = make(map[string]*retainEntry)
+	slf._rlist = list.New()
+	slf._rclients = make(map[string]*retainUsage)
+	slf._rexpiry = nil
+	slf._rstats = RetainStats{}
+	slf._rmu.Unlock()
 	return nil
 }
 
+// exclusiveFilter returns the filter of an exclusive subscription without the
+// prefix.
+func exclusiveFilter(topic []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(topic, []byte(ExclusivePrefix)) {
+		return nil, false
+	}
+
+	return topic[len(ExclusivePrefix):], true
+}
+
 // subscrition nodes
 type snode struct {
 	// If this is the end of the topic string, then add subscribers here
-	_subs []interface{}
+	_subs []*common.Subscription
 	_qos  []byte
 
 	// Otherwise add the next topic level here
@@ -143,7 +440,7 @@ func newSNode() *snode {
 	}
 }
 
-func (slf *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
+func (slf *snode) sinsert(topic []byte, qos byte, sub *common.Subscription) error {
 	// If there's no more topic levels, that means we are at the matching snode
 	// to insert the subscriber. So let's see if there's such subscriber,
 	// if so, update it. Otherwise insert it.
@@ -151,7 +448,7 @@ func (slf *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 		// Let's see if the subscriber is already on the list. If yes, update
 		// QoS and then return.
 		for i := range slf._subs {
-			if equal(slf._subs[i], sub) {
+			if slf._subs[i] == sub {
 				slf._qos[i] = qos
 				return nil
 			}
@@ -163,7 +460,6 @@ func (slf *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 
 		return nil
 	}
-
 	// Not the last level, so let's find or create the next level snode, and
 	// recursively call it's insert().
 
@@ -187,7 +483,7 @@ func (slf *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 
 // This remove implementation ignores the QoS, as long as the subscriber
 // matches then it's removed
-func (slf *snode) sremove(topic []byte, sub interface{}) error {
+func (slf *snode) sremove(topic []byte, sub *common.Subscription) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the matching subscribers and remove them.
 	if len(topic) == 0 {
@@ -201,7 +497,7 @@ func (slf *snode) sremove(topic []byte, sub interface{}) error {
 		// If we find the subscriber then remove it from the list. Technically
 		// we just overwrite the slot by shifting all other items up by one.
 		for i := range slf._subs {
-			if equal(slf._subs[i], sub) {
+			if slf._subs[i] == sub {
 				slf._subs = append(slf._subs[:i], slf._subs[i+1:]...)
 				slf._qos = append(slf._qos[:i], slf._qos[i+1:]...)
 				return nil
@@ -246,13 +542,13 @@ func (slf *snode) sremove(topic []byte, sub interface{}) error {
 // with no wildcards (publish topic), it returns a list of subscribers that subscribes
 // to the topic. For each of the level names, it's a match
 // - if there are subscribers to '#', then all the subscribers are added to result set
-func (slf *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+func (slf *snode) smatch(topic []byte, subs *[]*common.Subscription, qoss *[]byte) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the subscribers that match the qos and append them to the list.
 	if len(topic) == 0 {
-		slf.matchQos(qos, subs, qoss)
+		slf.matchQos(subs, qoss)
 		if mwcn, _ := slf._snodes[MWC]; mwcn != nil {
-			mwcn.matchQos(qos, subs, qoss)
+			mwcn.matchQos(subs, qoss)
 		}
 		return nil
 	}
@@ -263,14 +559,22 @@ func (slf *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]by
 		return err
 	}
 
-	level := string(ntl)
+	// If there is a "#" node, then these subscribers are added to the result set
+	if n, ok := slf._snodes[MWC]; ok {
+		n.matchQos(subs, qoss)
+	}
 
-	for k, n := range slf._snodes {
-		// If the key is "#", then these subscribers are added to the result set
-		if k == MWC {
-			n.matchQos(qos, subs, qoss)
-		} else if k == SWC || k == level {
-			if err := n.smatch(rem, qos, subs, qoss); err != nil {
+	// Only the "+" node and the node named after this level can match, look
+	// them up directly instead of walking every child.
+	if n, ok := slf._snodes[SWC]; ok {
+		if err := n.smatch(rem, subs, qoss); err != nil {
+			return err
+		}
+	}
+
+	if string(ntl) != SWC {
+		if n, ok := slf._snodes[string(ntl)]; ok {
+			if err := n.smatch(rem, subs, qoss); err != nil {
 				return err
 			}
 		}
@@ -282,7 +586,7 @@ func (slf *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]by
 // retained message nodes
 type rnode struct {
 	// If this is the end of the topic string, then add retained messages here
-	_msg *message.Publish
+	_entry *retainEntry
 	// Otherwise add the next topic level here
 	_rnodes map[string]*rnode
 }
@@ -293,11 +597,11 @@ func newRNode() *rnode {
 	}
 }
 
-func (slf *rnode) rinsertOrUpdate(topic []byte, msg *message.Publish) error {
+func (slf *rnode) rinsertOrUpdate(topic []byte, entry *retainEntry) error {
 	// If there's no more topic levels, that means we are at the matching rnode.
 	if len(topic) == 0 {
 		// Reuse the message if possible
-		slf._msg = msg
+		slf._entry = entry
 
 		return nil
 	}
@@ -320,7 +624,7 @@ func (slf *rnode) rinsertOrUpdate(topic []byte, msg *message.Publish) error {
 		slf._rnodes[level] = n
 	}
 
-	return n.rinsertOrUpdate(rem, msg)
+	return n.rinsertOrUpdate(rem, entry)
 }
 
 // Remove the retained message for the supplied topic
@@ -328,7 +632,7 @@ func (slf *rnode) rremove(topic []byte) error {
 	// If the topic is empty, it means we are at the final matching rnode. If so,
 	// let's remove the buffer and message.
 	if len(topic) == 0 {
-		slf._msg = nil
+		slf._entry = nil
 		return nil
 	}
 
@@ -354,8 +658,9 @@ func (slf *rnode) rremove(topic []byte) error {
 		return err
 	}
 
-	// If there are no more rnodes to the next level we just visited let's remove it
-	if len(n._rnodes) == 0 {
+	// If there are no more rnodes or retained message at the next level we just
+	// visited let's remove it
+	if len(n._rnodes) == 0 && n._entry == nil {
 		delete(slf._rnodes, level)
 	}
 
@@ -365,12 +670,13 @@ func (slf *rnode) rremove(topic []byte) error {
 // rmatch() finds the retained messages for the topic and qos provided. It's somewhat
 // of a reverse match compare to match() since the supplied topic can contain
 // wildcards, whereas the retained message topic is a full (no wildcard) topic.
-func (slf *rnode) rmatch(topic []byte, msgs *[]*message.Publish) error {
+// Expired messages are skipped, they are removed once the limits are reached.
+func (slf *rnode) rmatch(topic []byte, msgs *[]*message.Publish, now time.Time) error {
 	// If the topic is empty, it means we are at the final matching rnode. If so,
 	// add the retained msg to the list.
 	if len(topic) == 0 {
-		if slf._msg != nil {
-			*msgs = append(*msgs, slf._msg)
+		if slf._entry != nil && !slf._entry.expired(now) {
+			*msgs = append(*msgs, slf._entry._msg)
 		}
 		return nil
 	}
@@ -385,18 +691,18 @@ func (slf *rnode) rmatch(topic []byte, msgs *[]*message.Publish) error {
 
 	if level == MWC {
 		// If '#', add all retained messages starting this node
-		slf.allRetained(msgs)
+		slf.allRetained(msgs, now)
 	} else if level == SWC {
 		// If '+', check all nodes at this level. Next levels must be matched.
 		for _, n := range slf._rnodes {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, msgs, now); err != nil {
 				return err
 			}
 		}
 	} else {
 		// Otherwise, find the matching node, go to the next level
 		if n, ok := slf._rnodes[level]; ok {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, msgs, now); err != nil {
 				return err
 			}
 		}
@@ -405,13 +711,13 @@ func (slf *rnode) rmatch(topic []byte, msgs *[]*message.Publish) error {
 	return nil
 }
 
-func (slf *rnode) allRetained(msgs *[]*message.Publish) {
-	if slf._msg != nil {
-		*msgs = append(*msgs, slf._msg)
+func (slf *rnode) allRetained(msgs *[]*message.Publish, now time.Time) {
+	if slf._entry != nil && !slf._entry.expired(now) {
+		*msgs = append(*msgs, slf._entry._msg)
 	}
 
 	for _, n := range slf._rnodes {
-		n.allRetained(msgs)
+		n.allRetained(msgs, now)
 	}
 }
 
@@ -476,82 +782,11 @@ func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
 	return topic, nil, nil
 }
 
-// The QoS of the payload messages sent in response to a subscription must be the
-// minimum of the QoS of the originally published message (in this case, it's the
-// qos parameter) and the maximum QoS granted by the server (in this case, it's
-// the QoS in the topic tree).
-//
-// It's also possible that even if the topic matches, the subscriber is not included
-// due to the QoS granted is lower than the published message QoS. For example,
-// if the client is granted only QoS 0, and the publish message is QoS 1, then this
-// client is not to be send the published message.
-func (slf *snode) matchQos(qos byte, subs *[]interface{}, qoss *[]byte) {
-	for _, sub := range slf._subs {
-		// If the published QoS is higher than the subscriber QoS, then we skip the
-		// subscriber. Otherwise, add to the list.
-		// if qos >= this.qos[i] {
-		*subs = append(*subs, sub)
-		*qoss = append(*qoss, qos)
-		// }
-	}
-}
-
-func equal(k1, k2 interface{}) bool {
-	if reflect.TypeOf(k1) != reflect.TypeOf(k2) {
-		return false
-	}
-
-	if reflect.ValueOf(k1).Kind() == reflect.Func {
-		return &k1 == &k2
-	}
-
-	if k1 == k2 {
-		return true
-	}
-
-	switch k1 := k1.(type) {
-	case string:
-		return k1 == k2.(string)
-
-	case int64:
-		return k1 == k2.(int64)
-
-	case int32:
-		return k1 == k2.(int32)
-
-	case int16:
-		return k1 == k2.(int16)
-
-	case int8:
-		return k1 == k2.(int8)
-
-	case int:
-		return k1 == k2.(int)
-
-	case float32:
-		return k1 == k2.(float32)
-
-	case float64:
-		return k1 == k2.(float64)
-
-	case uint:
-		return k1 == k2.(uint)
-
-	case uint8:
-		return k1 == k2.(uint8)
-
-	case uint16:
-		return k1 == k2.(uint16)
-
-	case uint32:
-		return k1 == k2.(uint32)
-
-	case uint64:
-		return k1 == k2.(uint64)
-
-	case uintptr:
-		return k1 == k2.(uintptr)
-	}
-
-	return false
+// matchQos appends the subscribers of this node together with the QoS granted
+// to each of them. The QoS of the payload messages sent in response to a
+// subscription must be the minimum of the QoS of the originally published
+// message and the maximum QoS granted by the server, Subscribers applies it.
+func (slf *snode) matchQos(subs *[]*common.Subscription, qoss *[]byte) {
+	*subs = append(*subs, slf._subs...)
+	*qoss = append(*qoss, slf._qos...)
 }
@@ -0,0 +1,203 @@
+package topics
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/common"
+)
+
+const benchSubscriptions = 1000000
+
+func subscribedClients(t *testing.T, m *memTopics, topic string) string {
+	var subs []*common.Subscription
+	var qoss []byte
+	if err := m.Subscribers([]byte(topic), 2, &subs, &qoss); err != nil {
+		t.Fatal(err)
+	}
+	clients := make([]string, len(subs))
+	for i, sub := range subs {
+		clients[i] = sub.Client
+	}
+	sort.Strings(clients)
+	return strings.Join(clients, ",")
+}
+
+func TestShardSpread(t *testing.T) {
+	m := newMemProvider()
+	used := make(map[*subShard]bool)
+	for i := 0; i < 1000; i++ {
+		shard, err := m.shard([]byte(fmt.Sprintf("devices/%d/cmd", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		used[shard] = true
+	}
+
+	//第一层相同的主题也要分散到各分片
+	if len(used) < subShards/2 {
+		t.Fatalf("devices/{id}/cmd uses %d of %d shards", len(used), subShards)
+	}
+}
+
+func TestSubscribersMatch(t *testing.T) {
+	m := newMemProvider()
+	for client, filter := range map[string]string{
+		"exact":  "devices/1/cmd",
+		"single": "devices",
+		"swc2":   "devices/+/cmd",
+		"mwc2":   "devices/#",
+		"swc1":   "+/1/cmd",
+		"mwc1":   "#",
+		"swc3":   "devices/1/+",
+		"empty":  "/devices",
+		"other":  "devices/2/cmd",
+	} {
+		sub := &common.Subscription{Client: client, Topic: filter, Qos: 1}
+		if _, err := m.Subscribe([]byte(filter), 1, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for topic, want := range map[string]string{
+		"devices/1/cmd":   "exact,mwc1,mwc2,swc1,swc2,swc3",
+		"devices/2/cmd":   "mwc1,mwc2,other,swc2",
+		"devices/1/state": "mwc1,mwc2,swc3",
+		"devices":         "mwc1,mwc2,single",
+		"devices/1":       "mwc1,mwc2",
+		"sensors/1/cmd":   "mwc1,swc1",
+		"/devices":        "empty,mwc1",
+	} {
+		if got := subscribedClients(t, m, topic); got != want {
+			t.Errorf("%s matched %s, want %s", topic, got, want)
+		}
+	}
+}
+
+func TestSubscribersCacheInvalidation(t *testing.T) {
+	m := newMemProvider()
+	subs := make(map[string]*common.Subscription)
+	subscribe := func(client, filter string) {
+		sub := &common.Subscription{Client: client, Topic: filter, Qos: 1}
+		if _, err := m.Subscribe([]byte(filter), 1, sub); err != nil {
+			t.Fatal(err)
+		}
+		subs[client] = sub
+	}
+	expect := func(want string) {
+		t.Helper()
+		if got := subscribedClients(t, m, "devices/1/cmd"); got != want {
+			t.Fatalf("matched %s, want %s", got, want)
+		}
+	}
+
+	subscribe("a", "devices/1/cmd")
+	expect("a")
+	expect("a")
+
+	//三类分片的变化都要让缓存失效
+	subscribe("b", "devices/1/cmd")
+	expect("a,b")
+	subscribe("c", "devices/+/cmd")
+	expect("a,b,c")
+	subscribe("d", "+/1/cmd")
+	expect("a,b,c,d")
+
+	//其他分片的变化不影响缓存结果
+	subscribe("e", "sensors/1/cmd")
+	expect("a,b,c,d")
+
+	for _, client := range []string{"a", "c", "d"} {
+		if err := m.Unsubscribe([]byte(subs[client].Topic), subs[client]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("b")
+}
+
+var (
+	benchOnce     sync.Once
+	benchProvider *memTopics
+)
+
+// benchTopics returns a provider holding 1M exact subscriptions of the form
+// devices/{n}/cmd plus a few hundred wildcard subscriptions.
+func benchTopics(b *testing.B) *memTopics {
+	benchOnce.Do(func() {
+		benchProvider = newMemProvider()
+		for i := 0; i < benchSubscriptions; i++ {
+			topic := fmt.Sprintf("devices/%d/cmd", i)
+			sub := &common.Subscription{Client: fmt.Sprintf("c%d", i), Topic: topic, Qos: 1}
+			if _, err := benchProvider.Subscribe([]byte(topic), 1, sub); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 100; i++ {
+			for _, topic := range []string{"devices/+/cmd", "devices/#", "#"} {
+				sub := &common.Subscription{Client: fmt.Sprintf("w%d", i), Topic: topic, Qos: 0}
+				if _, err := benchProvider.Subscribe([]byte(topic), 0, sub); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	return benchProvider
+}
+
+func BenchmarkSubscribers1M(b *testing.B) {
+	p := benchTopics(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		var subs []*common.Subscription
+		var qoss []byte
+		for pb.Next() {
+			topic := []byte(fmt.Sprintf("devices/%d/cmd", r.Intn(benchSubscriptions)))
+			if err := p.Subscribers(topic, 1, &subs, &qoss); err != nil {
+				b.Fatal(err)
+			}
+			if len(subs) != 301 {
+				b.Fatalf("matched %d subscribers", len(subs))
+			}
+		}
+	})
+}
+
+func BenchmarkSubscribers1MHotTopic(b *testing.B) {
+	p := benchTopics(b)
+	topic := []byte("devices/42/cmd")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var subs []*common.Subscription
+		var qoss []byte
+		for pb.Next() {
+			if err := p.Subscribers(topic, 1, &subs, &qoss); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSubscribe1M(b *testing.B) {
+	p := benchTopics(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic := fmt.Sprintf("bench/%d/cmd", i)
+		sub := &common.Subscription{Client: "bench", Topic: topic, Qos: 1}
+		if _, err := p.Subscribe([]byte(topic), 1, sub); err != nil {
+			b.Fatal(err)
+		}
+		if err := p.Unsubscribe([]byte(topic), sub); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package topics
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+var (
+	//ErrRetainDisabled 主题禁止保留消息
+	ErrRetainDisabled = errors.New("retain disabled on topic")
+	//ErrRetainTooLarge 保留消息超过大小限制
+	ErrRetainTooLarge = errors.New("retained message too large")
+)
+
+//RetainPolicy 按过滤器配置的保留消息策略
+type RetainPolicy struct {
+	//Filter 主题过滤器, 支持通配符
+	Filter string `yaml:"filter" json:"filter"`
+	//Disable 禁止在匹配的主题上保留消息
+	Disable bool `yaml:"disable" json:"disable"`
+	//TTL 保留消息有效期(秒), <=0 时使用全局有效期
+	TTL int `yaml:"ttl" json:"ttl"`
+}
+
+//RetainLimit 保留消息限制, 各项<=0表示不限制
+type RetainLimit struct {
+	//Count 最大保留消息数
+	Count int
+	//Bytes 最大保留消息字节数
+	Bytes int
+	//ClientCount 每个客户端最大保留消息数
+	ClientCount int
+	//ClientBytes 每个客户端最大保留消息字节数
+	ClientBytes int
+	//TTL 保留消息有效期
+	TTL time.Duration
+	//Policies 按过滤器配置的策略, 使用第一个匹配的策略
+	Policies []RetainPolicy
+}
+
+//RetainStats 保留消息统计
+type RetainStats struct {
+	//Count 当前保留消息数
+	Count int
+	//Bytes 当前保留消息字节数
+	Bytes int
+	//Rejected 被拒绝保留的消息数
+	Rejected uint64
+	//Evicted 因超出限制被淘汰的消息数
+	Evicted uint64
+	//Expired 过期被删除的消息数
+	Expired uint64
+}
+
+// A retained message together with its accounting information.
+type retainEntry struct {
+	_topic  string
+	_client string
+	_msg    *message.Publish
+	_size   int
+	_expire time.Time
+	// Position in the global and per client lists, oldest first
+	_elem  *list.Element
+	_celem *list.Element
+	// Index in the expiry heap, -1 when the message never expires
+	_hindex int
+}
+
+func (slf *retainEntry) expired(now time.Time) bool {
+	return !slf._expire.IsZero() && !slf._expire.After(now)
+}
+
+// retainHeap orders the retained messages with a TTL by expiry, so expired
+// messages are found without scanning every retained message.
+type retainHeap []*retainEntry
+
+func (h retainHeap) Len() int { return len(h) }
+
+func (h retainHeap) Less(i, j int) bool { return h[i]._expire.Before(h[j]._expire) }
+
+func (h retainHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i]._hindex = i
+	h[j]._hindex = j
+}
+
+func (h *retainHeap) Push(x interface{}) {
+	entry := x.(*retainEntry)
+	entry._hindex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *retainHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry._hindex = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// due reports whether the earliest message has expired.
+func (h retainHeap) due(now time.Time) bool {
+	return len(h) > 0 && h[0].expired(now)
+}
+
+// Retained messages published by one client.
+type retainUsage struct {
+	_list  *list.List
+	_bytes int
+}
+
+// policy returns the first policy whose filter matches the topic.
+func (slf *RetainLimit) policy(topic string) *RetainPolicy {
+	for i := range slf.Policies {
+		if MatchFilter(slf.Policies[i].Filter, topic) {
+			return &slf.Policies[i]
+		}
+	}
+	return nil
+}
+
+// MatchFilter reports whether the topic matches the filter.
+func MatchFilter(filter, topic string) bool {
+	// Wildcards at the first level never match system topics
+	if strings.HasPrefix(topic, SYS) && (strings.HasPrefix(filter, MWC) || strings.HasPrefix(filter, SWC)) {
+		return false
+	}
+
+	fs := strings.Split(filter, SEP)
+	ts := strings.Split(topic, SEP)
+	for i, f := range fs {
+		if f == MWC {
+			return true
+		}
+
+		if i >= len(ts) {
+			return false
+		}
+
+		if f != SWC && f != ts[i] {
+			return false
+		}
+	}
+
+	return len(fs) == len(ts)
+}
+
+//WithRetainLimit 设置保留消息限制, 已保留的消息在下次保留时按新限制淘汰
+func (slf *memTopics) WithRetainLimit(limit RetainLimit) {
+	slf._rmu.Lock()
+	defer slf._rmu.Unlock()
+	slf._rlimit = limit
+}
+
+//RetainStats 返回保留消息统计
+func (slf *memTopics) RetainStats() RetainStats {
+	slf._rmu.RLock()
+	defer slf._rmu.RUnlock()
+	return slf._rstats
+}
+
+// retain stores the message as the retained message of its topic, evicting
+// the oldest messages when a limit is reached. Must hold _rmu.
+func (slf *memTopics) retain(client string, msg *message.Publish, now time.Time) error {
+	limit := &slf._rlimit
+	ttl := limit.TTL
+	if p := limit.policy(msg.TopicName); p != nil {
+		if p.Disable {
+			slf._rstats.Rejected++
+			return ErrRetainDisabled
+		}
+
+		if p.TTL > 0 {
+			ttl = time.Duration(p.TTL) * time.Second
+		}
+	}
+
+	size := len(msg.TopicName) + msg.PayloadSize()
+	if (limit.Bytes > 0 && size > limit.Bytes) ||
+		(client != "" && limit.ClientBytes > 0 && size > limit.ClientBytes) {
+		slf._rstats.Rejected++
+		return ErrRetainTooLarge
+	}
+
+	if old, ok := slf._retained[msg.TopicName]; ok {
+		slf.unaccount(old)
+	}
+
+	if client != "" {
+		usage := slf._rclients[client]
+		for usage != nil && usage._list.Len() > 0 &&
+			((limit.ClientCount > 0 && usage._list.Len() >= limit.ClientCount) ||
+				(limit.ClientBytes > 0 && usage._bytes+size > limit.ClientBytes)) {
+			slf.evict(usage._list.Front().Value.(*retainEntry))
+			usage = slf._rclients[client]
+		}
+	}
+
+	for slf._rlist.Len() > 0 && slf.rfull(size) {
+		slf.evict(slf._rlist.Front().Value.(*retainEntry))
+	}
+
+	//保存持有负载引用的副本, 调用者仍持有原消息
+	entry := &retainEntry{
+		_topic:  msg.TopicName,
+		_client: client,
+		_msg:    msg.Envelope(msg.QosLevel, true),
+		_size:   size,
+		_hindex: -1,
+	}
+	if ttl > 0 {
+		entry._expire = now.Add(ttl)
+	}
+
+	if err := slf._rroot.rinsertOrUpdate([]byte(msg.TopicName), entry); err != nil {
+		entry._msg.Release()
+		return err
+	}
+	slf.account(entry)
+
+	return nil
+}
+
+// unretain removes the retained message of the topic. Must hold _rmu.
+func (slf *memTopics) unretain(topic string) error {
+	if entry, ok := slf._retained[topic]; ok {
+		slf.unaccount(entry)
+	}
+
+	return slf._rroot.rremove([]byte(topic))
+}
+
+// rfull reports whether adding size bytes would exceed the global limits.
+func (slf *memTopics) rfull(size int) bool {
+	limit := &slf._rlimit
+	return (limit.Count > 0 && slf._rstats.Count >= limit.Count) ||
+		(limit.Bytes > 0 && slf._rstats.Bytes+size > limit.Bytes)
+}
+
+// evict removes a retained message to make room for a new one.
+func (slf *memTopics) evict(entry *retainEntry) {
+	slf.unaccount(entry)
+	slf._rroot.rremove([]byte(entry._topic))
+	slf._rstats.Evicted++
+}
+
+// expireRetained removes all expired retained messages, earliest first. Must
+// hold _rmu.
+func (slf *memTopics) expireRetained(now time.Time) {
+	for slf._rexpiry.due(now) {
+		entry := slf._rexpiry[0]
+		slf.unaccount(entry)
+		slf._rroot.rremove([]byte(entry._topic))
+		slf._rstats.Expired++
+	}
+}
+
+func (slf *memTopics) account(entry *retainEntry) {
+	slf._retained[entry._topic] = entry
+	entry._elem = slf._rlist.PushBack(entry)
+	if !entry._expire.IsZero() {
+		heap.Push(&slf._rexpiry, entry)
+	}
+	slf._rstats.Count++
+	slf._rstats.Bytes += entry._size
+
+	if entry._client == "" {
+		return
+	}
+
+	usage, ok := slf._rclients[entry._client]
+	if !ok {
+		usage = &retainUsage{_list: list.New()}
+		slf._rclients[entry._client] = usage
+	}
+	entry._celem = usage._list.PushBack(entry)
+	usage._bytes += entry._size
+}
+
+//unaccount 移除保留消息的统计并释放消息
+func (slf *memTopics) unaccount(entry *retainEntry) {
+	if cur, ok := slf._retained[entry._topic]; !ok || cur != entry {
+		return
+	}
+
+	entry._msg.Release()
+	delete(slf._retained, entry._topic)
+	slf._rlist.Remove(entry._elem)
+	if entry._hindex >= 0 {
+		heap.Remove(&slf._rexpiry, entry._hindex)
+	}
+	slf._rstats.Count--
+	slf._rstats.Bytes -= entry._size
+
+	if entry._client == "" {
+		return
+	}
+
+	if usage, ok := slf._rclients[entry._client]; ok {
+		usage._list.Remove(entry._celem)
+		usage._bytes -= entry._size
+		if usage._list.Len() == 0 {
+			delete(slf._rclients, entry._client)
+		}
+	}
+}
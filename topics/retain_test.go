@@ -0,0 +1,213 @@
+package topics
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func retainedMessage(topic string) *message.Publish {
+	msg := message.SpawnPublishMessage()
+	msg.TopicName = topic
+	msg.QosLevel = 1
+	msg.Payload = []byte("v")
+	return msg
+}
+
+func retainedTopics(t *testing.T, m *memTopics, filter string) []string {
+	var msgs []*message.Publish
+	if err := m.Retained([]byte(filter), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	topics := make([]string, len(msgs))
+	for i, msg := range msgs {
+		topics[i] = msg.TopicName
+	}
+	return topics
+}
+
+func TestRetainExpiry(t *testing.T) {
+	m := newMemProvider()
+	m.WithRetainLimit(RetainLimit{
+		TTL:      time.Hour,
+		Policies: []RetainPolicy{{Filter: "short/#", TTL: 1}},
+	})
+
+	//有效期短的消息后保留也先过期
+	past := time.Now().Add(-2 * time.Second)
+	m._rmu.Lock()
+	m.retain("", retainedMessage("long/a"), past)
+	m.retain("", retainedMessage("short/a"), past)
+	m._rmu.Unlock()
+
+	//没有设置数量限制时, 读取保留消息也会清除过期的消息
+	if got := retainedTopics(t, m, "#"); len(got) != 1 || got[0] != "long/a" {
+		t.Fatalf("retained %v", got)
+	}
+	if stats := m.RetainStats(); stats.Count != 1 || stats.Expired != 1 || len(m._rexpiry) != 1 {
+		t.Fatalf("stats %+v, %d expiring", stats, len(m._rexpiry))
+	}
+
+	//替换与删除的消息不再等待过期
+	m.Retain("", retainedMessage("long/a"))
+	if len(m._rexpiry) != 1 || m._rexpiry[0]._msg.TopicName != "long/a" {
+		t.Fatalf("%d expiring after replace", len(m._rexpiry))
+	}
+	empty := retainedMessage("long/a")
+	empty.Payload = nil
+	m.Retain("", empty)
+	if stats := m.RetainStats(); stats.Count != 0 || len(m._rexpiry) != 0 {
+		t.Fatalf("stats %+v, %d expiring after delete", stats, len(m._rexpiry))
+	}
+}
+
+func TestRetainExpiryOnRetain(t *testing.T) {
+	m := newMemProvider()
+	m.WithRetainLimit(RetainLimit{TTL: time.Second})
+	m._rmu.Lock()
+	m.retain("", retainedMessage("a"), time.Now().Add(-time.Minute))
+	m._rmu.Unlock()
+
+	//保留新消息时清除过期的消息
+	m.Retain("", retainedMessage("b"))
+	if stats := m.RetainStats(); stats.Count != 1 || stats.Expired != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestRetainedCopies(t *testing.T) {
+	m := newMemProvider()
+	m.Retain("", retainedMessage("a"))
+
+	//返回的是副本, 调用者修改QoS不影响保留的消息
+	var msgs []*message.Publish
+	m.Retained([]byte("a"), &msgs)
+	msgs[0].QosLevel = 0
+	msgs = msgs[:0]
+	m.Retained([]byte("a"), &msgs)
+	if len(msgs) != 1 || msgs[0].QosLevel != 1 || msgs[0].Retain != 1 {
+		t.Fatalf("retained %+v", msgs)
+	}
+}
+
+func TestRetainLimits(t *testing.T) {
+	type step struct {
+		client string
+		topic  string
+		err    error
+	}
+	tests := []struct {
+		name     string
+		limit    RetainLimit
+		steps    []step
+		retained []string
+		evicted  uint64
+		rejected uint64
+	}{
+		{
+			name:     "count",
+			limit:    RetainLimit{Count: 2},
+			steps:    []step{{topic: "a"}, {topic: "b"}, {topic: "c"}},
+			retained: []string{"b", "c"},
+			evicted:  1,
+		},
+		{
+			//替换已保留的主题不淘汰其它消息, 替换后的消息最新
+			name:     "count replace",
+			limit:    RetainLimit{Count: 2},
+			steps:    []step{{topic: "a"}, {topic: "b"}, {topic: "a"}, {topic: "c"}},
+			retained: []string{"a", "c"},
+			evicted:  1,
+		},
+		{
+			//每条消息占用主题与负载的字节数
+			name:     "bytes",
+			limit:    RetainLimit{Bytes: 4},
+			steps:    []step{{topic: "a"}, {topic: "b"}, {topic: "c"}},
+			retained: []string{"b", "c"},
+			evicted:  1,
+		},
+		{
+			name:     "bytes too large",
+			limit:    RetainLimit{Bytes: 4},
+			steps:    []step{{topic: "a"}, {topic: "long", err: ErrRetainTooLarge}},
+			retained: []string{"a"},
+			rejected: 1,
+		},
+		{
+			//只淘汰同一客户端的消息
+			name:  "client count",
+			limit: RetainLimit{ClientCount: 1},
+			steps: []step{{client: "x", topic: "a"}, {client: "y", topic: "b"},
+				{client: "x", topic: "c"}, {topic: "d"}},
+			retained: []string{"b", "c", "d"},
+			evicted:  1,
+		},
+		{
+			name:  "client bytes",
+			limit: RetainLimit{ClientBytes: 4},
+			steps: []step{{client: "x", topic: "a"}, {client: "x", topic: "b"},
+				{client: "x", topic: "c"}, {client: "y", topic: "d"},
+				{client: "x", topic: "long", err: ErrRetainTooLarge}},
+			retained: []string{"b", "c", "d"},
+			evicted:  1,
+			rejected: 1,
+		},
+		{
+			name:     "disable",
+			limit:    RetainLimit{Policies: []RetainPolicy{{Filter: "off/#", Disable: true}}},
+			steps:    []step{{topic: "off/a", err: ErrRetainDisabled}, {topic: "on/a"}},
+			retained: []string{"on/a"},
+			rejected: 1,
+		},
+		{
+			//使用第一个匹配的策略
+			name: "first match",
+			limit: RetainLimit{Policies: []RetainPolicy{
+				{Filter: "off/keep", TTL: 60},
+				{Filter: "off/#", Disable: true},
+			}},
+			steps:    []step{{topic: "off/keep"}, {topic: "off/a", err: ErrRetainDisabled}},
+			retained: []string{"off/keep"},
+			rejected: 1,
+		},
+		{
+			name: "first match disable",
+			limit: RetainLimit{Policies: []RetainPolicy{
+				{Filter: "off/#", Disable: true},
+				{Filter: "off/keep", TTL: 60},
+			}},
+			steps: []step{{topic: "off/keep", err: ErrRetainDisabled},
+				{topic: "off/a", err: ErrRetainDisabled}},
+			rejected: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemProvider()
+			m.WithRetainLimit(tt.limit)
+			for _, s := range tt.steps {
+				if err := m.Retain(s.client, retainedMessage(s.topic)); err != s.err {
+					t.Fatalf("retain %s: %v, want %v", s.topic, err, s.err)
+				}
+			}
+
+			got := retainedTopics(t, m, "#")
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.retained, ",") {
+				t.Fatalf("retained %v, want %v", got, tt.retained)
+			}
+			//每条消息的负载为1字节
+			bytes := len(strings.Join(tt.retained, "")) + len(tt.retained)
+			stats := m.RetainStats()
+			if stats.Count != len(tt.retained) || stats.Bytes != bytes ||
+				stats.Evicted != tt.evicted || stats.Rejected != tt.rejected {
+				t.Fatalf("stats %+v", stats)
+			}
+		})
+	}
+}
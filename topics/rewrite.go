@@ -0,0 +1,116 @@
+package topics
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	//RewritePublish 重写PUBLISH主题
+	RewritePublish = "publish"
+	//RewriteSubscribe 重写SUBSCRIBE/UNSUBSCRIBE过滤器
+	RewriteSubscribe = "subscribe"
+	//RewriteAll 同时重写主题与过滤器
+	RewriteAll = "all"
+)
+
+var (
+	//ErrUnsafePlaceholder 替换占位符的客户端ID或用户名为空, 或包含主题分隔符与通配符
+	ErrUnsafePlaceholder = errors.New("client id or username not allowed in topic placeholder")
+)
+
+//RewriteRule 主题重写规则
+//Pattern匹配时整个主题被替换为Replace, Replace中可以使用$1等捕获组,
+//%c替换为客户端ID, %u替换为用户名
+type RewriteRule struct {
+	Action  string `yaml:"action" json:"action"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Replace string `yaml:"replace" json:"replace"`
+}
+
+type rewriteRule struct {
+	_re      *regexp.Regexp
+	_replace string
+}
+
+//Rewriter 主题重写器, 按配置顺序匹配, 使用第一条匹配的规则
+type Rewriter struct {
+	_publish   []rewriteRule
+	_subscribe []rewriteRule
+}
+
+//NewRewriter 编译重写规则
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	r := &Rewriter{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %q: %s", rule.Pattern, err.Error())
+		}
+
+		compiled := rewriteRule{_re: re, _replace: rule.Replace}
+		switch strings.ToLower(rule.Action) {
+		case RewritePublish:
+			r._publish = append(r._publish, compiled)
+		case RewriteSubscribe:
+			r._subscribe = append(r._subscribe, compiled)
+		case RewriteAll, "":
+			r._publish = append(r._publish, compiled)
+			r._subscribe = append(r._subscribe, compiled)
+		default:
+			return nil, fmt.Errorf("rewrite rule %q: unknown action %q", rule.Pattern, rule.Action)
+		}
+	}
+
+	return r, nil
+}
+
+//Publish 重写PUBLISH主题
+func (slf *Rewriter) Publish(topic, clientID, username string) (string, error) {
+	if slf == nil {
+		return topic, nil
+	}
+	return rewrite(slf._publish, topic, clientID, username)
+}
+
+//Subscribe 重写SUBSCRIBE/UNSUBSCRIBE过滤器
+func (slf *Rewriter) Subscribe(filter, clientID, username string) (string, error) {
+	if slf == nil {
+		return filter, nil
+	}
+	return rewrite(slf._subscribe, filter, clientID, username)
+}
+
+func rewrite(rules []rewriteRule, topic, clientID, username string) (string, error) {
+	for _, rule := range rules {
+		match := rule._re.FindStringSubmatchIndex(topic)
+		if match == nil {
+			continue
+		}
+
+		result := rule._re.ExpandString(nil, rule._replace, topic, match)
+		return Placeholders(string(result), clientID, username)
+	}
+
+	return topic, nil
+}
+
+//Placeholders 替换%c为客户端ID, %u为用户名
+//被使用的值为空或包含'/'、'+'、'#'时返回ErrUnsafePlaceholder, 客户端不能借此改变主题层级或注入通配符
+func Placeholders(s, clientID, username string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	if (strings.Contains(s, "%c") && !safePlaceholder(clientID)) ||
+		(strings.Contains(s, "%u") && !safePlaceholder(username)) {
+		return "", ErrUnsafePlaceholder
+	}
+	return strings.NewReplacer("%c", clientID, "%u", username).Replace(s), nil
+}
+
+func safePlaceholder(v string) bool {
+	return v != "" && !strings.ContainsAny(v, SEP+_WC)
+}
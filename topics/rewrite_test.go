@@ -0,0 +1,60 @@
+package topics
+
+import "testing"
+
+func TestPlaceholders(t *testing.T) {
+	cases := []struct {
+		s, clientID, username string
+		want                  string
+		err                   error
+	}{
+		{"t/%c/%u", "dev1", "alice", "t/dev1/alice", nil},
+		{"t/fixed", "", "", "t/fixed", nil},
+		//未使用的占位符不检查
+		{"t/%c", "dev1", "a/b", "t/dev1", nil},
+		{"t/%c/cmd", "a/b", "", "", ErrUnsafePlaceholder},
+		{"t/%c/cmd", "+", "", "", ErrUnsafePlaceholder},
+		{"t/%c/cmd", "#", "", "", ErrUnsafePlaceholder},
+		{"t/%c/cmd", "", "", "", ErrUnsafePlaceholder},
+		{"t/%u/cmd", "dev1", "", "", ErrUnsafePlaceholder},
+		{"t/%u/cmd", "dev1", "x#", "", ErrUnsafePlaceholder},
+	}
+
+	for _, c := range cases {
+		got, err := Placeholders(c.s, c.clientID, c.username)
+		if got != c.want || err != c.err {
+			t.Errorf("Placeholders(%q, %q, %q) = %q, %v", c.s, c.clientID, c.username, got, err)
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	r, err := NewRewriter([]RewriteRule{
+		{Action: RewritePublish, Pattern: `^up/(.*)$`, Replace: "tenant/%u/$1"},
+		{Action: RewriteSubscribe, Pattern: `^down/(.*)$`, Replace: "tenant/%u/%c/$1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := r.Publish("up/temp", "dev1", "alice"); got != "tenant/alice/temp" || err != nil {
+		t.Fatalf("publish %q, %v", got, err)
+	}
+	if got, err := r.Publish("other", "dev1", "+"); got != "other" || err != nil {
+		t.Fatalf("unmatched publish %q, %v", got, err)
+	}
+	if _, err := r.Publish("up/temp", "dev1", "#"); err != ErrUnsafePlaceholder {
+		t.Fatalf("publish with unsafe username: %v", err)
+	}
+	if got, err := r.Subscribe("down/#", "dev1", "alice"); got != "tenant/alice/dev1/#" || err != nil {
+		t.Fatalf("subscribe %q, %v", got, err)
+	}
+	if _, err := r.Subscribe("down/#", "+", "alice"); err != ErrUnsafePlaceholder {
+		t.Fatalf("subscribe with unsafe client id: %v", err)
+	}
+
+	var none *Rewriter
+	if got, err := none.Subscribe("a/%c", "#", ""); got != "a/%c" || err != nil {
+		t.Fatalf("nil rewriter %q, %v", got, err)
+	}
+}
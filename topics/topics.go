@@ -1,8 +1,10 @@
 package topics
 
 import (
+	"errors"
 	"fmt"
 
+	"github.com/yamakiller/magicMqtt/common"
 	"github.com/yamakiller/magicMqtt/encoding/message"
 )
 
@@ -21,18 +23,24 @@ const (
 
 	// Both wildcards
 	_WC = "#+"
+
+	// ExclusivePrefix marks a filter that only one client can hold at a time
+	ExclusivePrefix = "$exclusive/"
 )
 
 var (
 	providers = make(map[string]TopicsProvider)
+
+	//ErrExclusiveTaken 排他订阅已被其它客户端持有
+	ErrExclusiveTaken = errors.New("exclusive subscription taken")
 )
 
 //TopicsProvider 主题接口
 type TopicsProvider interface {
-	Subscribe(topic []byte, qos byte, subscriber interface{}) (byte, error)
-	Unsubscribe(topic []byte, subscriber interface{}) error
-	Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error
-	Retain(msg *message.Publish) error
+	Subscribe(topic []byte, qos byte, subscriber *common.Subscription) (byte, error)
+	Unsubscribe(topic []byte, subscriber *common.Subscription) error
+	Subscribers(topic []byte, qos byte, subs *[]*common.Subscription, qoss *[]byte) error
+	Retain(client string, msg *message.Publish) error
 	Retained(topic []byte, msgs *[]*message.Publish) error
 	Close() error
 }
@@ -71,23 +79,23 @@ func NewManager(providerName string) (*Manager, error) {
 }
 
 //Subscribe 订阅主题
-func (slf *Manager) Subscribe(topic []byte, qos byte, subscriber interface{}) (byte, error) {
+func (slf *Manager) Subscribe(topic []byte, qos byte, subscriber *common.Subscription) (byte, error) {
 	return slf._p.Subscribe(topic, qos, subscriber)
 }
 
 //Unsubscribe 取消订阅
-func (slf *Manager) Unsubscribe(topic []byte, subscriber interface{}) error {
+func (slf *Manager) Unsubscribe(topic []byte, subscriber *common.Subscription) error {
 	return slf._p.Unsubscribe(topic, subscriber)
 }
 
 //Subscribers 订阅多个主题
-func (slf *Manager) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+func (slf *Manager) Subscribers(topic []byte, qos byte, subs *[]*common.Subscription, qoss *[]byte) error {
 	return slf._p.Subscribers(topic, qos, subs, qoss)
 }
 
-//Retain ...
-func (slf *Manager) Retain(msg *message.Publish) error {
-	return slf._p.Retain(msg)
+//Retain 保存client发布的保留消息, client为空时不受每个客户端的限制
+func (slf *Manager) Retain(client string, msg *message.Publish) error {
+	return slf._p.Retain(client, msg)
 }
 
 //Retained ...
@@ -95,6 +103,28 @@ func (slf *Manager) Retained(topic []byte, msgs *[]*message.Publish) error {
 	return slf._p.Retained(topic, msgs)
 }
 
+//WithCacheSize 设置匹配缓存大小, 提供者不支持缓存时忽略
+func (slf *Manager) WithCacheSize(size int) {
+	if p, ok := slf._p.(interface{ WithCacheSize(int) }); ok {
+		p.WithCacheSize(size)
+	}
+}
+
+//WithRetainLimit 设置保留消息限制, 提供者不支持时忽略
+func (slf *Manager) WithRetainLimit(limit RetainLimit) {
+	if p, ok := slf._p.(interface{ WithRetainLimit(RetainLimit) }); ok {
+		p.WithRetainLimit(limit)
+	}
+}
+
+//RetainStats 返回保留消息统计, 提供者不支持时返回空统计
+func (slf *Manager) RetainStats() RetainStats {
+	if p, ok := slf._p.(interface{ RetainStats() RetainStats }); ok {
+		return p.RetainStats()
+	}
+	return RetainStats{}
+}
+
 //Close 关闭
 func (slf *Manager) Close() error {
 	return slf._p.Close()
@@ -0,0 +1,67 @@
+package topics
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+const (
+	//MaxTopicLength 协议允许的最大主题长度
+	MaxTopicLength = 65535
+)
+
+var (
+	//ErrTopicTooLong 主题超过长度限制
+	ErrTopicTooLong = errors.New("topic too long")
+	//ErrTopicTooManyLevels 主题超过层级限制
+	ErrTopicTooManyLevels = errors.New("topic has too many levels")
+)
+
+//Validator 主题与订阅过滤器的长度与层级限制, 各项<=0时只按协议的最大长度限制
+//空主题、UTF-8、NUL与通配符等协议校验由编解码完成, 见message.CheckTopicName
+type Validator struct {
+	//MaxLength 最大主题字节数
+	MaxLength int
+	//MaxLevels 最大主题层级数
+	MaxLevels int
+}
+
+//Topic 校验PUBLISH主题名的长度与层级, 主题名已在解码时按协议校验
+func (slf *Validator) Topic(topic string) error {
+	return slf.limit(topic)
+}
+
+//Filter 校验订阅过滤器, 通配符位置与编解码共用message.CheckTopicFilter
+//SUBSCRIBE解码时不校验通配符位置, 无效的过滤器在SUBACK中返回失败
+func (slf *Validator) Filter(filter string) error {
+	if err := message.CheckTopicFilter([]byte(filter)); err != nil {
+		return err
+	}
+
+	return slf.limit(filter)
+}
+
+//limit 校验配置的长度与层级限制, nil时只限制协议的最大长度
+func (slf *Validator) limit(topic string) error {
+	maxLength := MaxTopicLength
+	if slf != nil && slf.MaxLength > 0 && slf.MaxLength < maxLength {
+		maxLength = slf.MaxLength
+	}
+
+	if len(topic) > maxLength {
+		return ErrTopicTooLong
+	}
+
+	if slf != nil && slf.MaxLevels > 0 && strings.Count(topic, SEP)+1 > slf.MaxLevels {
+		return ErrTopicTooManyLevels
+	}
+
+	return nil
+}
+
+//IsWildcard 订阅过滤器是否包含通配符
+func IsWildcard(filter string) bool {
+	return strings.ContainsAny(filter, _WC)
+}
@@ -0,0 +1,74 @@
+package topics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func TestValidator(t *testing.T) {
+	limited := &Validator{MaxLength: 16, MaxLevels: 3}
+	cases := []struct {
+		v   *Validator
+		s   string
+		err error
+	}{
+		{nil, "a/b/c", nil},
+		{nil, strings.Repeat("a", MaxTopicLength+1), ErrTopicTooLong},
+		//配置的限制小于协议限制时生效
+		{limited, strings.Repeat("a", 16), nil},
+		{limited, strings.Repeat("a", 17), ErrTopicTooLong},
+		{limited, "a/b/c", nil},
+		{limited, "a/b/c/d", ErrTopicTooManyLevels},
+		{&Validator{MaxLength: MaxTopicLength + 10}, strings.Repeat("a", MaxTopicLength+1), ErrTopicTooLong},
+		{limited, "a/+/#", nil},
+	}
+
+	for _, c := range cases {
+		if err := c.v.Filter(c.s); err != c.err {
+			t.Errorf("Filter(%.20q) = %v, want %v", c.s, err, c.err)
+		}
+		if strings.ContainsAny(c.s, _WC) {
+			continue
+		}
+		if err := c.v.Topic(c.s); err != c.err {
+			t.Errorf("Topic(%.20q) = %v, want %v", c.s, err, c.err)
+		}
+	}
+}
+
+func TestValidatorFilter(t *testing.T) {
+	//过滤器的协议校验与编解码共用, 通配符必须占据整个层级, '#'只能在最后一层
+	cases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"a/+/c", true},
+		{"a/#", true},
+		{"#", true},
+		{"+", true},
+		{"", false},
+		{"a/\x00", false},
+		{"a/\xff", false},
+		{"a/b+", false},
+		{"a/#/c", false},
+		{"a/b#", false},
+	}
+
+	var v *Validator
+	for _, c := range cases {
+		switch err := v.Filter(c.filter); err.(type) {
+		case nil:
+			if !c.valid {
+				t.Errorf("Filter(%q) accepted", c.filter)
+			}
+		case *message.ErrProtocolViolation, *message.ErrMalformed:
+			if c.valid {
+				t.Errorf("Filter(%q) = %v", c.filter, err)
+			}
+		default:
+			t.Errorf("Filter(%q) = %v, want a codec error", c.filter, err)
+		}
+	}
+}
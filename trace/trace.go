@@ -0,0 +1,266 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding"
+	"github.com/yamakiller/magicMqtt/encoding/message"
+	"github.com/yamakiller/magicMqtt/topics"
+)
+
+const (
+	//In 客户端发往服务端的报文
+	In = "in"
+	//Out 服务端发往客户端的报文
+	Out = "out"
+
+	//defaultPayload 默认记录的负载字节数
+	defaultPayload = 256
+)
+
+var (
+	//ErrEmptyRule 跟踪规则既没有客户端ID也没有主题过滤器
+	ErrEmptyRule = errors.New("trace rule needs a client id or a topic filter")
+	//ErrRuleNotFound 跟踪规则不存在
+	ErrRuleNotFound = errors.New("trace rule not found")
+)
+
+//Rule 跟踪规则
+//ClientID匹配该客户端连接上的所有报文, Filter匹配主题(或订阅过滤器)符合过滤器的报文,
+//两者都设置时须同时满足. Expire为nil时规则一直有效, 直到被删除
+type Rule struct {
+	ID       int64      `json:"id"`
+	ClientID string     `json:"clientId,omitempty"`
+	Filter   string     `json:"filter,omitempty"`
+	Expire   *time.Time `json:"expire,omitempty"`
+}
+
+//match 报文是否符合规则
+func (slf *Rule) match(clientID string, msg message.Message, now time.Time) bool {
+	if slf.Expire != nil && now.After(*slf.Expire) {
+		return false
+	}
+	if slf.ClientID != "" && slf.ClientID != clientID {
+		return false
+	}
+	if slf.Filter == "" {
+		return true
+	}
+
+	switch m := msg.(type) {
+	case *message.Publish:
+		return topics.MatchFilter(slf.Filter, m.TopicName)
+	case *message.Subscribe:
+		for _, p := range m.Payload {
+			if p.TopicPath == slf.Filter || topics.MatchFilter(slf.Filter, p.TopicPath) {
+				return true
+			}
+		}
+	case *message.Unsubscribe:
+		for _, p := range m.Payload {
+			if p.TopicPath == slf.Filter || topics.MatchFilter(slf.Filter, p.TopicPath) {
+				return true
+			}
+		}
+	case *message.Connect:
+		return m.Will != nil && topics.MatchFilter(slf.Filter, m.Will.Topic)
+	}
+	return false
+}
+
+//entry 写入跟踪输出的一条记录
+type entry struct {
+	Time        string          `json:"time"`
+	Dir         string          `json:"dir"`
+	Client      string          `json:"client,omitempty"`
+	Addr        string          `json:"addr,omitempty"`
+	Type        string          `json:"type"`
+	PayloadSize int             `json:"payloadSize,omitempty"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	Rules       []int64         `json:"rules"`
+	Packet      json.RawMessage `json:"packet"`
+}
+
+//Tracer 按规则记录客户端收发的报文, 规则可以在运行时增删
+//没有规则时每个报文只有一次原子读取的开销
+type Tracer struct {
+	_mu      sync.RWMutex
+	_rules   []*Rule
+	_seq     int64
+	_active  int32
+	_wmu     sync.Mutex
+	_sink    io.Writer
+	_payload int
+}
+
+//New 创建跟踪器, 记录写入sink, PUBLISH负载最多记录payload字节, <=0时使用默认值
+func New(sink io.Writer, payload int) *Tracer {
+	if payload <= 0 {
+		payload = defaultPayload
+	}
+
+	return &Tracer{_sink: sink, _payload: payload}
+}
+
+//Add 添加跟踪规则, ttl>0时规则到期后自动失效
+func (slf *Tracer) Add(clientID, filter string, ttl time.Duration) (Rule, error) {
+	if clientID == "" && filter == "" {
+		return Rule{}, ErrEmptyRule
+	}
+	if filter != "" {
+		//nil校验器只按协议校验
+		var validator *topics.Validator
+		if err := validator.Filter(filter); err != nil {
+			return Rule{}, err
+		}
+	}
+
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf.expire(time.Now())
+
+	slf._seq++
+	rule := &Rule{ID: slf._seq, ClientID: clientID, Filter: filter}
+	if ttl > 0 {
+		expire := time.Now().Add(ttl)
+		rule.Expire = &expire
+	}
+	slf._rules = append(slf._rules, rule)
+	atomic.StoreInt32(&slf._active, int32(len(slf._rules)))
+	return *rule, nil
+}
+
+//Remove 删除跟踪规则
+func (slf *Tracer) Remove(id int64) error {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+
+	for i, rule := range slf._rules {
+		if rule.ID == id {
+			slf._rules = append(slf._rules[:i], slf._rules[i+1:]...)
+			atomic.StoreInt32(&slf._active, int32(len(slf._rules)))
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+//Clear 删除所有跟踪规则
+func (slf *Tracer) Clear() {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf._rules = nil
+	atomic.StoreInt32(&slf._active, 0)
+}
+
+//Rules 返回所有有效的跟踪规则, 按ID排序
+func (slf *Tracer) Rules() []Rule {
+	slf._mu.Lock()
+	defer slf._mu.Unlock()
+	slf.expire(time.Now())
+
+	result := make([]Rule, len(slf._rules))
+	for i, rule := range slf._rules {
+		result[i] = *rule
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+//expire 删除过期的规则, 调用者持有写锁
+func (slf *Tracer) expire(now time.Time) {
+	rules := slf._rules[:0]
+	for _, rule := range slf._rules {
+		if rule.Expire == nil || now.Before(*rule.Expire) {
+			rules = append(rules, rule)
+		}
+	}
+	for i := len(rules); i < len(slf._rules); i++ {
+		slf._rules[i] = nil
+	}
+	slf._rules = rules
+	atomic.StoreInt32(&slf._active, int32(len(slf._rules)))
+}
+
+//Packet 记录符合规则的报文, nil时不记录
+//clientID为空的CONNECT报文使用报文中的客户端ID匹配
+func (slf *Tracer) Packet(dir, clientID, addr string, msg message.Message) {
+	if slf == nil || atomic.LoadInt32(&slf._active) == 0 {
+		return
+	}
+
+	if connect, ok := msg.(*message.Connect); ok && clientID == "" {
+		clientID = connect.Identifier
+	}
+
+	now := time.Now()
+	var matched []int64
+	slf._mu.RLock()
+	for _, rule := range slf._rules {
+		if rule.match(clientID, msg, now) {
+			matched = append(matched, rule.ID)
+		}
+	}
+	slf._mu.RUnlock()
+	if len(matched) == 0 {
+		return
+	}
+
+	e := entry{
+		Time:   now.UTC().Format(time.RFC3339Nano),
+		Dir:    dir,
+		Client: clientID,
+		Addr:   addr,
+		Type:   msg.GetTypeAsString(),
+		Rules:  matched,
+	}
+	e.Packet = slf.packet(msg, &e)
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+
+	slf._wmu.Lock()
+	slf._sink.Write(append(b, '\n'))
+	slf._wmu.Unlock()
+}
+
+//packet 返回报文的JSON, 负载被截断, 密码不会被记录
+func (slf *Tracer) packet(msg message.Message, e *entry) json.RawMessage {
+	switch msg.GetType() {
+	case encoding.PTypePublish:
+		m := *msg.(*message.Publish)
+		e.PayloadSize = m.PayloadSize()
+		if m.Spool() != nil {
+			//落盘的负载不读取
+			m.Payload = nil
+			e.Truncated = e.PayloadSize > 0
+		} else if len(m.Payload) > slf._payload {
+			m.Payload = m.Payload[:slf._payload]
+			e.Truncated = true
+		}
+		return json.RawMessage(m.String())
+	case encoding.PTypeConnect:
+		m := *msg.(*message.Connect)
+		m.Password = nil
+		if m.Will != nil {
+			will := *m.Will
+			if len(will.Message) > slf._payload {
+				will.Message = will.Message[:slf._payload]
+			}
+			m.Will = &will
+		}
+		return json.RawMessage(m.String())
+	}
+
+	if s, ok := msg.(interface{ String() string }); ok {
+		return json.RawMessage(s.String())
+	}
+	return json.RawMessage("null")
+}
@@ -0,0 +1,141 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamakiller/magicMqtt/encoding/message"
+)
+
+func entries(t *testing.T, buf *bytes.Buffer) []entry {
+	var result []entry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		e := entry{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		result = append(result, e)
+	}
+	buf.Reset()
+	return result
+}
+
+func publish(topic string, payload string) *message.Publish {
+	pub := message.SpawnPublishMessage()
+	pub.TopicName = topic
+	pub.Payload = []byte(payload)
+	return pub
+}
+
+func TestTracerMatch(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := New(&buf, 4)
+
+	//没有规则时不记录
+	tracer.Packet(In, "c1", "", publish("a/b", "x"))
+	if buf.Len() != 0 {
+		t.Fatalf("traced without rules: %s", buf.String())
+	}
+
+	if _, err := tracer.Add("", "", 0); err != ErrEmptyRule {
+		t.Fatalf("empty rule: %v", err)
+	}
+	if _, err := tracer.Add("", "a/#/b", 0); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+
+	byClient, _ := tracer.Add("c1", "", 0)
+	byTopic, _ := tracer.Add("", "sensors/+/temp", 0)
+
+	tracer.Packet(In, "c1", "127.0.0.1:5000", publish("a/b", "123456"))
+	tracer.Packet(Out, "c2", "", publish("sensors/7/temp", "1"))
+	tracer.Packet(Out, "c2", "", publish("sensors/7/hum", "1"))
+
+	sub := message.SpawnSubscribeMessage()
+	sub.Payload = []message.SubscribePayload{{TopicPath: "sensors/#"}}
+	tracer.Packet(In, "c3", "", sub)
+
+	got := entries(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("got %d entries: %+v", len(got), got)
+	}
+	if e := got[0]; e.Dir != In || e.Client != "c1" || e.Type != "publish" ||
+		e.PayloadSize != 6 || !e.Truncated || len(e.Rules) != 1 || e.Rules[0] != byClient.ID {
+		t.Fatalf("client entry %+v", e)
+	}
+	pub := message.Publish{}
+	if err := json.Unmarshal(got[0].Packet, &pub); err != nil || string(pub.Payload) != "1234" {
+		t.Fatalf("truncated payload %s: %v", got[0].Packet, err)
+	}
+	if e := got[1]; e.Dir != Out || e.Client != "c2" || e.Truncated || e.Rules[0] != byTopic.ID {
+		t.Fatalf("topic entry %+v", e)
+	}
+
+	if err := tracer.Remove(byClient.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.Remove(byClient.ID); err != ErrRuleNotFound {
+		t.Fatalf("remove twice: %v", err)
+	}
+	tracer.Packet(In, "c1", "", publish("a/b", "x"))
+	if buf.Len() != 0 {
+		t.Fatalf("traced after remove: %s", buf.String())
+	}
+
+	tracer.Clear()
+	if rules := tracer.Rules(); len(rules) != 0 {
+		t.Fatalf("rules after clear: %+v", rules)
+	}
+}
+
+func TestTracerConnect(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := New(&buf, 0)
+	tracer.Add("dev-1", "", 0)
+
+	connect := message.SpawnConnectMessage()
+	connect.Identifier = "dev-1"
+	connect.UserName = []byte("user")
+	connect.Password = []byte("secret")
+	tracer.Packet(In, "", "", connect)
+
+	got := entries(t, &buf)
+	if len(got) != 1 || got[0].Client != "dev-1" {
+		t.Fatalf("got %+v", got)
+	}
+	if bytes.Contains(got[0].Packet, []byte("secret")) ||
+		bytes.Contains(got[0].Packet, []byte(`"c2VjcmV0"`)) {
+		t.Fatalf("password traced: %s", got[0].Packet)
+	}
+	//原报文不受影响
+	if string(connect.Password) != "secret" {
+		t.Fatal("password cleared on the original message")
+	}
+}
+
+func TestTracerExpire(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := New(&buf, 0)
+	tracer.Add("c1", "", time.Millisecond)
+	keep, _ := tracer.Add("c2", "", 0)
+	time.Sleep(5 * time.Millisecond)
+
+	tracer.Packet(In, "c1", "", publish("a", "x"))
+	if buf.Len() != 0 {
+		t.Fatalf("expired rule traced: %s", buf.String())
+	}
+	if rules := tracer.Rules(); len(rules) != 1 || rules[0].ID != keep.ID {
+		t.Fatalf("rules %+v", rules)
+	}
+}
+
+func TestTracerNil(t *testing.T) {
+	var tracer *Tracer
+	tracer.Packet(In, "c1", "", publish("a", "x"))
+}